@@ -5,6 +5,8 @@ require (
 	github.com/xgfone/go-http-matcher v0.2.0
 	github.com/xgfone/go-loadbalancer v0.10.0
 	github.com/xgfone/go-toolkit v0.28.0
+	golang.org/x/net v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 go 1.24
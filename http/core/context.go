@@ -63,10 +63,14 @@ type Context struct {
 	// For Upstream
 	Upstream         any
 	UpstreamRequest  *http.Request
-	UpstreamResponse *http.Response // Set by the upstream after forwarding the request.
-	ForwardTimeout   time.Duration
+	UpstreamResponse *http.Response        // Set by the upstream after forwarding the request.
+	ForwardTimeout   time.Duration         // Only limit the wait for the response header.
 	Endpoint         loadbalancer.Endpoint // Set by the endpoint
 
+	// For the tunnel after upgrading the protocol, such as WebSocket.
+	UpgradeIdleTimeout time.Duration
+	UpgradeMaxLifetime time.Duration
+
 	IsAborted bool
 	Error     error          // Set when aborting the context process anytime.
 	Data      any            // The contex data that is set and used by the final user.
@@ -78,6 +82,7 @@ type Context struct {
 
 	// Callbacks
 	forwards    []func()
+	upreqs      []func()
 	respheaders []func()
 }
 
@@ -85,6 +90,7 @@ func NewContext() *Context {
 	return &Context{
 		Kvs:         make(map[string]any, DefaultCapSize),
 		forwards:    make([]func(), 0, DefaultCapSize),
+		upreqs:      make([]func(), 0, DefaultCapSize),
 		respheaders: make([]func(), 0, DefaultCapSize),
 	}
 }
@@ -95,8 +101,14 @@ func NewContext() *Context {
 func (c *Context) Reset() {
 	clear(c.Kvs)
 	clear(c.forwards)
+	clear(c.upreqs)
 	clear(c.respheaders)
-	*c = Context{Kvs: c.Kvs, forwards: c.forwards[:0], respheaders: c.respheaders[:0]}
+	*c = Context{
+		Kvs:         c.Kvs,
+		forwards:    c.forwards[:0],
+		upreqs:      c.upreqs[:0],
+		respheaders: c.respheaders[:0],
+	}
 }
 
 // Abort sets the error informaion and aborts the context process.
@@ -116,6 +128,9 @@ func runcbs(cbs []func()) {
 // CallbackOnForward calls the callback functions added by OnForward.
 func (c *Context) CallbackOnForward() { runcbs(c.forwards) }
 
+// CallbackOnUpstreamRequest calls the callback functions added by OnUpstreamRequest.
+func (c *Context) CallbackOnUpstreamRequest() { runcbs(c.upreqs) }
+
 // CallbackOnResponseHeader calls the callback functions added by OnResponseHeader.
 func (c *Context) CallbackOnResponseHeader() { runcbs(c.respheaders) }
 
@@ -125,6 +140,13 @@ func (c *Context) OnForward(cb func()) {
 	c.forwards = append(c.forwards, cb)
 }
 
+// OnUpstreamRequest appends the callback function, which is called
+// with the final upstream request after all the callback functions
+// added by OnForward are called and before upstream forwards the request.
+func (c *Context) OnUpstreamRequest(cb func()) {
+	c.upreqs = append(c.upreqs, cb)
+}
+
 // OnResponseHeader appends the callback function, which is called
 // after setting the response header and before copying the response body
 // from the upstream server to the client.
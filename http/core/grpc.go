@@ -0,0 +1,185 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xgfone/go-apigateway/http/statuscode"
+	"github.com/xgfone/go-loadbalancer"
+)
+
+// Pre-define some gRPC status codes used by the gateway.
+//
+// See https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	GRPCStatusOK               = 0
+	GRPCStatusUnknown          = 2
+	GRPCStatusDeadlineExceeded = 4
+	GRPCStatusPermissionDenied = 7
+	GRPCStatusUnimplemented    = 12
+	GRPCStatusInternal         = 13
+	GRPCStatusUnavailable      = 14
+	GRPCStatusUnauthenticated  = 16
+)
+
+// IsGRPC reports whether the request is a gRPC request,
+// the Content-Type of which is "application/grpc" or "application/grpc+xxx".
+func IsGRPC(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "application/grpc") {
+		return false
+	}
+
+	switch ct = ct[len("application/grpc"):]; {
+	case ct == "":
+		return true
+	case ct[0] == '+', ct[0] == ';':
+		return true
+	default: // Such as "application/grpc-web"
+		return false
+	}
+}
+
+func (c *Context) isGRPC() bool {
+	return c.ClientRequest != nil && IsGRPC(c.ClientRequest)
+}
+
+// GRPCTimeout parses and returns the timeout from the header Grpc-Timeout.
+//
+// Return false if the header does not exist or is invalid.
+// And the timeout is limited to the maximum duration if overflowing,
+// such as "99999999H".
+func GRPCTimeout(r *http.Request) (timeout time.Duration, ok bool) {
+	value := r.Header.Get("Grpc-Timeout")
+	if len(value) < 2 || len(value) > 9 { // At most 8 digits and 1 unit.
+		return
+	}
+
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return
+	}
+
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return
+	}
+
+	if n > uint64(math.MaxInt64/unit) {
+		return math.MaxInt64, true
+	}
+	return time.Duration(n) * unit, true
+}
+
+// GRPCStatus converts the http status code to the gRPC status code.
+//
+// See https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func GRPCStatus(code int) int {
+	switch code {
+	case http.StatusOK:
+		return GRPCStatusOK
+	case http.StatusBadRequest:
+		return GRPCStatusInternal
+	case http.StatusUnauthorized:
+		return GRPCStatusUnauthenticated
+	case http.StatusForbidden:
+		return GRPCStatusPermissionDenied
+	case http.StatusNotFound:
+		return GRPCStatusUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return GRPCStatusUnavailable
+	default:
+		return GRPCStatusUnknown
+	}
+}
+
+// SendGRPCStatus sends the gRPC status as the trailers-only response,
+// which uses the http status code 200 and carries the status by the headers.
+func SendGRPCStatus(w http.ResponseWriter, status int, msg string) {
+	header := w.Header()
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(status))
+	if msg != "" {
+		header.Set("Grpc-Message", encodeGRPCMessage(msg))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// sendGRPCError converts the error to the gRPC status and sends it.
+func sendGRPCError(w http.ResponseWriter, err error) {
+	status, msg := grpcStatusFromError(err)
+	SendGRPCStatus(w, status, msg)
+}
+
+// setGRPCErrorTrailer converts the error to the gRPC status and sets it
+// as the trailers, which is used after the response header has been sent.
+func setGRPCErrorTrailer(w http.ResponseWriter, err error) {
+	status, msg := grpcStatusFromError(err)
+	header := w.Header()
+	header.Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(status))
+	header.Set(http.TrailerPrefix+"Grpc-Message", encodeGRPCMessage(msg))
+}
+
+func grpcStatusFromError(err error) (status int, msg string) {
+	var e statuscode.Error
+	switch {
+	case errors.Is(err, loadbalancer.ErrNoAvailableEndpoints):
+		return GRPCStatusUnavailable, err.Error()
+
+	case errors.Is(err, context.DeadlineExceeded):
+		return GRPCStatusDeadlineExceeded, err.Error()
+
+	case errors.As(err, &e):
+		return GRPCStatus(e.Code), e.Message
+
+	default:
+		return GRPCStatus(http.StatusInternalServerError), err.Error()
+	}
+}
+
+// encodeGRPCMessage percent-encodes the message as the header Grpc-Message.
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7E || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
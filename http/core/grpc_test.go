@@ -0,0 +1,127 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-apigateway/http/statuscode"
+	"github.com/xgfone/go-loadbalancer"
+)
+
+func TestIsGRPC(t *testing.T) {
+	for ct, expect := range map[string]bool{
+		"application/grpc":               true,
+		"application/grpc+proto":         true,
+		"application/grpc;charset=utf-8": true,
+		"application/grpc-web":           false,
+		"application/json":               false,
+		"":                               false,
+	} {
+		r := &http.Request{Header: http.Header{"Content-Type": {ct}}}
+		if IsGRPC(r) != expect {
+			t.Errorf("%s: expect %v, but got %v", ct, expect, !expect)
+		}
+	}
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	for value, expect := range map[string]time.Duration{
+		"1H":         time.Hour,
+		"2M":         time.Minute * 2,
+		"3S":         time.Second * 3,
+		"100m":       time.Millisecond * 100,
+		"5u":         time.Microsecond * 5,
+		"99999999n":  time.Nanosecond * 99999999,
+		"99999999u":  time.Microsecond * 99999999,
+		"99999999m":  time.Millisecond * 99999999,
+		"99999999S":  time.Second * 99999999,
+		"99999999M":  time.Minute * 99999999,
+		"99999999H":  math.MaxInt64, // Overflow
+		"":           -1,
+		"m":          -1,
+		"10s":        -1,
+		"-1S":        -1,
+		"123456789S": -1,
+	} {
+		r := &http.Request{Header: http.Header{"Grpc-Timeout": {value}}}
+		timeout, ok := GRPCTimeout(r)
+		switch {
+		case expect < 0 && ok:
+			t.Errorf("%s: expect invalid, but got %s", value, timeout)
+		case expect >= 0 && !ok:
+			t.Errorf("%s: expect %s, but got invalid", value, expect)
+		case ok && timeout != expect:
+			t.Errorf("%s: expect %s, but got %s", value, expect, timeout)
+		}
+	}
+}
+
+func TestStdResponseGRPC(t *testing.T) {
+	for _, test := range []struct {
+		err     error
+		status  string
+		message string
+	}{
+		{statuscode.ErrNotFound, "12", "Not Found"},
+		{statuscode.ErrUnauthorized.WithMessage("bad token"), "16", "bad token"},
+		{statuscode.ErrForbidden, "7", "Forbidden"},
+		{statuscode.ErrTooManyRequests, "14", "Too Many Requests"},
+		{loadbalancer.ErrNoAvailableEndpoints, "14", loadbalancer.ErrNoAvailableEndpoints.Error()},
+		{fmt.Errorf("forward: %w", context.DeadlineExceeded), "4", "forward: context deadline exceeded"},
+		{errors.New("100% failed\n"), "2", "100%25 failed%0A"},
+	} {
+		rec := httptest.NewRecorder()
+		c := AcquireContext(context.Background())
+		c.ClientRequest = &http.Request{Header: http.Header{"Content-Type": {"application/grpc"}}}
+		c.ClientResponse = AcquireResponseWriter(rec)
+		c.Error = test.err
+		c.SendResponse()
+		ReleaseContext(c)
+
+		if rec.Code != 200 {
+			t.Errorf("%v: expect the status code 200, but got %d", test.err, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/grpc" {
+			t.Errorf("%v: expect the content type 'application/grpc', but got '%s'", test.err, ct)
+		}
+		if status := rec.Header().Get("Grpc-Status"); status != test.status {
+			t.Errorf("%v: expect the grpc status '%s', but got '%s'", test.err, test.status, status)
+		}
+		if msg := rec.Header().Get("Grpc-Message"); msg != test.message {
+			t.Errorf("%v: expect the grpc message '%s', but got '%s'", test.err, test.message, msg)
+		}
+	}
+
+	// Not a gRPC request.
+	rec := httptest.NewRecorder()
+	c := AcquireContext(context.Background())
+	defer ReleaseContext(c)
+	c.ClientRequest = &http.Request{Header: http.Header{}}
+	c.ClientResponse = AcquireResponseWriter(rec)
+	c.Error = statuscode.ErrNotFound
+	c.SendResponse()
+
+	if rec.Code != 404 {
+		t.Errorf("expect the status code 404, but got %d", rec.Code)
+	}
+}
@@ -65,7 +65,15 @@ func (f ResponserFunc) Respond(c *Context, resp *http.Response, err error) {
 }
 
 // StdResponse is a standard response handler.
+//
+// If the client request is a gRPC request, the error is sent
+// as the gRPC status.
 func StdResponse(c *Context, resp *http.Response, err error) {
+	if err != nil && c.isGRPC() {
+		sendGRPCError(c.ClientResponse, err)
+		return
+	}
+
 	switch err {
 	case nil:
 		if resp != nil {
@@ -113,9 +121,96 @@ func CopyResponseHeader(c *Context, resp *http.Response) {
 	c.CallbackOnResponseHeader()
 }
 
-// CopyResponse copies the response header and body from the upstream server
-// to the client.
+// CopyResponse copies the response header, body and trailer
+// from the upstream server to the client.
+//
+// If the length of the response body is unknown, such as the streaming
+// response, or the response has the trailers, the header is sent at once.
+// And the streaming body is flushed to the client as soon as it is read.
+//
+// If the upstream server switches the protocol, such as WebSocket,
+// hijack the client connection and tunnel it to the upstream server.
 func CopyResponse(c *Context, resp *http.Response) {
 	CopyResponseHeader(c, resp)
-	_ = httpx.HandleResponseBody(c.ClientResponse, resp)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		switchProtocol(c, resp)
+		return
+	}
+
+	if resp.ContentLength >= 0 && len(resp.Trailer) == 0 {
+		err := httpx.HandleResponseBody(c.ClientResponse, resp)
+		switch {
+		case err == nil: // The http/2 transport may set the unannounced trailers.
+			copyTrailer(c.ClientResponse.Header(), resp.Trailer, nil)
+		case c.isGRPC():
+			setGRPCErrorTrailer(c.ClientResponse, err)
+		}
+		return
+	}
+
+	// Announce the trailers before writing the header.
+	header := c.ClientResponse.Header()
+	announced := make([]string, 0, len(resp.Trailer))
+	for k := range resp.Trailer {
+		header.Add("Trailer", k)
+		announced = append(announced, k)
+	}
+
+	c.ClientResponse.WriteHeader(resp.StatusCode)
+
+	// Send the header at once, because the upstream server of the streaming
+	// response may wait for the client to send more data. And it also avoids
+	// calculating Content-Length for the trailers.
+	rc := http.NewResponseController(c.ClientResponse)
+	streaming := resp.ContentLength == -1
+	_ = rc.Flush()
+
+	if err := copyBody(c.ClientResponse, resp.Body, rc, streaming); err != nil {
+		// The header has been sent, so the gRPC client can only
+		// know the failure by the status trailer.
+		if c.isGRPC() {
+			setGRPCErrorTrailer(c.ClientResponse, err)
+		}
+		return
+	}
+
+	copyTrailer(header, resp.Trailer, announced)
+}
+
+// copyTrailer copies the trailers after reading the body, because their values
+// are available only then. The trailers not announced must be sent with the prefix.
+func copyTrailer(header, trailer http.Header, announced []string) {
+	for k, vs := range trailer {
+		if slices.Contains(announced, k) {
+			header[k] = vs
+		} else {
+			header[http.TrailerPrefix+k] = vs
+		}
+	}
+}
+
+func copyBody(w io.Writer, r io.Reader, rc *http.ResponseController, flush bool) error {
+	if !flush {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			_ = rc.Flush()
+		}
+
+		switch err {
+		case nil:
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
 }
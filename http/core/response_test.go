@@ -0,0 +1,149 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/xgfone/go-loadbalancer/httpx"
+)
+
+// trailerBody sets the unannounced trailer when reaching EOF,
+// like the http/2 transport.
+type trailerBody struct {
+	io.Reader
+	resp *http.Response
+}
+
+func (b trailerBody) Close() error { return nil }
+func (b trailerBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.resp.Trailer.Set("Grpc-Status", "0")
+		b.resp.Trailer.Set("X-Checksum", "abc")
+	}
+	return n, err
+}
+
+func TestCopyResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	c := AcquireContext(context.Background())
+	defer ReleaseContext(c)
+	c.ClientResponse = AcquireResponseWriter(rec)
+
+	resp := &http.Response{
+		StatusCode:    200,
+		ContentLength: -1,
+		Header:        http.Header{"Content-Type": {"application/grpc"}, "Trailer": {"Grpc-Status"}},
+		Trailer:       http.Header{"Grpc-Status": nil},
+	}
+	resp.Body = trailerBody{Reader: strings.NewReader("streaming"), resp: resp}
+
+	CopyResponse(c, resp)
+	result := rec.Result()
+
+	if !rec.Flushed {
+		t.Error("expect to flush the streaming response, but got not")
+	}
+	if body, _ := io.ReadAll(result.Body); string(body) != "streaming" {
+		t.Errorf("expect the body '%s', but got '%s'", "streaming", body)
+	}
+	if v := result.Header.Get("Content-Type"); v != "application/grpc" {
+		t.Errorf("expect the content type '%s', but got '%s'", "application/grpc", v)
+	}
+	if v := result.Trailer.Get("Grpc-Status"); v != "0" {
+		t.Errorf("expect the trailer Grpc-Status '0', but got '%s'", v)
+	}
+	if v := result.Trailer.Get("X-Checksum"); v != "abc" {
+		t.Errorf("expect the unannounced trailer X-Checksum 'abc', but got '%s'", v)
+	}
+
+	// The response with the known length is not flushed.
+	rec = httptest.NewRecorder()
+	c.ClientResponse = AcquireResponseWriter(rec)
+	CopyResponse(c, &http.Response{
+		StatusCode:    201,
+		ContentLength: 4,
+		Body:          io.NopCloser(strings.NewReader("body")),
+	})
+
+	if rec.Flushed {
+		t.Error("unexpect to flush the response with the known length")
+	}
+	if rec.Code != 201 || rec.Body.String() != "body" {
+		t.Errorf("expect the response 201 'body', but got %d '%s'", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCopyResponseCompatibility(t *testing.T) {
+	// The previous implementation before supporting the streaming and trailers.
+	oldCopyResponse := func(c *Context, resp *http.Response) {
+		CopyResponseHeader(c, resp)
+		_ = httpx.HandleResponseBody(c.ClientResponse, resp)
+	}
+
+	newresp := func(code int, header http.Header, body string) *http.Response {
+		return &http.Response{
+			StatusCode:    code,
+			Header:        header,
+			ContentLength: int64(len(body)),
+			Body:          io.NopCloser(strings.NewReader(body)),
+		}
+	}
+
+	record := func(respond func(*Context, *http.Response), resp *http.Response) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c := AcquireContext(context.Background())
+		defer ReleaseContext(c)
+		c.ClientResponse = AcquireResponseWriter(rec)
+		respond(c, resp)
+		return rec
+	}
+
+	for _, test := range []struct {
+		code   int
+		header http.Header
+		body   string
+	}{
+		{200, http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"5"}}, "hello"},
+		{201, http.Header{"Connection": {"close"}, "Keep-Alive": {"timeout=5"}, "X-Empty": {""}}, "{}"},
+		{204, http.Header{"X-Id": {"1", "2"}}, ""},
+		{304, http.Header{"Etag": {`"abc"`}}, ""},
+		{502, http.Header{}, "bad gateway"},
+	} {
+		expect := record(oldCopyResponse, newresp(test.code, test.header.Clone(), test.body))
+		result := record(CopyResponse, newresp(test.code, test.header.Clone(), test.body))
+
+		if result.Code != expect.Code {
+			t.Errorf("%d: expect the status code %d, but got %d", test.code, expect.Code, result.Code)
+		}
+		if !maps.EqualFunc(result.Header(), expect.Header(), slices.Equal) {
+			t.Errorf("%d: expect the header %v, but got %v", test.code, expect.Header(), result.Header())
+		}
+		if result.Body.String() != expect.Body.String() {
+			t.Errorf("%d: expect the body '%s', but got '%s'", test.code, expect.Body.String(), result.Body.String())
+		}
+		if result.Flushed != expect.Flushed {
+			t.Errorf("%d: expect the flushed %v, but got %v", test.code, expect.Flushed, result.Flushed)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+var tunnels sync.Map // map[routeid]*atomic.Int64
+
+// ActiveTunnels returns the number of the active tunnelled connections
+// of the route, which have been upgraded to another protocol, such as WebSocket.
+func ActiveTunnels(routeid string) int64 {
+	if v, ok := tunnels.Load(routeid); ok {
+		return v.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+func addTunnels(routeid string, delta int64) {
+	v, ok := tunnels.Load(routeid)
+	if !ok {
+		v, _ = tunnels.LoadOrStore(routeid, new(atomic.Int64))
+	}
+	v.(*atomic.Int64).Add(delta)
+}
+
+// IsUpgrade reports whether the request is a HTTP/1.1 upgrade request,
+// such as WebSocket, which has the headers "Connection: Upgrade"
+// and "Upgrade: PROTOCOL".
+func IsUpgrade(r *http.Request) bool {
+	return r.ProtoMajor == 1 && r.ProtoMinor >= 1 && upgradeType(r.Header) != ""
+}
+
+func upgradeType(h http.Header) string {
+	if !httpguts.HeaderValuesContainsToken(h["Connection"], "Upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// switchProtocol hijacks the client connection, and pipes it with
+// the upgraded connection to the upstream server bidirectionally
+// until either is closed or the tunnel times out.
+func switchProtocol(c *Context, resp *http.Response) {
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		sendtext(c.ClientResponse, http.StatusBadGateway, "the upgraded body is not writable")
+		return
+	}
+	defer backConn.Close()
+
+	reqType, respType := upgradeType(c.ClientRequest.Header), upgradeType(resp.Header)
+	if !strings.EqualFold(reqType, respType) {
+		msg := fmt.Sprintf("backend tried to switch protocol %q when %q was requested", respType, reqType)
+		sendtext(c.ClientResponse, http.StatusBadGateway, msg)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(c.ClientResponse).Hijack()
+	if err != nil {
+		sendtext(c.ClientResponse, http.StatusInternalServerError, "fail to hijack the connection: "+err.Error())
+		return
+	}
+	defer conn.Close()
+
+	// The header has been copied and filtered by CopyResponseHeader.
+	header := c.ClientResponse.Header()
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", respType)
+
+	res := &http.Response{
+		StatusCode: resp.StatusCode,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+	}
+	if err = res.Write(brw); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		slog.Error("fail to write the switching protocol response",
+			"reqid", c.RequestID(), "route", c.RouteId, "err", err)
+		return
+	}
+
+	addTunnels(c.RouteId, 1)
+	defer addTunnels(c.RouteId, -1)
+
+	t := tunnel{idle: c.UpgradeIdleTimeout, close: func() { conn.Close(); backConn.Close() }}
+	t.run(c.UpgradeMaxLifetime, func() {
+		// Use brw instead of conn, which may buffer the data from the client.
+		_, _ = io.Copy(t.writer(backConn), brw)
+	}, func() {
+		_, _ = io.Copy(t.writer(conn), backConn)
+	})
+}
+
+type tunnel struct {
+	idle  time.Duration
+	last  atomic.Int64 // The unix nano of the last active time.
+	close func()
+}
+
+// run runs the forward and backward copy until either returns, and closes
+// the connections if the tunnel is idle for t.idle or alive for lifetime.
+func (t *tunnel) run(lifetime time.Duration, forward, backward func()) {
+	if lifetime > 0 {
+		timer := time.AfterFunc(lifetime, t.close)
+		defer timer.Stop()
+	}
+
+	if t.idle > 0 {
+		t.last.Store(time.Now().UnixNano())
+		stop := make(chan struct{})
+		defer close(stop)
+		go t.watch(stop)
+	}
+
+	done := make(chan struct{}, 2)
+	go func() { forward(); done <- struct{}{} }()
+	go func() { backward(); done <- struct{}{} }()
+
+	<-done
+	t.close()
+	<-done
+}
+
+// watch closes the connections when the tunnel is idle for t.idle.
+func (t *tunnel) watch(stop <-chan struct{}) {
+	timer := time.NewTimer(t.idle)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, t.last.Load()))
+			if idle >= t.idle {
+				t.close()
+				return
+			}
+			timer.Reset(t.idle - idle)
+		}
+	}
+}
+
+// writer returns a writer that refreshes the active time of the tunnel.
+func (t *tunnel) writer(w io.Writer) io.Writer {
+	if t.idle <= 0 {
+		return w
+	}
+	return activeWriter{w: w, t: t}
+}
+
+type activeWriter struct {
+	w io.Writer
+	t *tunnel
+}
+
+func (w activeWriter) Write(p []byte) (int, error) {
+	w.t.last.Store(time.Now().UnixNano())
+	return w.w.Write(p)
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIsUpgrade(t *testing.T) {
+	for _, test := range []struct {
+		proto  string
+		header http.Header
+		expect bool
+	}{
+		{"HTTP/1.1", http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}}, true},
+		{"HTTP/1.1", http.Header{"Connection": {"upgrade"}, "Upgrade": {"h2c"}}, true},
+		{"HTTP/1.1", http.Header{"Upgrade": {"websocket"}}, false},
+		{"HTTP/1.1", http.Header{"Connection": {"Upgrade"}}, false},
+		{"HTTP/1.0", http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, false},
+		{"HTTP/2.0", http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, false},
+	} {
+		r := &http.Request{Header: test.header}
+		r.ProtoMajor, r.ProtoMinor, _ = http.ParseHTTPVersion(test.proto)
+		if IsUpgrade(r) != test.expect {
+			t.Errorf("%s %v: expect %v, but got %v", test.proto, test.header, test.expect, !test.expect)
+		}
+	}
+}
+
+func runTunnel(idle, lifetime time.Duration) (client net.Conn, closed <-chan struct{}) {
+	client, front := net.Pipe()
+	back, server := net.Pipe()
+	go func() { _, _ = io.Copy(server, server) }() // Echo server
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := tunnel{idle: idle, close: func() { front.Close(); back.Close(); server.Close() }}
+		t.run(lifetime, func() {
+			_, _ = io.Copy(t.writer(back), front)
+		}, func() {
+			_, _ = io.Copy(t.writer(front), back)
+		})
+	}()
+
+	return client, done
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != msg {
+		t.Errorf("expect '%s', but got '%s'", msg, buf)
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	expectClosed := func(closed <-chan struct{}, timeout time.Duration) {
+		t.Helper()
+		select {
+		case <-closed:
+		case <-time.After(timeout):
+			t.Fatal("expect the tunnel to be closed, but not")
+		}
+	}
+
+	// Idle timeout, and the active tunnel is not closed.
+	client, closed := runTunnel(time.Millisecond*100, 0)
+	for range 4 {
+		time.Sleep(time.Millisecond * 50)
+		echo(t, client, "ping")
+	}
+	expectClosed(closed, time.Second)
+	client.Close()
+
+	// Max lifetime.
+	client, closed = runTunnel(0, time.Millisecond*100)
+	echo(t, client, "ping")
+	expectClosed(closed, time.Second)
+	client.Close()
+
+	// Closed by the client.
+	client, closed = runTunnel(0, 0)
+	echo(t, client, "ping")
+	client.Close()
+	expectClosed(closed, time.Second)
+}
@@ -17,6 +17,7 @@ package directive
 import (
 	"net/http"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/xgfone/go-apigateway/http/core"
@@ -25,11 +26,18 @@ import (
 func init() {
 	fix := func(s string) string { return strings.TrimSuffix(s, "/") }
 
-	DefaultRegistry.RegisterOneArg("setpath", "string: change the path of the request",
-		func(c *core.Context, s string) {
-			setpath(c.UpstreamRequest, s)
-		},
-	)
+	DefaultRegistry.Register("setpath", []string{
+		"string: change the path of the request, the segment of which is a variable if starting with '$'",
+	}, func(directive string, args ...string) (Processor, error) {
+		if err := checkOneArgs(directive, args); err != nil {
+			return nil, err
+		}
+
+		getpath := buildpath(args[0])
+		return ProcessorFunc(func(c *core.Context) {
+			setpath(c.UpstreamRequest, getpath(c))
+		}), nil
+	})
 
 	DefaultRegistry.RegisterOneArg("addprefix", "string: add a prefix to the path of the request",
 		func(c *core.Context, s string) {
@@ -86,6 +94,29 @@ func init() {
 	})
 }
 
+// buildpath returns a function to build the path, the segments of which,
+// split by "/", are the variables if starting with "$", such as the path
+// parameters captured by the router, like "/v2/users/$id/orders/$oid".
+func buildpath(path string) func(*core.Context) string {
+	segs := strings.Split(path, "/")
+	if !slices.ContainsFunc(segs, isvarseg) {
+		return func(*core.Context) string { return path }
+	}
+
+	return func(c *core.Context) string {
+		values := make([]string, len(segs))
+		for i, seg := range segs {
+			if isvarseg(seg) {
+				seg, _ = QueryVariable(c, seg)
+			}
+			values[i] = seg
+		}
+		return strings.Join(values, "/")
+	}
+}
+
+func isvarseg(seg string) bool { return len(seg) > 1 && seg[0] == '$' }
+
 func setpath(r *http.Request, s string) {
 	r.URL.Path = s
 	r.URL.RawPath = ""
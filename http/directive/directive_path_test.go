@@ -40,3 +40,23 @@ func TestRewrite(t *testing.T) {
 		t.Errorf("expect path '%s', but got '%s'", expect, req.URL.Path)
 	}
 }
+
+func TestSetPathWithVariables(t *testing.T) {
+	p, err := DefaultRegistry.Build("setpath", "/v2/users/$id/orders/$oid/$rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &http.Request{URL: &url.URL{Path: "/users/123/orders/456"}}
+	c := core.AcquireContext(req.Context())
+	c.ClientRequest = req
+	c.UpstreamRequest = req
+	c.Kvs["id"] = "123"
+	c.Kvs["oid"] = 456
+	c.Kvs["rest"] = "a/b"
+	p.Process(c)
+
+	if expect := "/v2/users/123/orders/456/a/b"; req.URL.Path != expect {
+		t.Errorf("expect path '%s', but got '%s'", expect, req.URL.Path)
+	}
+}
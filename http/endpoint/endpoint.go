@@ -16,11 +16,21 @@ package endpoint
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-apigateway/http/statuscode"
 	"github.com/xgfone/go-apigateway/http/upstream"
+	gwupstream "github.com/xgfone/go-apigateway/upstream"
+	"github.com/xgfone/go-apigateway/upstream/breaker"
+	"github.com/xgfone/go-loadbalancer"
 	"github.com/xgfone/go-loadbalancer/endpoint"
 )
 
@@ -44,6 +54,28 @@ func New(host string, port uint16, weight int) *endpoint.Endpoint {
 	return ep
 }
 
+// WithPriority returns a new endpoint with the priority wrapping ep,
+// which is used by the priority tiers of the upstream. See Priority.
+func WithPriority(ep *endpoint.Endpoint, priority int) loadbalancer.Endpoint {
+	return &priorityEndpoint{Endpoint: ep, priority: priority}
+}
+
+// Priority returns the priority of the endpoint set by WithPriority,
+// the smaller the value, the higher the priority.
+//
+// Return 0 if the endpoint has no priority.
+func Priority(ep loadbalancer.Endpoint) int {
+	if p, ok := ep.(*priorityEndpoint); ok {
+		return p.priority
+	}
+	return 0
+}
+
+type priorityEndpoint struct {
+	*endpoint.Endpoint
+	priority int
+}
+
 type proxy struct {
 	*endpoint.Endpoint
 	addr string
@@ -53,10 +85,37 @@ func (p proxy) Serve(ctx context.Context, req any) (any, error) {
 	c := req.(*core.Context)
 	c.Endpoint = p.Endpoint
 
+	// The resources of the request, such as the forward timeout and
+	// the in-flight tracking, must be released only after the response body
+	// is closed, or the streaming response would be interrupted.
+	var releases []func()
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+
 	r := c.UpstreamRequest
+
+	// The deadline of the gRPC client limits the whole call, including the stream.
+	if c.ClientRequest != nil {
+		if timeout, ok := core.GRPCTimeout(c.ClientRequest); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			releases = append(releases, cancel)
+			r = r.WithContext(ctx)
+		}
+	}
+
+	// The forward timeout only limits the wait for the response header,
+	// so the timer is stopped once the header arrives, and the response body,
+	// such as a large download or SSE, can be streamed as long as it needs.
+	var timer *time.Timer
 	if c.ForwardTimeout > 0 {
-		ctx, cancel := context.WithTimeout(ctx, c.ForwardTimeout)
-		defer cancel()
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		timer = time.AfterFunc(c.ForwardTimeout, func() { cancel(context.DeadlineExceeded) })
+		releases = append(releases, func() { cancel(nil) })
 		r = r.WithContext(ctx)
 	}
 
@@ -65,9 +124,82 @@ func (p proxy) Serve(ctx context.Context, req any) (any, error) {
 		r.Host = p.addr
 	}
 
+	up, _ := c.Upstream.(*gwupstream.Upstream)
+	var done func(bool)
+	if up != nil {
+		var ok bool
+		if done, ok = up.AllowEndpoint(p.ID()); !ok {
+			release()
+			return nil, statuscode.ErrServiceUnavailable.WithError(
+				fmt.Errorf("endpoint '%s': %w", p.ID(), breaker.ErrOpen))
+		}
+	}
+
+	var observer gwupstream.Observer
+	if up != nil {
+		observer = up
+		if lc := up.Lifecycle(); lc != nil {
+			ctx, end := lc.Track(r.Context(), p.ID())
+			releases = append(releases, end)
+			r = r.WithContext(ctx)
+		}
+	} else {
+		observer, _ = c.Upstream.(gwupstream.Observer)
+	}
+	if t, ok := observer.(gwupstream.Tracker); ok {
+		t.Begin(p.ID())
+	}
+
+	start := time.Now()
 	resp, err := upstream.Send(c, r)
+	if timer != nil && !timer.Stop() && err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+	}
+
+	var code int
+	if resp != nil {
+		code = resp.StatusCode
+	}
+	if done != nil {
+		done(breaker.Succeeded(code, err))
+	}
+	if observer != nil {
+		observer.Observe(p.ID(), code, err, time.Since(start))
+	}
+
 	if err != nil && resp != nil {
 		resp.Body.Close() // For status code 3xx
 	}
+
+	if err != nil || len(releases) == 0 {
+		release()
+	} else {
+		b := &body{ReadCloser: resp.Body, release: release}
+		if w, ok := resp.Body.(io.Writer); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+			resp.Body = upgradedBody{body: b, Writer: w} // Keep the upgraded connection writable.
+		} else {
+			resp.Body = b
+		}
+	}
+
 	return resp, err
 }
+
+// body is the response body that releases the resources of the request
+// when it is closed.
+type body struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *body) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+type upgradedBody struct {
+	*body
+	io.Writer
+}
@@ -16,15 +16,23 @@ package endpoint
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/xgfone/go-apigateway/http/core"
 	"github.com/xgfone/go-apigateway/http/internal/httpx"
+	"github.com/xgfone/go-apigateway/http/statuscode"
 	"github.com/xgfone/go-apigateway/http/upstream"
+	gwupstream "github.com/xgfone/go-apigateway/upstream"
+	"github.com/xgfone/go-apigateway/upstream/breaker"
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-loadbalancer/balancer"
+	"github.com/xgfone/go-loadbalancer/forwarder"
 )
 
 func TestNewEndpoint(t *testing.T) {
@@ -44,6 +52,13 @@ func TestNewEndpoint(t *testing.T) {
 		}),
 	}
 
+	var observed int
+	c.Upstream = observer(func(epid string, code int, err error, _ time.Duration) {
+		if epid == ep.ID() && err == nil {
+			observed = code
+		}
+	})
+
 	c.UpstreamRequest = &http.Request{URL: &url.URL{Path: "/"}}
 	_resp, err := ep.Serve(context.Background(), c)
 	if err != nil {
@@ -61,4 +76,131 @@ func TestNewEndpoint(t *testing.T) {
 	if c.UpstreamRequest.Host != ep.ID() {
 		t.Errorf("expect host '%s', but got '%s'", ep.ID(), c.UpstreamRequest.Host)
 	}
+	if observed != 204 {
+		t.Errorf("expect the observed status code 204, but got %d", observed)
+	}
+}
+
+func TestEndpointForwardTimeout(t *testing.T) {
+	ep := New("127.0.0.1", 80, 10)
+
+	c := core.AcquireContext(context.Background())
+	defer core.ReleaseContext(c)
+
+	oldclient := upstream.DefaultHttpClient
+	defer func() { upstream.DefaultHttpClient = oldclient }()
+
+	var ctx context.Context
+	upstream.DefaultHttpClient = &http.Client{
+		Transport: httpx.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+			ctx = r.Context()
+			return &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader("streaming")),
+			}, nil
+		}),
+	}
+
+	c.ForwardTimeout = time.Minute
+	c.UpstreamRequest = &http.Request{URL: &url.URL{Path: "/"}}
+	_resp, err := ep.Serve(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The forward timeout is released only after the body is closed.
+	resp := _resp.(*http.Response)
+	if err := ctx.Err(); err != nil {
+		t.Errorf("expect the context to be alive before closing the body, but got '%v'", err)
+	}
+
+	resp.Body.Close()
+	if err := ctx.Err(); err != context.Canceled {
+		t.Errorf("expect the context to be canceled after closing the body, but got '%v'", err)
+	}
+
+	// The forward timeout does not limit the reading of the response body.
+	c.ForwardTimeout = time.Millisecond * 20
+	_resp, err = ep.Serve(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	resp = _resp.(*http.Response)
+	if err := ctx.Err(); err != nil {
+		t.Errorf("expect the context to be alive after the response header arrives, but got '%v'", err)
+	}
+	resp.Body.Close()
+
+	// The forward timeout limits the wait for the response header.
+	upstream.DefaultHttpClient = &http.Client{
+		Transport: httpx.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}),
+	}
+	if _, err = ep.Serve(context.Background(), c); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect the error '%v', but got '%v'", context.DeadlineExceeded, err)
+	}
+}
+
+func TestEndpointBreakerOpen(t *testing.T) {
+	ep := New("127.0.0.1", 80, 10)
+
+	g, err := breaker.NewGroup("up", breaker.GroupConfig{
+		Config:      breaker.Config{ConsecutiveFailures: 1},
+		PerEndpoint: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done, _ := g.Endpoint(ep.ID()).Allow()
+	done(false)
+
+	up := gwupstream.New(forwarder.New("up", balancer.DefaultBalancer, loadbalancer.None))
+	up.SetBreakers(g)
+
+	c := core.AcquireContext(context.Background())
+	defer core.ReleaseContext(c)
+	c.Upstream = up
+	c.UpstreamRequest = &http.Request{URL: &url.URL{Path: "/"}}
+
+	_, err = ep.Serve(context.Background(), c)
+	if !errors.Is(err, breaker.ErrOpen) {
+		t.Errorf("expect the error '%s', but got '%v'", breaker.ErrOpen, err)
+	} else if err, ok := err.(statuscode.Error); !ok || err.Code != http.StatusServiceUnavailable {
+		t.Errorf("expect the status code 503, but got '%v'", err)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	ep := New("127.0.0.1", 80, 1)
+	if p := Priority(ep); p != 0 {
+		t.Errorf("expect the priority 0, but got %d", p)
+	}
+
+	// The priority does not overwrite the config of the endpoint.
+	ep.SetConfig(map[string]any{"priority": 1.0})
+	pep := WithPriority(ep, 2)
+	if p := Priority(pep); p != 2 {
+		t.Errorf("expect the priority 2, but got %d", p)
+	} else if pep.ID() != ep.ID() {
+		t.Errorf("expect the endpoint id '%s', but got '%s'", ep.ID(), pep.ID())
+	} else if p := Priority(ep); p != 0 {
+		t.Errorf("expect the priority 0 of the config, but got %d", p)
+	}
+
+	if c, ok := pep.(interface{ Config() any }); !ok {
+		t.Error("expect the endpoint to have the config")
+	} else if v := c.Config().(map[string]any)["priority"]; v != 1.0 {
+		t.Errorf("expect the config priority 1.0, but got %v", v)
+	}
+}
+
+type observer func(epid string, code int, err error, latency time.Duration)
+
+func (f observer) Observe(epid string, code int, err error, latency time.Duration) {
+	f(epid, code, err, latency)
 }
@@ -15,8 +15,10 @@
 package httpx
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"sync"
 )
@@ -111,5 +113,15 @@ func (r *ResponseWriter) WroteHeader() bool { return r.code > 0 }
 // Written returns the byte number of the data written into the response.
 func (r *ResponseWriter) Written() int { return r.wroten }
 
+// Hijack implements the interface http.Hijacker, which is used to take over
+// the connection, such as WebSocket, and the response is regarded as 101.
+func (r *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil && r.code == 0 {
+		r.code = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
 // Unwrap unwraps the wrapped original http.ResponseWriter.
 func (r *ResponseWriter) Unwrap() http.ResponseWriter { return r.ResponseWriter }
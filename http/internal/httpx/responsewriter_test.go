@@ -16,6 +16,7 @@ package httpx
 
 import (
 	"io"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 )
@@ -52,3 +53,38 @@ func TestResponseWriter(t *testing.T) {
 		t.Errorf("expect body '%s', but got '%s'", expect, s)
 	}
 }
+
+func TestResponseWriterHijack(t *testing.T) {
+	rw := NewResponseWriter(httptest.NewRecorder())
+	if _, _, err := rw.Hijack(); err == nil {
+		t.Error("expect an error for the recorder not supporting hijack, but got nil")
+	} else if rw.WroteHeader() {
+		t.Error("unexpect to write the header")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := NewResponseWriter(w)
+		conn, _, err := rw.Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		if code := rw.StatusCode(); code != http.StatusSwitchingProtocols {
+			t.Errorf("expect status code %d, but got %d", http.StatusSwitchingProtocols, code)
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 204 {
+		t.Errorf("expect status code 204, but got %d", resp.StatusCode)
+	}
+}
@@ -20,6 +20,8 @@ import (
 	_ "github.com/xgfone/go-apigateway/http/middleware/middlewares/auth"
 	_ "github.com/xgfone/go-apigateway/http/middleware/middlewares/auth/forwardauth"
 	_ "github.com/xgfone/go-apigateway/http/middleware/middlewares/block"
+	_ "github.com/xgfone/go-apigateway/http/middleware/middlewares/mirror"
 	_ "github.com/xgfone/go-apigateway/http/middleware/middlewares/processor"
 	_ "github.com/xgfone/go-apigateway/http/middleware/middlewares/redirect"
+	_ "github.com/xgfone/go-apigateway/http/middleware/middlewares/subrequest"
 )
@@ -0,0 +1,281 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mirror provides a traffic mirroring middleware, which sends a copy
+// of the request to the shadow upstream and discards its response.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-apigateway/http/middleware"
+	httpup "github.com/xgfone/go-apigateway/http/upstream"
+	"github.com/xgfone/go-apigateway/internal/rand"
+	"github.com/xgfone/go-toolkit/runtimex"
+)
+
+func init() {
+	middleware.DefaultRegistry.Register("mirror", func(name string, conf any) (middleware.Middleware, error) {
+		var config Config
+		if err := middleware.BindConf(name, &config, conf); err != nil {
+			return nil, err
+		}
+		return Mirror(config)
+	})
+}
+
+// Config is used to configure the mirror middleware.
+type Config struct {
+	// Required, the id of the shadow upstream to receive the mirrored requests.
+	Upstream string `json:"upstream,omitempty" yaml:"upstream,omitempty"`
+
+	// Optional, the percentage of the mirrored requests, range: [1, 100].
+	//
+	// Default: 100
+	Percentage int `json:"percentage,omitempty" yaml:"percentage,omitempty"`
+
+	// Optional, the maximum size of the request body to be buffered.
+	// If the request body is larger than it, the request is not mirrored.
+	//
+	// Default: 1MB
+	MaxBodySize int64 `json:"maxBodySize,omitempty" yaml:"maxBodySize,omitempty"`
+
+	// Optional, the maximum number of the concurrent mirrored requests.
+	// If exceeding it, the request is not mirrored.
+	//
+	// Default: 100
+	MaxConcurrency int `json:"maxConcurrency,omitempty" yaml:"maxConcurrency,omitempty"`
+
+	// Optional, the timeout to forward the mirrored request.
+	//
+	// Default: 3s
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// Mirror returns a new mirror middleware, which clones the final upstream
+// request after the callback functions added by OnForward are called,
+// and forwards it to the shadow upstream asynchronously.
+//
+// The request body is copied while the original request is reading it,
+// and the mirrored request is sent only after the body has been read fully.
+//
+// The failure and latency of the mirrored request never affect
+// the original request.
+func Mirror(config Config) (middleware.Middleware, error) {
+	if config.Upstream == "" {
+		return nil, fmt.Errorf("Mirror: missing the upstream")
+	}
+
+	switch {
+	case config.Percentage == 0:
+		config.Percentage = 100
+	case config.Percentage < 0 || config.Percentage > 100:
+		return nil, fmt.Errorf("Mirror: invalid percentage %d", config.Percentage)
+	}
+
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = 1024 * 1024
+	}
+	if config.MaxConcurrency <= 0 {
+		config.MaxConcurrency = 100
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second * 3
+	}
+
+	m := &mirror{
+		upid:     config.Upstream,
+		percent:  config.Percentage,
+		maxbody:  config.MaxBodySize,
+		maxconc:  int32(config.MaxConcurrency),
+		timeout:  config.Timeout,
+		inflight: new(atomic.Int32),
+	}
+
+	return middleware.New("mirror", config, func(next core.Handler) core.Handler {
+		return func(c *core.Context) {
+			if c.IsAborted {
+				return
+			}
+
+			var body *teeBody
+			c.OnUpstreamRequest(func() { body = m.Mirror(c) })
+			next(c)
+
+			// The body is not read fully, such as the failed forwarding.
+			if body != nil {
+				body.finish(false)
+			}
+		}
+	}), nil
+}
+
+type mirror struct {
+	upid     string
+	percent  int
+	maxbody  int64
+	maxconc  int32
+	timeout  time.Duration
+	inflight *atomic.Int32
+}
+
+// Mirror clones the upstream request of the context and forwards it
+// to the shadow upstream asynchronously.
+//
+// If the request has a body, return the wrapper of the body, which sends
+// the mirrored request after the original request reads the body fully.
+func (m *mirror) Mirror(c *core.Context) (body *teeBody) {
+	if m.percent < 100 && rand.Intn(100) >= m.percent {
+		return
+	}
+
+	// The upgraded connection, such as WebSocket, cannot be mirrored.
+	if core.IsUpgrade(c.ClientRequest) {
+		return
+	}
+
+	if m.inflight.Add(1) > m.maxconc {
+		m.inflight.Add(-1)
+		slog.Debug("discard the mirrored request because of too many concurrent requests",
+			"reqid", c.RequestID(), "route", c.RouteId, "mirror", m.upid)
+		return
+	}
+
+	orig := c.UpstreamRequest
+	if orig.ContentLength > m.maxbody {
+		m.discard(c.RequestID(), c.RouteId, "the too large body")
+		return
+	}
+
+	req := orig.Clone(context.Background())
+	req.RequestURI = ""
+	if orig.Body == nil || orig.Body == http.NoBody {
+		go m.forward(c.RouteId, req)
+		return
+	}
+
+	reqid, routeId := c.RequestID(), c.RouteId
+	body = &teeBody{ReadCloser: orig.Body, size: orig.ContentLength, max: m.maxbody}
+	body.send = func(data []byte) {
+		req.Body = io.NopCloser(bytes.NewReader(data))
+		req.ContentLength = int64(len(data))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+		go m.forward(routeId, req)
+	}
+	body.discard = func(reason string) { m.discard(reqid, routeId, reason) }
+
+	orig.Body = body
+	return
+}
+
+func (m *mirror) discard(reqid, routeId, reason string) {
+	m.inflight.Add(-1)
+	slog.Debug("discard the mirrored request because of "+reason,
+		"reqid", reqid, "route", routeId, "mirror", m.upid)
+}
+
+func (m *mirror) forward(routeId string, req *http.Request) {
+	defer m.inflight.Add(-1)
+	defer runtimex.Recover(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	c := core.AcquireContext(ctx)
+	defer core.ReleaseContext(c)
+
+	c.RouteId = routeId
+	c.UpstreamId = m.upid
+	c.ClientRequest = req
+	c.UpstreamRequest = req.WithContext(ctx)
+	httpup.Forward(c)
+	if c.IsAborted && c.Error != nil {
+		slog.Error("fail to mirror the request", "route", routeId,
+			"mirror", m.upid, "err", c.Error)
+	}
+
+	if c.UpstreamResponse != nil {
+		_, _ = io.Copy(io.Discard, c.UpstreamResponse.Body)
+		c.UpstreamResponse.Body.Close()
+	}
+}
+
+// teeBody copies the body into the bounded buffer while the original request
+// is reading it, and sends the mirrored request with the buffered body once
+// the body has been read fully, so the original request is never delayed.
+type teeBody struct {
+	io.ReadCloser
+	size int64 // The length of the body, which is unknown if not positive.
+	read int64
+	max  int64
+	buf  bytes.Buffer
+
+	overflow bool
+	once     sync.Once
+	send     func(data []byte)
+	discard  func(reason string)
+}
+
+func (b *teeBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if n > 0 {
+		b.read += int64(n)
+		if !b.overflow {
+			if b.read > b.max {
+				b.overflow = true
+				b.buf = bytes.Buffer{}
+			} else {
+				b.buf.Write(p[:n])
+			}
+		}
+	}
+
+	switch {
+	case err == io.EOF, err == nil && b.size > 0 && b.read >= b.size:
+		b.finish(true)
+	case err != nil:
+		b.finish(false)
+	}
+	return
+}
+
+func (b *teeBody) Close() error {
+	b.finish(false)
+	return b.ReadCloser.Close()
+}
+
+// finish sends or discards the mirrored request only once.
+func (b *teeBody) finish(complete bool) {
+	b.once.Do(func() {
+		switch {
+		case !complete:
+			b.discard("the incomplete body")
+		case b.overflow:
+			b.discard("the too large body")
+		default:
+			b.send(b.buf.Bytes())
+		}
+	})
+}
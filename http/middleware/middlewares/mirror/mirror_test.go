@@ -0,0 +1,203 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	httpup "github.com/xgfone/go-apigateway/http/upstream"
+	"github.com/xgfone/go-apigateway/upstream"
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-loadbalancer/balancer"
+	"github.com/xgfone/go-loadbalancer/endpoint"
+	"github.com/xgfone/go-loadbalancer/forwarder"
+)
+
+type mirrored struct {
+	header string
+	body   string
+}
+
+func addTestUpstream(name string, serve func(c *core.Context) (*http.Response, error)) {
+	static := &loadbalancer.Static{Endpoints: loadbalancer.Endpoints{
+		endpoint.New(name, func(ctx context.Context, req any) (any, error) {
+			return serve(req.(*core.Context))
+		}),
+	}}
+
+	discovery := loadbalancer.DiscoveryFunc(func() *loadbalancer.Static { return static })
+	upstream.Manager.Add(name, upstream.New(forwarder.New(name, balancer.DefaultBalancer, discovery)))
+}
+
+func newTestContext(body string) *core.Context {
+	c := core.AcquireContext(context.Background())
+	c.ClientRequest = &http.Request{
+		Host:          "localhost",
+		Method:        "POST",
+		RequestURI:    "/",
+		RemoteAddr:    "127.0.0.1:1234",
+		Header:        http.Header{},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	c.UpstreamRequest = c.ClientRequest.Clone(context.Background())
+	c.UpstreamRequest.RequestURI = ""
+	c.UpstreamRequest.URL = &url.URL{Path: "/path"}
+	c.OnForward(func() { c.UpstreamRequest.Header.Set("X-Forward", "1") })
+	return c
+}
+
+func TestMirror(t *testing.T) {
+	results := make(chan mirrored, 4)
+	addTestUpstream("mirror_primary", func(c *core.Context) (*http.Response, error) {
+		data, err := io.ReadAll(c.UpstreamRequest.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(string(data)))}, nil
+	})
+	addTestUpstream("mirror_shadow", func(c *core.Context) (*http.Response, error) {
+		data, err := io.ReadAll(c.UpstreamRequest.Body)
+		if err != nil {
+			return nil, err
+		}
+		results <- mirrored{header: c.UpstreamRequest.Header.Get("X-Forward"), body: string(data)}
+		return nil, errors.New("the mirror error is ignored")
+	})
+	defer upstream.Manager.Del("mirror_primary")
+	defer upstream.Manager.Del("mirror_shadow")
+
+	m, err := Mirror(Config{Upstream: "mirror_shadow", MaxBodySize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := m.Handler(httpup.Forward)
+
+	for _, body := range []string{"", "abc", "abcdefgh", "abcdefghi"} {
+		c := newTestContext(body)
+		c.UpstreamId = "mirror_primary"
+		handler(c)
+
+		if c.Error != nil {
+			t.Errorf("unexpected error: %v", c.Error)
+		} else if data, _ := io.ReadAll(c.UpstreamResponse.Body); string(data) != body {
+			t.Errorf("expect the primary body '%s', but got '%s'", body, data)
+		}
+
+		if len(body) > 8 {
+			select {
+			case r := <-results:
+				t.Errorf("unexpect the mirrored request with the body '%s'", r.body)
+			case <-time.After(time.Millisecond * 50):
+			}
+			continue
+		}
+
+		select {
+		case r := <-results:
+			if r.header != "1" {
+				t.Errorf("expect the mirrored header '1', but got '%s'", r.header)
+			}
+			if r.body != body {
+				t.Errorf("expect the mirrored body '%s', but got '%s'", body, r.body)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("expect the mirrored request with the body '%s', but got none", body)
+		}
+	}
+}
+
+func TestMirrorStreamingBody(t *testing.T) {
+	started := make(chan struct{})
+	results := make(chan mirrored, 1)
+	addTestUpstream("mirror_streaming_primary", func(c *core.Context) (*http.Response, error) {
+		close(started)
+		data, err := io.ReadAll(c.UpstreamRequest.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case r := <-results:
+			t.Errorf("unexpect the mirrored request before reading the body fully: %+v", r)
+		default:
+		}
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(string(data)))}, nil
+	})
+	addTestUpstream("mirror_streaming_shadow", func(c *core.Context) (*http.Response, error) {
+		data, _ := io.ReadAll(c.UpstreamRequest.Body)
+		results <- mirrored{body: string(data)}
+		return nil, nil
+	})
+	defer upstream.Manager.Del("mirror_streaming_primary")
+	defer upstream.Manager.Del("mirror_streaming_shadow")
+
+	m, err := Mirror(Config{Upstream: "mirror_streaming_shadow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The body is sent only after the primary request starts to read it,
+	// which would block forever if the body were read before forwarding.
+	pr, pw := io.Pipe()
+	go func() {
+		select {
+		case <-started:
+			_, _ = io.WriteString(pw, "chunk1,")
+			_, _ = io.WriteString(pw, "chunk2")
+			pw.Close()
+		case <-time.After(time.Second):
+			pw.CloseWithError(errors.New("the primary request is not forwarded"))
+		}
+	}()
+
+	c := newTestContext("")
+	c.UpstreamId = "mirror_streaming_primary"
+	c.UpstreamRequest.Body = pr
+	c.UpstreamRequest.ContentLength = -1
+	m.Handler(httpup.Forward)(c)
+
+	if c.Error != nil {
+		t.Fatalf("unexpected error: %v", c.Error)
+	} else if data, _ := io.ReadAll(c.UpstreamResponse.Body); string(data) != "chunk1,chunk2" {
+		t.Errorf("expect the primary body '%s', but got '%s'", "chunk1,chunk2", data)
+	}
+
+	select {
+	case r := <-results:
+		if r.body != "chunk1,chunk2" {
+			t.Errorf("expect the mirrored body '%s', but got '%s'", "chunk1,chunk2", r.body)
+		}
+	case <-time.After(time.Second):
+		t.Error("expect the mirrored request, but got none")
+	}
+}
+
+func TestMirrorConfig(t *testing.T) {
+	if _, err := Mirror(Config{}); err == nil {
+		t.Error("expect an error, but got nil")
+	}
+	if _, err := Mirror(Config{Upstream: "shadow", Percentage: 101}); err == nil {
+		t.Error("expect an error, but got nil")
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package subrequest provides a middleware to perform an internal sub-request
+// into a route, which is generally protected.
+package subrequest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-apigateway/http/middleware"
+	"github.com/xgfone/go-apigateway/http/router"
+	"github.com/xgfone/go-apigateway/http/statuscode"
+)
+
+func init() {
+	middleware.DefaultRegistry.Register("subrequest", func(name string, conf any) (middleware.Middleware, error) {
+		var config Config
+		if err := middleware.BindConf(name, &config, conf); err != nil {
+			return nil, err
+		}
+		return SubRequest(config)
+	})
+}
+
+// The modes of the sub-request.
+const (
+	// The request is redirected into the route internally,
+	// and its response is sent to the client instead.
+	ModeRedirect = "redirect"
+
+	// A sub-request without body is sent to the route to authorize
+	// the request. If its response status code is 2xx, continue to handle
+	// the request. Or, its response is sent to the client.
+	ModeAuth = "auth"
+)
+
+// Config is used to configure the subrequest middleware.
+type Config struct {
+	// Required, the id of the route handling the sub-request.
+	Route string `json:"route,omitempty" yaml:"route,omitempty"`
+
+	// Optional, one of "redirect" or "auth".
+	//
+	// Default: "redirect"
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+
+	// Optional, the response headers of the auth sub-request,
+	// which are added into the request forwarded to the upstream
+	// if the auth succeeded.
+	//
+	// Support that the last character is "*" as the prefix matching,
+	// Such as "X-User-*".
+	UpstreamHeaders []string `json:"upstreamHeaders,omitempty" yaml:"upstreamHeaders,omitempty"`
+
+	// Optional, the maximum size of the response body of the auth sub-request,
+	// which is buffered in memory. If exceeding, respond with the status code 502.
+	//
+	// Unit: byte, Default: 65536
+	MaxBodySize int `json:"maxBodySize,omitempty" yaml:"maxBodySize,omitempty"`
+
+	// Optional, the router to dispatch the sub-request.
+	//
+	// Default: router.DefaultRouter
+	Router *router.Router `json:"-" yaml:"-"`
+}
+
+// SubRequest returns a new middleware named "subrequest", which performs
+// an internal sub-request into the route with its own context.
+//
+// The loop of the sub-requests is detected by the router,
+// and responds with the status code 508.
+func SubRequest(config Config) (middleware.Middleware, error) {
+	if config.Route == "" {
+		return nil, fmt.Errorf("SubRequest: missing the route")
+	}
+
+	if config.Router == nil {
+		config.Router = router.DefaultRouter
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = 64 * 1024
+	}
+
+	s := subrequest{route: config.Route, router: config.Router, maxBodySize: config.MaxBodySize}
+	for _, key := range config.UpstreamHeaders {
+		if strings.HasSuffix(key, "*") {
+			s.prefixHeaders = append(s.prefixHeaders, http.CanonicalHeaderKey(key[:len(key)-1]))
+		} else {
+			s.exactHeaders = append(s.exactHeaders, http.CanonicalHeaderKey(key))
+		}
+	}
+
+	var handle func(*subrequest, core.Handler, *core.Context)
+	switch config.Mode {
+	case "", ModeRedirect:
+		config.Mode = ModeRedirect
+		handle = (*subrequest).redirect
+
+	case ModeAuth:
+		handle = (*subrequest).auth
+
+	default:
+		return nil, fmt.Errorf("SubRequest: unsupported the mode '%s'", config.Mode)
+	}
+
+	return middleware.New("subrequest", config, func(next core.Handler) core.Handler {
+		return func(c *core.Context) {
+			if c.IsAborted {
+				return
+			}
+			handle(&s, next, c)
+		}
+	}), nil
+}
+
+type subrequest struct {
+	route       string
+	router      *router.Router
+	maxBodySize int
+
+	exactHeaders  []string
+	prefixHeaders []string
+}
+
+func (s *subrequest) redirect(_ core.Handler, c *core.Context) {
+	if err := s.router.SubRequest(c, s.route, nil, c.ClientResponse); err != nil {
+		c.Abort(err)
+	}
+}
+
+func (s *subrequest) auth(next core.Handler, c *core.Context) {
+	req := c.ClientRequest.Clone(c.Context)
+	req.Body = http.NoBody
+	req.GetBody = nil
+	req.ContentLength = 0
+	req.Header.Del("Content-Length")
+
+	rec := newRecorder(s.maxBodySize)
+	err := s.router.SubRequest(c, s.route, req, rec)
+	if err != nil {
+		slog.Error("fail to authorize the request by the sub-request",
+			"reqid", c.RequestID(), "route", c.RouteId, "subroute", s.route,
+			"code", rec.code, "err", err)
+	}
+
+	if rec.overflow {
+		c.Abort(statuscode.ErrBadGateway.WithError(fmt.Errorf(
+			"the response body of the sub-request exceeds %d bytes", s.maxBodySize)))
+		return
+	}
+
+	if rec.code == 0 {
+		if err != nil {
+			c.Abort(err)
+			return
+		}
+		rec.code = http.StatusOK
+	}
+
+	if rec.code < 300 {
+		c.OnForward(func() { s.copyHeaders(c.UpstreamRequest.Header, rec.header) })
+		next(c)
+		return
+	}
+
+	header := c.ClientResponse.Header()
+	for key, values := range rec.header {
+		header[key] = values
+	}
+	c.ClientResponse.WriteHeader(rec.code)
+	_, _ = c.ClientResponse.Write(rec.body.Bytes())
+}
+
+func (s *subrequest) copyHeaders(dst, src http.Header) {
+	for key, values := range src {
+		if s.matchHeader(key) {
+			dst[key] = values
+		}
+	}
+}
+
+func (s *subrequest) matchHeader(key string) bool {
+	for _, k := range s.exactHeaders {
+		if k == key {
+			return true
+		}
+	}
+	for _, prefix := range s.prefixHeaders {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var errBodyTooLarge = errors.New("the response body is too large")
+
+// recorder is used to record the response of the sub-request,
+// the body of which is limited to the given size.
+type recorder struct {
+	header   http.Header
+	body     bytes.Buffer
+	code     int
+	limit    int
+	overflow bool
+}
+
+func newRecorder(limit int) *recorder { return &recorder{header: make(http.Header, 4), limit: limit} }
+
+func (r *recorder) Header() http.Header { return r.header }
+func (r *recorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.body.Len()+len(p) > r.limit {
+		r.overflow = true
+		return 0, errBodyTooLarge
+	}
+	return r.body.Write(p)
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subrequest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-apigateway/http/router"
+)
+
+func newRouter(t *testing.T, config Config, handler core.Handler) *router.Router {
+	r := router.New()
+	config.Router = r
+
+	m, err := SubRequest(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddRoutes(
+		router.Route{
+			RouteId:    "public",
+			UpstreamId: "up",
+			Matcher:    router.AlwaysTrue,
+			Handler:    m.Handler(handler),
+		},
+		router.Route{
+			RouteId:    "inner",
+			UpstreamId: "up",
+			Protect:    true,
+			Matcher:    router.AlwaysTrue,
+			Handler: func(c *core.Context) {
+				if c.ClientRequest.Header.Get("Authorization") == "large" {
+					c.ClientResponse.WriteHeader(401)
+					_, _ = c.ClientResponse.Write([]byte(strings.Repeat("a", 2048)))
+					return
+				}
+
+				if c.ClientRequest.Header.Get("Authorization") != "token" {
+					c.ClientResponse.Header().Set("X-Reason", "invalid token")
+					c.ClientResponse.WriteHeader(401)
+					return
+				}
+
+				c.ClientResponse.Header().Set("X-User-Id", "123")
+				c.ClientResponse.Header().Set("X-Other", "abc")
+				c.ClientResponse.WriteHeader(204)
+			},
+		},
+	)
+
+	return r
+}
+
+func TestSubRequestRedirect(t *testing.T) {
+	r := newRouter(t, Config{Route: "inner"}, func(c *core.Context) {
+		t.Error("unexpect to call the next handler")
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "token")
+	r.ServeHTTP(rec, req)
+	if rec.Code != 204 {
+		t.Errorf("expect status code 204, but got %d", rec.Code)
+	} else if id := rec.Header().Get("X-User-Id"); id != "123" {
+		t.Errorf("expect the header X-User-Id '123', but got '%s'", id)
+	}
+}
+
+func TestSubRequestAuth(t *testing.T) {
+	config := Config{Route: "inner", Mode: ModeAuth, UpstreamHeaders: []string{"X-User-*"}}
+	r := newRouter(t, config, func(c *core.Context) {
+		c.UpstreamRequest = c.ClientRequest.Clone(c.Context)
+		c.CallbackOnForward()
+
+		if id := c.UpstreamRequest.Header.Get("X-User-Id"); id != "123" {
+			t.Errorf("expect the upstream header X-User-Id '123', but got '%s'", id)
+		}
+		if v := c.UpstreamRequest.Header.Get("X-Other"); v != "" {
+			t.Errorf("unexpect the upstream header X-Other, but got '%s'", v)
+		}
+		c.ClientResponse.WriteHeader(200)
+	})
+
+	// Success
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("Authorization", "token")
+	r.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Errorf("expect status code 200, but got %d", rec.Code)
+	}
+
+	// Failure
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	r.ServeHTTP(rec, req)
+	if rec.Code != 401 {
+		t.Errorf("expect status code 401, but got %d", rec.Code)
+	} else if reason := rec.Header().Get("X-Reason"); reason != "invalid token" {
+		t.Errorf("expect the header X-Reason 'invalid token', but got '%s'", reason)
+	}
+}
+
+func TestSubRequestAuthMaxBodySize(t *testing.T) {
+	config := Config{Route: "inner", Mode: ModeAuth, MaxBodySize: 1024}
+	r := newRouter(t, config, func(c *core.Context) {
+		t.Error("unexpect to call the next handler")
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "large")
+	r.ServeHTTP(rec, req)
+	if rec.Code != 502 {
+		t.Errorf("expect status code 502, but got %d", rec.Code)
+	} else if strings.Contains(rec.Body.String(), "aaaa") {
+		t.Errorf("unexpect the response body of the sub-request, but got '%s'", rec.Body.String())
+	}
+}
+
+func TestSubRequestLoop(t *testing.T) {
+	r := router.New()
+	m, err := SubRequest(Config{Route: "public", Router: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.AddRoutes(router.Route{
+		RouteId:    "public",
+		UpstreamId: "up",
+		Matcher:    router.AlwaysTrue,
+		Handler:    m.Handler(func(c *core.Context) { t.Error("unexpect to call the next handler") }),
+	})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != 508 {
+		t.Errorf("expect status code 508, but got %d", rec.Code)
+	}
+}
+
+func TestSubRequestConfig(t *testing.T) {
+	if _, err := SubRequest(Config{}); err == nil {
+		t.Error("expect an error for the missing route, but got nil")
+	}
+	if _, err := SubRequest(Config{Route: "r", Mode: "unknown"}); err == nil {
+		t.Error("expect an error for the unknown mode, but got nil")
+	}
+}
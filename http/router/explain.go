@@ -0,0 +1,200 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/json"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/xgfone/go-apigateway/http/core"
+)
+
+// RouteExplanation is the explanation of a route matching the request.
+type RouteExplanation struct {
+	RouteId    string `json:"routeId"`
+	UpstreamId string `json:"upstreamId"`
+	Priority   int    `json:"priority"`
+	Desc       string `json:"desc"`
+
+	Matched bool   `json:"matched"`
+	Skipped string `json:"skipped,omitempty"` // The reason why the route is skipped
+}
+
+// ExplainedRoute is the final matched route of the request.
+type ExplainedRoute struct {
+	RouteId    string `json:"routeId"`
+	UpstreamId string `json:"upstreamId"` // The upstream selected for the request.
+
+	// The weighted upstreams if the upstream is selected randomly
+	// by the weight for each request, in which case UpstreamId is empty.
+	Upstreams []WeightedUpstream `json:"upstreams,omitempty"`
+
+	RequestTimeout time.Duration `json:"requestTimeout,omitempty"`
+	ForwardTimeout time.Duration `json:"forwardTimeout,omitempty"`
+
+	// The names of the global and route middlewares from outside to inside.
+	Middlewares []string `json:"middlewares,omitempty"`
+
+	// The parameters captured from the request, such as the path parameters.
+	Params map[string]any `json:"params,omitempty"`
+}
+
+// Explanation is the explanation of the router matching a request.
+type Explanation struct {
+	// All the routes in the order of being evaluated.
+	Routes []RouteExplanation `json:"routes"`
+
+	// The final matched route, which is nil if no route matches.
+	Winner *ExplainedRoute `json:"winner,omitempty"`
+}
+
+// Explain explains how the router matches the request without forwarding it,
+// which evaluates all the routes by the priority and returns the results.
+func (r *Router) Explain(req *http.Request) Explanation {
+	routes := r.routes.Load()
+	exp := Explanation{Routes: make([]RouteExplanation, len(routes.Routes))}
+	for i := range routes.Routes {
+		route := &routes.Routes[i]
+		exp.Routes[i] = RouteExplanation{
+			RouteId:    route.RouteId,
+			UpstreamId: route.UpstreamId,
+			Priority:   route.Priority,
+			Desc:       route.Desc,
+		}
+
+		if route.Protect {
+			exp.Routes[i].Skipped = "protect"
+		} else {
+			exp.Routes[i].Matched = route.Match(req)
+		}
+	}
+
+	if route := routes.match(req); route != nil {
+		exp.Winner = r.explainRoute(req, route)
+	}
+
+	return exp
+}
+
+func (r *Router) explainRoute(req *http.Request, route *Route) *ExplainedRoute {
+	c := core.AcquireContext(req.Context())
+	defer core.ReleaseContext(c)
+
+	c.ClientRequest = req
+	c.UpstreamId = route.UpstreamId
+	if capturer, ok := route.Matcher.(Capturer); ok {
+		capturer.Capture(c)
+	}
+
+	// Not use the random result of the splitter, which may be different
+	// for each explanation, but report all the weighted upstreams instead.
+	var upstreams []WeightedUpstream
+	switch selector := route.UpstreamSelector.(type) {
+	case nil:
+	case *Splitter:
+		if id, ok := selector.stickyUpstream(selector.targets.Load(), c); !ok {
+			upstreams = selector.Targets()
+			c.UpstreamId = ""
+		} else if id != "" {
+			c.UpstreamId = id
+		}
+	default:
+		if id := selector.SelectUpstream(c); id != "" {
+			c.UpstreamId = id
+		}
+	}
+
+	middlewares := make([]string, 0, len(r.gmddlws)+len(route.Middlewares))
+	for _, m := range r.gmddlws {
+		middlewares = append(middlewares, m.Name())
+	}
+	middlewares = append(middlewares, route.Middlewares...)
+
+	winner := &ExplainedRoute{
+		RouteId:        route.RouteId,
+		UpstreamId:     c.UpstreamId,
+		Upstreams:      upstreams,
+		RequestTimeout: route.RequestTimeout,
+		ForwardTimeout: route.ForwardTimeout,
+		Middlewares:    middlewares,
+	}
+
+	if len(c.Kvs) > 0 {
+		winner.Params = maps.Clone(c.Kvs)
+	}
+
+	return winner
+}
+
+// ExplainHandler returns a http handler to explain how the router matches
+// a request described by the query arguments as follow:
+//
+//	url:      Required, the url of the request, such as "http://www.example.com/path?k=v".
+//	method:   Optional, the method of the request. Default: GET
+//	clientip: Optional, the client ip of the request. Default: the ip of the explain request.
+//
+// The headers of the explain request are used as those of the explained request.
+// And the explanation is responded as JSON.
+func ExplainHandler(r *Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		rawurl := query.Get("url")
+		if rawurl == "" {
+			http.Error(w, "missing the query argument 'url'", http.StatusBadRequest)
+			return
+		}
+
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			http.Error(w, "invalid url: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		method := query.Get("method")
+		if method == "" {
+			method = http.MethodGet
+		}
+
+		remoteaddr := req.RemoteAddr
+		if ip := query.Get("clientip"); ip != "" {
+			remoteaddr = net.JoinHostPort(ip, "0")
+		}
+
+		host := u.Host
+		if host == "" {
+			host = req.Host
+		}
+
+		explained := (&http.Request{
+			Method:     method,
+			URL:        u,
+			Host:       host,
+			Header:     req.Header.Clone(),
+			RemoteAddr: remoteaddr,
+			RequestURI: u.RequestURI(),
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Body:       http.NoBody,
+		}).WithContext(req.Context())
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(r.Explain(explained))
+	})
+}
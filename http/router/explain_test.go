@@ -0,0 +1,180 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-apigateway/http/middleware"
+)
+
+func TestRouterExplain(t *testing.T) {
+	prefix := func(prefix string) MatcherFunc {
+		return func(r *http.Request) bool { return strings.HasPrefix(r.URL.Path, prefix) }
+	}
+
+	forwarded := false
+	handler := func(*core.Context) { forwarded = true }
+
+	r := New()
+	r.Use(middleware.New("global", nil, func(next core.Handler) core.Handler { return next }))
+	r.AddRoutes(
+		Route{RouteId: "r1", UpstreamId: "up1", Priority: 1, Matcher: prefix("/"), Handler: handler},
+		Route{RouteId: "r2", UpstreamId: "up2", Priority: 3, Matcher: prefix("/a"), Handler: handler},
+		Route{RouteId: "r3", UpstreamId: "up3", Priority: 2, Matcher: prefix("/a/b"), Handler: handler,
+			RequestTimeout: time.Second, Middlewares: []string{"auth"}},
+		Route{RouteId: "r4", UpstreamId: "up4", Priority: 9, Matcher: prefix("/"), Handler: handler, Protect: true},
+	)
+
+	exp := r.Explain(&http.Request{URL: &url.URL{Path: "/a/b/c"}})
+	if forwarded {
+		t.Error("unexpect the request to be forwarded")
+	}
+
+	expects := []RouteExplanation{
+		{RouteId: "r2", UpstreamId: "up2", Priority: 3, Matched: true},
+		{RouteId: "r3", UpstreamId: "up3", Priority: 2, Matched: true},
+		{RouteId: "r1", UpstreamId: "up1", Priority: 1, Matched: true},
+		{RouteId: "r4", UpstreamId: "up4", Priority: 9, Skipped: "protect"},
+	}
+	if len(exp.Routes) != len(expects) {
+		t.Fatalf("expect %d routes, but got %d", len(expects), len(exp.Routes))
+	}
+	for i, expect := range expects {
+		if exp.Routes[i] != expect {
+			t.Errorf("%d: expect %+v, but got %+v", i, expect, exp.Routes[i])
+		}
+	}
+
+	if exp.Winner == nil {
+		t.Fatal("expect a winner, but got nil")
+	} else if exp.Winner.RouteId != "r2" || exp.Winner.UpstreamId != "up2" {
+		t.Errorf("expect the winner 'r2', but got %+v", exp.Winner)
+	} else if len(exp.Winner.Middlewares) != 1 || exp.Winner.Middlewares[0] != "global" {
+		t.Errorf("expect the middlewares [global], but got %v", exp.Winner.Middlewares)
+	}
+
+	r.DelRoutesByIds("r2")
+	exp = r.Explain(&http.Request{URL: &url.URL{Path: "/a/b/c"}})
+	if exp.Winner == nil || exp.Winner.RouteId != "r3" {
+		t.Errorf("expect the winner 'r3', but got %+v", exp.Winner)
+	} else if exp.Winner.RequestTimeout != time.Second {
+		t.Errorf("expect the request timeout '%s', but got '%s'", time.Second, exp.Winner.RequestTimeout)
+	} else if mws := exp.Winner.Middlewares; len(mws) != 2 || mws[0] != "global" || mws[1] != "auth" {
+		t.Errorf("expect the middlewares [global auth], but got %v", mws)
+	}
+
+	r.DelRoutesByIds("r1", "r3")
+	if exp = r.Explain(&http.Request{URL: &url.URL{Path: "/a"}}); exp.Winner != nil {
+		t.Errorf("expect no winner, but got %+v", exp.Winner)
+	}
+}
+
+func TestRouterExplainParams(t *testing.T) {
+	r := New()
+	r.AddRoutes(Route{
+		RouteId:          "route",
+		UpstreamId:       "up",
+		Matcher:          templatematcher{MustPathTemplate("/users/{id}")},
+		UpstreamSelector: NewSplitter(nil, WeightedUpstream{UpstreamId: "up2", Weight: 1}),
+	})
+
+	exp := r.Explain(&http.Request{URL: &url.URL{Path: "/users/123"}})
+	if exp.Winner == nil {
+		t.Fatal("expect a winner, but got nil")
+	} else if exp.Winner.UpstreamId != "up2" {
+		t.Errorf("expect the upstream 'up2', but got '%s'", exp.Winner.UpstreamId)
+	} else if id := exp.Winner.Params["id"]; id != "123" {
+		t.Errorf("expect the param id '123', but got '%v'", id)
+	}
+}
+
+func TestRouterExplainSplitter(t *testing.T) {
+	targets := []WeightedUpstream{{UpstreamId: "up1", Weight: 1}, {UpstreamId: "up2", Weight: 1}}
+	splitter := NewSplitter(func(c *core.Context) string { return c.ClientRequest.Header.Get("X-User") }, targets...)
+
+	r := New()
+	r.AddRoutes(Route{RouteId: "route", UpstreamId: "up", Matcher: AlwaysTrue, UpstreamSelector: splitter})
+
+	// Report all the weighted upstreams instead of a random one.
+	exp := r.Explain(&http.Request{URL: &url.URL{Path: "/"}, Header: http.Header{}})
+	if exp.Winner == nil {
+		t.Fatal("expect a winner, but got nil")
+	} else if exp.Winner.UpstreamId != "" {
+		t.Errorf("expect no upstream, but got '%s'", exp.Winner.UpstreamId)
+	} else if !slices.Equal(exp.Winner.Upstreams, targets) {
+		t.Errorf("expect the upstreams %v, but got %v", targets, exp.Winner.Upstreams)
+	}
+
+	// Report the upstream selected by the sticky key.
+	req := &http.Request{URL: &url.URL{Path: "/"}, Header: http.Header{"X-User": {"123"}}}
+	expect := splitter.SelectUpstream(&core.Context{ClientRequest: req})
+	for range 10 {
+		exp = r.Explain(req)
+		if exp.Winner.UpstreamId != expect {
+			t.Fatalf("expect the upstream '%s', but got '%s'", expect, exp.Winner.UpstreamId)
+		} else if exp.Winner.Upstreams != nil {
+			t.Fatalf("unexpect the upstreams, but got %v", exp.Winner.Upstreams)
+		}
+	}
+}
+
+type templatematcher struct{ *PathTemplate }
+
+func (m templatematcher) Capture(c *core.Context) { m.PathTemplate.Capture(c.ClientRequest, c.Kvs) }
+
+func TestExplainHandler(t *testing.T) {
+	r := New()
+	r.AddRoutes(Route{
+		RouteId:    "route",
+		UpstreamId: "up",
+		Matcher: MatcherFunc(func(r *http.Request) bool {
+			return r.Host == "www.example.com" && r.Method == "POST" &&
+				r.Header.Get("X-Env") == "test" && r.URL.Path == "/path"
+		}),
+	})
+
+	handler := ExplainHandler(r)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/explain", nil)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 400 {
+		t.Errorf("expect status code 400, but got %d", rec.Code)
+	}
+
+	query := url.Values{"url": {"http://www.example.com/path"}, "method": {"POST"}}
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/explain?"+query.Encode(), nil)
+	req.Header.Set("X-Env", "test")
+	handler.ServeHTTP(rec, req)
+
+	var exp Explanation
+	if rec.Code != 200 {
+		t.Fatalf("expect status code 200, but got %d", rec.Code)
+	} else if err := json.Unmarshal(rec.Body.Bytes(), &exp); err != nil {
+		t.Fatal(err)
+	} else if exp.Winner == nil || exp.Winner.RouteId != "route" {
+		t.Errorf("expect the winner 'route', but got %+v", exp.Winner)
+	}
+}
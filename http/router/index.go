@@ -0,0 +1,284 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	matcher "github.com/xgfone/go-http-matcher"
+)
+
+// IndexRule is a necessary condition of a route matcher,
+// which is used to index the route by the host and path of the request.
+//
+// The route matcher can match the request only if the request satisfies
+// the index rule, that's, the request host is one of Hosts if Hosts is not
+// empty, and the request path is one of Paths or has a prefix in PathPrefixes
+// if Paths or PathPrefixes is not empty.
+//
+// The semantics of the hosts and paths are the same as those of
+// the matchers Host, Path and PathPrefix in github.com/xgfone/go-http-matcher.
+type IndexRule struct {
+	Hosts        []string // Exact(www.example.com) or Wildcard(*.example.com)
+	Paths        []string // Exact
+	PathPrefixes []string // Prefix, which is split by "/"
+}
+
+// Indexer is an optional interface that the route matcher implements
+// to report its index rules, any of which must be satisfied by the request
+// before the matcher matches it.
+//
+// If the matcher does not implement the interface or returns no rules,
+// the route is a candidate for all the requests.
+type Indexer interface {
+	IndexRules() []IndexRule
+}
+
+var indexbufpool = &sync.Pool{New: func() any {
+	buf := make([]int, 0, 16)
+	return &buf
+}}
+
+// routeindex is the index of the sorted routes by the request host and path,
+// which stores the positions of the routes in the sorted route slice.
+type routeindex struct {
+	exacts  map[string]*pathindex // For the exact hosts
+	wilds   map[string]*pathindex // For the suffixes of the wildcard hosts
+	wlens   []int                 // The lengths of the wildcard host suffixes
+	anyhost *pathindex            // For the routes without the hosts
+}
+
+func newRouteIndex(routes []Route) *routeindex {
+	var indexed bool
+	for i := range routes {
+		if _, ok := routes[i].Matcher.(Indexer); ok {
+			indexed = true
+			break
+		}
+	}
+	if !indexed {
+		return nil
+	}
+
+	index := &routeindex{
+		exacts:  make(map[string]*pathindex, 16),
+		wilds:   make(map[string]*pathindex, 4),
+		anyhost: new(pathindex),
+	}
+
+	for pos := range routes {
+		route := &routes[pos]
+		if route.Protect {
+			// The protected routes are never routed.
+			continue
+		}
+
+		indexer, ok := route.Matcher.(Indexer)
+		if !ok {
+			index.anyhost.addAny(pos)
+			continue
+		}
+
+		rules := indexer.IndexRules()
+		if len(rules) == 0 {
+			index.anyhost.addAny(pos)
+			continue
+		}
+
+		for _, rule := range rules {
+			index.add(pos, rule)
+		}
+	}
+
+	slices.Sort(index.wlens)
+	index.wlens = slices.Compact(index.wlens)
+	return index
+}
+
+func (x *routeindex) add(pos int, rule IndexRule) {
+	if len(rule.Hosts) == 0 || slices.Contains(rule.Hosts, "*") {
+		x.anyhost.add(pos, rule)
+		return
+	}
+
+	for _, host := range rule.Hosts {
+		host = strings.ToLower(host)
+		if suffix, ok := strings.CutPrefix(host, "*"); ok {
+			x.wlens = append(x.wlens, len(suffix))
+			x.wilds[suffix] = x.wilds[suffix].add(pos, rule)
+		} else {
+			x.exacts[host] = x.exacts[host].add(pos, rule)
+		}
+	}
+}
+
+// lookup appends the positions of the candidate routes into buf,
+// which may contain the duplicate positions and are not sorted.
+func (x *routeindex) lookup(req *http.Request, buf []int) []int {
+	path := matcher.GetPath(req)
+	buf = x.anyhost.lookup(path, buf)
+	if len(x.exacts) == 0 && len(x.wilds) == 0 {
+		return buf
+	}
+
+	host := matcher.GetHost(req)
+	if index, ok := x.exacts[host]; ok {
+		buf = index.lookup(path, buf)
+	}
+
+	for _, _len := range x.wlens {
+		if _len > len(host) {
+			break
+		}
+		if index, ok := x.wilds[host[len(host)-_len:]]; ok {
+			buf = index.lookup(path, buf)
+		}
+	}
+
+	return buf
+}
+
+type pathindex struct {
+	any  []int      // For the routes without the paths
+	tree *radixnode // For the routes with the paths or path prefixes
+}
+
+func (p *pathindex) addAny(pos int) { p.any = append(p.any, pos) }
+
+func (p *pathindex) add(pos int, rule IndexRule) *pathindex {
+	if p == nil {
+		p = new(pathindex)
+	}
+
+	if len(rule.Paths) == 0 && len(rule.PathPrefixes) == 0 {
+		p.addAny(pos)
+		return p
+	}
+
+	if p.tree == nil {
+		p.tree = new(radixnode)
+	}
+
+	for _, path := range rule.Paths {
+		p.tree.insert(fixpath(path), pos, false)
+	}
+
+	for _, prefix := range rule.PathPrefixes {
+		if prefix = fixpath(prefix); prefix == "/" {
+			p.addAny(pos)
+		} else {
+			p.tree.insert(prefix, pos, true)
+		}
+	}
+
+	return p
+}
+
+func (p *pathindex) lookup(path string, buf []int) []int {
+	buf = append(buf, p.any...)
+	if p.tree != nil {
+		buf = p.tree.lookup(path, buf)
+	}
+	return buf
+}
+
+func fixpath(path string) string {
+	if path = strings.TrimRight(path, "/"); path == "" {
+		return "/"
+	}
+	return path
+}
+
+// radixnode is a node of the radix tree of the paths.
+type radixnode struct {
+	path     string
+	indices  string // The first bytes of the paths of the children.
+	children []*radixnode
+
+	exacts   []int // The routes whose path is equal to the full node path.
+	prefixes []int // The routes whose path prefix is the full node path.
+}
+
+func (n *radixnode) insert(path string, pos int, prefix bool) {
+	for {
+		i := commonPrefixLen(path, n.path)
+		if i < len(n.path) { // Split the current node.
+			child := &radixnode{
+				path:     n.path[i:],
+				indices:  n.indices,
+				children: n.children,
+				exacts:   n.exacts,
+				prefixes: n.prefixes,
+			}
+
+			*n = radixnode{
+				path:     n.path[:i],
+				indices:  n.path[i : i+1],
+				children: []*radixnode{child},
+			}
+		}
+
+		if path = path[i:]; path == "" {
+			if prefix {
+				n.prefixes = append(n.prefixes, pos)
+			} else {
+				n.exacts = append(n.exacts, pos)
+			}
+			return
+		}
+
+		if index := strings.IndexByte(n.indices, path[0]); index > -1 {
+			n = n.children[index]
+			continue
+		}
+
+		child := &radixnode{path: path}
+		n.indices += path[:1]
+		n.children = append(n.children, child)
+		n = child
+	}
+}
+
+func (n *radixnode) lookup(path string, buf []int) []int {
+	for {
+		if !strings.HasPrefix(path, n.path) {
+			return buf
+		}
+
+		path = path[len(n.path):]
+		if len(n.prefixes) > 0 && (path == "" || path[0] == '/') {
+			buf = append(buf, n.prefixes...)
+		}
+
+		if path == "" {
+			return append(buf, n.exacts...)
+		}
+
+		index := strings.IndexByte(n.indices, path[0])
+		if index < 0 {
+			return buf
+		}
+		n = n.children[index]
+	}
+}
+
+func commonPrefixLen(a, b string) (i int) {
+	for _len := min(len(a), len(b)); i < _len && a[i] == b[i]; i++ {
+	}
+	return
+}
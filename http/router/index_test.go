@@ -0,0 +1,154 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	matcher "github.com/xgfone/go-http-matcher"
+)
+
+type testIndexMatcher struct {
+	matcher.Matcher
+	rules []IndexRule
+}
+
+func (m testIndexMatcher) IndexRules() []IndexRule { return m.rules }
+
+func newTestIndexMatcher(hosts, paths, prefixes []string) Matcher {
+	ms := make([]matcher.Matcher, 0, 3)
+	if m := matcher.Host(hosts...); m != nil {
+		ms = append(ms, m)
+	}
+	if m := matcher.Path(paths...); m != nil {
+		ms = append(ms, m)
+	}
+	if m := matcher.PathPrefix(prefixes...); m != nil {
+		ms = append(ms, m)
+	}
+
+	return testIndexMatcher{
+		Matcher: matcher.And(ms...),
+		rules:   []IndexRule{{Hosts: hosts, Paths: paths, PathPrefixes: prefixes}},
+	}
+}
+
+func TestRadixTree(t *testing.T) {
+	root := new(radixnode)
+	root.insert("/api/v1/users", 0, false)
+	root.insert("/api/v1", 1, true)
+	root.insert("/api/v2/users", 2, false)
+	root.insert("/api", 3, true)
+	root.insert("/apis", 4, false)
+	root.insert("/", 5, false)
+
+	tests := []struct {
+		path   string
+		expect []int
+	}{
+		{"/", []int{5}},
+		{"/api", []int{3}},
+		{"/apis", []int{4}},
+		{"/apix", nil},
+		{"/api/v1", []int{1, 3}},
+		{"/api/v1/users", []int{0, 1, 3}},
+		{"/api/v1/users/1", []int{1, 3}},
+		{"/api/v2/users", []int{2, 3}},
+		{"/api/v10", []int{3}},
+		{"/none", nil},
+	}
+
+	for _, test := range tests {
+		result := root.lookup(test.path, nil)
+		slices.Sort(result)
+		if !slices.Equal(result, test.expect) {
+			t.Errorf("%s: expect %v, but got %v", test.path, test.expect, result)
+		}
+	}
+}
+
+func TestRouterIndex(t *testing.T) {
+	router := New()
+	router.AddRoutes(
+		Route{
+			RouteId:    "exact_host",
+			UpstreamId: "up",
+			Matcher:    newTestIndexMatcher([]string{"www.example.com"}, nil, []string{"/api"}),
+		},
+		Route{
+			RouteId:    "wildcard_host",
+			UpstreamId: "up",
+			Matcher:    newTestIndexMatcher([]string{"*.example.com"}, nil, []string{"/api"}),
+		},
+		Route{
+			RouteId:    "path",
+			UpstreamId: "up",
+			Matcher:    newTestIndexMatcher(nil, []string{"/api/v1/users"}, nil),
+		},
+		Route{
+			RouteId:    "prefix",
+			UpstreamId: "up",
+			Priority:   -1,
+			Matcher:    newTestIndexMatcher(nil, nil, []string{"/api"}),
+		},
+		Route{
+			RouteId:    "custom",
+			UpstreamId: "up",
+			Priority:   -2,
+			Matcher:    MatcherFunc(func(r *http.Request) bool { return r.Method == http.MethodPost }),
+		},
+		Route{
+			RouteId:    "protect",
+			UpstreamId: "up",
+			Protect:    true,
+			Priority:   100,
+			Matcher:    AlwaysTrue,
+		},
+	)
+
+	if router.routes.Load().index == nil {
+		t.Fatal("expect the route index, but got nil")
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		expect string
+	}{
+		{http.MethodGet, "http://www.example.com/api/v1", "exact_host"},
+		{http.MethodGet, "http://WWW.Example.com:8080/api", "exact_host"},
+		{http.MethodGet, "http://abc.example.com/api/v1", "wildcard_host"},
+		{http.MethodGet, "http://www.example.org/api/v1/users", "path"},
+		{http.MethodGet, "http://www.example.org/api/v1/users/", "path"},
+		{http.MethodGet, "http://www.example.org/api/v1", "prefix"},
+		{http.MethodGet, "http://www.example.com/apis", ""},
+		{http.MethodPost, "http://www.example.com/apis", "custom"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		var id string
+		if route := router.routes.Load().match(req); route != nil {
+			id = route.RouteId
+		}
+
+		if id != test.expect {
+			t.Errorf("%s %s: expect route '%s', but got '%s'", test.method, test.url, test.expect, id)
+		}
+	}
+}
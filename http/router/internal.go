@@ -0,0 +1,131 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-apigateway/http/statuscode"
+)
+
+// MaxInternalDepth is the maximum number of the routes
+// that a request is dispatched through internally.
+var MaxInternalDepth = 8
+
+// ErrInternalLoop is returned when a request is dispatched internally
+// into a route that it has passed through, or too deep.
+var ErrInternalLoop = statuscode.ErrLoopDetected.WithMessage("internal request loop detected")
+
+type internalkey struct{}
+
+// InternalRoutes returns the ids of the routes, from outside to inside,
+// that the request of the context has been dispatched through internally.
+//
+// Return nil if the request is not dispatched internally.
+func InternalRoutes(ctx context.Context) []string {
+	routes, _ := ctx.Value(internalkey{}).([]string)
+	return routes
+}
+
+func enterInternalRoute(ctx context.Context, from, to string) (context.Context, error) {
+	routes := InternalRoutes(ctx)
+	if from != "" && (len(routes) == 0 || routes[len(routes)-1] != from) {
+		routes = append(slices.Clip(routes), from)
+	}
+
+	if slices.Contains(routes, to) || len(routes) >= MaxInternalDepth {
+		slog.Error("internal request loop detected", "routes", routes, "route", to)
+		return ctx, ErrInternalLoop
+	}
+
+	routes = append(slices.Clip(routes), to)
+	return context.WithValue(ctx, internalkey{}, routes), nil
+}
+
+// ServeRoute dispatches the context into the route by the id without matching,
+// which is used to call the route, including the protected route, internally.
+// It reuses the handler, responser and timeouts of the route as serving
+// the matched route, but does not send the response like Handle.
+//
+// If the route has been passed through by the request of the context,
+// or the number of the passed routes reaches MaxInternalDepth,
+// abort the context with ErrInternalLoop.
+//
+// Return false if the route does not exist.
+func (r *Router) ServeRoute(c *core.Context, routeId string) (found bool) {
+	return r.serveInternalRoute(c, c.RouteId, routeId)
+}
+
+func (r *Router) serveInternalRoute(c *core.Context, from, to string) (found bool) {
+	route, found := r.GetRoute(to)
+	if !found {
+		return
+	}
+
+	ctx, err := enterInternalRoute(c.Context, from, to)
+	if err != nil {
+		c.Abort(err)
+		return
+	}
+
+	c.Context = ctx
+	dispatch(c, &route)
+	return
+}
+
+// SubRequest performs an internal sub-request into the route by the id
+// with a new context, which sends the request req, or the client request
+// of c if req is nil, and writes the response into w.
+//
+// It may be used to implement the internal redirect, the auth sub-request
+// or the aggregation of the sub-requests, and the loop is detected
+// as ServeRoute.
+//
+// Return the error of the sub-request after sending the response,
+// or statuscode.ErrNotFound if the route does not exist.
+func (r *Router) SubRequest(c *core.Context, routeId string, req *http.Request, w http.ResponseWriter) error {
+	subc := core.AcquireContext(c.Context)
+	defer core.ReleaseContext(subc)
+
+	if req == nil {
+		req = c.ClientRequest
+	}
+
+	if rw, ok := w.(core.ResponseWriter); ok {
+		subc.ClientResponse = rw
+	} else {
+		rw := core.AcquireResponseWriter(w)
+		defer core.ReleaseResponseWriter(rw)
+		subc.ClientResponse = rw
+	}
+
+	subc.Client = c.Client
+	subc.ClientRequest = req
+	defer closeResponse(subc)
+
+	if !r.serveInternalRoute(subc, c.RouteId, routeId) {
+		return statuscode.ErrNotFound.WithMessage("not found the route '%s'", routeId)
+	}
+
+	if !subc.ClientResponse.WroteHeader() {
+		subc.SendResponse()
+	}
+
+	return subc.Error
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-apigateway/http/core"
+)
+
+func TestRouterServeRoute(t *testing.T) {
+	r := New()
+	r.AddRoutes(
+		Route{
+			RouteId:    "public",
+			UpstreamId: "up",
+			Matcher:    MatcherFunc(func(r *http.Request) bool { return r.URL.Path == "/public" }),
+			Handler: func(c *core.Context) {
+				if !r.ServeRoute(c, "inner") {
+					c.Abort(errors.New("not found the route 'inner'"))
+				}
+			},
+		},
+		Route{
+			RouteId:        "inner",
+			UpstreamId:     "up",
+			Protect:        true,
+			Matcher:        AlwaysTrue,
+			RequestTimeout: time.Second,
+			Handler: func(c *core.Context) {
+				if _, ok := c.Context.Deadline(); !ok {
+					c.Abort(errors.New("missing the request timeout"))
+					return
+				}
+
+				c.ClientResponse.Header().Set("X-Routes", strings.Join(InternalRoutes(c.Context), ","))
+				c.ClientResponse.WriteHeader(201)
+			},
+		},
+		Route{
+			RouteId:    "loop",
+			UpstreamId: "up",
+			Matcher:    MatcherFunc(func(r *http.Request) bool { return r.URL.Path == "/loop" }),
+			Handler: func(c *core.Context) {
+				if err := r.SubRequest(c, "loop", nil, c.ClientResponse); !errors.Is(err, ErrInternalLoop) {
+					t.Errorf("expect the error ErrInternalLoop, but got %v", err)
+				}
+			},
+		},
+	)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/public", nil))
+	if rec.Code != 201 {
+		t.Errorf("expect status code 201, but got %d", rec.Code)
+	} else if routes := rec.Header().Get("X-Routes"); routes != "public,inner" {
+		t.Errorf("expect the routes 'public,inner', but got '%s'", routes)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/inner", nil))
+	if rec.Code != 404 {
+		t.Errorf("expect status code 404 for the protected route, but got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/loop", nil))
+	if rec.Code != 508 {
+		t.Errorf("expect status code 508, but got %d", rec.Code)
+	}
+
+	c := core.AcquireContext(t.Context())
+	defer core.ReleaseContext(c)
+	if r.ServeRoute(c, "missing") {
+		t.Errorf("expect not found the route 'missing'")
+	}
+}
+
+func TestRouterSubRequestDepth(t *testing.T) {
+	defer func(depth int) { MaxInternalDepth = depth }(MaxInternalDepth)
+	MaxInternalDepth = 3
+
+	var calls int
+	r := New()
+	for _, id := range []string{"r1", "r2", "r3", "r4"} {
+		next := map[string]string{"r1": "r2", "r2": "r3", "r3": "r4"}[id]
+		r.AddRoutes(Route{
+			RouteId:    id,
+			UpstreamId: "up",
+			Protect:    id != "r1",
+			Matcher:    AlwaysTrue,
+			Handler: func(c *core.Context) {
+				calls++
+				if next == "" {
+					c.ClientResponse.WriteHeader(204)
+				} else if err := r.SubRequest(c, next, nil, c.ClientResponse); err != nil {
+					c.Abort(err)
+				}
+			},
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 508 {
+		t.Errorf("expect status code 508, but got %d", rec.Code)
+	} else if calls != 3 {
+		t.Errorf("expect %d calls, but got %d", 3, calls)
+	}
+
+	MaxInternalDepth = 4
+	calls = 0
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 204 {
+		t.Errorf("expect status code 204, but got %d", rec.Code)
+	} else if calls != 4 {
+		t.Errorf("expect %d calls, but got %d", 4, calls)
+	}
+}
@@ -59,13 +59,30 @@ type Route struct {
 
 	// Optional
 	//
-	// If true, the route is called in the apigateway inside, and not routed.
+	// If true, the route is called in the apigateway inside, and not routed,
+	// such as by Router.ServeRoute or Router.SubRequest.
 	Protect bool `json:"protect,omitempty" yaml:"protect,omitempty"`
 
 	// Optional
+	//
+	// If set, it is used to select the upstream id for each request,
+	// and UpstreamId is used as the default.
+	UpstreamSelector UpstreamSelector `json:"-" yaml:"-"`
+
+	// Optional
+	//
+	// ForwardTimeout only limits the wait for the response header
+	// from the upstream server, not the reading of the response body.
 	RequestTimeout time.Duration `json:"requestTimeout,omitempty" yaml:"requestTimeout,omitempty"`
 	ForwardTimeout time.Duration `json:"forwardTimeout,omitempty" yaml:"forwardTimeout,omitempty"`
 
+	// Optional
+	//
+	// The idle timeout and max lifetime of the tunnelled connection
+	// after upgrading the protocol, such as WebSocket. 0 means no limit.
+	UpgradeIdleTimeout time.Duration `json:"upgradeIdleTimeout,omitempty" yaml:"upgradeIdleTimeout,omitempty"`
+	UpgradeMaxLifetime time.Duration `json:"upgradeMaxLifetime,omitempty" yaml:"upgradeMaxLifetime,omitempty"`
+
 	// Optional
 	//
 	// The original configuration of the route.
@@ -81,6 +98,12 @@ type Route struct {
 	// It may be the description of the matcher.
 	Desc string `json:"desc" yaml:"desc"`
 
+	// Optional
+	//
+	// The names of the middlewares that wrap the handler from outside to inside,
+	// which is only used to describe the route, such as Router.Explain.
+	Middlewares []string `json:"middlewares,omitempty" yaml:"middlewares,omitempty"`
+
 	Matcher        `json:"-" yaml:"-"` // Required
 	core.Handler   `json:"-" yaml:"-"` // Optional, Default: AfterRoute
 	core.Responser `json:"-" yaml:"-"` // Optional, Default: core.StdResponse
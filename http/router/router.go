@@ -21,6 +21,7 @@ import (
 	"log/slog"
 	"maps"
 	"net/http"
+	"slices"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -35,7 +36,10 @@ import (
 // DefaultRouter is the default global http router.
 var DefaultRouter = New()
 
-type routeswrapper struct{ Routes []Route }
+type routeswrapper struct {
+	Routes []Route
+	index  *routeindex
+}
 
 // Router represents a http router handler
 // to match and forward the http request to the upstream.
@@ -143,6 +147,7 @@ func (r *Router) updateroutes() {
 		routes.Routes = append(routes.Routes, route)
 	}
 	sortroutes(routes.Routes)
+	routes.index = newRouteIndex(routes.Routes)
 
 	r.routes.Store(routes)
 	r.allmap.Store(maps.Clone(r.routem))
@@ -220,27 +225,72 @@ func (r *Router) serve(c *core.Context) {
 }
 
 func (r *Router) serveRoute(c *core.Context) (matched bool) {
-	routes := r.Routes()
-	for i, _len := 0, len(routes); i < _len; i++ {
-		route := &routes[i]
-		if route.Protect {
-			// (xgf): after sorting the routes, the protected routes
-			// are at the end, so we have no need to match them.
-			break
+	route := r.routes.Load().match(c.ClientRequest)
+	if matched = route != nil; matched {
+		dispatch(c, route)
+	}
+	return
+}
+
+func dispatch(c *core.Context, route *Route) {
+	c.RouteId = route.RouteId
+	c.UpstreamId = route.UpstreamId
+	if capturer, ok := route.Matcher.(Capturer); ok {
+		capturer.Capture(c)
+	}
+
+	if route.UpstreamSelector != nil {
+		if id := route.UpstreamSelector.SelectUpstream(c); id != "" {
+			c.UpstreamId = id
 		}
+	}
+
+	c.Responser = route.Responser
+	c.ForwardTimeout = route.ForwardTimeout
+	c.UpgradeIdleTimeout = route.UpgradeIdleTimeout
+	c.UpgradeMaxLifetime = route.UpgradeMaxLifetime
+	serveRoute(c, route.Handler, route.RequestTimeout)
+}
 
-		if matched = route.Match(c.ClientRequest); matched {
-			c.RouteId = route.RouteId
-			c.UpstreamId = route.UpstreamId
-			c.Responser = route.Responser
-			c.ForwardTimeout = route.ForwardTimeout
-			serveRoute(c, route.Handler, route.RequestTimeout)
-			break
+func (w *routeswrapper) match(req *http.Request) *Route {
+	if w.index == nil {
+		for i, _len := 0, len(w.Routes); i < _len; i++ {
+			route := &w.Routes[i]
+			if route.Protect {
+				// (xgf): after sorting the routes, the protected routes
+				// are at the end, so we have no need to match them.
+				break
+			}
+
+			if route.Match(req) {
+				return route
+			}
 		}
+		return nil
 	}
-	return
+
+	buf := indexbufpool.Get().(*[]int)
+	defer putindexbuf(buf)
+
+	*buf = w.index.lookup(req, (*buf)[:0])
+	slices.Sort(*buf)
+
+	last := -1
+	for _, pos := range *buf {
+		if pos == last {
+			continue
+		}
+
+		last = pos
+		if route := &w.Routes[pos]; route.Match(req) {
+			return route
+		}
+	}
+	return nil
 }
 
+func putindexbuf(buf *[]int) { *buf = (*buf)[:0]; indexbufpool.Put(buf) }
+
 func serveRoute(c *core.Context, handler core.Handler, timeout time.Duration) {
 	defer wrappanic(c)
 
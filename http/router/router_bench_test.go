@@ -15,12 +15,14 @@
 package router
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/xgfone/go-apigateway/http/core"
 	"github.com/xgfone/go-apigateway/internal/slogx"
+	matcher "github.com/xgfone/go-http-matcher"
 )
 
 func BenchmarkRouter(b *testing.B) {
@@ -47,3 +49,54 @@ func BenchmarkRouter(b *testing.B) {
 		}
 	})
 }
+
+func benchmarkRouter10kRoutes(b *testing.B, newMatcher func(i int) Matcher) {
+	slogx.DisableSLog()
+
+	const number = 10000
+	routes := make([]Route, number)
+	for i := range routes {
+		routes[i] = Route{
+			RouteId:    fmt.Sprintf("route%d", i),
+			UpstreamId: "up",
+			Priority:   i,
+			Matcher:    newMatcher(i),
+			Handler:    func(*core.Context) {},
+			Responser:  core.ResponserFunc(func(*core.Context, *http.Response, error) {}),
+		}
+	}
+
+	router := New()
+	router.AddRoutes(routes...)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://host%d.example.com/path%d", 0, 0), nil)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			router.ServeHTTP(rec, req)
+		}
+	})
+}
+
+func BenchmarkRouter10kRoutes_Linear(b *testing.B) {
+	benchmarkRouter10kRoutes(b, func(i int) Matcher {
+		host, path := fmt.Sprintf("host%d.example.com", i), fmt.Sprintf("/path%d", i)
+		return matcher.And(matcher.Host(host), matcher.Path(path))
+	})
+}
+
+func BenchmarkRouter10kRoutes_IndexHost(b *testing.B) {
+	benchmarkRouter10kRoutes(b, func(i int) Matcher {
+		host, path := fmt.Sprintf("host%d.example.com", i), fmt.Sprintf("/path%d", i)
+		return newTestIndexMatcher([]string{host}, []string{path}, nil)
+	})
+}
+
+func BenchmarkRouter10kRoutes_IndexPath(b *testing.B) {
+	benchmarkRouter10kRoutes(b, func(i int) Matcher {
+		return newTestIndexMatcher(nil, nil, []string{fmt.Sprintf("/path%d", i)})
+	})
+}
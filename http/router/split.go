@@ -0,0 +1,145 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"slices"
+	"sync/atomic"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-apigateway/internal/rand"
+)
+
+// UpstreamSelector is used to select the upstream id for the request.
+//
+// If returning "", the router uses Route.UpstreamId instead.
+type UpstreamSelector interface {
+	SelectUpstream(c *core.Context) (upstreamId string)
+}
+
+// WeightedUpstream is an upstream target with the weight.
+type WeightedUpstream struct {
+	UpstreamId string `json:"upstreamId" yaml:"upstreamId"`
+	Weight     int    `json:"weight" yaml:"weight"`
+}
+
+type splittargets struct {
+	targets []WeightedUpstream
+	weights []int // The cumulative weights of the targets.
+	total   int
+}
+
+var _ UpstreamSelector = new(Splitter)
+
+// Splitter is an upstream selector to split the traffic
+// across a set of the weighted upstreams.
+type Splitter struct {
+	targets atomic.Pointer[splittargets]
+	key     func(*core.Context) string
+}
+
+// NewSplitter returns a new upstream splitter.
+//
+// If key is nil or returns "", select the upstream randomly by the weight.
+// Or, select the upstream by the hash of the key, so that the requests
+// with the same key are always forwarded to the same upstream
+// if the targets do not change.
+func NewSplitter(key func(*core.Context) string, targets ...WeightedUpstream) *Splitter {
+	s := &Splitter{key: key}
+	s.Reset(targets...)
+	return s
+}
+
+// Targets returns the weighted upstream targets, which are read-only.
+func (s *Splitter) Targets() []WeightedUpstream { return s.targets.Load().targets }
+
+// Reset resets the weighted upstream targets.
+//
+// The targets whose weight is not greater than 0 will receive no traffic.
+func (s *Splitter) Reset(targets ...WeightedUpstream) {
+	t := &splittargets{
+		targets: slices.Clone(targets),
+		weights: make([]int, len(targets)),
+	}
+
+	for i, target := range targets {
+		if target.Weight > 0 {
+			t.total += target.Weight
+		}
+		t.weights[i] = t.total
+	}
+
+	s.targets.Store(t)
+}
+
+// SelectUpstream implements the interface UpstreamSelector.
+func (s *Splitter) SelectUpstream(c *core.Context) string {
+	t := s.targets.Load()
+	if id, ok := s.stickyUpstream(t, c); ok {
+		return id
+	}
+	return t.upstream(rand.Intn(t.total))
+}
+
+// stickyUpstream returns the upstream selected deterministically for the request,
+// such as by the hash of the key, and false if it is selected randomly by the weight.
+func (s *Splitter) stickyUpstream(t *splittargets, c *core.Context) (upstreamId string, ok bool) {
+	switch {
+	case t.total <= 0:
+		return "", true
+
+	case len(t.targets) == 1:
+		return t.targets[0].UpstreamId, true
+	}
+
+	if key := s.getkey(c); key != "" {
+		return t.upstream(int(fnv32a(key) % uint32(t.total))), true
+	}
+	return "", false
+}
+
+// upstream returns the upstream id of the target where n in [0, total) falls.
+func (t *splittargets) upstream(n int) string {
+	// The number of the targets is small, so we use the linear search.
+	for i, weight := range t.weights {
+		if n < weight {
+			return t.targets[i].UpstreamId
+		}
+	}
+	return ""
+}
+
+func (s *Splitter) getkey(c *core.Context) string {
+	if s.key == nil {
+		return ""
+	}
+	return s.key(c)
+}
+
+// fnv32a is the FNV-1a hash, which is stable across the processes
+// so that the different gateway instances select the same upstream.
+func fnv32a(s string) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	hash := uint32(offset32)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= prime32
+	}
+	return hash
+}
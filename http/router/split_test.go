@@ -0,0 +1,95 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xgfone/go-apigateway/http/core"
+)
+
+func TestSplitter(t *testing.T) {
+	s := NewSplitter(nil,
+		WeightedUpstream{UpstreamId: "v1", Weight: 95},
+		WeightedUpstream{UpstreamId: "v2", Weight: 5},
+	)
+
+	c := core.AcquireContext(context.Background())
+	defer core.ReleaseContext(c)
+
+	counts := make(map[string]int, 2)
+	for i := 0; i < 10000; i++ {
+		counts[s.SelectUpstream(c)]++
+	}
+	if n := counts["v1"]; n < 9000 || n > 9900 {
+		t.Errorf("expect about 9500 requests to v1, but got %d", n)
+	}
+	if n := counts["v2"]; n < 100 || n > 1000 {
+		t.Errorf("expect about 500 requests to v2, but got %d", n)
+	}
+
+	s.Reset(WeightedUpstream{UpstreamId: "v1"}, WeightedUpstream{UpstreamId: "v2", Weight: 1})
+	for i := 0; i < 100; i++ {
+		if id := s.SelectUpstream(c); id != "v2" {
+			t.Fatalf("expect upstream '%s', but got '%s'", "v2", id)
+		}
+	}
+
+	s.Reset(WeightedUpstream{UpstreamId: "v1"})
+	if id := s.SelectUpstream(c); id != "" {
+		t.Errorf("expect no upstream, but got '%s'", id)
+	}
+}
+
+func TestSplitterSticky(t *testing.T) {
+	s := NewSplitter(func(c *core.Context) string { return c.ClientRequest.Header.Get("X-User") },
+		WeightedUpstream{UpstreamId: "v1", Weight: 50},
+		WeightedUpstream{UpstreamId: "v2", Weight: 50},
+	)
+
+	c := core.AcquireContext(context.Background())
+	defer core.ReleaseContext(c)
+
+	c.ClientRequest = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.ClientRequest.Header.Set("X-User", "user1")
+
+	expect := s.SelectUpstream(c)
+	for i := 0; i < 100; i++ {
+		if id := s.SelectUpstream(c); id != expect {
+			t.Fatalf("expect upstream '%s', but got '%s'", expect, id)
+		}
+	}
+}
+
+func TestRouterUpstreamSelector(t *testing.T) {
+	var upstreamId string
+	router := New()
+	router.AddRoutes(Route{
+		RouteId:    "route",
+		UpstreamId: "default",
+		Matcher:    AlwaysTrue,
+		Handler:    func(c *core.Context) { upstreamId = c.UpstreamId },
+
+		UpstreamSelector: NewSplitter(nil, WeightedUpstream{UpstreamId: "v2", Weight: 1}),
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if upstreamId != "v2" {
+		t.Errorf("expect upstream '%s', but got '%s'", "v2", upstreamId)
+	}
+}
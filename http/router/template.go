@@ -0,0 +1,242 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	matcher "github.com/xgfone/go-http-matcher"
+)
+
+// Capturer is an optional interface that the route matcher implements
+// to capture the parameters from the request, such as the path parameters,
+// which is called by the router only after the route is matched.
+type Capturer interface {
+	Capture(c *core.Context)
+}
+
+// IsPathTemplate reports whether the path is a path template,
+// that's, it contains the parameter like "{name}".
+func IsPathTemplate(path string) bool { return strings.IndexByte(path, '{') > -1 }
+
+var _ matcher.Matcher = new(PathTemplate)
+
+// PathTemplate is a path matcher with the named parameters,
+// which supports the parameters as follow:
+//
+//	{name}         // Match a non-empty path segment without "/".
+//	{name:regexp}  // Match the regular expression, which may contain "/".
+//	{*name}        // Match the rest of the path, which must be the last.
+//
+// For example,
+//
+//	/users/{id}/orders/{oid:[0-9]+}
+//	/static/{*filepath}
+//
+// The values of the parameters are stored into core.Context.Kvs by the name,
+// so they can be used as the variables "$name" by the directives.
+type PathTemplate struct {
+	path   string
+	prefix string // The literal prefix before the first parameter.
+	weight int    // The number of the literal characters.
+	names  []string
+	regexp *regexp.Regexp
+
+	indexes []int // The indexes of the names in the regexp submatches.
+}
+
+// NewPathTemplate parses the path template and returns a new PathTemplate.
+func NewPathTemplate(path string) (*PathTemplate, error) {
+	if path == "" || path[0] != '/' {
+		return nil, fmt.Errorf("path template '%s' must start with '/'", path)
+	}
+
+	path = fixpath(path)
+	t := &PathTemplate{path: path}
+	if index := strings.IndexByte(path, '{'); index > -1 {
+		t.prefix = path[:index]
+	}
+
+	var b strings.Builder
+	b.Grow(len(path) * 2)
+	b.WriteByte('^')
+
+	for s := path; s != ""; {
+		start := strings.IndexByte(s, '{')
+		if start < 0 {
+			t.addliteral(&b, s)
+			break
+		}
+
+		end := findParamEnd(s, start)
+		if end < 0 {
+			return nil, fmt.Errorf("path template '%s' has an unclosed parameter", path)
+		}
+
+		param, rest := s[start+1:end], s[end+1:]
+		if strings.HasPrefix(param, "*") {
+			if rest != "" {
+				return nil, fmt.Errorf("path template '%s': the parameter '{%s}' must be the last", path, param)
+			}
+
+			// The path has been trimmed the suffix "/" by matcher.GetPath,
+			// so let the separator before the rest be optional.
+			lead, hasslash := strings.CutSuffix(s[:start], "/")
+			t.addliteral(&b, lead)
+			if err := t.addname(param[1:]); err != nil {
+				return nil, err
+			}
+
+			if hasslash {
+				fmt.Fprintf(&b, "(?:/(?P<%s>.*))?", param[1:])
+			} else {
+				fmt.Fprintf(&b, "(?P<%s>.*)", param[1:])
+			}
+
+			break
+		}
+
+		t.addliteral(&b, s[:start])
+
+		name, expr, hasexpr := strings.Cut(param, ":")
+		if err := t.addname(name); err != nil {
+			return nil, err
+		}
+
+		if !hasexpr {
+			expr = "[^/]+"
+		} else if expr == "" {
+			return nil, fmt.Errorf("path template '%s': the parameter '%s' has an empty regexp", path, name)
+		} else if _, err := regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("path template '%s': the parameter '%s' has an invalid regexp: %w", path, name, err)
+		}
+
+		fmt.Fprintf(&b, "(?P<%s>%s)", name, expr)
+		s = rest
+	}
+
+	if len(t.names) == 0 {
+		return nil, fmt.Errorf("path template '%s' has no parameters", path)
+	}
+
+	b.WriteByte('$')
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("path template '%s': %w", path, err)
+	}
+
+	t.regexp = re
+	t.indexes = make([]int, len(t.names))
+	for i, name := range t.names {
+		t.indexes[i] = re.SubexpIndex(name)
+	}
+	return t, nil
+}
+
+// MustPathTemplate is the same as NewPathTemplate, but panics if failing.
+func MustPathTemplate(path string) *PathTemplate {
+	t, err := NewPathTemplate(path)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (t *PathTemplate) addliteral(b *strings.Builder, s string) {
+	t.weight += len(s)
+	b.WriteString(regexp.QuoteMeta(s))
+}
+
+func (t *PathTemplate) addname(name string) error {
+	if !isParamName(name) {
+		return fmt.Errorf("path template '%s' has an invalid parameter name '%s'", t.path, name)
+	} else if slices.Contains(t.names, name) {
+		return fmt.Errorf("path template '%s' has the duplicated parameter '%s'", t.path, name)
+	}
+	t.names = append(t.names, name)
+	return nil
+}
+
+func findParamEnd(s string, start int) int {
+	var depth int
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isParamName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Names returns the names of the parameters, which are read-only.
+func (t *PathTemplate) Names() []string { return t.names }
+
+// Prefix returns the longest literal path prefix split by "/",
+// which all the matched paths must have.
+func (t *PathTemplate) Prefix() string {
+	if index := strings.LastIndexByte(t.prefix, '/'); index > 0 {
+		return t.prefix[:index]
+	}
+	return "/"
+}
+
+// String implements the interface fmt.Stringer.
+func (t *PathTemplate) String() string { return fmt.Sprintf("PathTemplate(`%s`)", t.path) }
+
+// Priority implements the interface matcher.Matcher,
+// which is lower than that of the exact path with the same length.
+func (t *PathTemplate) Priority() int { return matcher.PriorityPath * t.weight }
+
+// Match implements the interface matcher.Matcher.
+func (t *PathTemplate) Match(r *http.Request) bool {
+	return t.regexp.MatchString(matcher.GetPath(r))
+}
+
+// Capture captures the parameters from the request path into kvs,
+// and reports whether the request path matches the template.
+func (t *PathTemplate) Capture(r *http.Request, kvs map[string]any) (ok bool) {
+	matches := t.regexp.FindStringSubmatch(matcher.GetPath(r))
+	if ok = matches != nil; ok {
+		for i, name := range t.names {
+			kvs[name] = matches[t.indexes[i]]
+		}
+	}
+	return
+}
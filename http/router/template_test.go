@@ -0,0 +1,97 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"maps"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestPathTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		prefix   string
+		path     string
+		kvs      map[string]any // nil means not matched
+	}{
+		{"/users/{id}", "/users", "/users/123", map[string]any{"id": "123"}},
+		{"/users/{id}", "/users", "/users/123/", map[string]any{"id": "123"}},
+		{"/users/{id}", "/users", "/users", nil},
+		{"/users/{id}", "/users", "/users/123/orders", nil},
+		{"/users/{id}/orders/{oid}", "/users", "/users/1/orders/2", map[string]any{"id": "1", "oid": "2"}},
+		{"/users/{id:[0-9]+}", "/users", "/users/123", map[string]any{"id": "123"}},
+		{"/users/{id:[0-9]+}", "/users", "/users/abc", nil},
+		{"/users/{id:[0-9]{2}}", "/users", "/users/12", map[string]any{"id": "12"}},
+		{"/users/{id:[0-9]{2}}", "/users", "/users/123", nil},
+		{"/files/{path:.+\\.txt}", "/files", "/files/a/b.txt", map[string]any{"path": "a/b.txt"}},
+		{"/static/{*rest}", "/static", "/static/js/app.js", map[string]any{"rest": "js/app.js"}},
+		{"/static/{*rest}", "/static", "/static/", map[string]any{"rest": ""}},
+		{"/static/{*rest}", "/static", "/static", map[string]any{"rest": ""}},
+		{"/static/{*rest}", "/static", "/staticfile", nil},
+		{"/v1-{name}", "/", "/v1-abc", map[string]any{"name": "abc"}},
+		{"/{*all}", "/", "/a/b/c", map[string]any{"all": "a/b/c"}},
+	}
+
+	for _, test := range tests {
+		tmpl, err := NewPathTemplate(test.template)
+		if err != nil {
+			t.Errorf("%s: %v", test.template, err)
+			continue
+		}
+
+		if prefix := tmpl.Prefix(); prefix != test.prefix {
+			t.Errorf("%s: expect prefix '%s', but got '%s'", test.template, test.prefix, prefix)
+		}
+
+		req := &http.Request{URL: &url.URL{Path: test.path}}
+		if matched := tmpl.Match(req); matched != (test.kvs != nil) {
+			t.Errorf("%s: expect match '%v' for path '%s', but got '%v'",
+				test.template, test.kvs != nil, test.path, matched)
+			continue
+		}
+
+		kvs := make(map[string]any)
+		if ok := tmpl.Capture(req, kvs); ok && !maps.Equal(kvs, test.kvs) {
+			t.Errorf("%s: expect kvs %v for path '%s', but got %v", test.template, test.kvs, test.path, kvs)
+		}
+	}
+}
+
+func TestPathTemplateError(t *testing.T) {
+	for _, template := range []string{
+		"users/{id}",
+		"/users",
+		"/users/{id",
+		"/users/{}",
+		"/users/{1id}",
+		"/users/{id}/{id}",
+		"/users/{id:}",
+		"/users/{id:[0-9}",
+		"/static/{*rest}/a",
+	} {
+		if _, err := NewPathTemplate(template); err == nil {
+			t.Errorf("%s: expect an error, but got nil", template)
+		}
+	}
+}
+
+func TestPathTemplatePriority(t *testing.T) {
+	exact := len("/users/me")
+	if p := MustPathTemplate("/users/{id}").Priority(); p >= 500*exact {
+		t.Errorf("expect the priority is less than %d, but got %d", 500*exact, p)
+	}
+}
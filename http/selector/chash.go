@@ -0,0 +1,249 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-apigateway/http/directive"
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-loadbalancer/selector"
+)
+
+// VirtualNodes is the number of the virtual nodes of each endpoint
+// with the weight 1 on the hash ring.
+const VirtualNodes = 160
+
+// MaxVirtualNodes is the maximum number of the virtual nodes on the hash ring.
+//
+// The weights are normalized by their greatest common divisor first,
+// and the virtual nodes of each endpoint are reduced in proportion
+// if the total still exceeds it.
+const MaxVirtualNodes = VirtualNodes * 1024
+
+// maxRings is the maximum number of the cached hash rings, so that the ring
+// is not rebuilt for each request when the endpoints switch among a few sets,
+// such as filtered by the priority or the health status.
+const maxRings = 4
+
+// ConsistentHash returns a new selector with the policy "chash(key)",
+// which selects the endpoint by the consistent hash ring of the key,
+// so that adding or removing an endpoint only moves the minimal share of keys.
+//
+// key is a variable as follow:
+//   - "@name": the header value, see directive.QueryVariable.
+//   - "#name": the query value, see directive.QueryVariable.
+//   - "$path": the request path.
+//   - "$cookie_name": the cookie value.
+//   - "$name": other variable, see directive.QueryVariable.
+//
+// If the value of the key is empty, or the request is not *core.Context,
+// use fallback to select the endpoint instead.
+//
+// The weight of the endpoint is supported if it has the method Weight() int.
+func ConsistentHash(key string, fallback selector.Selector) (selector.Selector, error) {
+	if len(key) < 2 || !strings.ContainsRune("@#$", rune(key[0])) {
+		return nil, fmt.Errorf("invalid consistent hash key '%s'", key)
+	}
+	if fallback == nil {
+		panic("ConsistentHash: fallback selector must not be nil")
+	}
+
+	policy := fmt.Sprintf("chash(%s)", key)
+	return &chash{policy: policy, key: key, fallback: fallback}, nil
+}
+
+type chash struct {
+	policy   string
+	key      string
+	fallback selector.Selector
+	rings    atomic.Pointer[[]*ring] // The most recently built is first.
+}
+
+func (s *chash) Policy() string { return s.policy }
+
+func (s *chash) Select(req any, eps loadbalancer.Endpoints) loadbalancer.Endpoint {
+	c, ok := req.(*core.Context)
+	if !ok {
+		return s.fallback.Select(req, eps)
+	}
+
+	value := getKeyValue(c, s.key)
+	if value == "" {
+		return s.fallback.Select(req, eps)
+	}
+
+	if len(eps) == 1 {
+		return eps[0]
+	}
+
+	return eps[s.getRing(eps).get(value)]
+}
+
+func (s *chash) getRing(eps loadbalancer.Endpoints) *ring {
+	var rings []*ring
+	if p := s.rings.Load(); p != nil {
+		rings = *p
+		for _, r := range rings {
+			if r.match(eps) {
+				return r
+			}
+		}
+	}
+
+	// Evict the oldest ring if the cache is full.
+	r := newRing(eps)
+	rings = append([]*ring{r}, rings[:min(len(rings), maxRings-1)]...)
+	s.rings.Store(&rings)
+	return r
+}
+
+func getKeyValue(c *core.Context, key string) (value string) {
+	if key[0] == '$' {
+		switch name := key[1:]; {
+		case name == "path":
+			return c.ClientRequest.URL.Path
+
+		case strings.HasPrefix(name, "cookie_"):
+			return c.Cookie(name[len("cookie_"):])
+		}
+	}
+
+	value, _ = directive.QueryVariable(c, key)
+	return
+}
+
+// ------------------------------------------------------------------------ //
+
+type vnode struct {
+	hash  uint64
+	index int
+}
+
+type ring struct {
+	ids     []string // Only used to check whether the endpoints change.
+	weights []int    // Only used to check whether the endpoints change.
+	nodes   []vnode
+}
+
+func newRing(eps loadbalancer.Endpoints) *ring {
+	r := &ring{ids: make([]string, len(eps)), weights: make([]int, len(eps))}
+
+	var gcd int
+	for i, ep := range eps {
+		r.ids[i] = ep.ID()
+		r.weights[i] = getWeight(ep)
+		gcd = getGCD(gcd, r.weights[i])
+	}
+
+	var total int64
+	for _, weight := range r.weights {
+		total += int64(weight/gcd) * VirtualNodes
+	}
+
+	for i := range eps {
+		vnodes := int64(r.weights[i]/gcd) * VirtualNodes
+		if total > MaxVirtualNodes {
+			vnodes = max(1, vnodes*MaxVirtualNodes/total)
+		}
+
+		for j := range vnodes {
+			hash := hashkey(r.ids[i] + "#" + strconv.FormatInt(j, 10))
+			r.nodes = append(r.nodes, vnode{hash: hash, index: i})
+		}
+	}
+
+	slices.SortFunc(r.nodes, func(a, b vnode) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		default: // Use the id to keep it stable when the hashes conflict.
+			return strings.Compare(r.ids[a.index], r.ids[b.index])
+		}
+	})
+
+	return r
+}
+
+// match reports whether the ring is built by the endpoints,
+// the ids and weights of which are not changed.
+func (r *ring) match(eps loadbalancer.Endpoints) bool {
+	if len(eps) != len(r.ids) {
+		return false
+	}
+
+	for i, ep := range eps {
+		if ep.ID() != r.ids[i] || getWeight(ep) != r.weights[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func getWeight(ep loadbalancer.Endpoint) int {
+	if w, ok := ep.(interface{ Weight() int }); ok && w.Weight() > 1 {
+		return w.Weight()
+	}
+	return 1
+}
+
+func getGCD(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// get returns the index of the endpoint selected by the key.
+func (r *ring) get(key string) int {
+	hash := hashkey(key)
+	index, _ := slices.BinarySearchFunc(r.nodes, hash, func(n vnode, hash uint64) int {
+		switch {
+		case n.hash < hash:
+			return -1
+		case n.hash > hash:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	if index == len(r.nodes) {
+		index = 0
+	}
+	return r.nodes[index].index
+}
+
+func hashkey(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+
+	// Mix the bits to distribute the similar keys evenly.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
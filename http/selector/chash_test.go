@@ -0,0 +1,238 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-loadbalancer"
+)
+
+type testendpoint struct {
+	id     string
+	weight int
+}
+
+func (ep testendpoint) ID() string                              { return ep.id }
+func (ep testendpoint) Weight() int                             { return ep.weight }
+func (ep testendpoint) Serve(context.Context, any) (any, error) { return nil, nil }
+
+type firstSelector struct{}
+
+func (firstSelector) Policy() string { return "first" }
+func (firstSelector) Select(_ any, eps loadbalancer.Endpoints) loadbalancer.Endpoint {
+	return eps[0]
+}
+
+func newEndpoints(n int) loadbalancer.Endpoints {
+	eps := make(loadbalancer.Endpoints, n)
+	for i := range eps {
+		eps[i] = testendpoint{id: fmt.Sprintf("127.0.0.%d:80", i+1), weight: 1}
+	}
+	return eps
+}
+
+func newContext(rawurl string, header http.Header) *core.Context {
+	u, _ := url.Parse(rawurl)
+	c := core.AcquireContext(context.Background())
+	c.ClientRequest = &http.Request{URL: u, Header: header}
+	return c
+}
+
+func TestConsistentHashKey(t *testing.T) {
+	var fallback firstSelector
+
+	eps := newEndpoints(8)
+	header := http.Header{"X-User-Id": {"user"}, "Cookie": {"sid=session"}}
+	c := newContext("http://localhost/path?uid=user", header)
+
+	for _, key := range []string{"@X-User-Id", "#uid", "$uid", "$path", "$cookie_sid"} {
+		s, err := ConsistentHash(key, fallback)
+		if err != nil {
+			t.Fatal(err)
+		} else if policy := s.Policy(); policy != "chash("+key+")" {
+			t.Errorf("expect the policy 'chash(%s)', but got '%s'", key, policy)
+		}
+
+		ep := s.Select(c, eps)
+		for range 10 {
+			if _ep := s.Select(c, eps); _ep.ID() != ep.ID() {
+				t.Errorf("%s: expect the endpoint '%s', but got '%s'", key, ep.ID(), _ep.ID())
+			}
+		}
+	}
+
+	// The header and query values are the same, so select the same endpoint.
+	s1, _ := ConsistentHash("@X-User-Id", fallback)
+	s2, _ := ConsistentHash("#uid", fallback)
+	if ep1, ep2 := s1.Select(c, eps), s2.Select(c, eps); ep1.ID() != ep2.ID() {
+		t.Errorf("expect the same endpoint, but got '%s' and '%s'", ep1.ID(), ep2.ID())
+	}
+
+	// Use the fallback selector if the key is empty.
+	s, _ := ConsistentHash("@X-Missing", fallback)
+	for range 10 {
+		if ep := s.Select(c, eps); ep.ID() != eps[0].ID() {
+			t.Errorf("expect the fallback endpoint '%s', but got '%s'", eps[0].ID(), ep.ID())
+		}
+	}
+	if ep := s.Select("request", eps); ep.ID() != eps[0].ID() {
+		t.Errorf("expect the fallback endpoint '%s', but got '%s'", eps[0].ID(), ep.ID())
+	}
+
+	for _, key := range []string{"", "@", "uid"} {
+		if _, err := ConsistentHash(key, fallback); err == nil {
+			t.Errorf("expect an error for the key '%s', but got nil", key)
+		}
+	}
+}
+
+func TestConsistentHashRemap(t *testing.T) {
+	const keys = 10000
+	var fallback firstSelector
+
+	selectAll := func(eps loadbalancer.Endpoints) map[string]string {
+		s, _ := ConsistentHash("#key", fallback)
+		results := make(map[string]string, keys)
+		for i := range keys {
+			key := fmt.Sprintf("key%d", i)
+			results[key] = s.Select(newContext("http://localhost/?key="+key, nil), eps).ID()
+		}
+		return results
+	}
+
+	eps := newEndpoints(5)
+	olds := selectAll(eps)
+
+	// The keys are distributed evenly.
+	counts := make(map[string]int, len(eps))
+	for _, id := range olds {
+		counts[id]++
+	}
+	for id, count := range counts {
+		if count < keys/len(eps)/2 || count > keys/len(eps)*3/2 {
+			t.Errorf("unbalanced endpoint '%s' with %d keys", id, count)
+		}
+	}
+
+	// Add an endpoint: only the keys moved to the new endpoint are changed.
+	news := selectAll(newEndpoints(6))
+	var moved int
+	for key, id := range news {
+		if id != olds[key] {
+			if moved++; id != "127.0.0.6:80" {
+				t.Fatalf("key '%s' moves from '%s' to the old endpoint '%s'", key, olds[key], id)
+			}
+		}
+	}
+	if moved > keys/6*3/2 {
+		t.Errorf("too many keys are moved: %d", moved)
+	}
+
+	// Remove an endpoint: only the keys on the removed endpoint are changed.
+	news = selectAll(append(eps[:2:2], eps[3:]...))
+	for key, id := range news {
+		if old := olds[key]; id != old && old != eps[2].ID() {
+			t.Fatalf("key '%s' moves from '%s' to '%s'", key, old, id)
+		}
+	}
+}
+
+func TestConsistentHashWeight(t *testing.T) {
+	var fallback firstSelector
+
+	eps := loadbalancer.Endpoints{
+		testendpoint{id: "127.0.0.1:80", weight: 1},
+		testendpoint{id: "127.0.0.2:80", weight: 3},
+	}
+
+	s, _ := ConsistentHash("#key", fallback)
+	counts := make(map[string]int, 2)
+	for i := range 10000 {
+		c := newContext(fmt.Sprintf("http://localhost/?key=key%d", i), nil)
+		counts[s.Select(c, eps).ID()]++
+	}
+
+	if n := counts["127.0.0.2:80"]; n < 6500 || n > 8500 {
+		t.Errorf("expect about 7500 keys on the endpoint with weight 3, but got %d", n)
+	}
+}
+
+func TestConsistentHashVirtualNodes(t *testing.T) {
+	var fallback firstSelector
+	s, _ := ConsistentHash("#key", fallback)
+	c := newContext("http://localhost/?key=value", nil)
+	ring := func() *ring { return (*s.(*chash).rings.Load())[0] }
+
+	// The weights are normalized by their greatest common divisor.
+	eps := loadbalancer.Endpoints{
+		testendpoint{id: "127.0.0.1:80", weight: 10000},
+		testendpoint{id: "127.0.0.2:80", weight: 30000},
+	}
+	s.Select(c, eps)
+	if n := len(ring().nodes); n != VirtualNodes*4 {
+		t.Errorf("expect %d virtual nodes, but got %d", VirtualNodes*4, n)
+	}
+
+	// The total virtual nodes are limited.
+	eps[1] = testendpoint{id: "127.0.0.2:80", weight: 30001}
+	s.Select(c, eps)
+	if n := len(ring().nodes); n > MaxVirtualNodes || n < MaxVirtualNodes*9/10 {
+		t.Errorf("expect about %d virtual nodes, but got %d", MaxVirtualNodes, n)
+	}
+
+	// The weight is changed in place.
+	eps[1] = testendpoint{id: "127.0.0.2:80", weight: 10000}
+	s.Select(c, eps)
+	if n := len(ring().nodes); n != VirtualNodes*2 {
+		t.Errorf("expect %d virtual nodes, but got %d", VirtualNodes*2, n)
+	}
+}
+
+func TestConsistentHashRings(t *testing.T) {
+	var fallback firstSelector
+	s, _ := ConsistentHash("#key", fallback)
+	c := newContext("http://localhost/?key=value", nil)
+	rings := func() []*ring { return *s.(*chash).rings.Load() }
+
+	// The endpoints switch between two sets, such as by the health filtering.
+	eps1, eps2 := newEndpoints(3), newEndpoints(2)
+	s.Select(c, eps1)
+	s.Select(c, eps2)
+	r1, r2 := rings()[1], rings()[0]
+	for range 10 {
+		s.Select(c, eps1)
+		s.Select(c, eps2)
+	}
+	if _rings := rings(); len(_rings) != 2 || _rings[0] != r2 || _rings[1] != r1 {
+		t.Fatalf("expect to reuse the cached rings, but got %d rings", len(_rings))
+	}
+
+	// Evict the oldest ring.
+	for i := range maxRings {
+		s.Select(c, newEndpoints(i+4))
+	}
+	if _rings := rings(); len(_rings) != maxRings {
+		t.Errorf("expect %d rings, but got %d", maxRings, len(_rings))
+	} else if slices.Contains(_rings, r1) || slices.Contains(_rings, r2) {
+		t.Errorf("expect the oldest rings to be evicted")
+	}
+}
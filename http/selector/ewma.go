@@ -0,0 +1,194 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xgfone/go-apigateway/internal/rand"
+	"github.com/xgfone/go-apigateway/upstream/breaker"
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-loadbalancer/selector"
+)
+
+// PeakEWMAPolicy is the policy name of the peak EWMA selector.
+const PeakEWMAPolicy = "p2c_ewma"
+
+var (
+	// DefaultEWMADecay is the default decay time of the latency EWMA.
+	DefaultEWMADecay = time.Second * 10
+
+	// DefaultEWMAPenalty is the minimum latency recorded for the failed
+	// request, so that the endpoint failing fast is not preferred.
+	DefaultEWMAPenalty = time.Second
+)
+
+// PeakEWMA returns a new selector with the policy "p2c_ewma", which picks
+// two random endpoints and selects the one with the lower score,
+// that's, the peak EWMA of the latency multiplied by the number
+// of the in-flight requests plus one.
+//
+// The peak EWMA takes the new latency at once if it is higher,
+// or else moves towards it with the decay time. And it also decays
+// towards zero when the endpoint is not selected, so that a slow endpoint
+// is probed again after a while.
+//
+// The newly added endpoint has no latency, so only the in-flight requests
+// are compared between it and the other.
+//
+// The returned selector implements the interface upstream.Tracker,
+// which must be added as the observer of the upstream to collect
+// the latency and in-flight requests of the endpoints.
+//
+// The stats of the endpoints missing from the selected endpoints, such as
+// being removed by the discovery, are dropped once they become idle.
+//
+// If decay is equal to or less than 0, use DefaultEWMADecay instead.
+func PeakEWMA(decay time.Duration) selector.Selector {
+	if decay <= 0 {
+		decay = DefaultEWMADecay
+	}
+
+	s := &peakEWMA{decay: float64(decay)}
+	s.pruned.Store(time.Now().UnixNano())
+	return s
+}
+
+type peakEWMA struct {
+	decay  float64
+	stats  sync.Map     // map[string]*ewmaStat
+	pruned atomic.Int64 // The unix nano of the last pruning.
+}
+
+func (s *peakEWMA) Policy() string { return PeakEWMAPolicy }
+
+func (s *peakEWMA) Select(req any, eps loadbalancer.Endpoints) loadbalancer.Endpoint {
+	now := time.Now()
+	s.prune(now, eps)
+
+	switch len(eps) {
+	case 0:
+		return nil
+	case 1:
+		return eps[0]
+	}
+
+	i := rand.Intn(len(eps))
+	j := rand.Intn(len(eps) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := s.stat(eps[i].ID()), s.stat(eps[j].ID())
+	la, lb := a.latency(now, s.decay), b.latency(now, s.decay)
+	if la == 0 || lb == 0 { // Any has no latency, only compare the in-flight requests.
+		la, lb = 1, 1
+	}
+
+	if la*float64(a.inflight.Load()+1) <= lb*float64(b.inflight.Load()+1) {
+		return eps[i]
+	}
+	return eps[j]
+}
+
+// Begin implements the interface upstream.Tracker.
+func (s *peakEWMA) Begin(epid string) {
+	s.stat(epid).inflight.Add(1)
+}
+
+// Observe implements the interface upstream.Observer.
+func (s *peakEWMA) Observe(epid string, code int, err error, latency time.Duration) {
+	if !breaker.Succeeded(code, err) {
+		latency = max(latency, DefaultEWMAPenalty)
+	}
+
+	stat := s.stat(epid)
+	stat.inflight.Add(-1)
+	stat.observe(time.Now(), float64(latency), s.decay)
+}
+
+func (s *peakEWMA) stat(epid string) *ewmaStat {
+	if v, ok := s.stats.Load(epid); ok {
+		return v.(*ewmaStat)
+	}
+	v, _ := s.stats.LoadOrStore(epid, new(ewmaStat))
+	return v.(*ewmaStat)
+}
+
+// prune drops the stats of the endpoints which are missing from eps,
+// and have no in-flight requests and no observations for the decay time,
+// so that a sub-slice of the endpoints, such as a priority tier,
+// does not drop the stats in use. It runs at most once per the decay time.
+func (s *peakEWMA) prune(now time.Time, eps loadbalancer.Endpoints) {
+	last := s.pruned.Load()
+	if now.UnixNano()-last < int64(s.decay) || !s.pruned.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+
+	s.stats.Range(func(key, value any) bool {
+		id, stat := key.(string), value.(*ewmaStat)
+		if stat.inflight.Load() <= 0 && stat.idle(now, s.decay) &&
+			!slices.ContainsFunc(eps, func(ep loadbalancer.Endpoint) bool { return ep.ID() == id }) {
+			s.stats.CompareAndDelete(key, value)
+		}
+		return true
+	})
+}
+
+// ------------------------------------------------------------------------ //
+
+type ewmaStat struct {
+	inflight atomic.Int64
+
+	lock  sync.Mutex
+	value float64 // Unit: ns
+	last  time.Time
+}
+
+func (s *ewmaStat) latency(now time.Time, decay float64) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.last.IsZero() {
+		return 0
+	}
+	return s.value * math.Exp(-float64(now.Sub(s.last))/decay)
+}
+
+func (s *ewmaStat) idle(now time.Time, decay float64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return float64(now.Sub(s.last)) >= decay
+}
+
+func (s *ewmaStat) observe(now time.Time, rtt, decay float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.last.IsZero() {
+		s.value = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(s.last)) / decay)
+		if value := s.value * w; rtt > value {
+			s.value = rtt // Take the peak at once.
+		} else {
+			s.value = value + rtt*(1-w)
+		}
+	}
+	s.last = now
+}
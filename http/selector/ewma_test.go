@@ -0,0 +1,142 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-loadbalancer/selector"
+)
+
+type tracker interface {
+	Begin(epid string)
+	Observe(epid string, code int, err error, latency time.Duration)
+}
+
+func expectSelect(t *testing.T, s selector.Selector, eps loadbalancer.Endpoints, expect string) {
+	t.Helper()
+	for range 20 {
+		if ep := s.Select(nil, eps); ep.ID() != expect {
+			t.Fatalf("expect the endpoint '%s', but got '%s'", expect, ep.ID())
+		}
+	}
+}
+
+func TestPeakEWMA(t *testing.T) {
+	s := PeakEWMA(0)
+	if policy := s.Policy(); policy != PeakEWMAPolicy {
+		t.Errorf("expect the policy '%s', but got '%s'", PeakEWMAPolicy, policy)
+	}
+
+	eps := newEndpoints(2)
+	id1, id2 := eps[0].ID(), eps[1].ID()
+	tr := s.(tracker)
+
+	tr.Begin(id1)
+	tr.Observe(id1, 200, nil, time.Millisecond*100)
+	tr.Begin(id2)
+	tr.Observe(id2, 200, nil, time.Millisecond*10)
+	expectSelect(t, s, eps, id2)
+
+	// 10ms * (10+1) > 100ms * (0+1)
+	for range 10 {
+		tr.Begin(id2)
+	}
+	expectSelect(t, s, eps, id1)
+
+	// The endpoint failing fast is penalized.
+	for range 10 {
+		tr.Observe(id2, 502, nil, time.Millisecond)
+	}
+	expectSelect(t, s, eps, id1)
+}
+
+func TestPeakEWMANewEndpoint(t *testing.T) {
+	s := PeakEWMA(0)
+	tr := s.(tracker)
+
+	eps := newEndpoints(2)
+	id1, id2 := eps[0].ID(), eps[1].ID()
+
+	tr.Begin(id1)
+	tr.Observe(id1, 200, nil, time.Millisecond*10)
+
+	// The new endpoint without the latency only compares the in-flight requests.
+	tr.Begin(id1)
+	expectSelect(t, s, eps, id2)
+
+	tr.Begin(id2)
+	tr.Begin(id2)
+	expectSelect(t, s, eps, id1)
+}
+
+func TestPeakEWMAPrune(t *testing.T) {
+	s := PeakEWMA(time.Millisecond * 20)
+	tr := s.(tracker)
+
+	eps := newEndpoints(3)
+	for _, ep := range eps {
+		tr.Begin(ep.ID())
+		tr.Observe(ep.ID(), 200, nil, time.Millisecond)
+	}
+
+	// The third endpoint is removed, and the second has an in-flight request.
+	tr.Begin(eps[1].ID())
+	time.Sleep(time.Millisecond * 30)
+	s.Select(nil, eps[:1])
+
+	stats := &s.(*peakEWMA).stats
+	for i, expect := range []bool{true, true, false} {
+		if _, ok := stats.Load(eps[i].ID()); ok != expect {
+			t.Errorf("endpoint '%s': expect the stat existence %v, but got %v", eps[i].ID(), expect, ok)
+		}
+	}
+}
+
+func TestEWMAStat(t *testing.T) {
+	const decay = float64(time.Second)
+
+	var s ewmaStat
+	now := time.Now()
+	if v := s.latency(now, decay); v != 0 {
+		t.Errorf("expect no latency, but got %v", v)
+	}
+
+	s.observe(now, 100, decay)
+	if v := s.latency(now, decay); v != 100 {
+		t.Errorf("expect the latency %v, but got %v", 100, v)
+	}
+
+	// Decay towards zero without the new latency.
+	now = now.Add(time.Second)
+	if v, expect := s.latency(now, decay), 100/math.E; math.Abs(v-expect) > 1e-9 {
+		t.Errorf("expect the latency %v, but got %v", expect, v)
+	}
+
+	// Move towards the lower latency.
+	s.observe(now, 10, decay)
+	if v, expect := s.latency(now, decay), 100/math.E+10*(1-1/math.E); math.Abs(v-expect) > 1e-9 {
+		t.Errorf("expect the latency %v, but got %v", expect, v)
+	}
+
+	// Take the higher latency at once.
+	s.observe(now, 200, decay)
+	if v := s.latency(now, decay); v != 200 {
+		t.Errorf("expect the latency %v, but got %v", 200, v)
+	}
+}
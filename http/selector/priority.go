@@ -0,0 +1,174 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync/atomic"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-loadbalancer/selector"
+)
+
+const priorityTriedKey = "_priority_tried"
+
+// Priority returns a new selector with the policy "priority(policy)",
+// which groups the endpoints into the tiers by the priority,
+// the smaller the value, the higher the priority, such as
+// http/endpoint.Priority, and uses next to select the endpoint
+// only from the available tier with the highest priority.
+//
+// So the lower tier receives the requests only when all the endpoints
+// of the higher tiers are unavailable, such as being unhealthy.
+//
+// If the request is *core.Context and is being retried, the tried endpoints
+// are excluded, so the retry may go to the next tier if all the endpoints
+// of the current tier have been tried. If all the endpoints have been tried,
+// select from the tier with the highest priority again.
+func Priority(priority func(loadbalancer.Endpoint) int, next selector.Selector) selector.Selector {
+	if priority == nil {
+		panic("Priority: priority function must not be nil")
+	}
+	if next == nil {
+		panic("Priority: next selector must not be nil")
+	}
+
+	policy := fmt.Sprintf("priority(%s)", next.Policy())
+	return &tiered{policy: policy, priority: priority, next: next}
+}
+
+type tiered struct {
+	policy   string
+	priority func(loadbalancer.Endpoint) int
+	next     selector.Selector
+	tiers    atomic.Pointer[tiers]
+}
+
+func (s *tiered) Policy() string { return s.policy }
+
+func (s *tiered) Select(req any, eps loadbalancer.Endpoints) loadbalancer.Endpoint {
+	if len(eps) < 2 {
+		return s.next.Select(req, eps)
+	}
+
+	t := s.tiers.Load()
+	if t == nil || !t.match(eps, s.priority) {
+		t = s.newTiers(eps)
+		s.tiers.Store(t)
+	}
+
+	if t.single {
+		return s.next.Select(req, eps)
+	}
+
+	var tried []string
+	if c, ok := req.(*core.Context); ok {
+		tried = getTried(c)
+	}
+
+	best := math.MaxInt
+	for i, ep := range eps {
+		if t.priorities[i] < best && !slices.Contains(tried, ep.ID()) {
+			best = t.priorities[i]
+		}
+	}
+
+	if best == math.MaxInt { // All the endpoints have been tried.
+		best, tried = t.highest, nil
+	}
+
+	start, end, count := -1, 0, 0
+	for i, ep := range eps {
+		if t.priorities[i] == best && !slices.Contains(tried, ep.ID()) {
+			if start < 0 {
+				start = i
+			}
+			end = i + 1
+			count++
+		}
+	}
+
+	// Use the sub-slice if possible to let next cache the endpoints.
+	if count == end-start {
+		return s.next.Select(req, eps[start:end])
+	}
+
+	candidates := make(loadbalancer.Endpoints, 0, count)
+	for i, ep := range eps[start:end] {
+		if t.priorities[start+i] == best && !slices.Contains(tried, ep.ID()) {
+			candidates = append(candidates, ep)
+		}
+	}
+	return s.next.Select(req, candidates)
+}
+
+// getTried returns the endpoints that have been tried by the request,
+// which is recorded when the request is being retried.
+func getTried(c *core.Context) []string {
+	tried, _ := c.Kvs[priorityTriedKey].([]string)
+
+	// c.Endpoint is set only when the endpoint has been tried,
+	// so it has failed if the request is being retried.
+	if c.Endpoint != nil && !slices.Contains(tried, c.Endpoint.ID()) {
+		tried = append(tried, c.Endpoint.ID())
+		c.Kvs[priorityTriedKey] = tried
+	}
+
+	return tried
+}
+
+// ------------------------------------------------------------------------ //
+
+type tiers struct {
+	ids        []string // Only used to check whether the endpoints change.
+	priorities []int
+	highest    int
+	single     bool // Whether all the endpoints have the same priority.
+}
+
+func (s *tiered) newTiers(eps loadbalancer.Endpoints) *tiers {
+	t := &tiers{ids: make([]string, len(eps)), priorities: make([]int, len(eps)), single: true}
+	for i, ep := range eps {
+		t.ids[i] = ep.ID()
+		t.priorities[i] = s.priority(ep)
+		switch {
+		case i == 0:
+			t.highest = t.priorities[i]
+
+		case t.priorities[i] != t.highest:
+			t.single = false
+			t.highest = min(t.highest, t.priorities[i])
+		}
+	}
+	return t
+}
+
+// match reports whether the tiers are built by the endpoints,
+// the ids and priorities of which are not changed.
+func (t *tiers) match(eps loadbalancer.Endpoints, priority func(loadbalancer.Endpoint) int) bool {
+	if len(eps) != len(t.ids) {
+		return false
+	}
+
+	for i, ep := range eps {
+		if ep.ID() != t.ids[i] || priority(ep) != t.priorities[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-loadbalancer"
+)
+
+func TestPriority(t *testing.T) {
+	eps := newEndpoints(5)
+	priorities := map[string]int{
+		eps[0].ID(): 1,
+		eps[1].ID(): 0,
+		eps[2].ID(): 1,
+		eps[3].ID(): 0,
+		eps[4].ID(): 2,
+	}
+
+	s := Priority(func(ep loadbalancer.Endpoint) int { return priorities[ep.ID()] }, new(rrSelector))
+	if policy := s.Policy(); policy != "priority(rr)" {
+		t.Errorf("expect the policy 'priority(rr)', but got '%s'", policy)
+	}
+
+	expectIn := func(c *core.Context, eps loadbalancer.Endpoints, expects ...loadbalancer.Endpoint) {
+		t.Helper()
+		var req any = c
+		if c == nil {
+			req = nil // Not *core.Context
+		}
+
+		for range 10 {
+			ep := s.Select(req, eps)
+			if c != nil {
+				c.Endpoint = ep // Simulate that the endpoint has been tried.
+			}
+
+			found := false
+			for _, e := range expects {
+				if e.ID() == ep.ID() {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Fatalf("unexpected endpoint '%s'", ep.ID())
+			}
+
+			if c != nil {
+				return
+			}
+		}
+	}
+
+	// Only the highest tier.
+	expectIn(nil, eps, eps[1], eps[3])
+
+	// The highest tier is unavailable.
+	expectIn(nil, loadbalancer.Endpoints{eps[0], eps[2], eps[4]}, eps[0], eps[2])
+	expectIn(nil, eps[4:], eps[4])
+
+	// Retry and fail over to the lower tiers.
+	c := newContext("http://localhost", http.Header{})
+	expectIn(c, eps, eps[1], eps[3])
+	expectIn(c, eps, eps[1], eps[3])
+	expectIn(c, eps, eps[0], eps[2])
+	expectIn(c, eps, eps[0], eps[2])
+	expectIn(c, eps, eps[4])
+
+	// All have been tried.
+	expectIn(c, eps, eps[1], eps[3])
+
+	// The endpoints of the same priority.
+	s = Priority(func(loadbalancer.Endpoint) int { return 0 }, firstSelector{})
+	expectIn(nil, eps, eps[0])
+
+	// The priority is changed in place.
+	s = Priority(func(ep loadbalancer.Endpoint) int { return priorities[ep.ID()] }, firstSelector{})
+	expectIn(nil, eps, eps[1])
+	priorities[eps[0].ID()] = -1
+	expectIn(nil, eps, eps[0])
+
+	// The new slice of the same endpoints reuses the tiers.
+	tiers := s.(*tiered).tiers.Load()
+	expectIn(nil, slices.Clone(eps), eps[0])
+	if s.(*tiered).tiers.Load() != tiers {
+		t.Error("expect to reuse the tiers for the same endpoints")
+	}
+}
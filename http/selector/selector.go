@@ -0,0 +1,60 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package selector provides some endpoint selectors based on the http request.
+package selector
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xgfone/go-loadbalancer/selector"
+)
+
+// DefaultFallbackPolicy is the default policy of the fallback selector
+// used by the consistent hash when the key is empty.
+var DefaultFallbackPolicy = "roundrobin"
+
+// Get returns the selector by the policy.
+//
+// Besides the policies registered in go-loadbalancer/selector,
+// it also supports the policy "chash(key[,fallback])",
+// such as "chash(@X-User-Id)" and "chash(#uid,random)". See ConsistentHash.
+//
+// And the policy "p2c_ewma" returns a new peak EWMA selector each time,
+// which must be added as the observer of the upstream. See PeakEWMA.
+func Get(policy string) (selector.Selector, error) {
+	if policy == PeakEWMAPolicy {
+		return PeakEWMA(0), nil
+	}
+
+	if !strings.HasPrefix(policy, "chash(") || !strings.HasSuffix(policy, ")") {
+		if s := selector.Get(policy); s != nil {
+			return s, nil
+		}
+		return nil, fmt.Errorf("invalid forwarding policy '%s'", policy)
+	}
+
+	key, fpolicy, _ := strings.Cut(policy[len("chash("):len(policy)-1], ",")
+	if key, fpolicy = strings.TrimSpace(key), strings.TrimSpace(fpolicy); fpolicy == "" {
+		fpolicy = DefaultFallbackPolicy
+	}
+
+	fallback := selector.Get(fpolicy)
+	if fallback == nil {
+		return nil, fmt.Errorf("invalid fallback policy '%s' of consistent hash", fpolicy)
+	}
+
+	return ConsistentHash(key, fallback)
+}
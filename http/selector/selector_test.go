@@ -0,0 +1,38 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import "testing"
+
+func TestGet(t *testing.T) {
+	for policy, expect := range map[string]string{
+		"roundrobin":          "roundrobin",
+		"chash(@X-User-Id)":   "chash(@X-User-Id)",
+		"chash(#uid, random)": "chash(#uid)",
+		"p2c_ewma":            "p2c_ewma",
+	} {
+		if s, err := Get(policy); err != nil {
+			t.Errorf("%s: %v", policy, err)
+		} else if p := s.Policy(); p != expect {
+			t.Errorf("expect the policy '%s', but got '%s'", expect, p)
+		}
+	}
+
+	for _, policy := range []string{"none", "chash(uid)", "chash(#uid,none)"} {
+		if _, err := Get(policy); err == nil {
+			t.Errorf("expect an error for the policy '%s', but got nil", policy)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-loadbalancer/selector"
+)
+
+// SlowStart returns a new selector with the policy "slowstart(policy)",
+// which scales down the effective weight of the endpoint by the ratio,
+// range: (0, 1], such as upstream/lifecycle.Lifecycle.Ratio.
+//
+// The endpoint selected by next is accepted with the probability of its ratio,
+// or else next selects again, so it has no effect on the hash-based policies,
+// which always select the same endpoint for the same request.
+func SlowStart(ratio func(epid string) float64, next selector.Selector) selector.Selector {
+	if ratio == nil {
+		panic("SlowStart: ratio function must not be nil")
+	}
+	if next == nil {
+		panic("SlowStart: next selector must not be nil")
+	}
+
+	policy := fmt.Sprintf("slowstart(%s)", next.Policy())
+	return &slowstart{policy: policy, ratio: ratio, next: next}
+}
+
+type slowstart struct {
+	policy string
+	ratio  func(string) float64
+	next   selector.Selector
+}
+
+func (s *slowstart) Policy() string { return s.policy }
+
+func (s *slowstart) Select(req any, eps loadbalancer.Endpoints) (ep loadbalancer.Endpoint) {
+	if len(eps) < 2 {
+		return s.next.Select(req, eps)
+	}
+
+	for range min(len(eps), 8) {
+		ep = s.next.Select(req, eps)
+		if ep == nil {
+			return
+		}
+
+		if r := s.ratio(ep.ID()); r >= 1 || rand.Float64() < r {
+			return
+		}
+	}
+
+	return // Use the last one if all are rejected.
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"testing"
+
+	"github.com/xgfone/go-loadbalancer"
+)
+
+type rrSelector struct{ n int }
+
+func (s *rrSelector) Policy() string { return "rr" }
+func (s *rrSelector) Select(_ any, eps loadbalancer.Endpoints) loadbalancer.Endpoint {
+	s.n++
+	return eps[s.n%len(eps)]
+}
+
+func TestSlowStart(t *testing.T) {
+	eps := newEndpoints(2)
+	warming := eps[1].ID()
+
+	ratio := 0.0
+	s := SlowStart(func(epid string) float64 {
+		if epid == warming {
+			return ratio
+		}
+		return 1
+	}, new(rrSelector))
+
+	if policy := s.Policy(); policy != "slowstart(rr)" {
+		t.Errorf("expect the policy 'slowstart(rr)', but got '%s'", policy)
+	}
+
+	for range 100 {
+		if ep := s.Select(nil, eps); ep.ID() == warming {
+			t.Fatalf("unexpect the warming endpoint '%s'", warming)
+		}
+	}
+
+	ratio = 0.5
+	counts := make(map[string]int, 2)
+	for range 10000 {
+		counts[s.Select(nil, eps).ID()]++
+	}
+
+	// The effective weights are 1 and 0.5.
+	if n := counts[warming]; n < 2800 || n > 3900 {
+		t.Errorf("expect about 3333 requests to the warming endpoint, but got %d", n)
+	}
+
+	// Only one endpoint.
+	if ep := s.Select(nil, eps[1:]); ep.ID() != warming {
+		t.Errorf("expect the endpoint '%s', but got '%s'", warming, ep.ID())
+	}
+}
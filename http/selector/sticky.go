@@ -0,0 +1,143 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-loadbalancer/selector"
+)
+
+// DefaultStickyCookie is the default name of the sticky session cookie.
+const DefaultStickyCookie = "_gw_sticky"
+
+// StickyConfig is used to configure the sticky session based on the cookie.
+type StickyConfig struct {
+	// Optional, the name of the cookie.
+	//
+	// Default: DefaultStickyCookie
+	Name string
+
+	// Optional, the max age of the cookie. 0 means the session cookie.
+	TTL time.Duration
+
+	// Optional, the attributes of the cookie.
+	//
+	// Path Default: "/"
+	Path     string
+	Domain   string
+	Secure   bool
+	HttpOnly bool
+}
+
+// Sticky returns a new selector with the policy "sticky(policy)",
+// which pins a client to the endpoint recorded by the cookie
+// issued in the first response.
+//
+// If the cookie is missing, or the endpoint is absent from the available
+// endpoints, such as being removed or unhealthy, or it has been tried and
+// failed by the current request, use next to select the endpoint instead.
+func Sticky(config StickyConfig, next selector.Selector) selector.Selector {
+	if next == nil {
+		panic("Sticky: next selector must not be nil")
+	}
+
+	if config.Name == "" {
+		config.Name = DefaultStickyCookie
+	}
+	if config.Path == "" {
+		config.Path = "/"
+	}
+
+	return &sticky{
+		policy: fmt.Sprintf("sticky(%s)", next.Policy()),
+		kvkey:  "_sticky_" + config.Name,
+		config: config,
+		next:   next,
+	}
+}
+
+type sticky struct {
+	policy string
+	kvkey  string
+	config StickyConfig
+	next   selector.Selector
+}
+
+func (s *sticky) Policy() string { return s.policy }
+
+func (s *sticky) Select(req any, eps loadbalancer.Endpoints) loadbalancer.Endpoint {
+	c, ok := req.(*core.Context)
+	if !ok {
+		return s.next.Select(req, eps)
+	}
+
+	if _, ok := c.Kvs[s.kvkey]; !ok {
+		c.Kvs[s.kvkey] = true
+		c.OnResponseHeader(func() { s.setCookie(c) })
+	}
+
+	if value := c.Cookie(s.config.Name); value != "" {
+		// c.Endpoint is set only when the endpoint has been tried,
+		// so it has failed if the request is being retried.
+		tried := c.Endpoint
+		for _, ep := range eps {
+			if stickyValue(ep) == value && (tried == nil || tried.ID() != ep.ID()) {
+				return ep
+			}
+		}
+	}
+
+	return s.next.Select(req, eps)
+}
+
+func (s *sticky) setCookie(c *core.Context) {
+	if c.Endpoint == nil {
+		return
+	}
+
+	value := stickyValue(c.Endpoint)
+	if value == c.Cookie(s.config.Name) {
+		return
+	}
+
+	cookie := http.Cookie{
+		Name:     s.config.Name,
+		Value:    value,
+		Path:     s.config.Path,
+		Domain:   s.config.Domain,
+		Secure:   s.config.Secure,
+		HttpOnly: s.config.HttpOnly,
+		MaxAge:   int(s.config.TTL / time.Second),
+	}
+	if s.config.TTL > 0 {
+		cookie.Expires = time.Now().Add(s.config.TTL)
+	}
+
+	if v := cookie.String(); v != "" {
+		c.ClientResponse.Header().Add("Set-Cookie", v)
+	}
+}
+
+// stickyValue returns the cookie value of the endpoint,
+// which is derived from its id and does not expose its address.
+func stickyValue(ep loadbalancer.Endpoint) string {
+	return strconv.FormatUint(hashkey(ep.ID()), 36)
+}
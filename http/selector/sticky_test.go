@@ -0,0 +1,95 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-loadbalancer"
+)
+
+type lastSelector struct{}
+
+func (lastSelector) Policy() string { return "last" }
+func (lastSelector) Select(_ any, eps loadbalancer.Endpoints) loadbalancer.Endpoint {
+	return eps[len(eps)-1]
+}
+
+func TestSticky(t *testing.T) {
+	s := Sticky(StickyConfig{Name: "sid", TTL: time.Hour, Secure: true, HttpOnly: true}, lastSelector{})
+	if policy := s.Policy(); policy != "sticky(last)" {
+		t.Errorf("expect the policy 'sticky(last)', but got '%s'", policy)
+	}
+
+	eps := newEndpoints(3)
+	serve := func(cookie string, eps loadbalancer.Endpoints) (ep loadbalancer.Endpoint, setcookie string) {
+		header := http.Header{}
+		if cookie != "" {
+			header.Set("Cookie", "sid="+cookie)
+		}
+
+		rec := httptest.NewRecorder()
+		c := newContext("http://localhost/", header)
+		c.ClientResponse = core.AcquireResponseWriter(rec)
+
+		ep = s.Select(c, eps)
+		c.Endpoint = ep
+		c.CallbackOnResponseHeader()
+		return ep, rec.Header().Get("Set-Cookie")
+	}
+
+	// The first request: issue the cookie.
+	ep, setcookie := serve("", eps)
+	if ep.ID() != eps[2].ID() {
+		t.Fatalf("expect the endpoint '%s', but got '%s'", eps[2].ID(), ep.ID())
+	}
+
+	value := stickyValue(eps[2])
+	for _, s := range []string{"sid=" + value, "Path=/", "Max-Age=3600", "HttpOnly", "Secure"} {
+		if !strings.Contains(setcookie, s) {
+			t.Errorf("expect the cookie contains '%s', but got '%s'", s, setcookie)
+		}
+	}
+	if strings.Contains(setcookie, "127.0.0") {
+		t.Errorf("unexpect the cookie to expose the address: %s", setcookie)
+	}
+
+	// The later request: pin the endpoint and not issue the cookie again.
+	value = stickyValue(eps[0])
+	if ep, setcookie := serve(value, eps); ep.ID() != eps[0].ID() {
+		t.Errorf("expect the sticky endpoint '%s', but got '%s'", eps[0].ID(), ep.ID())
+	} else if setcookie != "" {
+		t.Errorf("unexpect to issue the cookie again, but got '%s'", setcookie)
+	}
+
+	// The sticky endpoint is unavailable: fall back and reissue the cookie.
+	if ep, setcookie := serve(value, eps[1:]); ep.ID() != eps[2].ID() {
+		t.Errorf("expect the fallback endpoint '%s', but got '%s'", eps[2].ID(), ep.ID())
+	} else if !strings.HasPrefix(setcookie, "sid="+stickyValue(eps[2])) {
+		t.Errorf("expect to reissue the cookie, but got '%s'", setcookie)
+	}
+
+	// The sticky endpoint has been tried and failed.
+	c := newContext("http://localhost/", http.Header{"Cookie": {"sid=" + value}})
+	c.Endpoint = eps[0]
+	if ep := s.Select(c, eps); ep.ID() != eps[2].ID() {
+		t.Errorf("expect the retried endpoint '%s', but got '%s'", eps[2].ID(), ep.ID())
+	}
+}
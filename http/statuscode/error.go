@@ -36,6 +36,7 @@ var (
 	ErrBadGateway           = NewError(http.StatusBadGateway)           // 502
 	ErrServiceUnavailable   = NewError(http.StatusServiceUnavailable)   // 503
 	ErrGatewayTimeout       = NewError(http.StatusGatewayTimeout)       // 504
+	ErrLoopDetected         = NewError(http.StatusLoopDetected)         // 508
 )
 
 var (
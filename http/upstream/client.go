@@ -0,0 +1,309 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xgfone/go-toolkit/runtimex"
+)
+
+// Pre-define the protocols of the transport to the upstream servers.
+const (
+	ProtocolHTTP1 = "http1" // Only HTTP/1.1
+	ProtocolH2    = "h2"    // Only HTTP/2 over TLS
+	ProtocolH2C   = "h2c"   // Only HTTP/2 over cleartext TCP with prior knowledge
+)
+
+// TransportConfig is used to configure the transport of the client,
+// the defaults of which are the same as DefaultHttpClient.
+type TransportConfig struct {
+	// Optional, the protocol to the servers, such as ProtocolH2C.
+	//
+	// Default: "", that's, HTTP/1.1, or HTTP/2 negotiated by TLS ALPN.
+	Protocol string
+
+	// Optional, the timeout and keepalive period of dialing the server.
+	// A negative KeepAlive disables the keepalive.
+	//
+	// Default: 3s, 30s
+	DialTimeout time.Duration
+	KeepAlive   time.Duration
+
+	// Optional, the timeout of the TLS handshake.
+	//
+	// Default: 2s
+	TLSHandshakeTimeout time.Duration
+
+	// Optional, the maximum duration that an idle connection is kept.
+	//
+	// Default: 90s
+	IdleConnTimeout time.Duration
+
+	// Optional, the maximum number of the idle and total connections per host.
+	//
+	// Default: 100, 0 (no limit)
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+
+	// Optional, the timeout to wait for the response headers
+	// after writing the request.
+	//
+	// Default: 0 (no timeout)
+	ResponseHeaderTimeout time.Duration
+
+	// Optional, the timeout to wait for the first response headers
+	// after writing the request headers with "Expect: 100-continue".
+	//
+	// Default: 1s
+	ExpectContinueTimeout time.Duration
+
+	// Optional, if true, do not request the gzip compression
+	// when the request has no Accept-Encoding.
+	DisableCompression bool
+}
+
+func (c *TransportConfig) init() error {
+	switch c.Protocol {
+	case "", ProtocolHTTP1, ProtocolH2, ProtocolH2C:
+	default:
+		return fmt.Errorf("invalid protocol '%s'", c.Protocol)
+	}
+
+	if c.DialTimeout < 0 || c.TLSHandshakeTimeout < 0 || c.IdleConnTimeout < 0 ||
+		c.ResponseHeaderTimeout < 0 || c.ExpectContinueTimeout < 0 {
+		return fmt.Errorf("invalid negative timeout")
+	}
+	if c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 {
+		return fmt.Errorf("invalid negative max connections")
+	}
+
+	if c.DialTimeout == 0 {
+		c.DialTimeout = time.Second * 3
+	}
+	if c.KeepAlive == 0 {
+		c.KeepAlive = time.Second * 30
+	}
+	if c.TLSHandshakeTimeout == 0 {
+		c.TLSHandshakeTimeout = time.Second * 2
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = time.Second * 90
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = 100
+	}
+	if c.ExpectContinueTimeout == 0 {
+		c.ExpectContinueTimeout = time.Second
+	}
+
+	return nil
+}
+
+func (c TransportConfig) newTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: c.DialTimeout, KeepAlive: c.KeepAlive}
+	transport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		DialContext:       dialer.DialContext,
+		ForceAttemptHTTP2: true,
+
+		MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     c.MaxConnsPerHost,
+		IdleConnTimeout:     c.IdleConnTimeout,
+
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		ExpectContinueTimeout: c.ExpectContinueTimeout,
+		DisableCompression:    c.DisableCompression,
+	}
+
+	if c.Protocol != "" {
+		transport.Protocols = new(http.Protocols)
+		switch c.Protocol {
+		case ProtocolHTTP1:
+			transport.Protocols.SetHTTP1(true)
+		case ProtocolH2:
+			transport.Protocols.SetHTTP2(true)
+		case ProtocolH2C:
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+
+	return transport
+}
+
+// ClientConfig is used to configure the dedicated client of the upstream.
+type ClientConfig struct {
+	Transport TransportConfig
+
+	// Optional, the TLS to the https servers.
+	TLS *TLSConfig
+}
+
+// Client is a dedicated http client of the upstream, which has its own
+// transport and connection pool, and should be started to reload
+// the TLS certificate files when they change.
+type Client struct {
+	*http.Client
+
+	name      string
+	config    ClientConfig
+	transport atomic.Pointer[http.Transport]
+
+	llock sync.Mutex
+	pems  [3][]byte // CA, Cert, Key
+
+	slock  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewClient returns a new dedicated http client named name,
+// such as the upstream id.
+func NewClient(name string, config ClientConfig) (*Client, error) {
+	if err := config.Transport.init(); err != nil {
+		return nil, err
+	}
+	if config.TLS != nil {
+		if err := config.TLS.init(); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Client{name: name, config: config}
+	c.Client = &http.Client{Transport: roundTripper{c}}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type roundTripper struct{ c *Client }
+
+func (t roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.c.transport.Load().RoundTrip(r)
+}
+
+// Config returns the configuration of the client.
+func (c *Client) Config() ClientConfig { return c.config }
+
+// Reload loads the TLS certificates again, and replaces the transport
+// with a new one if they have changed.
+//
+// If failing, the last transport is kept.
+func (c *Client) Reload() error {
+	var pems [3][]byte
+	if c.config.TLS != nil {
+		var err error
+		if pems, err = c.config.TLS.load(); err != nil {
+			return err
+		}
+	}
+
+	c.llock.Lock()
+	defer c.llock.Unlock()
+
+	if c.transport.Load() != nil && bytes.Equal(pems[0], c.pems[0]) &&
+		bytes.Equal(pems[1], c.pems[1]) && bytes.Equal(pems[2], c.pems[2]) {
+		return nil
+	}
+
+	transport := c.config.Transport.newTransport()
+	if c.config.TLS != nil {
+		var err error
+		if transport.TLSClientConfig, err = c.config.TLS.build(pems); err != nil {
+			return err
+		}
+	}
+
+	old := c.transport.Swap(transport)
+	c.pems = pems
+
+	if old != nil {
+		old.CloseIdleConnections()
+		slog.Info("reload the tls certificates of the upstream client", "upstream", c.name)
+	}
+
+	return nil
+}
+
+// Start starts to reload the TLS certificate files in the background
+// when they change.
+func (c *Client) Start() {
+	if c.config.TLS == nil || !c.config.TLS.hasFiles() {
+		return
+	}
+
+	c.slock.Lock()
+	defer c.slock.Unlock()
+	if c.cancel != nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	c.done = make(chan struct{})
+	go c.loop(ctx, c.done)
+}
+
+// Stop stops reloading the TLS certificate files, waits until it exits,
+// and closes the idle connections.
+//
+// The connections in use are closed by the transport when they become idle
+// for IdleConnTimeout.
+func (c *Client) Stop() {
+	c.slock.Lock()
+	defer c.slock.Unlock()
+
+	if c.cancel != nil {
+		c.cancel()
+		<-c.done
+		c.cancel, c.done = nil, nil
+	}
+
+	c.transport.Load().CloseIdleConnections()
+}
+
+func (c *Client) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(c.config.TLS.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.reload(ctx)
+		}
+	}
+}
+
+func (c *Client) reload(ctx context.Context) {
+	defer runtimex.Recover(ctx)
+	if err := c.Reload(); err != nil {
+		slog.Error("fail to reload the tls certificates of the upstream client, and keep the last",
+			"upstream", c.name, "err", err)
+	}
+}
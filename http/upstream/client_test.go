@@ -0,0 +1,169 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upstream
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransportConfig(t *testing.T) {
+	for _, config := range []TransportConfig{
+		{DialTimeout: -1},
+		{ResponseHeaderTimeout: -1},
+		{MaxIdleConnsPerHost: -1},
+		{MaxConnsPerHost: -1},
+	} {
+		if _, err := NewClient("up", ClientConfig{Transport: config}); err == nil {
+			t.Errorf("expect an error for %+v, but got nil", config)
+		}
+	}
+
+	c, err := NewClient("up", ClientConfig{Transport: TransportConfig{
+		MaxConnsPerHost:       2,
+		ResponseHeaderTimeout: time.Second,
+		DisableCompression:    true,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := c.transport.Load()
+	if transport.MaxIdleConnsPerHost != 100 {
+		t.Errorf("expect MaxIdleConnsPerHost %d, but got %d", 100, transport.MaxIdleConnsPerHost)
+	}
+	if transport.MaxConnsPerHost != 2 {
+		t.Errorf("expect MaxConnsPerHost %d, but got %d", 2, transport.MaxConnsPerHost)
+	}
+	if transport.TLSHandshakeTimeout != time.Second*2 {
+		t.Errorf("expect TLSHandshakeTimeout %s, but got %s", time.Second*2, transport.TLSHandshakeTimeout)
+	}
+	if transport.ResponseHeaderTimeout != time.Second {
+		t.Errorf("expect ResponseHeaderTimeout %s, but got %s", time.Second, transport.ResponseHeaderTimeout)
+	}
+	if !transport.DisableCompression {
+		t.Error("expect DisableCompression, but got false")
+	}
+	if transport.TLSClientConfig != nil {
+		t.Error("expect no tls config, but got one")
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	c1, err := NewClient("up1", ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := NewClient("up2", ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each client has its own connection pool.
+	for range 3 {
+		if err := get(c1, server.URL); err != nil {
+			t.Fatal(err)
+		}
+		if err := get(c2, server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := conns.Load(); n != 2 {
+		t.Errorf("expect %d connections, but got %d", 2, n)
+	}
+
+	// The idle connections are closed when stopping the client.
+	c1.Stop()
+	if err := get(c1, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(c2, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := conns.Load(); n != 3 {
+		t.Errorf("expect %d connections, but got %d", 3, n)
+	}
+}
+
+func TestClientProtocol(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		w.WriteHeader(204)
+	})
+
+	h2c := httptest.NewUnstartedServer(handler)
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	for _, test := range []struct {
+		protocol string
+		url      string
+		expect   string
+	}{
+		{"", h2c.URL, "HTTP/1.1"},
+		{ProtocolHTTP1, h2c.URL, "HTTP/1.1"},
+		{ProtocolH2C, h2c.URL, "HTTP/2.0"},
+		{"", h2.URL, "HTTP/2.0"},
+		{ProtocolHTTP1, h2.URL, "HTTP/1.1"},
+		{ProtocolH2, h2.URL, "HTTP/2.0"},
+	} {
+		c, err := NewClient("up", ClientConfig{
+			Transport: TransportConfig{Protocol: test.protocol},
+			TLS:       &TLSConfig{InsecureSkipVerify: true},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := c.Get(test.url)
+		if err != nil {
+			t.Errorf("%s: %v", test.protocol, err)
+			continue
+		}
+		resp.Body.Close()
+
+		if proto := resp.Header.Get("X-Proto"); proto != test.expect {
+			t.Errorf("%s: expect the protocol '%s', but got '%s'", test.protocol, test.expect, proto)
+		}
+	}
+
+	if _, err := NewClient("up", ClientConfig{Transport: TransportConfig{Protocol: "h3"}}); err == nil {
+		t.Error("expect an error for the invalid protocol, but got nil")
+	}
+}
@@ -21,7 +21,9 @@ import (
 	"time"
 
 	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-apigateway/http/statuscode"
 	"github.com/xgfone/go-apigateway/upstream"
+	"github.com/xgfone/go-apigateway/upstream/breaker"
 )
 
 // Forward forwards the http request by the upstream.
@@ -36,7 +38,23 @@ func Forward(c *core.Context) {
 		return
 	}
 
+	done, ok := up.Allow()
+	if !ok {
+		if up, ok = fallback(up); ok {
+			done, ok = up.Allow()
+		}
+
+		if !ok {
+			c.Abort(statuscode.ErrServiceUnavailable.WithError(
+				fmt.Errorf("upstream '%s': %w", c.UpstreamId, breaker.ErrOpen)))
+			return
+		}
+	}
+
 	c.Upstream = up
+	if client := up.Client(); client != nil {
+		c.Client = client
+	}
 	if c.UpstreamRequest == nil {
 		c.UpstreamRequest = newRequest(c)
 	}
@@ -68,8 +86,12 @@ func Forward(c *core.Context) {
 
 	c.CallbackOnForward()
 	if c.IsAborted {
+		if done != nil {
+			done(true) // The request is not forwarded, so release the trial.
+		}
 		return
 	}
+	c.CallbackOnUpstreamRequest()
 
 	start := time.Now()
 
@@ -79,9 +101,36 @@ func Forward(c *core.Context) {
 		c.UpstreamResponse = resp.(*http.Response)
 	}
 
+	if done != nil {
+		var code int
+		if c.UpstreamResponse != nil {
+			code = c.UpstreamResponse.StatusCode
+		}
+		done(breaker.Succeeded(code, c.Error))
+	}
+
 	_log(c, up.Balancer().Policy(), time.Since(start), c.Error)
 }
 
+// fallback returns the fallback upstream when the circuit breaker
+// of the upstream is open.
+func fallback(up *upstream.Upstream) (*upstream.Upstream, bool) {
+	g := up.Breakers()
+	if g == nil || g.Fallback() == "" || g.Fallback() == up.Name() {
+		return nil, false
+	}
+
+	fup, ok := upstream.Manager.Get(g.Fallback())
+	if !ok {
+		slog.Warn("missing the fallback upstream", "upstream", up.Name(), "fallback", g.Fallback())
+		return nil, false
+	}
+
+	slog.Debug("fall back to the upstream as the circuit breaker is open",
+		"upstream", up.Name(), "fallback", fup.Name())
+	return fup, true
+}
+
 func _log(c *core.Context, policy string, cost time.Duration, err error) {
 	req := c.UpstreamRequest
 	if err != nil {
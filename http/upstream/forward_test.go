@@ -16,12 +16,15 @@ package upstream
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/url"
 	"testing"
 
 	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-apigateway/http/statuscode"
 	"github.com/xgfone/go-apigateway/upstream"
+	"github.com/xgfone/go-apigateway/upstream/breaker"
 	"github.com/xgfone/go-loadbalancer"
 	"github.com/xgfone/go-loadbalancer/balancer"
 	"github.com/xgfone/go-loadbalancer/forwarder"
@@ -33,11 +36,18 @@ func TestForward(t *testing.T) {
 	up.SetScheme("http")
 	upstream.Manager.Add(up.Name(), up)
 
+	client := new(http.Client)
+	up.SetClient(client)
+
 	c := core.AcquireContext(context.Background())
 	c.ClientRequest = &http.Request{URL: &url.URL{Path: "/"}}
 	c.UpstreamId = "http_forward_test"
 	Forward(c)
 
+	if c.Client != client {
+		t.Error("expect the http client of the upstream")
+	}
+
 	if c.UpstreamRequest.Host != "localhost" {
 		t.Errorf("expect the upstream request host '%s', but got '%s'",
 			c.UpstreamRequest.Host, "localhost")
@@ -50,3 +60,57 @@ func TestForward(t *testing.T) {
 		t.Errorf("expect error '%s', but got '%s'", loadbalancer.ErrNoAvailableEndpoints, c.Error)
 	}
 }
+
+func TestForwardCircuitBreaker(t *testing.T) {
+	g, err := breaker.NewGroup("http_forward_breaker", breaker.GroupConfig{
+		Config: breaker.Config{ConsecutiveFailures: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := upstream.New(forwarder.New("http_forward_breaker", balancer.DefaultBalancer, loadbalancer.None))
+	up.SetBreakers(g)
+	upstream.Manager.Add(up.Name(), up)
+	defer upstream.Manager.Del(up.Name())
+
+	forward := func() *core.Context {
+		c := core.AcquireContext(context.Background())
+		c.ClientRequest = &http.Request{URL: &url.URL{Path: "/"}}
+		c.UpstreamId = "http_forward_breaker"
+		Forward(c)
+		return c
+	}
+
+	// The first failure opens the breaker.
+	if c := forward(); c.Error != loadbalancer.ErrNoAvailableEndpoints {
+		t.Fatalf("expect error '%s', but got '%v'", loadbalancer.ErrNoAvailableEndpoints, c.Error)
+	} else if state := g.Upstream().State(); state != breaker.StateOpen {
+		t.Fatalf("expect the breaker state '%s', but got '%s'", breaker.StateOpen, state)
+	}
+
+	c := forward()
+	if !c.IsAborted || !errors.Is(c.Error, breaker.ErrOpen) {
+		t.Errorf("expect the error '%s', but got '%v'", breaker.ErrOpen, c.Error)
+	} else if err, ok := c.Error.(statuscode.Error); !ok || err.Code != http.StatusServiceUnavailable {
+		t.Errorf("expect the status code 503, but got '%v'", c.Error)
+	}
+
+	// Fall back to another upstream.
+	fallback := upstream.New(forwarder.New("http_forward_fallback", balancer.DefaultBalancer, loadbalancer.None))
+	upstream.Manager.Add(fallback.Name(), fallback)
+	defer upstream.Manager.Del(fallback.Name())
+
+	g, _ = breaker.NewGroup("http_forward_breaker", breaker.GroupConfig{
+		Config:   breaker.Config{ConsecutiveFailures: 1},
+		Fallback: "http_forward_fallback",
+	})
+	up.SetBreakers(g)
+
+	forward()
+	if c := forward(); c.IsAborted {
+		t.Errorf("unexpect the request to be aborted: %v", c.Error)
+	} else if c.Upstream != fallback {
+		t.Errorf("expect the fallback upstream, but got %v", c.Upstream)
+	}
+}
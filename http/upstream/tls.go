@@ -0,0 +1,140 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLSConfig is used to configure the TLS of the client
+// to forward the request to the https upstream servers.
+//
+// CA, Cert and Key are either the paths of the PEM files or the inline PEM
+// data starting with "-----BEGIN", and the files are reloaded when they change.
+type TLSConfig struct {
+	// Optional, the CA certificates to verify the servers.
+	//
+	// Default: the system CA certificates
+	CA string
+
+	// Optional, the client certificate and its private key for mTLS,
+	// which must be set together.
+	Cert string
+	Key  string
+
+	// Optional, the server name to verify the servers, which is also sent
+	// by SNI. If empty, use the host of the request.
+	ServerName string
+
+	// Optional, the minimum TLS version, such as tls.VersionTLS12.
+	//
+	// Default: tls.VersionTLS12
+	MinVersion uint16
+
+	// Optional, if true, do not verify the certificates of the servers,
+	// which should be used only for testing.
+	InsecureSkipVerify bool
+
+	// Optional, the interval to check whether the files change.
+	//
+	// Default: 10s
+	ReloadInterval time.Duration
+}
+
+func (c *TLSConfig) init() error {
+	if (c.Cert == "") != (c.Key == "") {
+		return errors.New("the client certificate and key must be set together")
+	}
+
+	switch c.MinVersion {
+	case 0:
+		c.MinVersion = tls.VersionTLS12
+	case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+	default:
+		return fmt.Errorf("invalid min tls version 0x%x", c.MinVersion)
+	}
+
+	if c.ReloadInterval <= 0 {
+		c.ReloadInterval = time.Second * 10
+	}
+
+	return nil
+}
+
+// load loads the PEM data of CA, Cert and Key.
+func (c *TLSConfig) load() (pems [3][]byte, err error) {
+	for i, s := range []string{c.CA, c.Cert, c.Key} {
+		if pems[i], err = loadPEM(s); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *TLSConfig) build(pems [3][]byte) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		MinVersion:         c.MinVersion,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if len(pems[0]) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pems[0]) {
+			return nil, errors.New("no valid CA certificates")
+		}
+	}
+
+	if len(pems[1]) > 0 {
+		cert, err := tls.X509KeyPair(pems[1], pems[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// hasFiles reports whether any certificate is loaded from the file.
+func (c *TLSConfig) hasFiles() bool {
+	for _, s := range []string{c.CA, c.Cert, c.Key} {
+		if s != "" && !isInlinePEM(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isInlinePEM(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN")
+}
+
+func loadPEM(s string) ([]byte, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case isInlinePEM(s):
+		return []byte(s), nil
+	default:
+		return os.ReadFile(s)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newClientCert(t *testing.T) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder})
+	return
+}
+
+func get(c *Client, url string) error {
+	resp, err := c.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestTLSClient(t *testing.T) {
+	certPEM, keyPEM := newClientCert(t)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	dir := t.TempDir()
+	capath := filepath.Join(dir, "ca.pem")
+	certpath := filepath.Join(dir, "cert.pem")
+	keypath := filepath.Join(dir, "key.pem")
+	for path, data := range map[string][]byte{capath: certPEM, certpath: certPEM, keypath: keyPEM} {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewClient("up", ClientConfig{TLS: &TLSConfig{CA: capath, Cert: certpath, Key: keypath}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The wrong CA certificate.
+	if err := get(c, server.URL); err == nil {
+		t.Error("expect a certificate error, but got nil")
+	}
+
+	if err := os.WriteFile(capath, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(c, server.URL); err != nil {
+		t.Error(err)
+	}
+
+	// Keep the last when failing to reload.
+	if err := os.WriteFile(keypath, []byte("invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reload(); err == nil {
+		t.Error("expect a reload error, but got nil")
+	}
+	if err := get(c, server.URL); err != nil {
+		t.Error(err)
+	}
+
+	// No client certificate.
+	c, err = NewClient("up", ClientConfig{TLS: &TLSConfig{CA: string(caPEM)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(c, server.URL); err == nil {
+		t.Error("expect a client certificate error, but got nil")
+	}
+
+	// The server name
+	for name, ok := range map[string]bool{"example.com": true, "unknown.com": false} {
+		c, err = NewClient("up", ClientConfig{TLS: &TLSConfig{
+			CA:         string(caPEM),
+			Cert:       string(certPEM),
+			Key:        string(keyPEM),
+			ServerName: name,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := get(c, server.URL); ok && err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !ok && err == nil {
+			t.Errorf("%s: expect a server name error, but got nil", name)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	for _, config := range []TLSConfig{
+		{Cert: "cert.pem"},
+		{MinVersion: 1},
+		{CA: "-----BEGIN CERTIFICATE-----\ninvalid\n-----END CERTIFICATE-----"},
+		{CA: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if _, err := NewClient("up", ClientConfig{TLS: &config}); err == nil {
+			t.Errorf("expect an error for %+v, but got nil", config)
+		}
+	}
+
+	c, err := NewClient("up", ClientConfig{TLS: &TLSConfig{InsecureSkipVerify: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := c.Config().TLS.MinVersion; v != tls.VersionTLS12 {
+		t.Errorf("expect the min version 0x%x, but got 0x%x", tls.VersionTLS12, v)
+	}
+
+	c.Start() // No files, and do nothing.
+	c.Stop()
+}
@@ -81,6 +81,11 @@ func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 func cloneRequest(orig *http.Request) *http.Request {
 	req := orig.Clone(orig.Context())
 	req.RequestURI = "" // Pretend to be a client request.
+
+	// The server fills the trailers into the original map
+	// after reading the body, so share it instead of the cloned one,
+	// which is required by the streaming request, such as gRPC.
+	req.Trailer = orig.Trailer
 	//req.URL.Host = "" // Dial to the backend http endpoint.
 	return req
 }
@@ -98,6 +103,12 @@ func newRequest(c *core.Context) (req *http.Request) {
 		req.URL.User = nil           // Clear the basic auth.
 		req.Close = false            // Enable the keepalive
 		req.Header.Del("Connection") // Enable the keepalive
+
+		// Keep the hop-by-hop headers to upgrade the protocol,
+		// such as WebSocket, and drop the other connection options.
+		if core.IsUpgrade(c.ClientRequest) {
+			req.Header.Set("Connection", "Upgrade")
+		}
 	}
 
 	return
@@ -0,0 +1,498 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orch
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/xgfone/go-apigateway/http/router"
+)
+
+// The kinds of the http route warnings.
+const (
+	// The route can never be matched, because all the requests matched by it
+	// are always matched by the other routes with the higher order.
+	HttpRouteShadowed = "shadowed"
+
+	// The route has the same priority as the other routes with the overlapping
+	// matchers, so the route is selected only by the lexical order of the ids.
+	HttpRouteAmbiguous = "ambiguous"
+)
+
+// HttpRouteWarning is a warning of the http route reported by AnalyzeHttpRoutes.
+type HttpRouteWarning struct {
+	Kind     string   `json:"kind" yaml:"kind"`
+	RouteId  string   `json:"routeId" yaml:"routeId"`
+	Priority int      `json:"priority" yaml:"priority"`
+	Others   []string `json:"others" yaml:"others"` // The ids of the routes shadowing or overlapping with it.
+	Message  string   `json:"message" yaml:"message"`
+}
+
+// String returns the description of the warning.
+func (w HttpRouteWarning) String() string {
+	return fmt.Sprintf("route '%s' is %s: %s", w.RouteId, w.Kind, w.Message)
+}
+
+// AnalyzeHttpRoutes analyzes the http routes by the hosts, methods, paths,
+// path prefixes, headers, queries and ips of their matchers, and returns
+// the warnings of the shadowed routes and the ambiguous overlapping routes.
+//
+// The analysis is conservative: a route is reported as shadowed only if
+// it is proved that all the requests matched by it are matched by the others,
+// and the matchers that cannot be analyzed, such as the regexp and expression,
+// are considered to overlap with any other matchers.
+//
+// The protected routes and the routes failing to be built are ignored.
+func AnalyzeHttpRoutes(routes []HttpRoute) (warnings []HttpRouteWarning) {
+	aroutes := make([]analyzedroute, 0, len(routes))
+	for _, r := range routes {
+		if r.Protect {
+			continue
+		}
+
+		m, err := r.Matchers.Build()
+		if err != nil {
+			continue
+		}
+
+		aroutes = append(aroutes, analyzedroute{
+			id:       r.Id,
+			priority: r.Priority + m.Priority(),
+			matchers: analyzematchers(r.Matchers),
+		})
+	}
+
+	// Sort the routes as the router does.
+	sort.SliceStable(aroutes, func(i, j int) bool {
+		if aroutes[i].priority != aroutes[j].priority {
+			return aroutes[i].priority > aroutes[j].priority
+		}
+		return aroutes[i].id <= aroutes[j].id
+	})
+
+	for j := range aroutes {
+		route := &aroutes[j]
+		if shadows := route.shadowedBy(aroutes[:j]); len(shadows) > 0 {
+			warnings = append(warnings, HttpRouteWarning{
+				Kind:     HttpRouteShadowed,
+				RouteId:  route.id,
+				Priority: route.priority,
+				Others:   shadows,
+				Message: fmt.Sprintf("all the requests are matched by the routes '%s' with the higher order",
+					strings.Join(shadows, "','")),
+			})
+			continue
+		}
+
+		var overlaps []string
+		for i := j - 1; i >= 0 && aroutes[i].priority == route.priority; i-- {
+			if route.overlaps(&aroutes[i]) {
+				overlaps = append(overlaps, aroutes[i].id)
+			}
+		}
+
+		if len(overlaps) > 0 {
+			slices.Reverse(overlaps)
+			warnings = append(warnings, HttpRouteWarning{
+				Kind:     HttpRouteAmbiguous,
+				RouteId:  route.id,
+				Priority: route.priority,
+				Others:   overlaps,
+				Message: fmt.Sprintf("the matchers overlap with those of the routes '%s' with the same priority %d",
+					strings.Join(overlaps, "','"), route.priority),
+			})
+		}
+	}
+
+	return
+}
+
+// ------------------------------------------------------------------------ //
+
+type analyzedroute struct {
+	id       string
+	priority int
+	matchers []analyzedmatcher // OR
+}
+
+// shadowedBy returns the ids of the routes that cover all the matchers
+// of the current route. Or, return nil.
+func (r *analyzedroute) shadowedBy(routes []analyzedroute) (ids []string) {
+	if len(r.matchers) == 0 {
+		return nil
+	}
+
+	for _, m := range r.matchers {
+		index := slices.IndexFunc(routes, func(route analyzedroute) bool {
+			return slices.ContainsFunc(route.matchers, func(other analyzedmatcher) bool {
+				return other.covers(m)
+			})
+		})
+		if index < 0 {
+			return nil
+		}
+
+		if id := routes[index].id; !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	return
+}
+
+func (r *analyzedroute) overlaps(other *analyzedroute) bool {
+	for _, m1 := range r.matchers {
+		for _, m2 := range other.matchers {
+			if m1.overlaps(m2) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type analyzedmatcher struct {
+	hosts   []string          // Lower case, empty means any host.
+	methods []string          // Upper case, empty means any method.
+	paths   []pathspec        // OR, nil means any path.
+	ips     [2][]netip.Prefix // For the client and server ips.
+
+	headers   map[string]string // Canonical key
+	queries   map[string]string
+	noheaders []string // Canonical key
+	noqueries []string
+
+	// The other conditions that cannot be analyzed.
+	others    HttpMatcher
+	hasothers bool
+}
+
+func analyzematchers(ms HttpMatchers) []analyzedmatcher {
+	ams := make([]analyzedmatcher, len(ms))
+	for i, m := range ms {
+		ams[i] = analyzematcher(m)
+	}
+	return ams
+}
+
+func analyzematcher(m HttpMatcher) (am analyzedmatcher) {
+	if !slices.Contains(m.Hosts, "*") {
+		for _, host := range m.Hosts {
+			am.hosts = append(am.hosts, strings.ToLower(host))
+		}
+	}
+
+	for _, method := range m.Methods {
+		am.methods = append(am.methods, strings.ToUpper(method))
+	}
+
+	am.paths = analyzepaths(m.Paths, m.PathPrefixes)
+	am.ips[0] = analyzeips(m.ClientIps)
+	am.ips[1] = analyzeips(m.ServerIps)
+
+	am.headers = make(map[string]string, len(m.Headers))
+	for key, value := range m.Headers {
+		am.headers[http.CanonicalHeaderKey(key)] = value
+	}
+	for _, key := range m.NoHeaders {
+		am.noheaders = append(am.noheaders, http.CanonicalHeaderKey(key))
+	}
+	am.queries = m.Queries
+	am.noqueries = m.NoQueries
+
+	am.others = HttpMatcher{
+		Cookies:       m.Cookies,
+		HeaderIn:      m.HeaderIn,
+		QueryIn:       m.QueryIn,
+		HeaderRegexps: m.HeaderRegexps,
+		QueryRegexps:  m.QueryRegexps,
+		CookieRegexps: m.CookieRegexps,
+		NoCookies:     m.NoCookies,
+		Not:           m.Not,
+		Expr:          m.Expr,
+	}
+	am.hasothers = !reflect.ValueOf(am.others).IsZero()
+	return
+}
+
+func analyzeips(ips []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(ips))
+	for _, ip := range ips {
+		if strings.IndexByte(ip, '/') < 0 {
+			if strings.IndexByte(ip, '.') < 0 {
+				ip += "/128"
+			} else {
+				ip += "/32"
+			}
+		}
+
+		if prefix, err := netip.ParsePrefix(ip); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return prefixes
+}
+
+// covers reports whether all the requests matched by other are matched by m.
+func (m analyzedmatcher) covers(other analyzedmatcher) bool {
+	if m.hasothers && !reflect.DeepEqual(m.others, other.others) {
+		return false
+	}
+
+	return coverall(m.hosts, other.hosts, hostCovers) &&
+		coverall(m.methods, other.methods, func(a, b string) bool { return a == b }) &&
+		coverall(m.paths, other.paths, pathspec.covers) &&
+		coverall(m.ips[0], other.ips[0], ipCovers) &&
+		coverall(m.ips[1], other.ips[1], ipCovers) &&
+		kvsCover(m.headers, other.headers) &&
+		kvsCover(m.queries, other.queries) &&
+		keysCover(m.noheaders, other.noheaders) &&
+		keysCover(m.noqueries, other.noqueries)
+}
+
+// overlaps reports whether a request may be matched by both m and other.
+func (m analyzedmatcher) overlaps(other analyzedmatcher) bool {
+	return overlapany(m.hosts, other.hosts, hostOverlaps) &&
+		overlapany(m.methods, other.methods, func(a, b string) bool { return a == b }) &&
+		overlapany(m.paths, other.paths, pathspec.overlaps) &&
+		overlapany(m.ips[0], other.ips[0], netip.Prefix.Overlaps) &&
+		overlapany(m.ips[1], other.ips[1], netip.Prefix.Overlaps) &&
+		kvsOverlap(m.headers, other.headers, m.noheaders, other.noheaders) &&
+		kvsOverlap(m.queries, other.queries, m.noqueries, other.noqueries)
+}
+
+// coverall reports whether each of bs is covered by any of as,
+// and the empty set means any.
+func coverall[T any](as, bs []T, covers func(a, b T) bool) bool {
+	if len(as) == 0 {
+		return true
+	} else if len(bs) == 0 {
+		return false
+	}
+
+	for _, b := range bs {
+		if !slices.ContainsFunc(as, func(a T) bool { return covers(a, b) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// overlapany reports whether any of as overlaps with any of bs,
+// and the empty set means any.
+func overlapany[T any](as, bs []T, overlaps func(a, b T) bool) bool {
+	if len(as) == 0 || len(bs) == 0 {
+		return true
+	}
+
+	for _, a := range as {
+		for _, b := range bs {
+			if overlaps(a, b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hostCovers(a, b string) bool {
+	switch {
+	case a == b:
+		return true
+	case a != "" && a[0] == '*':
+		return strings.HasSuffix(strings.TrimPrefix(b, "*"), a[1:])
+	default:
+		return false
+	}
+}
+
+func hostOverlaps(a, b string) bool {
+	return hostCovers(a, b) || hostCovers(b, a)
+}
+
+func ipCovers(a, b netip.Prefix) bool {
+	return a.Bits() <= b.Bits() && a.Contains(b.Addr())
+}
+
+// kvsCover reports whether the requests having all kvs2 have all kvs1,
+// and the empty value means that the key exists.
+func kvsCover(kvs1, kvs2 map[string]string) bool {
+	for key, value1 := range kvs1 {
+		value2, ok := kvs2[key]
+		if !ok || (value1 != "" && value1 != value2) {
+			return false
+		}
+	}
+	return true
+}
+
+// keysCover reports whether the requests having none of keys2
+// have none of keys1.
+func keysCover(keys1, keys2 []string) bool {
+	for _, key := range keys1 {
+		if !slices.Contains(keys2, key) {
+			return false
+		}
+	}
+	return true
+}
+
+func kvsOverlap(kvs1, kvs2 map[string]string, nokeys1, nokeys2 []string) bool {
+	for key, value1 := range kvs1 {
+		if slices.Contains(nokeys2, key) {
+			return false
+		}
+
+		// The key may have more than one values, but we only consider
+		// the common case that the key has only one value.
+		if value2, ok := kvs2[key]; ok && value1 != "" && value2 != "" && value1 != value2 {
+			return false
+		}
+	}
+
+	for key := range kvs2 {
+		if slices.Contains(nokeys1, key) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ------------------------------------------------------------------------ //
+
+type pathkind uint8
+
+const (
+	pathExact pathkind = iota
+	pathPrefix
+	pathTemplate
+)
+
+type pathspec struct {
+	kind     pathkind
+	path     string // For the template, it is the literal prefix split by "/".
+	template *router.PathTemplate
+}
+
+func analyzepaths(paths, _prefixes []string) (specs []pathspec) {
+	prefixes := make([]string, 0, len(_prefixes))
+	for _, prefix := range _prefixes {
+		if prefix = fixpath(prefix); prefix == "/" {
+			prefixes = nil // Any path
+			break
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	if len(paths) == 0 {
+		for _, prefix := range prefixes {
+			specs = append(specs, pathspec{kind: pathPrefix, path: prefix})
+		}
+		return
+	}
+
+	for _, path := range paths {
+		var spec pathspec
+		if router.IsPathTemplate(path) {
+			t, err := router.NewPathTemplate(path)
+			if err != nil {
+				continue
+			}
+			spec = pathspec{kind: pathTemplate, path: t.Prefix(), template: t}
+		} else {
+			spec = pathspec{kind: pathExact, path: fixpath(path)}
+		}
+
+		// The path must also have one of the prefixes.
+		if len(prefixes) == 0 || slices.ContainsFunc(prefixes, func(prefix string) bool {
+			return spec.overlaps(pathspec{kind: pathPrefix, path: prefix})
+		}) {
+			specs = append(specs, spec)
+		}
+	}
+
+	if specs == nil {
+		// No path can be matched, but we use an impossible path
+		// instead of nil, which means any path.
+		specs = []pathspec{{kind: pathExact, path: "\x00"}}
+	}
+
+	return
+}
+
+func fixpath(path string) string {
+	if path = strings.TrimRight(path, "/"); path == "" {
+		return "/"
+	}
+	return path
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	return prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func matchPathTemplate(t *router.PathTemplate, path string) bool {
+	return t.Match(&http.Request{URL: &url.URL{Path: path}})
+}
+
+// covers reports whether all the paths matched by b are matched by a.
+func (a pathspec) covers(b pathspec) bool {
+	switch a.kind {
+	case pathPrefix:
+		return hasPathPrefix(b.path, a.path)
+
+	case pathTemplate:
+		switch b.kind {
+		case pathExact:
+			return matchPathTemplate(a.template, b.path)
+		case pathTemplate:
+			return a.template.String() == b.template.String()
+		}
+
+	default: // pathExact
+		return b.kind == pathExact && a.path == b.path
+	}
+
+	return false
+}
+
+// overlaps reports whether a path may be matched by both a and b.
+func (a pathspec) overlaps(b pathspec) bool {
+	if a.kind == pathExact && b.kind == pathExact {
+		return a.path == b.path
+	}
+
+	if a.kind != pathExact {
+		a, b = b, a
+	}
+
+	if a.kind == pathExact {
+		if b.kind == pathTemplate {
+			return matchPathTemplate(b.template, a.path)
+		}
+		return hasPathPrefix(a.path, b.path)
+	}
+
+	// Both are the prefixes or templates.
+	return hasPathPrefix(a.path, b.path) || hasPathPrefix(b.path, a.path)
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orch
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeHttpRoutes(t *testing.T) {
+	route := func(id string, priority int, ms ...HttpMatcher) HttpRoute {
+		return HttpRoute{Id: id, Priority: priority, Matchers: ms}
+	}
+
+	routes := []HttpRoute{
+		// r2 is shadowed by r1 with the higher priority.
+		route("r1", 10000, HttpMatcher{PathPrefixes: []string{"/api"}}),
+		route("r2", 0, HttpMatcher{Methods: []string{"GET"}, Paths: []string{"/api/users"}}),
+
+		// r4 is shadowed by r3 with the same priority and the smaller id.
+		route("r3", 0, HttpMatcher{Hosts: []string{"*.example.com"}, Paths: []string{"/v1/{id}"}}),
+		route("r4", 0, HttpMatcher{Hosts: []string{"*.example.com"}, Paths: []string{"/v1/{id}"}}),
+
+		// r7 is ambiguous with r5, but r6 is disjoint with them by the host.
+		route("r5", 0, HttpMatcher{Hosts: []string{"a.com"}, Paths: []string{"/v2"}, Queries: map[string]string{"ver": ""}}),
+		route("r6", 0, HttpMatcher{Hosts: []string{"b.com"}, Paths: []string{"/v2"}, Queries: map[string]string{"env": ""}}),
+		route("r7", 0, HttpMatcher{Hosts: []string{"a.com"}, Paths: []string{"/v2"}, Queries: map[string]string{"env": ""}}),
+
+		// r9 is disjoint with r8 by the header.
+		route("r8", 0, HttpMatcher{Hosts: []string{"c.com"}, Paths: []string{"/v3"}, Headers: map[string]string{"X-Env": "test"}}),
+		route("r9", 0, HttpMatcher{Hosts: []string{"c.com"}, Paths: []string{"/v3"}, Headers: map[string]string{"x-env": "prod"}}),
+
+		// r11 is shadowed by r10 and r1 together.
+		route("r10", 100000, HttpMatcher{ClientIps: []string{"10.0.0.0/8"}}),
+		route("r11", 0,
+			HttpMatcher{Paths: []string{"/api/v1"}},
+			HttpMatcher{ClientIps: []string{"10.1.0.0/16"}, Paths: []string{"/v4"}},
+		),
+
+		// The routes are ignored.
+		{Id: "r12", Protect: true, Matchers: HttpMatchers{{Paths: []string{"/api"}}}},
+		route("r13", 0, HttpMatcher{ClientIps: []string{"abc"}}),
+	}
+
+	expects := []HttpRouteWarning{
+		{Kind: HttpRouteShadowed, RouteId: "r11", Others: []string{"r1", "r10"}},
+		{Kind: HttpRouteShadowed, RouteId: "r2", Others: []string{"r1"}},
+		{Kind: HttpRouteShadowed, RouteId: "r4", Others: []string{"r3"}},
+		{Kind: HttpRouteAmbiguous, RouteId: "r7", Others: []string{"r5"}},
+	}
+
+	warnings := AnalyzeHttpRoutes(routes)
+	slices.SortFunc(warnings, func(a, b HttpRouteWarning) int {
+		if a.Kind != b.Kind {
+			return -strings.Compare(a.Kind, b.Kind)
+		}
+		return strings.Compare(a.RouteId, b.RouteId)
+	})
+
+	if len(warnings) != len(expects) {
+		t.Fatalf("expect %d warnings, but got %d: %+v", len(expects), len(warnings), warnings)
+	}
+
+	for i, expect := range expects {
+		w := warnings[i]
+		if w.Kind != expect.Kind || w.RouteId != expect.RouteId || !slices.Equal(w.Others, expect.Others) {
+			t.Errorf("%d: expect %s '%s' by %v, but got %s '%s' by %v", i,
+				expect.Kind, expect.RouteId, expect.Others, w.Kind, w.RouteId, w.Others)
+		} else if w.Message == "" {
+			t.Errorf("%d: expect a message, but got empty", i)
+		}
+	}
+}
+
+func TestPathSpec(t *testing.T) {
+	specs := func(paths, prefixes []string) []pathspec { return analyzepaths(paths, prefixes) }
+
+	if s := specs(nil, []string{"/"}); s != nil {
+		t.Errorf("expect any path, but got %+v", s)
+	}
+
+	if s := specs([]string{"/a", "/b/c"}, []string{"/b/"}); len(s) != 1 || s[0].path != "/b/c" {
+		t.Errorf("expect the path '/b/c', but got %+v", s)
+	}
+
+	tests := []struct {
+		a, b     pathspec
+		covers   bool
+		overlaps bool
+	}{
+		{specs(nil, []string{"/a"})[0], specs([]string{"/a/b"}, nil)[0], true, true},
+		{specs(nil, []string{"/a"})[0], specs([]string{"/ab"}, nil)[0], false, false},
+		{specs(nil, []string{"/a"})[0], specs(nil, []string{"/a/b"})[0], true, true},
+		{specs(nil, []string{"/a/b"})[0], specs(nil, []string{"/a"})[0], false, true},
+		{specs([]string{"/u/{id}"}, nil)[0], specs([]string{"/u/1"}, nil)[0], true, true},
+		{specs([]string{"/u/{id}"}, nil)[0], specs([]string{"/u/1/2"}, nil)[0], false, false},
+		{specs([]string{"/u/{id}"}, nil)[0], specs(nil, []string{"/u"})[0], false, true},
+		{specs([]string{"/a"}, nil)[0], specs([]string{"/a/"}, nil)[0], true, true},
+	}
+
+	for i, test := range tests {
+		if covers := test.a.covers(test.b); covers != test.covers {
+			t.Errorf("%d: expect covers '%v', but got '%v'", i, test.covers, covers)
+		}
+		if overlaps := test.a.overlaps(test.b); overlaps != test.overlaps {
+			t.Errorf("%d: expect overlaps '%v', but got '%v'", i, test.overlaps, overlaps)
+		}
+	}
+}
@@ -16,6 +16,8 @@ package orch
 import (
 	"errors"
 
+	"github.com/xgfone/go-apigateway/http/core"
+	"github.com/xgfone/go-apigateway/http/router"
 	matcher "github.com/xgfone/go-http-matcher"
 )
 
@@ -23,27 +25,122 @@ var noroutematches = errors.New("matcher exists, but has no any matching items")
 
 // Build builds the matcher.
 func (m HttpMatcher) Build() (matcher.Matcher, error) {
-	ms, err := m.build()
+	_m, _, err := m.buildWithTemplates()
+	return _m, err
+}
+
+func (m HttpMatcher) buildWithTemplates() (matcher.Matcher, []*router.PathTemplate, error) {
+	ms, templates, err := m.build()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	} else if len(ms) == 0 {
-		return nil, noroutematches
+		return nil, nil, noroutematches
 	}
-	return matcher.And(ms...), nil
+	return matcher.And(ms...), templates, nil
 }
 
 // Build builds a set of matchers to a route matcher.
 func (ms HttpMatchers) Build() (m matcher.Matcher, err error) {
+	m, _, err = ms.build()
+	return
+}
+
+func (ms HttpMatchers) build() (m matcher.Matcher, captures []pathcapture, err error) {
 	_ms := make([]matcher.Matcher, len(ms))
 	for i, _m := range ms {
-		if _ms[i], err = _m.Build(); err != nil {
+		var templates []*router.PathTemplate
+		if _ms[i], templates, err = _m.buildWithTemplates(); err != nil {
+			return
+		}
+
+		if len(templates) > 0 {
+			captures = append(captures, pathcapture{matcher: _ms[i], templates: templates})
+		}
+	}
+
+	// matcher.Or sorts the matchers in place,
+	// so we must build it after collecting the captures.
+	return matcher.Or(_ms...), captures, nil
+}
+
+// IndexRule returns the index rule of the matcher used by the router.
+func (m HttpMatcher) IndexRule() router.IndexRule {
+	rule := router.IndexRule{Hosts: m.Hosts}
+	if len(m.Paths) == 0 {
+		// The path must be one of Paths if Paths is not empty,
+		// so we only need to index the path prefixes without Paths.
+		rule.PathPrefixes = m.PathPrefixes
+		return rule
+	}
+
+	for _, path := range m.Paths {
+		if !router.IsPathTemplate(path) {
+			rule.Paths = append(rule.Paths, path)
+		} else if t, err := router.NewPathTemplate(path); err == nil {
+			rule.PathPrefixes = append(rule.PathPrefixes, t.Prefix())
+		} else {
+			// It is never used since the matcher fails to be built.
+			rule.PathPrefixes = append(rule.PathPrefixes, "/")
+		}
+	}
+	return rule
+}
+
+// IndexRules returns the index rules of the matchers used by the router.
+func (ms HttpMatchers) IndexRules() []router.IndexRule {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	rules := make([]router.IndexRule, len(ms))
+	for i, m := range ms {
+		rules[i] = m.IndexRule()
+	}
+	return rules
+}
+
+type indexmatcher struct {
+	matcher.Matcher
+	rules    []router.IndexRule
+	captures []pathcapture
+}
+
+func (m indexmatcher) IndexRules() []router.IndexRule { return m.rules }
+
+func (m indexmatcher) Capture(c *core.Context) {
+	for _, capture := range m.captures {
+		if capture.Capture(c) {
 			return
 		}
 	}
-	return matcher.Or(_ms...), nil
 }
 
-func (m *HttpMatcher) build() ([]matcher.Matcher, error) {
+// pathcapture is used to capture the path parameters
+// by the path templates of a matched HttpMatcher.
+type pathcapture struct {
+	matcher   matcher.Matcher
+	templates []*router.PathTemplate
+}
+
+func (p pathcapture) Capture(c *core.Context) bool {
+	if !p.matcher.Match(c.ClientRequest) {
+		return false
+	}
+
+	for _, t := range p.templates {
+		if t.Capture(c.ClientRequest, c.Kvs) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *HttpMatcher) build() ([]matcher.Matcher, []*router.PathTemplate, error) {
+	pathMatcher, templates, err := buildPathMatcher(m.Paths)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	ms := make([]matcher.Matcher, 0, 4)
 
 	ms = _appendmatcher(ms, matcher.Host(m.Hosts...))
@@ -51,21 +148,55 @@ func (m *HttpMatcher) build() ([]matcher.Matcher, error) {
 	ms = _appendmatcher(ms, matcher.Headerm(m.Headers))
 	ms = _appendmatcher(ms, matcher.Querym(m.Queries))
 	ms = _appendmatcher(ms, matcher.PathPrefix(m.PathPrefixes...))
-	ms = _appendmatcher(ms, matcher.Path(m.Paths...))
+	ms = _appendmatcher(ms, pathMatcher)
 
 	clientIPMatcher, err := matcher.ClientIP(m.ClientIps...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	ms = _appendmatcher(ms, clientIPMatcher)
 
 	serverIPMatcher, err := matcher.ServerIP(m.ServerIps...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	ms = _appendmatcher(ms, serverIPMatcher)
 
-	return ms, nil
+	ms, err = m.buildkvs(ms)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ms, templates, nil
+}
+
+// buildPathMatcher builds the matcher of the exact paths and path templates.
+func buildPathMatcher(paths []string) (matcher.Matcher, []*router.PathTemplate, error) {
+	var exacts []string
+	var templates []*router.PathTemplate
+	for _, path := range paths {
+		if !router.IsPathTemplate(path) {
+			exacts = append(exacts, path)
+			continue
+		}
+
+		t, err := router.NewPathTemplate(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		templates = append(templates, t)
+	}
+
+	if len(templates) == 0 {
+		return matcher.Path(exacts...), nil, nil
+	}
+
+	ms := make([]matcher.Matcher, 0, len(templates)+1)
+	ms = _appendmatcher(ms, matcher.Path(exacts...))
+	for _, t := range templates {
+		ms = append(ms, t)
+	}
+	return matcher.Or(ms...), templates, nil
 }
 
 func _appendmatcher(ms []matcher.Matcher, m matcher.Matcher) []matcher.Matcher {
@@ -0,0 +1,526 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orch
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	matcher "github.com/xgfone/go-http-matcher"
+)
+
+// ExprError is the error to compile the matcher expression,
+// which contains the position of the error.
+type ExprError struct {
+	Line   int // Starting at 1
+	Column int // Starting at 1, which is counted by the unicode characters.
+	Err    string
+}
+
+// Error implements the interface error.
+func (e ExprError) Error() string {
+	return fmt.Sprintf("expr:%d:%d: %s", e.Line, e.Column, e.Err)
+}
+
+// CompileMatcherExpr compiles the matcher expression to a route matcher.
+//
+// The grammar of the expression is as follow:
+//
+//	Expr    = And { "||" And }
+//	And     = Unary { "&&" Unary }
+//	Unary   = "!" Unary | Primary
+//	Primary = "(" Expr ")" | "true" | "false" | Call [ CmpOp String ]
+//	Call    = Ident "(" [ String { "," String } ] ")"
+//	CmpOp   = "==" | "!=" | "=~" | "!~"
+//	String  = `"` Go interpreted string `"` | "`" Go raw string "`"
+//
+// The supported functions are as follow:
+//
+//	Host(hosts...)           // Exact(www.example.com) or Wildcard(*.example.com)
+//	Method(methods...)
+//	Path(paths...)
+//	PathPrefix(prefixes...)
+//	ClientIP(cidrs...)
+//	ServerIP(cidrs...)
+//	Header(key[, value])     // Match the existed header if no value.
+//	Query(key[, value])      // Match the existed query if no value.
+//	Cookie(name[, value])    // Match the existed cookie if no value.
+//	HeaderIn(key, values...)
+//	QueryIn(key, values...)
+//	HeaderRegexp(key, regexp)
+//	QueryRegexp(key, regexp)
+//	CookieRegexp(name, regexp)
+//
+// The functions Header, Query and Cookie with only one argument
+// support the comparison operators, for example,
+//
+//	Header("X-Beta") == "1"     // The same as Header("X-Beta", "1")
+//	Header("X-Beta") != "1"     // The same as !Header("X-Beta", "1")
+//	Query("v") =~ "^[0-9]+$"    // The same as QueryRegexp("v", "^[0-9]+$")
+//	Cookie("uid") !~ "^test"    // The same as !CookieRegexp("uid", "^test")
+//
+// For example,
+//
+//	Host("api.example.com") && (PathPrefix("/v2") || Header("X-Beta") == "1") && !ClientIP("10.0.0.0/8")
+func CompileMatcherExpr(expr string) (matcher.Matcher, error) {
+	p := &exprparser{src: expr, line: 1, column: 1}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind == tokenEOF {
+		return nil, p.errorf(p.tok.pos, "empty expression")
+	}
+
+	m, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokenEOF {
+		return nil, p.errorf(p.tok.pos, "unexpected %s", p.tok)
+	}
+	return m, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+type tokenkind uint8
+
+const (
+	tokenEOF tokenkind = iota
+	tokenIdent
+	tokenString
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenEq
+	tokenNe
+	tokenRe
+	tokenNre
+)
+
+var tokenops = map[string]tokenkind{
+	"&&": tokenAnd,
+	"||": tokenOr,
+	"==": tokenEq,
+	"!=": tokenNe,
+	"=~": tokenRe,
+	"!~": tokenNre,
+}
+
+type exprpos struct{ line, column int }
+
+type exprtoken struct {
+	kind  tokenkind
+	text  string // For the original text of the token
+	value string // For the unquoted string
+	pos   exprpos
+}
+
+func (t exprtoken) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+type exprparser struct {
+	src    string
+	offset int
+	line   int
+	column int
+	tok    exprtoken
+}
+
+func (p *exprparser) errorf(pos exprpos, format string, args ...any) error {
+	return ExprError{Line: pos.line, Column: pos.column, Err: fmt.Sprintf(format, args...)}
+}
+
+func (p *exprparser) peekrune() (r rune, size int) {
+	if p.offset >= len(p.src) {
+		return -1, 0
+	}
+	return utf8.DecodeRuneInString(p.src[p.offset:])
+}
+
+func (p *exprparser) advance(size int) {
+	for end := p.offset + size; p.offset < end; {
+		r, n := utf8.DecodeRuneInString(p.src[p.offset:])
+		p.offset += n
+		if r == '\n' {
+			p.line++
+			p.column = 1
+		} else {
+			p.column++
+		}
+	}
+}
+
+// next scans the next token into p.tok.
+func (p *exprparser) next() error {
+	for {
+		r, size := p.peekrune()
+		if r < 0 || !unicode.IsSpace(r) {
+			break
+		}
+		p.advance(size)
+	}
+
+	pos := exprpos{line: p.line, column: p.column}
+	start := p.offset
+
+	r, size := p.peekrune()
+	switch {
+	case r < 0:
+		p.tok = exprtoken{kind: tokenEOF, pos: pos}
+
+	case r == '(':
+		p.advance(size)
+		p.tok = exprtoken{kind: tokenLParen, text: "(", pos: pos}
+
+	case r == ')':
+		p.advance(size)
+		p.tok = exprtoken{kind: tokenRParen, text: ")", pos: pos}
+
+	case r == ',':
+		p.advance(size)
+		p.tok = exprtoken{kind: tokenComma, text: ",", pos: pos}
+
+	case r == '"' || r == '`':
+		text, err := p.scanstring(r, pos)
+		if err != nil {
+			return err
+		}
+
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return p.errorf(pos, "invalid string %s: %v", text, err)
+		}
+		p.tok = exprtoken{kind: tokenString, text: text, value: value, pos: pos}
+
+	case r == '_' || unicode.IsLetter(r):
+		for r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			p.advance(size)
+			r, size = p.peekrune()
+		}
+		p.tok = exprtoken{kind: tokenIdent, text: p.src[start:p.offset], pos: pos}
+
+	default:
+		if end := start + 2; end <= len(p.src) {
+			if kind, ok := tokenops[p.src[start:end]]; ok {
+				p.advance(2)
+				p.tok = exprtoken{kind: kind, text: p.src[start:end], pos: pos}
+				return nil
+			}
+		}
+
+		if r == '!' {
+			p.advance(size)
+			p.tok = exprtoken{kind: tokenNot, text: "!", pos: pos}
+			return nil
+		}
+
+		return p.errorf(pos, "unexpected character %q", r)
+	}
+
+	return nil
+}
+
+func (p *exprparser) scanstring(quote rune, pos exprpos) (string, error) {
+	start := p.offset
+	p.advance(1)
+	for {
+		r, size := p.peekrune()
+		switch {
+		case r < 0, r == '\n' && quote == '"':
+			return "", p.errorf(pos, "unterminated string")
+
+		case r == '\\' && quote == '"':
+			p.advance(size)
+			if _, size = p.peekrune(); size > 0 {
+				p.advance(size)
+			}
+
+		case r == quote:
+			p.advance(size)
+			return p.src[start:p.offset], nil
+
+		default:
+			p.advance(size)
+		}
+	}
+}
+
+func (p *exprparser) expect(kind tokenkind, desc string) (tok exprtoken, err error) {
+	if p.tok.kind != kind {
+		return tok, p.errorf(p.tok.pos, "expect %s, but got %s", desc, p.tok)
+	}
+	tok = p.tok
+	err = p.next()
+	return
+}
+
+func (p *exprparser) parseOr() (matcher.Matcher, error) {
+	m, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	ms := []matcher.Matcher{m}
+	for p.tok.kind == tokenOr {
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		if m, err = p.parseAnd(); err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return matcher.Or(ms...), nil
+}
+
+func (p *exprparser) parseAnd() (matcher.Matcher, error) {
+	m, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	ms := []matcher.Matcher{m}
+	for p.tok.kind == tokenAnd {
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		if m, err = p.parseUnary(); err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return matcher.And(ms...), nil
+}
+
+func (p *exprparser) parseUnary() (matcher.Matcher, error) {
+	if p.tok.kind != tokenNot {
+		return p.parsePrimary()
+	}
+
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	m, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return newNotMatcher(m), nil
+}
+
+func (p *exprparser) parsePrimary() (matcher.Matcher, error) {
+	switch tok := p.tok; tok.kind {
+	case tokenLParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = p.expect(tokenRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return m, nil
+
+	case tokenIdent:
+		switch tok.text {
+		case "true":
+			return matcher.New(0, "true", matcher.AlwaysTrue), p.next()
+		case "false":
+			return matcher.New(0, "false", matcher.AlwaysFalse), p.next()
+		}
+		return p.parseCall()
+
+	default:
+		return nil, p.errorf(tok.pos, "expect a function call or '(', but got %s", tok)
+	}
+}
+
+func (p *exprparser) parseCall() (matcher.Matcher, error) {
+	name := p.tok
+	fn, ok := exprfuncs[name.text]
+	if !ok {
+		return nil, p.errorf(name.pos, "unknown function '%s'", name.text)
+	}
+
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokenLParen, "'('"); err != nil {
+		return nil, err
+	}
+
+	var args []string
+	for p.tok.kind != tokenRParen {
+		if len(args) > 0 {
+			if _, err := p.expect(tokenComma, "',' or ')'"); err != nil {
+				return nil, err
+			}
+		}
+
+		arg, err := p.expect(tokenString, "a string argument")
+		if err != nil {
+			return nil, err
+		} else if fn.nonempty && strings.TrimSpace(arg.value) == "" {
+			return nil, p.errorf(arg.pos, "the argument of the function '%s' must not be empty", name.text)
+		}
+		args = append(args, arg.value)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(args) < fn.minargs:
+		return nil, p.errorf(name.pos, "function '%s' expects at least %d arguments, but got %d",
+			name.text, fn.minargs, len(args))
+
+	case fn.maxargs > 0 && len(args) > fn.maxargs:
+		return nil, p.errorf(name.pos, "function '%s' expects at most %d arguments, but got %d",
+			name.text, fn.maxargs, len(args))
+	}
+
+	switch p.tok.kind {
+	case tokenEq, tokenNe, tokenRe, tokenNre:
+		return p.parseCompare(name, fn, args)
+	}
+
+	m, err := fn.build(args)
+	if err != nil {
+		return nil, p.errorf(name.pos, "%s: %v", name.text, err)
+	}
+	return m, nil
+}
+
+func (p *exprparser) parseCompare(name exprtoken, fn exprfunc, args []string) (matcher.Matcher, error) {
+	op := p.tok
+	if fn.kv == nil || len(args) != 1 {
+		return nil, p.errorf(op.pos, "function '%s' with %d arguments does not support the operator '%s'",
+			name.text, len(args), op.text)
+	}
+
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	value, err := p.expect(tokenString, "a string")
+	if err != nil {
+		return nil, err
+	} else if value.value == "" {
+		return nil, p.errorf(value.pos, "the value of the operator '%s' must not be empty", op.text)
+	}
+
+	var m matcher.Matcher
+	switch op.kind {
+	case tokenEq, tokenNe:
+		m, err = fn.build([]string{args[0], value.value})
+	default:
+		m, err = newKvRegexpMatcher(name.text+"Regexp", fn.kv.reprio, fn.kv.fixkey(args[0]), value.value, fn.kv.get)
+	}
+	if err != nil {
+		return nil, p.errorf(value.pos, "%v", err)
+	}
+
+	if op.kind == tokenNe || op.kind == tokenNre {
+		m = newNotMatcher(m)
+	}
+	return m, nil
+}
+
+// ------------------------------------------------------------------------ //
+
+type exprkv struct {
+	reprio int
+	fixkey func(string) string
+	get    kvgetter
+}
+
+type exprfunc struct {
+	minargs  int
+	maxargs  int     // 0 means no limit.
+	nonempty bool    // Whether all the arguments must not be empty.
+	kv       *exprkv // Support the comparison operators if not nil.
+	build    func(args []string) (matcher.Matcher, error)
+}
+
+var (
+	exprHeaderKv = &exprkv{reprio: PriorityHeaderRegexp, fixkey: http.CanonicalHeaderKey, get: getHeaderValues}
+	exprQueryKv  = &exprkv{reprio: PriorityQueryRegexp, fixkey: func(s string) string { return s }, get: getQueryValues}
+	exprCookieKv = &exprkv{reprio: PriorityCookieRegexp, fixkey: func(s string) string { return s }, get: getCookieValues}
+)
+
+var exprfuncs = map[string]exprfunc{
+	"Host":       {minargs: 1, nonempty: true, build: nomatchererr(matcher.Host)},
+	"Method":     {minargs: 1, nonempty: true, build: nomatchererr(matcher.Method)},
+	"Path":       {minargs: 1, nonempty: true, build: nomatchererr(matcher.Path)},
+	"PathPrefix": {minargs: 1, nonempty: true, build: nomatchererr(matcher.PathPrefix)},
+	"ClientIP":   {minargs: 1, build: func(args []string) (matcher.Matcher, error) { return matcher.ClientIP(args...) }},
+	"ServerIP":   {minargs: 1, build: func(args []string) (matcher.Matcher, error) { return matcher.ServerIP(args...) }},
+
+	"Header": {minargs: 1, maxargs: 2, kv: exprHeaderKv, build: kvmatcher(matcher.Header)},
+	"Query":  {minargs: 1, maxargs: 2, kv: exprQueryKv, build: kvmatcher(matcher.Query)},
+	"Cookie": {minargs: 1, maxargs: 2, kv: exprCookieKv, build: kvmatcher(newCookieMatcher)},
+
+	"HeaderIn": {minargs: 2, build: inmatcher("HeaderIn", PriorityHeaderIn, exprHeaderKv)},
+	"QueryIn":  {minargs: 2, build: inmatcher("QueryIn", PriorityQueryIn, exprQueryKv)},
+
+	"HeaderRegexp": {minargs: 2, maxargs: 2, build: rematcher("HeaderRegexp", exprHeaderKv)},
+	"QueryRegexp":  {minargs: 2, maxargs: 2, build: rematcher("QueryRegexp", exprQueryKv)},
+	"CookieRegexp": {minargs: 2, maxargs: 2, build: rematcher("CookieRegexp", exprCookieKv)},
+}
+
+func nomatchererr(f func(...string) matcher.Matcher) func([]string) (matcher.Matcher, error) {
+	return func(args []string) (matcher.Matcher, error) { return f(args...), nil }
+}
+
+func kvmatcher(f func(key, value string) matcher.Matcher) func([]string) (matcher.Matcher, error) {
+	return func(args []string) (matcher.Matcher, error) {
+		args = append(slices.Clone(args), "")
+		if strings.TrimSpace(args[0]) == "" {
+			return nil, fmt.Errorf("the key must not be empty")
+		}
+		return f(args[0], args[1]), nil
+	}
+}
+
+func inmatcher(name string, prio int, kv *exprkv) func([]string) (matcher.Matcher, error) {
+	return func(args []string) (matcher.Matcher, error) {
+		return newKvInMatcher(name, prio, kv.fixkey(args[0]), args[1:], kv.get), nil
+	}
+}
+
+func rematcher(name string, kv *exprkv) func([]string) (matcher.Matcher, error) {
+	return func(args []string) (matcher.Matcher, error) {
+		return newKvRegexpMatcher(name, kv.reprio, kv.fixkey(args[0]), args[1], kv.get)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orch
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newExprTestRequest(host, path, clientip string, header http.Header) *http.Request {
+	if header == nil {
+		header = http.Header{}
+	}
+
+	u, err := url.Parse(path)
+	if err != nil {
+		panic(err)
+	}
+
+	return &http.Request{
+		Method:     "GET",
+		Host:       host,
+		URL:        u,
+		Header:     header,
+		RemoteAddr: net.JoinHostPort(clientip, "12345"),
+	}
+}
+
+func TestCompileMatcherExpr(t *testing.T) {
+	const expr = `Host("api.x.com") && (PathPrefix("/v2") || Header("X-Beta") == "1") && !ClientIP("10.0.0.0/8")`
+
+	m, err := CompileMatcherExpr(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		req    *http.Request
+		expect bool
+	}{
+		{newExprTestRequest("api.x.com", "/v2/users", "1.2.3.4", nil), true},
+		{newExprTestRequest("api.x.com", "/v1/users", "1.2.3.4", http.Header{"X-Beta": {"1"}}), true},
+		{newExprTestRequest("api.x.com", "/v1/users", "1.2.3.4", nil), false},
+		{newExprTestRequest("api.x.com", "/v2/users", "10.1.2.3", nil), false},
+		{newExprTestRequest("www.x.com", "/v2/users", "1.2.3.4", nil), false},
+	}
+
+	for i, test := range tests {
+		if matched := m.Match(test.req); matched != test.expect {
+			t.Errorf("%d: expect '%v', but got '%v'", i, test.expect, matched)
+		}
+	}
+}
+
+func TestCompileMatcherExprFunctions(t *testing.T) {
+	req := newExprTestRequest("www.example.com", "/path/to?a=1&b=xyz", "1.2.3.4", http.Header{
+		"X-Env":  {"test"},
+		"Cookie": {"uid=123; ver=v2.1"},
+	})
+
+	exprs := map[string]bool{
+		`Host("*.example.com")`:                    true,
+		`Method("GET", "POST")`:                    true,
+		`Path("/path/to")`:                         true,
+		`PathPrefix("/path")`:                      true,
+		`ClientIP("1.2.3.0/24")`:                   true,
+		`Header("x-env")`:                          true,
+		`Header("X-Env", "prod")`:                  false,
+		`Header("X-Env") != "prod"`:                true,
+		`Header("X-Env") =~ "^te"`:                 true,
+		`Header("X-Env") !~ "^te"`:                 false,
+		`Query("a") == "1"`:                        true,
+		`Query("b") =~ "^[a-z]+$"`:                 true,
+		`Cookie("uid") == "123"`:                   true,
+		`Cookie("sid")`:                            false,
+		`HeaderIn("X-Env", "dev", "test")`:         true,
+		`QueryIn("a", "2", "3")`:                   false,
+		`HeaderRegexp("X-Env", "es")`:              true,
+		`QueryRegexp("a", "^[0-9]$")`:              true,
+		"CookieRegexp(\"ver\", `^v2\\.`)":          true,
+		`true && !false`:                           true,
+		`!!Path("/path/to")`:                       true,
+		"Path(\"/\") ||\n\tPath(\"/path/to\")":     true,
+		`(Path("/a") || Path("/b")) && true`:       false,
+		`Header("X-Env") == "test" && !Query("c")`: true,
+	}
+
+	for expr, expect := range exprs {
+		m, err := CompileMatcherExpr(expr)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+		} else if matched := m.Match(req); matched != expect {
+			t.Errorf("%s: expect '%v', but got '%v'", expr, expect, matched)
+		}
+	}
+}
+
+func TestCompileMatcherExprError(t *testing.T) {
+	tests := []struct {
+		expr   string
+		line   int
+		column int
+	}{
+		{``, 1, 1},
+		{`Host("a.com") &&`, 1, 17},
+		{`Host("a.com") & Path("/")`, 1, 15},
+		{`Host("a.com"`, 1, 13},
+		{`Host(a.com)`, 1, 6},
+		{`Host("a.com") Path("/")`, 1, 15},
+		{`Unknown("a")`, 1, 1},
+		{`Host()`, 1, 1},
+		{`Host("")`, 1, 6},
+		{`Host("a.com", " ")`, 1, 15},
+		{`Method("GET") && PathPrefix("")`, 1, 29},
+		{`Header("a", "b", "c")`, 1, 1},
+		{`Host("a.com") == "b"`, 1, 15},
+		{`Header("X") == ""`, 1, 16},
+		{`Header("X") =~ "("`, 1, 16},
+		{"Host(\"a.com\") &&\n  ClientIP(\"abc\")", 2, 3},
+		{"Host(\"a.com\") &&\n  Path(\"/\"", 2, 11},
+		{"Path(\"/\") && (\n\tHost(\"中文\") || Path(\"unclosed)", 2, 21},
+	}
+
+	for _, test := range tests {
+		_, err := CompileMatcherExpr(test.expr)
+
+		var e ExprError
+		if !errors.As(err, &e) {
+			t.Errorf("%q: expect an ExprError, but got %v", test.expr, err)
+		} else if e.Line != test.line || e.Column != test.column {
+			t.Errorf("%q: expect the position %d:%d, but got %d:%d (%s)",
+				test.expr, test.line, test.column, e.Line, e.Column, e.Err)
+		}
+	}
+}
+
+func TestHttpMatcherExpr(t *testing.T) {
+	m, err := HttpMatcher{
+		Methods: []string{"GET"},
+		Expr:    `Header("X-Beta") == "1" || Query("beta") == "1"`,
+	}.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req := newExprTestRequest("", "/?beta=1", "1.2.3.4", nil); !m.Match(req) {
+		t.Errorf("expect matched, but got not: %s", m.String())
+	}
+	if req := newExprTestRequest("", "/", "1.2.3.4", nil); m.Match(req) {
+		t.Errorf("expect not matched, but got matched: %s", m.String())
+	}
+
+	if _, err := (HttpMatcher{Expr: `Path("/"`}).Build(); err == nil {
+		t.Error("expect an error, but got nil")
+	}
+}
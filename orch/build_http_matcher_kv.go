@@ -0,0 +1,232 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orch
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	matcher "github.com/xgfone/go-http-matcher"
+)
+
+// The priorities of the extended matchers, each of which is contributed
+// per key. The less specific the matcher is, the lower the priority is.
+const (
+	PriorityCookie       = matcher.PriorityHeader     // Same as the exact header
+	PriorityHeaderIn     = matcher.PriorityHeader - 1 // Lower than the exact header
+	PriorityHeaderRegexp = matcher.PriorityHeader - 2 // Lower than HeaderIn
+	PriorityCookieRegexp = PriorityHeaderRegexp
+	PriorityQueryIn      = matcher.PriorityQuery
+	PriorityQueryRegexp  = matcher.PriorityQuery
+	PriorityAbsence      = 1
+	PriorityNot          = 1
+)
+
+type kvgetter func(r *http.Request, key string) (values []string, ok bool)
+
+func getHeaderValues(r *http.Request, key string) ([]string, bool) {
+	values, ok := r.Header[key]
+	return values, ok
+}
+
+func getQueryValues(r *http.Request, key string) ([]string, bool) {
+	values, ok := r.URL.Query()[key]
+	return values, ok
+}
+
+func getCookieValues(r *http.Request, key string) ([]string, bool) {
+	if cookie, err := r.Cookie(key); err == nil {
+		return []string{cookie.Value}, true
+	}
+	return nil, false
+}
+
+func sortedkeys[M ~map[string]V, V any](m M) []string {
+	keys := slices.Collect(maps.Keys(m))
+	slices.Sort(keys)
+	return keys
+}
+
+// buildKvInMatchers returns the matchers, each of which checks whether
+// one of the values of the key is equal to any of the given values.
+func buildKvInMatchers(ms []matcher.Matcher, name string, prio int,
+	kvs map[string][]string, fixkey func(string) string, get kvgetter) []matcher.Matcher {
+	for _, key := range sortedkeys(kvs) {
+		expects := kvs[key]
+		if fixkey != nil {
+			key = fixkey(key)
+		}
+		ms = append(ms, newKvInMatcher(name, prio, key, expects, get))
+	}
+	return ms
+}
+
+func newKvInMatcher(name string, prio int, key string, expects []string, get kvgetter) matcher.Matcher {
+	desc := fmt.Sprintf("%s(`%s`,`%s`)", name, key, strings.Join(expects, "`,`"))
+	return matcher.New(prio, desc, func(r *http.Request) bool {
+		values, _ := get(r, key)
+		for _, value := range values {
+			if slices.Contains(expects, value) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// buildKvRegexpMatchers returns the matchers, each of which checks whether
+// one of the values of the key matches the regular expression.
+func buildKvRegexpMatchers(ms []matcher.Matcher, name string, prio int,
+	kvs map[string]string, fixkey func(string) string, get kvgetter) ([]matcher.Matcher, error) {
+	for _, key := range sortedkeys(kvs) {
+		expr := kvs[key]
+		if fixkey != nil {
+			key = fixkey(key)
+		}
+
+		m, err := newKvRegexpMatcher(name, prio, key, expr, get)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func newKvRegexpMatcher(name string, prio int, key, expr string, get kvgetter) (matcher.Matcher, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%s '%s' has an invalid regexp: %w", name, key, err)
+	}
+
+	desc := fmt.Sprintf("%s(`%s`,`%s`)", name, key, re.String())
+	return matcher.New(prio, desc, func(r *http.Request) bool {
+		values, _ := get(r, key)
+		return slices.ContainsFunc(values, re.MatchString)
+	}), nil
+}
+
+// buildAbsenceMatchers returns the matchers, each of which checks
+// whether the request does not have the key.
+func buildAbsenceMatchers(ms []matcher.Matcher, name string,
+	keys []string, fixkey func(string) string, get kvgetter) []matcher.Matcher {
+	for _, key := range keys {
+		if fixkey != nil {
+			key = fixkey(key)
+		}
+		ms = append(ms, newAbsenceMatcher(name, key, get))
+	}
+	return ms
+}
+
+func newAbsenceMatcher(name, key string, get kvgetter) matcher.Matcher {
+	desc := fmt.Sprintf("%s(`%s`)", name, key)
+	return matcher.New(PriorityAbsence, desc, func(r *http.Request) bool {
+		_, ok := get(r, key)
+		return !ok
+	})
+}
+
+// buildCookieMatchers returns the matchers, each of which checks
+// whether the cookie value is equal to the given value,
+// or the cookie exists if the given value is empty.
+func buildCookieMatchers(ms []matcher.Matcher, cookies map[string]string) []matcher.Matcher {
+	for _, name := range sortedkeys(cookies) {
+		ms = append(ms, newCookieMatcher(name, cookies[name]))
+	}
+	return ms
+}
+
+func newCookieMatcher(name, value string) matcher.Matcher {
+	if value == "" {
+		desc := fmt.Sprintf("Cookie(`%s`)", name)
+		return matcher.New(PriorityCookie, desc, func(r *http.Request) bool {
+			_, err := r.Cookie(name)
+			return err == nil
+		})
+	}
+
+	desc := fmt.Sprintf("Cookie(`%s`,`%s`)", name, value)
+	return matcher.New(PriorityCookie, desc, func(r *http.Request) bool {
+		cookie, err := r.Cookie(name)
+		return err == nil && cookie.Value == value
+	})
+}
+
+func buildNotMatcher(m *HttpMatcher) (matcher.Matcher, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	_m, err := m.Build()
+	if err != nil {
+		return nil, fmt.Errorf("not matcher: %w", err)
+	}
+	return newNotMatcher(_m), nil
+}
+
+func newNotMatcher(m matcher.Matcher) matcher.Matcher {
+	desc := fmt.Sprintf("!(%s)", matcher.RemoveParentheses(m.String()))
+	return matcher.New(PriorityNot, desc, func(r *http.Request) bool {
+		return !m.Match(r)
+	})
+}
+
+func (m *HttpMatcher) buildkvs(ms []matcher.Matcher) (_ []matcher.Matcher, err error) {
+	fixheader := http.CanonicalHeaderKey
+
+	ms = buildCookieMatchers(ms, m.Cookies)
+	ms = buildKvInMatchers(ms, "HeaderIn", PriorityHeaderIn, m.HeaderIn, fixheader, getHeaderValues)
+	ms = buildKvInMatchers(ms, "QueryIn", PriorityQueryIn, m.QueryIn, nil, getQueryValues)
+
+	ms, err = buildKvRegexpMatchers(ms, "HeaderRegexp", PriorityHeaderRegexp, m.HeaderRegexps, fixheader, getHeaderValues)
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err = buildKvRegexpMatchers(ms, "QueryRegexp", PriorityQueryRegexp, m.QueryRegexps, nil, getQueryValues)
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err = buildKvRegexpMatchers(ms, "CookieRegexp", PriorityCookieRegexp, m.CookieRegexps, nil, getCookieValues)
+	if err != nil {
+		return nil, err
+	}
+
+	ms = buildAbsenceMatchers(ms, "NoHeader", m.NoHeaders, fixheader, getHeaderValues)
+	ms = buildAbsenceMatchers(ms, "NoQuery", m.NoQueries, nil, getQueryValues)
+	ms = buildAbsenceMatchers(ms, "NoCookie", m.NoCookies, nil, getCookieValues)
+
+	notMatcher, err := buildNotMatcher(m.Not)
+	if err != nil {
+		return nil, err
+	}
+	ms = _appendmatcher(ms, notMatcher)
+
+	if m.Expr != "" {
+		exprMatcher, err := CompileMatcherExpr(m.Expr)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, exprMatcher)
+	}
+
+	return ms, nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orch
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newMatcherTestRequest(rawquery string, header http.Header) *http.Request {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/", RawQuery: rawquery},
+		Header: header,
+	}
+}
+
+func TestHttpMatcherKvs(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher HttpMatcher
+		req     *http.Request
+		expect  bool
+	}{
+		{
+			name:    "cookie",
+			matcher: HttpMatcher{Cookies: map[string]string{"uid": "123"}},
+			req:     newMatcherTestRequest("", http.Header{"Cookie": {"uid=123"}}),
+			expect:  true,
+		},
+		{
+			name:    "cookie_mismatch",
+			matcher: HttpMatcher{Cookies: map[string]string{"uid": "123"}},
+			req:     newMatcherTestRequest("", http.Header{"Cookie": {"uid=456"}}),
+		},
+		{
+			name:    "cookie_presence",
+			matcher: HttpMatcher{Cookies: map[string]string{"uid": ""}},
+			req:     newMatcherTestRequest("", http.Header{"Cookie": {"uid=456"}}),
+			expect:  true,
+		},
+		{
+			name:    "header_in",
+			matcher: HttpMatcher{HeaderIn: map[string][]string{"x-env": {"dev", "test"}}},
+			req:     newMatcherTestRequest("", http.Header{"X-Env": {"test"}}),
+			expect:  true,
+		},
+		{
+			name:    "header_in_mismatch",
+			matcher: HttpMatcher{HeaderIn: map[string][]string{"x-env": {"dev", "test"}}},
+			req:     newMatcherTestRequest("", http.Header{"X-Env": {"prod"}}),
+		},
+		{
+			name:    "query_in",
+			matcher: HttpMatcher{QueryIn: map[string][]string{"v": {"1", "2"}}},
+			req:     newMatcherTestRequest("v=2", nil),
+			expect:  true,
+		},
+		{
+			name:    "header_regexp",
+			matcher: HttpMatcher{HeaderRegexps: map[string]string{"user-agent": "(?i)mobile"}},
+			req:     newMatcherTestRequest("", http.Header{"User-Agent": {"XX Mobile Safari"}}),
+			expect:  true,
+		},
+		{
+			name:    "query_regexp_mismatch",
+			matcher: HttpMatcher{QueryRegexps: map[string]string{"id": "^[0-9]+$"}},
+			req:     newMatcherTestRequest("id=abc", nil),
+		},
+		{
+			name:    "cookie_regexp",
+			matcher: HttpMatcher{CookieRegexps: map[string]string{"ver": "^v2\\."}},
+			req:     newMatcherTestRequest("", http.Header{"Cookie": {"ver=v2.1"}}),
+			expect:  true,
+		},
+		{
+			name:    "no_header",
+			matcher: HttpMatcher{NoHeaders: []string{"x-debug"}},
+			req:     newMatcherTestRequest("", nil),
+			expect:  true,
+		},
+		{
+			name:    "no_header_mismatch",
+			matcher: HttpMatcher{NoHeaders: []string{"x-debug"}},
+			req:     newMatcherTestRequest("", http.Header{"X-Debug": {""}}),
+		},
+		{
+			name:    "no_query",
+			matcher: HttpMatcher{NoQueries: []string{"debug"}},
+			req:     newMatcherTestRequest("debug=1", nil),
+		},
+		{
+			name:    "no_cookie",
+			matcher: HttpMatcher{NoCookies: []string{"uid"}},
+			req:     newMatcherTestRequest("", http.Header{"Cookie": {"sid=1"}}),
+			expect:  true,
+		},
+		{
+			name:    "not",
+			matcher: HttpMatcher{Not: &HttpMatcher{Methods: []string{"POST"}}},
+			req:     newMatcherTestRequest("", nil),
+			expect:  true,
+		},
+		{
+			name: "not_mismatch",
+			matcher: HttpMatcher{
+				Methods: []string{"GET"},
+				Not:     &HttpMatcher{Headers: map[string]string{"X-Env": "test"}},
+			},
+			req: newMatcherTestRequest("", http.Header{"X-Env": {"test"}}),
+		},
+	}
+
+	for _, test := range tests {
+		m, err := test.matcher.Build()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if matched := m.Match(test.req); matched != test.expect {
+			t.Errorf("%s: expect '%v', but got '%v': %s", test.name, test.expect, matched, m.String())
+		}
+	}
+}
+
+func TestHttpMatcherKvsPriority(t *testing.T) {
+	build := func(m HttpMatcher) int {
+		_m, err := m.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return _m.Priority()
+	}
+
+	exact := build(HttpMatcher{Headers: map[string]string{"X-Env": "test"}})
+	in := build(HttpMatcher{HeaderIn: map[string][]string{"X-Env": {"test", "dev"}}})
+	regexp := build(HttpMatcher{HeaderRegexps: map[string]string{"X-Env": "^te"}})
+	absence := build(HttpMatcher{NoHeaders: []string{"X-Env"}})
+	if !(exact > in && in > regexp && regexp > absence && absence > 0) {
+		t.Errorf("unexpected priorities: exact=%d, in=%d, regexp=%d, absence=%d",
+			exact, in, regexp, absence)
+	}
+
+	if prio := build(HttpMatcher{
+		Paths:   []string{"/"},
+		Cookies: map[string]string{"a": "1", "b": "2"},
+	}); prio != 500+2*PriorityCookie {
+		t.Errorf("expect priority %d, but got %d", 500+2*PriorityCookie, prio)
+	}
+}
+
+func TestHttpMatcherKvsError(t *testing.T) {
+	for _, m := range []HttpMatcher{
+		{HeaderRegexps: map[string]string{"X-Env": "("}},
+		{QueryRegexps: map[string]string{"v": "["}},
+		{Not: &HttpMatcher{}},
+	} {
+		if _, err := m.Build(); err == nil {
+			t.Errorf("expect an error for %+v, but got nil", m)
+		}
+	}
+}
@@ -17,9 +17,12 @@ package orch
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 
 	"github.com/xgfone/go-apigateway/http/core"
 	"github.com/xgfone/go-apigateway/http/middleware"
+	"github.com/xgfone/go-apigateway/http/middleware/middlewares/mirror"
 	"github.com/xgfone/go-apigateway/http/router"
 )
 
@@ -55,15 +58,43 @@ func buildMiddlewareGroupHandler(group string, next core.Handler) (core.Handler,
 	return func(c *core.Context) { middleware.HandleGroup(c, group, next) }, nil
 }
 
+func buildMirrorHandler(m *HttpMirror, next core.Handler) (core.Handler, error) {
+	if m == nil {
+		return next, nil
+	}
+
+	mw, err := mirror.Mirror(mirror.Config{
+		Upstream:       m.Upstream,
+		Percentage:     m.Percentage,
+		MaxBodySize:    m.MaxBodySize,
+		MaxConcurrency: m.MaxConcurrency,
+		Timeout:        ms(m.Timeout),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mw.Handler(next), nil
+}
+
 // Build builds the runtime route by the route config.
 func (r HttpRoute) Build() (router.Route, error) {
 	if r.Id == "" {
 		return router.Route{}, errors.New("missing route id")
-	} else if r.Upstream == "" {
+	} else if r.Upstream == "" && len(r.Upstreams) == 0 {
 		return router.Route{}, fmt.Errorf("route '%s' has no upstream", r.Id)
 	}
 
-	matcher, err := r.Matchers.Build()
+	upselector, err := r.buildUpstreamSelector()
+	if err != nil {
+		return router.Route{}, err
+	}
+
+	upstreamId := r.Upstream
+	if upstreamId == "" {
+		upstreamId = r.Upstreams[0].Id
+	}
+
+	matcher, captures, err := r.Matchers.build()
 	if err != nil {
 		return router.Route{}, err
 	}
@@ -81,6 +112,11 @@ func (r HttpRoute) Build() (router.Route, error) {
 		return router.Route{}, err
 	}
 
+	handler, err = buildMirrorHandler(r.Mirror, handler)
+	if err != nil {
+		return router.Route{}, fmt.Errorf("route '%s': %w", r.Id, err)
+	}
+
 	extra := r.Extra
 	r.Extra = nil
 
@@ -95,21 +131,114 @@ func (r HttpRoute) Build() (router.Route, error) {
 		}
 	}
 
+	var upgrade HttpUpgrade
+	if r.Upgrade != nil {
+		if r.Upgrade.IdleTimeout < 0 || r.Upgrade.MaxLifetime < 0 {
+			return router.Route{}, fmt.Errorf("route '%s': invalid negative upgrade timeout", r.Id)
+		}
+		upgrade = *r.Upgrade
+	}
+
 	priority := r.Priority + matcher.Priority()
 	return router.Route{
 		Priority:   priority,
-		UpstreamId: r.Upstream,
+		UpstreamId: upstreamId,
 		Protect:    r.Protect,
 		RouteId:    r.Id,
 		Config:     r,
 		Extra:      extra,
 
-		RequestTimeout: ms(r.RequestTimeout),
-		ForwardTimeout: ms(r.ForwardTimeout),
+		UpstreamSelector: upselector,
+		RequestTimeout:   ms(r.RequestTimeout),
+		ForwardTimeout:   ms(r.ForwardTimeout),
+
+		UpgradeIdleTimeout: ms(upgrade.IdleTimeout),
+		UpgradeMaxLifetime: ms(upgrade.MaxLifetime),
 
-		Desc:      matcher.String(),
-		Matcher:   matcher,
-		Handler:   handler,
-		Responser: responser,
+		Desc:        matcher.String(),
+		Middlewares: r.middlewareNames(),
+		Matcher:     indexmatcher{Matcher: matcher, rules: r.Matchers.IndexRules(), captures: captures},
+		Handler:     handler,
+		Responser:   responser,
 	}, nil
 }
+
+// middlewareNames returns the names of the middlewares of the route
+// from outside to inside, and the groups are formatted as "group:NAME".
+func (r HttpRoute) middlewareNames() []string {
+	names := make([]string, 0, len(r.Middlewares)+len(r.MiddlewareGroups)+1)
+	if r.Mirror != nil {
+		names = append(names, "mirror")
+	}
+	for _, m := range r.Middlewares {
+		names = append(names, m.Name)
+	}
+	for _, group := range r.MiddlewareGroups {
+		if group != "" {
+			names = append(names, "group:"+group)
+		}
+	}
+	return names
+}
+
+// UpstreamTargets returns the weighted upstream targets of the route.
+func (r HttpRoute) UpstreamTargets() []router.WeightedUpstream {
+	targets := make([]router.WeightedUpstream, len(r.Upstreams))
+	for i, up := range r.Upstreams {
+		targets[i] = router.WeightedUpstream{UpstreamId: up.Id, Weight: up.Weight}
+	}
+	return targets
+}
+
+func (r HttpRoute) buildUpstreamSelector() (router.UpstreamSelector, error) {
+	if len(r.Upstreams) == 0 {
+		return nil, nil
+	}
+
+	for _, up := range r.Upstreams {
+		if up.Id == "" {
+			return nil, fmt.Errorf("route '%s' has an upstream without id", r.Id)
+		} else if up.Weight < 0 {
+			return nil, fmt.Errorf("route '%s' has an upstream '%s' with the negative weight", r.Id, up.Id)
+		}
+	}
+
+	key, err := buildUpstreamStickyKey(r.UpstreamSticky)
+	if err != nil {
+		return nil, fmt.Errorf("route '%s': %w", r.Id, err)
+	}
+
+	return router.NewSplitter(key, r.UpstreamTargets()...), nil
+}
+
+func buildUpstreamStickyKey(sticky string) (func(*core.Context) string, error) {
+	switch kind, name, _ := strings.Cut(sticky, ":"); kind {
+	case "":
+		return nil, nil
+
+	case "clientip":
+		return func(c *core.Context) string {
+			if ip := c.ClientIP(); ip.IsValid() {
+				return ip.String()
+			}
+			return ""
+		}, nil
+
+	case "header":
+		if name == "" {
+			return nil, errors.New("missing the header name of the upstream sticky")
+		}
+
+		name = http.CanonicalHeaderKey(name)
+		return func(c *core.Context) string { return c.ClientRequest.Header.Get(name) }, nil
+
+	case "cookie":
+		if name == "" {
+			return nil, errors.New("missing the cookie name of the upstream sticky")
+		}
+		return func(c *core.Context) string { return c.Cookie(name) }, nil
+
+	default:
+		return nil, fmt.Errorf("invalid upstream sticky '%s'", sticky)
+	}
+}
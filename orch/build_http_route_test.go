@@ -15,14 +15,28 @@
 package orch
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"io"
+	"maps"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/xgfone/go-apigateway/http/core"
 	"github.com/xgfone/go-apigateway/http/middleware"
 	"github.com/xgfone/go-apigateway/http/router"
+	"github.com/xgfone/go-apigateway/http/statuscode"
+	httpupstream "github.com/xgfone/go-apigateway/http/upstream"
+	"github.com/xgfone/go-apigateway/upstream"
 )
 
 func addPathSuffixBuilder(name string, conf any) (middleware.Middleware, error) {
@@ -79,3 +93,560 @@ func TestRouteMiddleware(t *testing.T) {
 		t.Errorf("expect path '%s', but got '%s'", expect, path)
 	}
 }
+
+func TestRouteUpstreams(t *testing.T) {
+	route, err := HttpRoute{
+		Id:             "route",
+		Matchers:       []HttpMatcher{{Paths: []string{"/"}}},
+		UpstreamSticky: "header:x-user-id",
+		Upstreams: []WeightedUpstream{
+			{Id: "v1", Weight: 0},
+			{Id: "v2", Weight: 1},
+		},
+	}.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if route.UpstreamId != "v1" {
+		t.Errorf("expect default upstream '%s', but got '%s'", "v1", route.UpstreamId)
+	}
+
+	c := core.AcquireContext(context.Background())
+	c.ClientRequest = &http.Request{Header: http.Header{"X-User-Id": []string{"1"}}}
+	if id := route.UpstreamSelector.SelectUpstream(c); id != "v2" {
+		t.Errorf("expect upstream '%s', but got '%s'", "v2", id)
+	}
+
+	_, err = HttpRoute{
+		Id:             "route",
+		Matchers:       []HttpMatcher{{Paths: []string{"/"}}},
+		UpstreamSticky: "query:id",
+		Upstreams:      []WeightedUpstream{{Id: "v1", Weight: 1}},
+	}.Build()
+	if err == nil {
+		t.Errorf("expect an error, but got nil")
+	}
+}
+
+func TestRouteMirror(t *testing.T) {
+	route := HttpRoute{
+		Id:       "route",
+		Upstream: "primary",
+		Matchers: []HttpMatcher{{Paths: []string{"/"}}},
+		Mirror:   &HttpMirror{Upstream: "shadow", Percentage: 50, Timeout: 1000},
+	}
+	if _, err := route.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	route.Mirror = &HttpMirror{}
+	if _, err := route.Build(); err == nil {
+		t.Error("expect an error for the mirror without upstream, but got nil")
+	}
+}
+
+func TestRouteUpgradeBuild(t *testing.T) {
+	route := HttpRoute{
+		Id:       "route",
+		Upstream: "upstream",
+		Matchers: []HttpMatcher{{Paths: []string{"/"}}},
+		Upgrade:  &HttpUpgrade{IdleTimeout: 1000, MaxLifetime: 60000},
+	}
+
+	r, err := route.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.UpgradeIdleTimeout != time.Second {
+		t.Errorf("expect the upgrade idle timeout %s, but got %s", time.Second, r.UpgradeIdleTimeout)
+	}
+	if r.UpgradeMaxLifetime != time.Minute {
+		t.Errorf("expect the upgrade max lifetime %s, but got %s", time.Minute, r.UpgradeMaxLifetime)
+	}
+
+	route.Upgrade = &HttpUpgrade{IdleTimeout: -1}
+	if _, err := route.Build(); err == nil {
+		t.Error("expect an error for the negative upgrade timeout, but got nil")
+	}
+}
+
+func TestRoutePathTemplate(t *testing.T) {
+	newroute := func(id string, paths ...string) router.Route {
+		route, err := HttpRoute{
+			Id:       id,
+			Upstream: "upstream",
+			Matchers: []HttpMatcher{{Paths: paths}},
+		}.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return route
+	}
+
+	var kvs map[string]any
+	r := router.New()
+	for _, route := range []router.Route{
+		newroute("exact", "/users/me"),
+		newroute("user", "/users/{id}"),
+		newroute("order", "/users/{id:[0-9]+}/orders/{oid}"),
+		newroute("static", "/static/{*rest}", "/assets/{*rest}"),
+	} {
+		route.Handler = func(c *core.Context) { kvs = maps.Clone(c.Kvs) }
+		r.AddRoutes(route)
+	}
+
+	tests := []struct {
+		path  string
+		route string
+		kvs   map[string]any
+	}{
+		{"/users/me", "exact", map[string]any{}},
+		{"/users/abc", "user", map[string]any{"id": "abc"}},
+		{"/users/123/orders/456", "order", map[string]any{"id": "123", "oid": "456"}},
+		{"/users/abc/orders/456", "", nil},
+		{"/assets/js/app.js", "static", map[string]any{"rest": "js/app.js"}},
+	}
+
+	for _, test := range tests {
+		kvs = nil
+		c := core.AcquireContext(context.Background())
+		c.ClientRequest = &http.Request{Method: "GET", URL: &url.URL{Path: test.path}}
+		r.Handle(c)
+
+		if c.RouteId != test.route {
+			t.Errorf("%s: expect route '%s', but got '%s'", test.path, test.route, c.RouteId)
+		} else if !maps.Equal(kvs, test.kvs) {
+			t.Errorf("%s: expect kvs %v, but got %v", test.path, test.kvs, kvs)
+		}
+		core.ReleaseContext(c)
+	}
+
+	if _, err := (HttpRoute{
+		Id:       "route",
+		Upstream: "upstream",
+		Matchers: []HttpMatcher{{Paths: []string{"/users/{id"}}},
+	}).Build(); err == nil {
+		t.Error("expect an error for the invalid path template, but got nil")
+	}
+}
+
+func TestRouteMiddlewareNames(t *testing.T) {
+	route, err := HttpRoute{
+		Id:               "route",
+		Upstream:         "upstream",
+		Matchers:         []HttpMatcher{{Paths: []string{"/"}}},
+		Mirror:           &HttpMirror{Upstream: "shadow"},
+		Middlewares:      Middlewares{{Name: "addpathsuffix", Conf: "/a"}},
+		MiddlewareGroups: []string{"group1"},
+	}.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expects := []string{"mirror", "addpathsuffix", "group:group1"}
+	if !slices.Equal(route.Middlewares, expects) {
+		t.Errorf("expect the middlewares %v, but got %v", expects, route.Middlewares)
+	}
+}
+
+func newH2CServer(handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+func newH2CTransport() *http.Transport {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return transport
+}
+
+func serverPort(server *httptest.Server) uint16 {
+	port, _ := strconv.ParseUint(server.URL[strings.LastIndexByte(server.URL, ':')+1:], 10, 16)
+	return uint16(port)
+}
+
+func writeGRPCMessage(w io.Writer, msg string) error {
+	buf := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(msg)))
+	copy(buf[5:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readGRPCMessage(r io.Reader) (string, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// grpcEchoServer is a minimal gRPC server, which echoes the messages,
+// and sends the status by the unannounced trailers like the gRPC servers.
+func grpcEchoServer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(200)
+	w.(http.Flusher).Flush()
+
+	switch r.URL.Path {
+	case "/echo.Echo/Slow":
+		<-r.Context().Done()
+		return
+
+	case "/echo.Echo/Fail":
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "5")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "not found")
+		return
+	}
+
+	var count int
+	for {
+		msg, err := readGRPCMessage(r.Body)
+		if err != nil {
+			break
+		}
+
+		count++
+		_ = writeGRPCMessage(w, "echo:"+msg)
+		w.(http.Flusher).Flush()
+	}
+
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	w.Header().Set(http.TrailerPrefix+"X-Count", strconv.Itoa(count))
+}
+
+func TestRouteGRPC(t *testing.T) {
+	backend := newH2CServer(http.HandlerFunc(grpcEchoServer))
+	defer backend.Close()
+
+	up, err := Upstream{
+		Id:       "orch_route_grpc",
+		Protocol: "h2c",
+		Discovery: Discovery{
+			Static: &StaticDiscovery{Servers: []Server{{Host: "127.0.0.1", Port: serverPort(backend)}}},
+		},
+	}.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Manager.Add(up.Name(), up)
+	defer upstream.Manager.Del(up.Name())
+
+	empty, err := Upstream{Id: "orch_route_grpc_empty", Discovery: Discovery{Static: &StaticDiscovery{}}}.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Manager.Add(empty.Name(), empty)
+	defer upstream.Manager.Del(empty.Name())
+
+	prefix := func(prefix string) router.MatcherFunc {
+		return func(r *http.Request) bool { return strings.HasPrefix(r.URL.Path, prefix) }
+	}
+
+	r := router.New()
+	r.AddRoutes(
+		router.Route{
+			RouteId:    "orch_route_grpc_echo",
+			UpstreamId: up.Name(),
+			Matcher:    prefix("/echo.Echo/"),
+			Handler:    httpupstream.Forward,
+		},
+		router.Route{
+			RouteId:    "orch_route_grpc_auth",
+			UpstreamId: up.Name(),
+			Matcher:    prefix("/auth.Auth/"),
+			Handler: func(c *core.Context) {
+				c.Abort(statuscode.ErrUnauthorized.WithMessage("invalid token"))
+			},
+		},
+		router.Route{
+			RouteId:    "orch_route_grpc_empty",
+			UpstreamId: empty.Name(),
+			Matcher:    prefix("/empty.Empty/"),
+			Handler:    httpupstream.Forward,
+		},
+	)
+
+	gateway := newH2CServer(r)
+	defer gateway.Close()
+
+	transport := newH2CTransport()
+	defer transport.CloseIdleConnections()
+
+	call := func(method string, header http.Header, body io.Reader) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, gateway.URL+method, body)
+		req.Header = header
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// The gRPC status may be in the header for the trailers-only response.
+	status := func(resp *http.Response) (code, msg string) {
+		if code = resp.Trailer.Get("Grpc-Status"); code == "" {
+			code = resp.Header.Get("Grpc-Status")
+			msg = resp.Header.Get("Grpc-Message")
+		} else {
+			msg = resp.Trailer.Get("Grpc-Message")
+		}
+		return
+	}
+
+	t.Run("unary", func(t *testing.T) {
+		var body bytes.Buffer
+		_ = writeGRPCMessage(&body, "hello")
+
+		resp := call("/echo.Echo/Unary", http.Header{}, &body)
+		defer resp.Body.Close()
+
+		if msg, err := readGRPCMessage(resp.Body); err != nil {
+			t.Fatal(err)
+		} else if msg != "echo:hello" {
+			t.Errorf("expect the message '%s', but got '%s'", "echo:hello", msg)
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if code, _ := status(resp); code != "0" {
+			t.Errorf("expect the grpc status '0', but got '%s'", code)
+		}
+		if count := resp.Trailer.Get("X-Count"); count != "1" {
+			t.Errorf("expect the trailer X-Count '1', but got '%s'", count)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		resp := call("/echo.Echo/Stream", http.Header{}, pr)
+		defer resp.Body.Close()
+
+		for _, msg := range []string{"a", "b", "c"} {
+			if err := writeGRPCMessage(pw, msg); err != nil {
+				t.Fatal(err)
+			}
+			if echo, err := readGRPCMessage(resp.Body); err != nil {
+				t.Fatal(err)
+			} else if echo != "echo:"+msg {
+				t.Errorf("expect the message '%s', but got '%s'", "echo:"+msg, echo)
+			}
+		}
+
+		pw.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if code, _ := status(resp); code != "0" {
+			t.Errorf("expect the grpc status '0', but got '%s'", code)
+		}
+		if count := resp.Trailer.Get("X-Count"); count != "3" {
+			t.Errorf("expect the trailer X-Count '3', but got '%s'", count)
+		}
+	})
+
+	for _, test := range []struct {
+		name    string
+		method  string
+		header  http.Header
+		code    string
+		message string
+	}{
+		{"upstream status", "/echo.Echo/Fail", http.Header{}, "5", "not found"},
+		{"grpc timeout", "/echo.Echo/Slow", http.Header{"Grpc-Timeout": {"50m"}}, "4", ""},
+		{"not found", "/unknown.Unknown/Call", http.Header{}, "12", "Not Found"},
+		{"unauthenticated", "/auth.Auth/Call", http.Header{}, "16", "invalid token"},
+		{"unavailable", "/empty.Empty/Call", http.Header{}, "14", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := call(test.method, test.header, http.NoBody)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != 200 {
+				t.Errorf("expect the status code 200, but got %d", resp.StatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/grpc" {
+				t.Errorf("expect the content type 'application/grpc', but got '%s'", ct)
+			}
+
+			code, msg := status(resp)
+			if code != test.code {
+				t.Errorf("expect the grpc status '%s', but got '%s'", test.code, code)
+			}
+			if test.message != "" && msg != test.message {
+				t.Errorf("expect the grpc message '%s', but got '%s'", test.message, msg)
+			}
+		})
+	}
+}
+
+func upgradeEchoServer(w http.ResponseWriter, r *http.Request) {
+	if !core.IsUpgrade(r) || r.Header.Get("Upgrade") != "echo" {
+		w.WriteHeader(400)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	_, _ = io.Copy(conn, brw)
+}
+
+func TestRouteUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(upgradeEchoServer))
+	defer backend.Close()
+
+	up, err := Upstream{
+		Id: "orch_route_upgrade",
+		Discovery: Discovery{
+			Static: &StaticDiscovery{Servers: []Server{{Host: "127.0.0.1", Port: serverPort(backend)}}},
+		},
+	}.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Manager.Add(up.Name(), up)
+	defer upstream.Manager.Del(up.Name())
+
+	path := func(path string) router.MatcherFunc {
+		return func(r *http.Request) bool { return r.URL.Path == path }
+	}
+
+	r := router.New()
+	r.AddRoutes(
+		router.Route{
+			RouteId:    "orch_route_upgrade_echo",
+			UpstreamId: up.Name(),
+			Matcher:    path("/echo"),
+			Handler:    httpupstream.Forward,
+		},
+		router.Route{
+			RouteId:            "orch_route_upgrade_idle",
+			UpstreamId:         up.Name(),
+			Matcher:            path("/idle"),
+			Handler:            httpupstream.Forward,
+			UpgradeIdleTimeout: time.Millisecond * 100,
+		},
+		router.Route{
+			RouteId:    "orch_route_upgrade_auth",
+			UpstreamId: up.Name(),
+			Matcher:    path("/auth"),
+			Handler: func(c *core.Context) {
+				if c.ClientRequest.Header.Get("Authorization") == "" {
+					c.Abort(statuscode.ErrUnauthorized)
+					return
+				}
+				httpupstream.Forward(c)
+			},
+		},
+	)
+
+	gateway := httptest.NewServer(r)
+	defer gateway.Close()
+
+	upgrade := func(path string, header string) (net.Conn, *bufio.Reader, *http.Response) {
+		t.Helper()
+		conn, err := net.Dial("tcp", gateway.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := "GET " + path + " HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive, Upgrade\r\nUpgrade: echo\r\n" + header + "\r\n"
+		if _, err = io.WriteString(conn, req); err != nil {
+			t.Fatal(err)
+		}
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, reader, resp
+	}
+
+	echo := func(conn net.Conn, reader *bufio.Reader, msg string) {
+		t.Helper()
+		if _, err := io.WriteString(conn, msg+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		if line, err := reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		} else if line != msg+"\n" {
+			t.Errorf("expect the echo '%s', but got '%s'", msg, strings.TrimSpace(line))
+		}
+	}
+
+	waitTunnels := func(routeid string, expect int64) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			if core.ActiveTunnels(routeid) == expect {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Errorf("route '%s': expect %d active tunnels, but got %d",
+			routeid, expect, core.ActiveTunnels(routeid))
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		conn, reader, resp := upgrade("/echo", "")
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("expect the status code 101, but got %d", resp.StatusCode)
+		}
+		if v := resp.Header.Get("Upgrade"); v != "echo" {
+			t.Errorf("expect the header Upgrade 'echo', but got '%s'", v)
+		}
+
+		echo(conn, reader, "hello")
+		echo(conn, reader, "world")
+		waitTunnels("orch_route_upgrade_echo", 1)
+
+		conn.Close()
+		waitTunnels("orch_route_upgrade_echo", 0)
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		conn, reader, resp := upgrade("/idle", "")
+		defer conn.Close()
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("expect the status code 101, but got %d", resp.StatusCode)
+		}
+
+		echo(conn, reader, "hello")
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Errorf("expect the tunnel to be closed by the idle timeout, but got %v", err)
+		}
+		waitTunnels("orch_route_upgrade_idle", 0)
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		conn, _, resp := upgrade("/auth", "")
+		conn.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expect the status code 401, but got %d", resp.StatusCode)
+		}
+
+		conn, reader, resp := upgrade("/auth", "Authorization: token\r\n")
+		defer conn.Close()
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("expect the status code 101, but got %d", resp.StatusCode)
+		}
+		echo(conn, reader, "hello")
+	})
+}
@@ -15,15 +15,24 @@
 package orch
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/xgfone/go-apigateway/http/endpoint"
+	"github.com/xgfone/go-apigateway/http/selector"
+	httpupstream "github.com/xgfone/go-apigateway/http/upstream"
 	"github.com/xgfone/go-apigateway/upstream"
+	"github.com/xgfone/go-apigateway/upstream/breaker"
+	gwdiscovery "github.com/xgfone/go-apigateway/upstream/discovery"
+	"github.com/xgfone/go-apigateway/upstream/health"
+	"github.com/xgfone/go-apigateway/upstream/lifecycle"
+	"github.com/xgfone/go-apigateway/upstream/outlier"
 	"github.com/xgfone/go-loadbalancer"
 	"github.com/xgfone/go-loadbalancer/balancer"
 	"github.com/xgfone/go-loadbalancer/forwarder"
-	"github.com/xgfone/go-loadbalancer/selector"
 )
 
 var (
@@ -43,12 +52,56 @@ func init() {
 		if s.Host == "" {
 			return nil, errors.New("BuildStaticServer: host must not be empty")
 		}
-		return endpoint.New(s.Host, s.Port, s.Weight), nil
+
+		ep := endpoint.New(s.Host, s.Port, s.Weight)
+		if s.Priority != 0 {
+			return endpoint.WithPriority(ep, s.Priority), nil
+		}
+		return ep, nil
 	}
+
+	gwdiscovery.DefaultRegistry.Register("static", func(name string, conf any) (loadbalancer.Discovery, error) {
+		var static StaticDiscovery
+		if err := gwdiscovery.BindConf(name, &static, conf); err != nil {
+			return nil, err
+		}
+		return buildStaticDiscovery(static)
+	})
 }
 
 func buildDiscovery(_ string, discovery Discovery) (loadbalancer.Discovery, error) {
-	eps, err := BuildStaticServers(discovery.Static.Servers)
+	switch {
+	case discovery.Type != "":
+		return gwdiscovery.DefaultRegistry.Build(discovery.Type, discovery.Conf)
+
+	case discovery.Static != nil:
+		return buildStaticDiscovery(*discovery.Static)
+
+	default:
+		return nil, errors.New("missing the discovery type or static servers")
+	}
+}
+
+// hasPriority reports whether the servers may have the different priorities,
+// which is true if the discovery is dynamic.
+func (d Discovery) hasPriority() bool {
+	if d.Type != "" {
+		return true
+	}
+
+	if d.Static != nil {
+		for _, s := range d.Static.Servers {
+			if s.Priority != 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func buildStaticDiscovery(static StaticDiscovery) (loadbalancer.Discovery, error) {
+	eps, err := BuildStaticServers(static.Servers)
 	if err != nil {
 		return nil, err
 	}
@@ -74,27 +127,124 @@ func BuildStaticServers(servers []Server) (loadbalancer.Endpoints, error) {
 }
 
 // Build builds an upstream by the config.
+//
+// The background services of the upstream, such as the dynamic discovery,
+// the active health checker and the lifecycle of the servers, are not started
+// by Build. So, if adding the upstream into upstream.Manager directly,
+// call its method Start before adding it and Stop after removing it,
+// or it discovers no servers. orch/updater.SyncUpstreams has done them.
 func (up Upstream) Build() (*upstream.Upstream, error) {
 	if up.Id == "" {
 		return nil, errors.New("Upstream: missing Id")
 	}
 
+	if up.TLS != nil && up.Scheme != "https" {
+		return nil, fmt.Errorf("Upstream<%s>: tls requires the scheme https", up.Id)
+	}
+
+	switch up.Protocol {
+	case "", httpupstream.ProtocolHTTP1:
+	case httpupstream.ProtocolH2:
+		if up.Scheme != "https" {
+			return nil, fmt.Errorf("Upstream<%s>: protocol h2 requires the scheme https", up.Id)
+		}
+	case httpupstream.ProtocolH2C:
+		if up.Scheme != "" && up.Scheme != "http" {
+			return nil, fmt.Errorf("Upstream<%s>: protocol h2c requires the scheme http", up.Id)
+		}
+	default:
+		return nil, fmt.Errorf("Upstream<%s>: invalid protocol '%s'", up.Id, up.Protocol)
+	}
+
+	var client *httpupstream.Client
+	if up.Protocol != "" || up.TLS != nil || up.Transport != nil {
+		var err error
+		if client, err = up.buildClient(); err != nil {
+			return nil, fmt.Errorf("Upstream<%s>: fail to build client: %w", up.Id, err)
+		}
+	}
+
 	discovery, err := BuildDiscovery(up.Id, up.Discovery)
 	if err != nil {
 		return nil, fmt.Errorf("Upstream<%s>: fail to build discovery: %w", up.Id, err)
 	}
 
+	// Keep the original discovery to start and stop it with the upstream
+	// if it is dynamic, and to manage the lifecycle of all the endpoints,
+	// because it may be wrapped by the checker or detector.
+	source := discovery
+	service, _ := discovery.(upstream.Service)
+
+	var checker *health.Checker
+	if up.HealthCheck != nil {
+		checker, err = up.HealthCheck.build(up.Id, up.Scheme, client, discovery)
+		if err != nil {
+			return nil, fmt.Errorf("Upstream<%s>: fail to build health checker: %w", up.Id, err)
+		}
+		discovery = checker
+	}
+
+	var detector *outlier.Detector
+	if up.OutlierDetection != nil {
+		detector, err = up.OutlierDetection.build(up.Id, discovery)
+		if err != nil {
+			return nil, fmt.Errorf("Upstream<%s>: fail to build outlier detector: %w", up.Id, err)
+		}
+		discovery = detector
+	}
+
+	var breakers *breaker.Group
+	if up.CircuitBreaker != nil {
+		breakers, err = up.CircuitBreaker.build(up.Id)
+		if err != nil {
+			return nil, fmt.Errorf("Upstream<%s>: fail to build circuit breaker: %w", up.Id, err)
+		}
+
+		if up.CircuitBreaker.PerEndpoint {
+			discovery = breaker.NewDiscovery(breakers, discovery)
+		}
+	}
+
 	policy := up.ForwardPolicy()
-	selector := selector.Get(policy)
-	if selector == nil {
-		return nil, fmt.Errorf("Upstream<%s>: invalid forwarding policy '%s'", up.Id, policy)
+	_selector, err := selector.Get(policy)
+	if err != nil {
+		return nil, fmt.Errorf("Upstream<%s>: %w", up.Id, err)
+	}
+
+	observer, _ := _selector.(upstream.Observer)
+
+	var _lifecycle *lifecycle.Lifecycle
+	if up.SlowStart != nil || up.Drain != nil {
+		_lifecycle, err = up.buildLifecycle(source)
+		if err != nil {
+			return nil, fmt.Errorf("Upstream<%s>: fail to build lifecycle: %w", up.Id, err)
+		}
+
+		if up.SlowStart != nil {
+			_selector = selector.SlowStart(_lifecycle.Ratio, _selector)
+		}
+	}
+
+	if ss := up.StickySession; ss != nil {
+		_selector = selector.Sticky(selector.StickyConfig{
+			Name:     ss.Cookie,
+			TTL:      ms(ss.TTL),
+			Path:     ss.Path,
+			Domain:   ss.Domain,
+			Secure:   ss.Secure,
+			HttpOnly: ss.HttpOnly,
+		}, _selector)
+	}
+
+	if up.Discovery.hasPriority() {
+		_selector = selector.Priority(endpoint.Priority, _selector)
 	}
 
 	var _balancer balancer.Balancer
 	if up.Retry.Number >= 0 {
-		_balancer = balancer.NewRetry(selector, ms(up.Retry.Interval), up.Retry.Number)
+		_balancer = balancer.NewRetry(_selector, ms(up.Retry.Interval), up.Retry.Number)
 	} else {
-		_balancer = balancer.NewFromSelector(selector)
+		_balancer = balancer.NewFromSelector(_selector)
 	}
 
 	forwarder := forwarder.New(up.Id, _balancer, discovery)
@@ -107,5 +257,166 @@ func (up Upstream) Build() (*upstream.Upstream, error) {
 	_up.SetScheme(up.Scheme)
 	_up.SetHost(up.Host)
 	_up.SetPath(up.Path)
+	if service != nil {
+		_up.AddService(service)
+	}
+	if client != nil {
+		_up.SetClient(client.Client)
+		_up.AddService(client)
+	}
+	if _lifecycle != nil {
+		_up.SetLifecycle(_lifecycle)
+	}
+	if checker != nil {
+		_up.SetHealthChecker(checker)
+	}
+	if detector != nil {
+		_up.SetOutlierDetector(detector)
+	}
+	if breakers != nil {
+		_up.SetBreakers(breakers)
+	}
+	if observer != nil {
+		_up.AddObserver(observer)
+	}
 	return _up, nil
 }
+
+func (up Upstream) buildLifecycle(discovery loadbalancer.Discovery) (*lifecycle.Lifecycle, error) {
+	var config lifecycle.Config
+	if ss := up.SlowStart; ss != nil {
+		if ss.Window <= 0 {
+			return nil, fmt.Errorf("invalid slow start window %d", ss.Window)
+		}
+		config.SlowStart = ms(ss.Window)
+		config.MinWeightPercent = ss.MinWeightPercent
+	}
+
+	if d := up.Drain; d != nil {
+		config.DrainTimeout = time.Second * 30
+		if d.Timeout > 0 {
+			config.DrainTimeout = ms(d.Timeout)
+		}
+	}
+
+	return lifecycle.New(up.Id, discovery, config)
+}
+
+func (cb CircuitBreaker) build(upid string) (*breaker.Group, error) {
+	return breaker.NewGroup(upid, breaker.GroupConfig{
+		Config: breaker.Config{
+			Window:              ms(cb.Window),
+			ErrorRatio:          cb.ErrorRatio,
+			MinRequests:         cb.MinRequests,
+			ConsecutiveFailures: cb.ConsecutiveFailures,
+			OpenTimeout:         ms(cb.OpenTimeout),
+			HalfOpenRequests:    cb.HalfOpenRequests,
+		},
+		PerEndpoint: cb.PerEndpoint,
+		Fallback:    cb.Fallback,
+	})
+}
+
+func (od OutlierDetection) build(upid string, discovery loadbalancer.Discovery) (*outlier.Detector, error) {
+	return outlier.NewDetector(upid, discovery, outlier.Config{
+		ConsecutiveErrors:  od.ConsecutiveErrors,
+		SlowLatency:        ms(od.SlowLatency),
+		ConsecutiveSlows:   od.ConsecutiveSlows,
+		BaseEjectionTime:   ms(od.BaseEjectionTime),
+		MaxEjectionTime:    ms(od.MaxEjectionTime),
+		MaxEjectionPercent: od.MaxEjectionPercent,
+	})
+}
+
+func (up Upstream) buildClient() (*httpupstream.Client, error) {
+	var config httpupstream.ClientConfig
+	if t := up.Transport; t != nil {
+		config.Transport = httpupstream.TransportConfig{
+			DialTimeout:           ms(t.DialTimeout),
+			KeepAlive:             ms(t.KeepAlive),
+			TLSHandshakeTimeout:   ms(t.TLSHandshakeTimeout),
+			IdleConnTimeout:       ms(t.IdleConnTimeout),
+			MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       t.MaxConnsPerHost,
+			ResponseHeaderTimeout: ms(t.ResponseHeaderTimeout),
+			ExpectContinueTimeout: ms(t.ExpectContinueTimeout),
+			DisableCompression:    t.DisableCompression,
+		}
+	}
+	config.Transport.Protocol = up.Protocol
+
+	if up.TLS != nil {
+		tlsconfig, err := up.TLS.build()
+		if err != nil {
+			return nil, err
+		}
+		config.TLS = &tlsconfig
+	}
+
+	return httpupstream.NewClient(up.Id, config)
+}
+
+func (t TLS) build() (httpupstream.TLSConfig, error) {
+	var version uint16
+	switch t.MinVersion {
+	case "":
+	case "1.0":
+		version = tls.VersionTLS10
+	case "1.1":
+		version = tls.VersionTLS11
+	case "1.2":
+		version = tls.VersionTLS12
+	case "1.3":
+		version = tls.VersionTLS13
+	default:
+		return httpupstream.TLSConfig{}, fmt.Errorf("invalid min tls version '%s'", t.MinVersion)
+	}
+
+	return httpupstream.TLSConfig{
+		CA:                 t.CA,
+		Cert:               t.Cert,
+		Key:                t.Key,
+		ServerName:         t.ServerName,
+		MinVersion:         version,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		ReloadInterval:     ms(t.ReloadInterval),
+	}, nil
+}
+
+func (hc HealthCheck) build(upid, scheme string, client *httpupstream.Client,
+	discovery loadbalancer.Discovery) (*health.Checker, error) {
+	config := health.Config{
+		Type:      hc.Type,
+		Path:      hc.Path,
+		Host:      hc.Host,
+		StatusMin: hc.StatusMin,
+		StatusMax: hc.StatusMax,
+
+		Interval: ms(hc.Interval),
+		Timeout:  ms(hc.Timeout),
+
+		HealthyThreshold:   hc.HealthyThreshold,
+		UnhealthyThreshold: hc.UnhealthyThreshold,
+	}
+
+	switch scheme {
+	case "https":
+		config.Scheme = "https"
+
+	case "tcp", "tls":
+		if config.Type == "" {
+			config.Type = health.TypeTCP
+		}
+	}
+
+	// Probe the servers by the transport forwarding the requests,
+	// so that the probe uses the same TLS certificates and protocol, such as h2c.
+	if client != nil {
+		config.Client = &http.Client{
+			Transport:     client.Client.Transport,
+			CheckRedirect: health.DefaultClient.CheckRedirect,
+		}
+	}
+
+	return health.NewChecker(upid, discovery, config)
+}
@@ -14,7 +14,26 @@
 
 package orch
 
-import "testing"
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-apigateway/http/endpoint"
+	"github.com/xgfone/go-apigateway/http/router"
+	httpupstream "github.com/xgfone/go-apigateway/http/upstream"
+	"github.com/xgfone/go-apigateway/upstream"
+	"github.com/xgfone/go-apigateway/upstream/breaker"
+	gwdiscovery "github.com/xgfone/go-apigateway/upstream/discovery"
+	"github.com/xgfone/go-loadbalancer"
+)
 
 func TestUpstreamBuild(t *testing.T) {
 	up := Upstream{
@@ -42,3 +61,408 @@ func TestUpstreamBuild(t *testing.T) {
 		t.Errorf("expect an upstream, but got nil")
 	}
 }
+
+func TestUpstreamBuildHealthCheck(t *testing.T) {
+	up := Upstream{
+		Id:          "up1",
+		Scheme:      "tcp",
+		HealthCheck: &HealthCheck{Interval: 1000},
+		Discovery: Discovery{
+			Static: &StaticDiscovery{Servers: []Server{{Host: "127.0.0.1", Port: 8001}}},
+		},
+	}
+
+	_up, err := up.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker := _up.HealthChecker()
+	if checker == nil {
+		t.Fatal("expect a health checker, but got nil")
+	} else if _up.Discovery() != checker {
+		t.Errorf("expect the discovery is the health checker")
+	}
+
+	config := checker.Config()
+	if config.Type != "tcp" {
+		t.Errorf("expect the probe type 'tcp', but got '%s'", config.Type)
+	} else if config.Interval != time.Second {
+		t.Errorf("expect the interval '%s', but got '%s'", time.Second, config.Interval)
+	}
+
+	up.HealthCheck = &HealthCheck{Type: "udp"}
+	if _, err := up.Build(); err == nil {
+		t.Errorf("expect an error for the health check type 'udp', but got nil")
+	}
+}
+
+func TestUpstreamBuildCircuitBreaker(t *testing.T) {
+	up := Upstream{
+		Id:             "up1",
+		CircuitBreaker: &CircuitBreaker{OpenTimeout: 1000, PerEndpoint: true, Fallback: "up2"},
+		Discovery: Discovery{
+			Static: &StaticDiscovery{Servers: []Server{{Host: "127.0.0.1", Port: 8001}}},
+		},
+	}
+
+	_up, err := up.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := _up.Breakers()
+	if g == nil {
+		t.Fatal("expect the circuit breakers, but got nil")
+	} else if config := g.Config(); config.OpenTimeout != time.Second {
+		t.Errorf("expect the open timeout '%s', but got '%s'", time.Second, config.OpenTimeout)
+	} else if !config.PerEndpoint || config.Fallback != "up2" {
+		t.Errorf("unexpected circuit breaker config: %+v", config)
+	}
+
+	if _, ok := _up.Discovery().(*breaker.Discovery); !ok {
+		t.Errorf("expect the discovery is wrapped by the breakers, but got %T", _up.Discovery())
+	}
+
+	up.CircuitBreaker = &CircuitBreaker{ErrorRatio: 2}
+	if _, err := up.Build(); err == nil {
+		t.Errorf("expect an error for the error ratio, but got nil")
+	}
+}
+
+type testdiscovery struct {
+	loadbalancer.Discovery
+	starts, stops int
+}
+
+func (d *testdiscovery) Start() { d.starts++ }
+func (d *testdiscovery) Stop()  { d.stops++ }
+
+func TestUpstreamBuildDiscovery(t *testing.T) {
+	var discovery *testdiscovery
+	gwdiscovery.DefaultRegistry.Register("orch_test", func(name string, conf any) (loadbalancer.Discovery, error) {
+		var static StaticDiscovery
+		if err := gwdiscovery.BindConf(name, &static, conf); err != nil {
+			return nil, err
+		}
+
+		d, err := buildStaticDiscovery(static)
+		if err != nil {
+			return nil, err
+		}
+
+		discovery = &testdiscovery{Discovery: d}
+		return discovery, nil
+	})
+	defer gwdiscovery.DefaultRegistry.Unregister("orch_test")
+
+	var up Upstream
+	err := json.Unmarshal([]byte(`{
+		"id": "up1",
+		"discovery": {
+			"type": "orch_test",
+			"conf": {"servers": [{"host": "127.0.0.1", "port": 8001}]}
+		},
+		"healthCheck": {"type": "tcp"}
+	}`), &up)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_up, err := up.Build()
+	if err != nil {
+		t.Fatal(err)
+	} else if eps := _up.Discovery().Discover().Endpoints; len(eps) != 1 {
+		t.Errorf("expect 1 endpoint, but got %d", len(eps))
+	}
+
+	// The services are started only by Start, not by Build.
+	if discovery.starts != 0 {
+		t.Fatalf("unexpect to start the discovery by Build, but got %d", discovery.starts)
+	}
+
+	_up.Start()
+	_up.Stop()
+	if discovery.starts != 1 || discovery.stops != 1 {
+		t.Errorf("expect to start and stop the discovery once, but got %d and %d",
+			discovery.starts, discovery.stops)
+	}
+
+	up.Discovery = Discovery{Type: "static", Conf: map[string]any{
+		"servers": []any{map[string]any{"host": "127.0.0.1", "port": 8002}},
+	}}
+	if _up, err := up.Build(); err != nil {
+		t.Error(err)
+	} else if eps := _up.Discovery().Discover().Endpoints; len(eps) != 1 {
+		t.Errorf("expect 1 endpoint, but got %d", len(eps))
+	}
+
+	up.Discovery = Discovery{Type: "none"}
+	if _, err := up.Build(); err == nil {
+		t.Error("expect an error for the unregistered discovery type, but got nil")
+	}
+
+	up.Discovery = Discovery{}
+	if _, err := up.Build(); err == nil {
+		t.Error("expect an error for the missing discovery, but got nil")
+	}
+}
+
+func TestUpstreamBuildPolicy(t *testing.T) {
+	up := Upstream{
+		Id:            "up1",
+		Policy:        "consistent_hash(@X-User-Id)",
+		StickySession: &StickySession{Cookie: "sid"},
+		Discovery: Discovery{
+			Static: &StaticDiscovery{Servers: []Server{{Host: "127.0.0.1", Port: 8001}}},
+		},
+	}
+
+	_up, err := up.Build()
+	if err != nil {
+		t.Fatal(err)
+	} else if policy := _up.Balancer().Policy(); policy != "sticky(chash(@X-User-Id))" {
+		t.Errorf("expect the policy 'sticky(chash(@X-User-Id))', but got '%s'", policy)
+	}
+
+	up.Policy, up.StickySession = "ewma", nil
+	if _up, err := up.Build(); err != nil {
+		t.Error(err)
+	} else if policy := _up.Balancer().Policy(); policy != "p2c_ewma" {
+		t.Errorf("expect the policy 'p2c_ewma', but got '%s'", policy)
+	}
+
+	up.Policy = "chash(uid)"
+	if _, err := up.Build(); err == nil {
+		t.Error("expect an error for the invalid consistent hash key, but got nil")
+	}
+}
+
+func TestUpstreamBuildLifecycle(t *testing.T) {
+	up := Upstream{
+		Id:        "up1",
+		SlowStart: &SlowStart{Window: 30000},
+		Drain:     &Drain{},
+		Discovery: Discovery{
+			Static: &StaticDiscovery{Servers: []Server{{Host: "127.0.0.1", Port: 8001}}},
+		},
+	}
+
+	_up, err := up.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if policy := _up.Balancer().Policy(); policy != "slowstart(roundrobin)" {
+		t.Errorf("expect the policy 'slowstart(roundrobin)', but got '%s'", policy)
+	}
+
+	if lc := _up.Lifecycle(); lc == nil {
+		t.Error("expect the lifecycle, but got nil")
+	} else if config := lc.Config(); config.SlowStart != time.Second*30 ||
+		config.MinWeightPercent != 10 || config.DrainTimeout != time.Second*30 {
+		t.Errorf("unexpected lifecycle config %+v", config)
+	}
+
+	up.SlowStart.Window = 0
+	if _, err := up.Build(); err == nil {
+		t.Error("expect an error for the invalid slow start window, but got nil")
+	}
+}
+
+func TestUpstreamBuildPriority(t *testing.T) {
+	up := Upstream{
+		Id: "up1",
+		Discovery: Discovery{
+			Static: &StaticDiscovery{Servers: []Server{
+				{Host: "127.0.0.1", Port: 8001},
+				{Host: "127.0.0.1", Port: 8002, Priority: 1},
+			}},
+		},
+	}
+
+	_up, err := up.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if policy := _up.Balancer().Policy(); policy != "priority(roundrobin)" {
+		t.Errorf("expect the policy 'priority(roundrobin)', but got '%s'", policy)
+	}
+
+	for i, ep := range _up.Discovery().Discover().Endpoints {
+		if p := endpoint.Priority(ep); p != i {
+			t.Errorf("%s: expect the priority %d, but got %d", ep.ID(), i, p)
+		}
+	}
+
+	up.Discovery.Static.Servers[1].Priority = 0
+	if _up, err := up.Build(); err != nil {
+		t.Error(err)
+	} else if policy := _up.Balancer().Policy(); policy != "roundrobin" {
+		t.Errorf("expect the policy 'roundrobin', but got '%s'", policy)
+	}
+}
+
+func TestUpstreamBuildTLS(t *testing.T) {
+	up := Upstream{
+		Id:     "up1",
+		Scheme: "https",
+		TLS:    &TLS{ServerName: "example.com", MinVersion: "1.3"},
+		Discovery: Discovery{
+			Static: &StaticDiscovery{Servers: []Server{{Host: "127.0.0.1", Port: 8443}}},
+		},
+		HealthCheck: &HealthCheck{},
+	}
+
+	_up, err := up.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _up.Client() == nil {
+		t.Error("expect the http client of the upstream, but got nil")
+	}
+	if client := _up.HealthChecker().Config().Client; client == nil || client.Transport != _up.Client().Transport {
+		t.Error("expect the health checker to use the transport of the upstream client")
+	}
+
+	up.TLS.MinVersion = "1.4"
+	if _, err := up.Build(); err == nil {
+		t.Error("expect an error for the invalid min tls version, but got nil")
+	}
+
+	up.TLS.MinVersion, up.Scheme = "", "http"
+	if _, err := up.Build(); err == nil {
+		t.Error("expect an error for the scheme http, but got nil")
+	}
+}
+
+func TestUpstreamBuildTransport(t *testing.T) {
+	up := Upstream{
+		Id: "up1",
+		Discovery: Discovery{
+			Static: &StaticDiscovery{Servers: []Server{{Host: "127.0.0.1", Port: 8080}}},
+		},
+	}
+
+	if _up, err := up.Build(); err != nil {
+		t.Fatal(err)
+	} else if _up.Client() != nil {
+		t.Error("expect to share the default http client, but got a dedicated one")
+	}
+
+	up.Transport = &Transport{MaxConnsPerHost: 10, ResponseHeaderTimeout: 1000}
+	_up, err := up.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _up.Client() == nil {
+		t.Error("expect the dedicated http client of the upstream, but got nil")
+	}
+
+	up.Transport.MaxConnsPerHost = -1
+	if _, err := up.Build(); err == nil {
+		t.Error("expect an error for the invalid max connections, but got nil")
+	}
+}
+
+func TestUpstreamBuildProtocol(t *testing.T) {
+	for _, up := range []Upstream{
+		{Id: "up1", Protocol: "h3"},
+		{Id: "up1", Protocol: "h2", Scheme: "http"},
+		{Id: "up1", Protocol: "h2c", Scheme: "https"},
+	} {
+		if _, err := up.Build(); err == nil {
+			t.Errorf("expect an error for the protocol '%s' and scheme '%s', but got nil", up.Protocol, up.Scheme)
+		}
+	}
+
+	newh2cServer := func(handler http.Handler) *httptest.Server {
+		server := httptest.NewUnstartedServer(handler)
+		server.Config.Protocols = new(http.Protocols)
+		server.Config.Protocols.SetHTTP1(true)
+		server.Config.Protocols.SetUnencryptedHTTP2(true)
+		server.Start()
+		return server
+	}
+
+	// The backend echoes the request body line by line,
+	// and returns the number of the lines by the trailer.
+	backend := newh2cServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Lines")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+
+		var lines int
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			lines++
+			fmt.Fprintln(w, scanner.Text())
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("X-Lines", strconv.Itoa(lines))
+	}))
+	defer backend.Close()
+
+	port, _ := strconv.ParseUint(backend.URL[strings.LastIndexByte(backend.URL, ':')+1:], 10, 16)
+	up := Upstream{
+		Id:       "orch_upstream_h2c",
+		Protocol: "h2c",
+		Discovery: Discovery{
+			Static: &StaticDiscovery{Servers: []Server{{Host: "127.0.0.1", Port: uint16(port)}}},
+		},
+	}
+
+	_up, err := up.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Manager.Add(_up.Name(), _up)
+	defer upstream.Manager.Del(_up.Name())
+
+	r := router.New()
+	r.AddRoutes(router.Route{
+		RouteId:    "orch_route_h2c",
+		UpstreamId: _up.Name(),
+		Matcher:    router.MatcherFunc(func(*http.Request) bool { return true }),
+		Handler:    httpupstream.Forward,
+	})
+
+	gateway := newh2cServer(r)
+	defer gateway.Close()
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+
+	// Stream the request and response bodies in both directions.
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, gateway.URL, pr)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	for _, line := range []string{"ping1", "ping2"} {
+		fmt.Fprintln(pw, line)
+		if s, err := reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		} else if s = strings.TrimSpace(s); s != line {
+			t.Errorf("expect the line '%s', but got '%s'", line, s)
+		}
+	}
+
+	pw.Close()
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("expect the error EOF, but got '%v'", err)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expect the protocol HTTP/2, but got '%s'", resp.Proto)
+	}
+	if lines := resp.Trailer.Get("X-Lines"); lines != "2" {
+		t.Errorf("expect the trailer X-Lines '2', but got '%s'", lines)
+	}
+}
@@ -15,7 +15,6 @@
 package orch
 
 import (
-	"fmt"
 	"reflect"
 	"slices"
 )
@@ -27,6 +26,25 @@ type HttpRoute struct {
 	Upstream string       `json:"upstream" yaml:"upstream"`
 	Matchers HttpMatchers `json:"matchers" yaml:"matchers"`
 
+	// Optional, split the traffic across the weighted upstreams.
+	//
+	// If set, Upstream is optional and used as the default upstream
+	// when all the weights are equal to 0.
+	Upstreams []WeightedUpstream `json:"upstreams,omitempty" yaml:"upstreams,omitempty"`
+
+	// Optional, the sticky key to select the upstream from Upstreams,
+	// which is one of "clientip", "header:NAME" and "cookie:NAME".
+	//
+	// Default: select the upstream randomly by the weight.
+	UpstreamSticky string `json:"upstreamSticky,omitempty" yaml:"upstreamSticky,omitempty"`
+
+	// Optional, mirror the requests to the shadow upstream.
+	Mirror *HttpMirror `json:"mirror,omitempty" yaml:"mirror,omitempty"`
+
+	// Optional, the timeouts of the connection upgraded to another protocol,
+	// such as WebSocket, which is always allowed.
+	Upgrade *HttpUpgrade `json:"upgrade,omitempty" yaml:"upgrade,omitempty"`
+
 	// Optional
 	Protect  bool `json:"protect,omitempty" yaml:"protect,omitempty"`
 	Priority int  `json:"priority,omitempty" yaml:"priority,omitempty"`
@@ -43,6 +61,57 @@ type HttpRoute struct {
 	Extra   any `json:"extra,omitempty" yaml:"extra,omitempty"`
 }
 
+// WeightedUpstream is the configuration of a weighted upstream target.
+type WeightedUpstream struct {
+	Id     string `json:"id" yaml:"id"`
+	Weight int    `json:"weight" yaml:"weight"`
+}
+
+// HttpMirror is the configuration to mirror the requests to the shadow upstream,
+// the responses of which are discarded.
+type HttpMirror struct {
+	// Required, the id of the shadow upstream.
+	Upstream string `json:"upstream" yaml:"upstream"`
+
+	// Optional, the percentage of the mirrored requests, range: [1, 100].
+	//
+	// Default: 100
+	Percentage int `json:"percentage,omitempty" yaml:"percentage,omitempty"`
+
+	// Optional, the maximum size of the buffered request body.
+	//
+	// Default: 1MB
+	MaxBodySize int64 `json:"maxBodySize,omitempty" yaml:"maxBodySize,omitempty"`
+
+	// Optional, the maximum number of the concurrent mirrored requests.
+	//
+	// Default: 100
+	MaxConcurrency int `json:"maxConcurrency,omitempty" yaml:"maxConcurrency,omitempty"`
+
+	// Optional, the timeout to forward the mirrored request.
+	//
+	// Unit: ms
+	// Default: 3000
+	Timeout int `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// HttpUpgrade is the configuration of the connection upgraded to another
+// protocol, such as WebSocket, which is tunnelled between the client
+// and the upstream server.
+type HttpUpgrade struct {
+	// Optional, close the tunnel if no data is transferred in either direction.
+	//
+	// Unit: ms
+	// Default: 0 (no timeout)
+	IdleTimeout int `json:"idleTimeout,omitempty" yaml:"idleTimeout,omitempty"`
+
+	// Optional, close the tunnel after it has been alive for the duration.
+	//
+	// Unit: ms
+	// Default: 0 (no limit)
+	MaxLifetime int `json:"maxLifetime,omitempty" yaml:"maxLifetime,omitempty"`
+}
+
 // HttpRouteMatcher is the configuraiton of a route matcher.
 type HttpMatcher struct {
 	// Exact(www.example.com) or Wildcard(*.example.com)
@@ -54,6 +123,11 @@ type HttpMatcher struct {
 	Methods []string `json:"methods,omitempty" yaml:"methods,omitempty"`
 
 	// Exact OR Match
+	//
+	// The path may be a template with the parameters, such as
+	// "/users/{id}", "/users/{id:[0-9]+}" and "/static/{*filepath}",
+	// the captured values of which are stored into the context Kvs
+	// and can be used by the directives as the variables like "$id".
 	Paths        []string `json:"paths,omitempty" yaml:"paths,omitempty"`
 	PathPrefixes []string `json:"pathPrefixes,omitempty" yaml:"pathPrefixes,omitempty"`
 
@@ -64,6 +138,35 @@ type HttpMatcher struct {
 	// IPv4CIDR or IPv6CIDR
 	ClientIps []string `json:"clientIps,omitempty" yaml:"clientIps,omitempty"`
 	ServerIps []string `json:"serverIps,omitempty" yaml:"serverIps,omitempty"`
+
+	// Exact Match, and match the existed cookie if the value is empty.
+	Cookies map[string]string `json:"cookies,omitempty" yaml:"cookies,omitempty"`
+
+	// OR Match for the values of each key.
+	HeaderIn map[string][]string `json:"headerIn,omitempty" yaml:"headerIn,omitempty"`
+	QueryIn  map[string][]string `json:"queryIn,omitempty" yaml:"queryIn,omitempty"`
+
+	// Regular Expression Match, based on go stdlib regexp.
+	HeaderRegexps map[string]string `json:"headerRegexps,omitempty" yaml:"headerRegexps,omitempty"`
+	QueryRegexps  map[string]string `json:"queryRegexps,omitempty" yaml:"queryRegexps,omitempty"`
+	CookieRegexps map[string]string `json:"cookieRegexps,omitempty" yaml:"cookieRegexps,omitempty"`
+
+	// Absence Match, match if the request has none of them.
+	NoHeaders []string `json:"noHeaders,omitempty" yaml:"noHeaders,omitempty"`
+	NoQueries []string `json:"noQueries,omitempty" yaml:"noQueries,omitempty"`
+	NoCookies []string `json:"noCookies,omitempty" yaml:"noCookies,omitempty"`
+
+	// Negation Match, match if the request does not match it.
+	Not *HttpMatcher `json:"not,omitempty" yaml:"not,omitempty"`
+
+	// Expression Match, which is ANDed with the other matchers above.
+	//
+	// For example,
+	//
+	//	Host("api.example.com") && (PathPrefix("/v2") || Header("X-Beta") == "1") && !ClientIP("10.0.0.0/8")
+	//
+	// See CompileMatcherExpr for the grammar and the supported functions.
+	Expr string `json:"expr,omitempty" yaml:"expr,omitempty"`
 }
 
 // HttpMatchers represents a set of http matchers.
@@ -73,7 +176,17 @@ type HttpMatchers []HttpMatcher
 
 // DiffHttpRoutes compares the difference between new and old routes,
 // and reutrns the added and deleted routes.
+//
+// NOTICE: adds also contains the existed but changed routes.
 func DiffHttpRoutes(news, olds []HttpRoute) (adds, dels []HttpRoute) {
+	adds, dels, reweights := DiffHttpRoutesWithWeights(news, olds)
+	return append(adds, reweights...), dels
+}
+
+// DiffHttpRoutesWithWeights is the same as DiffHttpRoutes, but returns
+// the existed routes, only the weights of whose upstreams are changed,
+// as reweights instead of adds, which have no need to be rebuilt.
+func DiffHttpRoutesWithWeights(news, olds []HttpRoute) (adds, dels, reweights []HttpRoute) {
 	ids := make(map[string]struct{}, len(news))
 	adds = make([]HttpRoute, 0, len(news)/2)
 	dels = make([]HttpRoute, 0, len(olds)/2)
@@ -82,11 +195,17 @@ func DiffHttpRoutes(news, olds []HttpRoute) (adds, dels []HttpRoute) {
 	for _, route := range news {
 		ids[route.Id] = struct{}{}
 		index := findroute(olds, route.Id)
-		if index < 0 || !routeequal(route, olds[index]) {
+		switch {
+		case index < 0:
+			adds = append(adds, route)
+
+		case routeequal(route, olds[index]):
+
+		case routeweightonly(route, olds[index]):
+			reweights = append(reweights, route)
+
+		default:
 			adds = append(adds, route)
-		} else {
-			fmt.Println(index, !routeequal(route, olds[index]))
-			fmt.Println(route, olds[index])
 		}
 	}
 
@@ -100,6 +219,26 @@ func DiffHttpRoutes(news, olds []HttpRoute) (adds, dels []HttpRoute) {
 	return
 }
 
+// routeweightonly reports whether the two routes are equal
+// except the weights of the upstreams.
+func routeweightonly(r1, r2 HttpRoute) bool {
+	if len(r1.Upstreams) == 0 || len(r1.Upstreams) != len(r2.Upstreams) {
+		return false
+	}
+
+	r1.Upstreams = clearweights(r1.Upstreams)
+	r2.Upstreams = clearweights(r2.Upstreams)
+	return routeequal(r1, r2)
+}
+
+func clearweights(ups []WeightedUpstream) []WeightedUpstream {
+	ups = slices.Clone(ups)
+	for i := range ups {
+		ups[i].Weight = 0
+	}
+	return ups
+}
+
 func routeequal(r1, r2 HttpRoute) bool { return reflect.DeepEqual(r1, r2) }
 func findroute(routes []HttpRoute, id string) (index int) {
 	return slices.IndexFunc(routes, func(r HttpRoute) bool { return r.Id == id })
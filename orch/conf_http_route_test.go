@@ -117,3 +117,41 @@ func TestDiffRoutes(t *testing.T) {
 		t.Errorf("expect deled routes %+v, but got %+v", routes2[1:], dels)
 	}
 }
+
+func TestDiffRoutesWithWeights(t *testing.T) {
+	route := HttpRoute{
+		Id:       "route",
+		Matchers: []HttpMatcher{{Paths: []string{"/path"}}},
+		Upstreams: []WeightedUpstream{
+			{Id: "v1", Weight: 95},
+			{Id: "v2", Weight: 5},
+		},
+	}
+
+	newroute := route
+	newroute.Upstreams = []WeightedUpstream{{Id: "v1", Weight: 50}, {Id: "v2", Weight: 50}}
+	adds, dels, reweights := DiffHttpRoutesWithWeights([]HttpRoute{newroute}, []HttpRoute{route})
+	if len(adds) != 0 {
+		t.Errorf("unexpect added routes, but got %+v", adds)
+	}
+	if len(dels) != 0 {
+		t.Errorf("unexpect deled routes, but got %+v", dels)
+	}
+	if len(reweights) != 1 {
+		t.Errorf("expect one reweighted route, but got %d: %+v", len(reweights), reweights)
+	}
+
+	adds, _ = DiffHttpRoutes([]HttpRoute{newroute}, []HttpRoute{route})
+	if len(adds) != 1 {
+		t.Errorf("expect one added route, but got %d: %+v", len(adds), adds)
+	}
+
+	newroute.Upstreams = []WeightedUpstream{{Id: "v1", Weight: 50}, {Id: "v3", Weight: 50}}
+	adds, _, reweights = DiffHttpRoutesWithWeights([]HttpRoute{newroute}, []HttpRoute{route})
+	if len(adds) != 1 {
+		t.Errorf("expect one added route, but got %d: %+v", len(adds), adds)
+	}
+	if len(reweights) != 0 {
+		t.Errorf("unexpect reweighted routes, but got %+v", reweights)
+	}
+}
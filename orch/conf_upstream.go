@@ -17,6 +17,7 @@ package orch
 import (
 	"reflect"
 	"slices"
+	"strings"
 )
 
 // Upstream is an upstream configuraiton.
@@ -32,13 +33,58 @@ type Upstream struct {
 	Policy string `json:"policy,omitempty" yaml:"policy,omitempty"` // Default: roundrobin
 	Retry  Retry  `json:"retry,omitempty" yaml:"retry,omitempty"`
 
+	// Optional, pin the client to a server by the cookie,
+	// and fall back to Policy if the server is unavailable.
+	StickySession *StickySession `json:"stickySession,omitempty" yaml:"stickySession,omitempty"`
+
 	// Optional
 	Scheme string `json:"scheme,omitempty" yaml:"scheme,omitempty"` // "http(default)", "https", "tcp", "tls"
 	Host   string `json:"host,omitempty" yaml:"host,omitempty"`     // "$client"(default), "$server", "xxx"
 	Path   string `json:"path,omitempty" yaml:"path,omitempty"`
+
+	// Optional, the protocol to the servers, "http1", "h2" or "h2c".
+	//
+	// "h2" is HTTP/2 over TLS only for the scheme "https", and "h2c" is
+	// HTTP/2 over cleartext TCP with prior knowledge only for the scheme "http",
+	// such as the gRPC servers.
+	//
+	// Default: "", that's, HTTP/1.1, or HTTP/2 negotiated by TLS ALPN.
+	Protocol string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+
+	// Optional, the TLS of the client to the servers, only for the scheme "https".
+	TLS *TLS `json:"tls,omitempty" yaml:"tls,omitempty"`
+
+	// Optional, the transport and connection pool of the client to the servers.
+	//
+	// If Protocol, TLS or Transport is set, the upstream has its own connection pool.
+	// Or, share the default one with the other upstreams.
+	Transport *Transport `json:"transport,omitempty" yaml:"transport,omitempty"`
+
+	// Optional, the active health check of the upstream servers.
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty"`
+
+	// Optional, the passive health check ejecting the outlier servers.
+	OutlierDetection *OutlierDetection `json:"outlierDetection,omitempty" yaml:"outlierDetection,omitempty"`
+
+	// Optional, the circuit breaker of the upstream and its servers.
+	CircuitBreaker *CircuitBreaker `json:"circuitBreaker,omitempty" yaml:"circuitBreaker,omitempty"`
+
+	// Optional, ramp up the weight of the newly added servers.
+	SlowStart *SlowStart `json:"slowStart,omitempty" yaml:"slowStart,omitempty"`
+
+	// Optional, let the removed servers finish the in-flight requests.
+	Drain *Drain `json:"drain,omitempty" yaml:"drain,omitempty"`
 }
 
 // ForwardPolicy returns the normalized forwarding policy.
+//
+// The consistent hash policy is "chash(key[,fallback])" or its alias
+// "consistent_hash(key[,fallback])", such as "chash(@X-User-Id)".
+//
+// The least-latency policy is "p2c_ewma" or its alias "ewma", "peak_ewma"
+// or "least_latency", which selects the server by the latency and
+// the in-flight requests.
+// See http/selector.Get.
 func (u Upstream) ForwardPolicy() string {
 	switch u.Policy {
 	case "lc":
@@ -59,7 +105,14 @@ func (u Upstream) ForwardPolicy() string {
 	case "wrr":
 		return "weight_roundrobin"
 
+	case "ewma", "peak_ewma", "least_latency":
+		return "p2c_ewma"
+
 	default:
+		// consistent_hash(key[,fallback]) => chash(key[,fallback])
+		if strings.HasPrefix(u.Policy, "consistent_hash(") {
+			return "chash(" + u.Policy[len("consistent_hash("):]
+		}
 		return u.Policy
 	}
 }
@@ -70,8 +123,240 @@ type Retry struct {
 	Interval int `json:"interval,omitempty" yaml:"interval,omitempty"` // [0, +∞), Unit: ms
 }
 
+// StickySession is the configuration of the sticky session based on the cookie,
+// the value of which is derived from the id of the server.
+type StickySession struct {
+	// Optional, the name of the cookie.
+	//
+	// Default: "_gw_sticky"
+	Cookie string `json:"cookie,omitempty" yaml:"cookie,omitempty"`
+
+	// Optional, the max age of the cookie.
+	//
+	// Unit: ms, Default: 0 (the session cookie)
+	TTL int `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+
+	// Optional, the attributes of the cookie.
+	Path     string `json:"path,omitempty" yaml:"path,omitempty"` // Default: "/"
+	Domain   string `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Secure   bool   `json:"secure,omitempty" yaml:"secure,omitempty"`
+	HttpOnly bool   `json:"httpOnly,omitempty" yaml:"httpOnly,omitempty"`
+}
+
+// TLS is the configuration of the TLS of the client to the https servers,
+// which is also used by the http health check.
+//
+// CA, Cert and Key are either the paths of the PEM files or the inline PEM
+// data starting with "-----BEGIN", and the files are reloaded when they change.
+type TLS struct {
+	// Optional, the CA certificates to verify the servers.
+	//
+	// Default: the system CA certificates
+	CA string `json:"ca,omitempty" yaml:"ca,omitempty"`
+
+	// Optional, the client certificate and its private key for mTLS.
+	Cert string `json:"cert,omitempty" yaml:"cert,omitempty"`
+	Key  string `json:"key,omitempty" yaml:"key,omitempty"`
+
+	// Optional, the server name to verify the servers and to send by SNI.
+	//
+	// Default: the host of the request
+	ServerName string `json:"serverName,omitempty" yaml:"serverName,omitempty"`
+
+	// Optional, the minimum TLS version, "1.0", "1.1", "1.2" or "1.3".
+	//
+	// Default: "1.2"
+	MinVersion string `json:"minVersion,omitempty" yaml:"minVersion,omitempty"`
+
+	// Optional, if true, do not verify the certificates of the servers,
+	// which should be used only for testing.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+
+	// Optional, the interval to check whether the files change.
+	//
+	// Unit: ms, Default: 10000
+	ReloadInterval int `json:"reloadInterval,omitempty" yaml:"reloadInterval,omitempty"`
+}
+
+// Transport is the configuration of the transport of the client to the servers.
+type Transport struct {
+	// Optional, the timeout to dial the server.
+	//
+	// Unit: ms, Default: 3000
+	DialTimeout int `json:"dialTimeout,omitempty" yaml:"dialTimeout,omitempty"`
+
+	// Optional, the keepalive period of the connection, and <0 disables it.
+	//
+	// Unit: ms, Default: 30000
+	KeepAlive int `json:"keepAlive,omitempty" yaml:"keepAlive,omitempty"`
+
+	// Optional, the timeout of the TLS handshake.
+	//
+	// Unit: ms, Default: 2000
+	TLSHandshakeTimeout int `json:"tlsHandshakeTimeout,omitempty" yaml:"tlsHandshakeTimeout,omitempty"`
+
+	// Optional, the maximum duration that an idle connection is kept.
+	//
+	// Unit: ms, Default: 90000
+	IdleConnTimeout int `json:"idleConnTimeout,omitempty" yaml:"idleConnTimeout,omitempty"`
+
+	// Optional, the maximum number of the idle connections per server.
+	//
+	// Default: 100
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost,omitempty" yaml:"maxIdleConnsPerHost,omitempty"`
+
+	// Optional, the maximum number of the total connections per server,
+	// including the dialing, active and idle ones.
+	//
+	// Default: 0 (no limit)
+	MaxConnsPerHost int `json:"maxConnsPerHost,omitempty" yaml:"maxConnsPerHost,omitempty"`
+
+	// Optional, the timeout to wait for the response headers
+	// after writing the request.
+	//
+	// Unit: ms, Default: 0 (no timeout)
+	ResponseHeaderTimeout int `json:"responseHeaderTimeout,omitempty" yaml:"responseHeaderTimeout,omitempty"`
+
+	// Optional, the timeout to wait for the response headers after writing
+	// the request headers with "Expect: 100-continue".
+	//
+	// Unit: ms, Default: 1000
+	ExpectContinueTimeout int `json:"expectContinueTimeout,omitempty" yaml:"expectContinueTimeout,omitempty"`
+
+	// Optional, if true, do not request the gzip compression from the servers.
+	DisableCompression bool `json:"disableCompression,omitempty" yaml:"disableCompression,omitempty"`
+}
+
+// HealthCheck is the configuration of the active health check,
+// which takes the unhealthy servers out of the discovery until they recover.
+type HealthCheck struct {
+	// Optional, the type of the probe, "http" or "tcp".
+	//
+	// Default: "tcp" if the scheme of the upstream is "tcp" or "tls". Or, "http".
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	// Optional, only for the http probe, which uses the scheme of the upstream.
+	Path      string `json:"path,omitempty" yaml:"path,omitempty"`           // Default: "/"
+	Host      string `json:"host,omitempty" yaml:"host,omitempty"`           // Default: the address of the server
+	StatusMin int    `json:"statusMin,omitempty" yaml:"statusMin,omitempty"` // Default: 200
+	StatusMax int    `json:"statusMax,omitempty" yaml:"statusMax,omitempty"` // Default: max(399, statusMin/100*100+99)
+
+	// Optional, Unit: ms
+	Interval int `json:"interval,omitempty" yaml:"interval,omitempty"` // Default: 10000
+	Timeout  int `json:"timeout,omitempty" yaml:"timeout,omitempty"`   // Default: 3000
+
+	// Optional, the number of the consecutive successful or failed probes
+	// to mark the server healthy or unhealthy.
+	HealthyThreshold   int `json:"healthyThreshold,omitempty" yaml:"healthyThreshold,omitempty"`     // Default: 2
+	UnhealthyThreshold int `json:"unhealthyThreshold,omitempty" yaml:"unhealthyThreshold,omitempty"` // Default: 3
+}
+
+// OutlierDetection is the configuration of the passive health check,
+// which ejects the failing servers detected from the real traffic
+// for a back-off period growing on repeated ejection.
+type OutlierDetection struct {
+	// Optional, the number of the consecutive errors or 5xx responses
+	// to eject the server. A negative value disables it.
+	//
+	// Default: 5
+	ConsecutiveErrors int `json:"consecutiveErrors,omitempty" yaml:"consecutiveErrors,omitempty"`
+
+	// Optional, the number of the consecutive responses, the latency of which
+	// is greater than SlowLatency, to eject the server.
+	//
+	// SlowLatency Unit: ms, Default: 0 (disabled)
+	// ConsecutiveSlows Default: 5
+	SlowLatency      int `json:"slowLatency,omitempty" yaml:"slowLatency,omitempty"`
+	ConsecutiveSlows int `json:"consecutiveSlows,omitempty" yaml:"consecutiveSlows,omitempty"`
+
+	// Optional, the ejection time is BaseEjectionTime multiplied by
+	// the number of the ejection times, but not more than MaxEjectionTime.
+	//
+	// Unit: ms, Default: 30000, 300000
+	BaseEjectionTime int `json:"baseEjectionTime,omitempty" yaml:"baseEjectionTime,omitempty"`
+	MaxEjectionTime  int `json:"maxEjectionTime,omitempty" yaml:"maxEjectionTime,omitempty"`
+
+	// Optional, the maximum percentage of the servers to be ejected,
+	// and at least one server is never ejected.
+	//
+	// Default: 50
+	MaxEjectionPercent int `json:"maxEjectionPercent,omitempty" yaml:"maxEjectionPercent,omitempty"`
+}
+
+// CircuitBreaker is the configuration of the circuit breaker,
+// which fails fast or falls back to another upstream while it is open.
+type CircuitBreaker struct {
+	// Optional, the rolling window to count the requests.
+	//
+	// Unit: ms, Default: 10000
+	Window int `json:"window,omitempty" yaml:"window,omitempty"`
+
+	// Optional, the breaker opens if the ratio of the failed requests
+	// in the window, range: [0, 1], reaches ErrorRatio, and the number
+	// of the requests in the window is not less than MinRequests.
+	//
+	// Default: 0 (disabled), 20
+	ErrorRatio  float64 `json:"errorRatio,omitempty" yaml:"errorRatio,omitempty"`
+	MinRequests int     `json:"minRequests,omitempty" yaml:"minRequests,omitempty"`
+
+	// Optional, the breaker opens if the number of the consecutive
+	// failed requests reaches it.
+	//
+	// Default: 5 if ErrorRatio is 0. Or, 0 (disabled).
+	ConsecutiveFailures int `json:"consecutiveFailures,omitempty" yaml:"consecutiveFailures,omitempty"`
+
+	// Optional, the duration that the breaker keeps open before it becomes half-open.
+	//
+	// Unit: ms, Default: 30000
+	OpenTimeout int `json:"openTimeout,omitempty" yaml:"openTimeout,omitempty"`
+
+	// Optional, the maximum number of the trial requests in the half-open state.
+	//
+	// Default: 1
+	HalfOpenRequests int `json:"halfOpenRequests,omitempty" yaml:"halfOpenRequests,omitempty"`
+
+	// Optional, if true, each server of the upstream has its own breaker.
+	PerEndpoint bool `json:"perEndpoint,omitempty" yaml:"perEndpoint,omitempty"`
+
+	// Optional, the id of the upstream to forward the request to
+	// while the breaker of the upstream is open.
+	Fallback string `json:"fallback,omitempty" yaml:"fallback,omitempty"`
+}
+
+// SlowStart is the configuration of the slow start, during which the weight
+// of the newly added server ramps up linearly from MinWeightPercent percent
+// of Server.Weight to the full.
+//
+// It has no effect on the hash-based policies, such as "chash(key)".
+type SlowStart struct {
+	// Required, the duration of the slow start.
+	//
+	// Unit: ms
+	Window int `json:"window" yaml:"window"`
+
+	// Optional, the percent of the weight when the slow start begins, range: (0, 100].
+	//
+	// Default: 10
+	MinWeightPercent int `json:"minWeightPercent,omitempty" yaml:"minWeightPercent,omitempty"`
+}
+
+// Drain is the configuration of the draining, during which the removed
+// server takes no new requests but may finish the in-flight requests.
+type Drain struct {
+	// Optional, the in-flight requests are canceled after the timeout.
+	//
+	// Unit: ms, Default: 30000
+	Timeout int `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
 // Discovery is the configuration of the upstream server discovery.
+//
+// If Type is set, the discovery is built by the builder registered
+// in upstream/discovery.DefaultRegistry with Conf. Or, use Static.
 type Discovery struct {
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+	Conf any    `json:"conf,omitempty" yaml:"conf,omitempty"`
+
 	Static *StaticDiscovery `json:"static,omitempty" yaml:"static,omitempty"`
 }
 
@@ -85,6 +370,14 @@ type Server struct {
 	Host   string `json:"host,omitempty" yaml:"host,omitempty"`
 	Port   uint16 `json:"port,omitempty" yaml:"port,omitempty"`
 	Weight int    `json:"weight,omitempty" yaml:"weight,omitempty"`
+
+	// Optional, the priority tier of the server, the smaller the value,
+	// the higher the priority, such as 0 for the primary servers and 1 for
+	// the backup servers. The servers of the lower tier receive the requests
+	// only when all the servers of the higher tiers are unavailable.
+	//
+	// Default: 0
+	Priority int `json:"priority,omitempty" yaml:"priority,omitempty"`
 }
 
 // ------------------------------------------------------------------------ //
@@ -96,6 +389,12 @@ type Server struct {
 //	 1 if a >  b
 func CompareServer(a, b Server) int {
 	switch {
+	case a.Priority < b.Priority:
+		return -1
+
+	case a.Priority > b.Priority:
+		return 1
+
 	case a.Weight < b.Weight:
 		return 1
 
@@ -103,6 +103,7 @@ func TestCompareServer(t *testing.T) {
 		{Host: "127.0.0.1", Port: 80, Weight: 3},
 		{Host: "127.0.0.2", Port: 80, Weight: 1},
 		{Host: "127.0.0.1", Port: 10, Weight: 1},
+		{Host: "127.0.0.3", Port: 80, Weight: 9, Priority: 1},
 	}
 	slices.SortFunc(servers, CompareServer)
 
@@ -112,9 +113,24 @@ func TestCompareServer(t *testing.T) {
 		{Host: "127.0.0.1", Port: 10, Weight: 1},
 		{Host: "127.0.0.1", Port: 80, Weight: 1},
 		{Host: "127.0.0.2", Port: 80, Weight: 1},
+		{Host: "127.0.0.3", Port: 80, Weight: 9, Priority: 1},
 	}
 
 	if !reflect.DeepEqual(servers, expects) {
 		t.Errorf("expect %+v, but got %+v", expects, servers)
 	}
 }
+
+func TestUpstreamForwardPolicy(t *testing.T) {
+	for policy, expect := range map[string]string{
+		"":                              "roundrobin",
+		"sh":                            "sourceip_hash",
+		"chash(@X-User-Id)":             "chash(@X-User-Id)",
+		"consistent_hash(#uid, random)": "chash(#uid, random)",
+		"least_latency":                 "p2c_ewma",
+	} {
+		if p := (Upstream{Policy: policy}).ForwardPolicy(); p != expect {
+			t.Errorf("expect the policy '%s', but got '%s'", expect, p)
+		}
+	}
+}
@@ -22,15 +22,43 @@ import (
 	"github.com/xgfone/go-apigateway/orch"
 )
 
+// OnHttpRouteWarnings is called with the warnings analyzed by
+// orch.AnalyzeHttpRoutes when the http routes are changed.
+//
+// Default: nil, which disables the analysis. LogHttpRouteWarnings may be used.
+var OnHttpRouteWarnings func(warnings []orch.HttpRouteWarning)
+
+// LogHttpRouteWarnings logs each of the http route warnings.
+func LogHttpRouteWarnings(warnings []orch.HttpRouteWarning) {
+	for _, w := range warnings {
+		slog.Warn("conflicting http route", "routeid", w.RouteId, "kind", w.Kind,
+			"priority", w.Priority, "others", w.Others, "msg", w.Message)
+	}
+}
+
 // SyncHttpRoutes receives the whole http route configurations,
 // and synchronize them to the runtime.
 func SyncHttpRoutes(ctx context.Context, config <-chan []orch.HttpRoute) {
 	var lasts []orch.HttpRoute
 
 	_sync(ctx, config, func(configs []orch.HttpRoute) {
-		adds, dels := orch.DiffHttpRoutes(configs, lasts)
+		adds, dels, reweights := orch.DiffHttpRoutesWithWeights(configs, lasts)
+
+		addroutes := make([]router.Route, 0, len(adds)+len(reweights))
+		for _, c := range reweights {
+			// Only reset the weights of the upstreams without rebuilding the route.
+			route, ok := router.DefaultRouter.GetRoute(c.Id)
+			if splitter, _ := route.UpstreamSelector.(*router.Splitter); ok && splitter != nil {
+				splitter.Reset(c.UpstreamTargets()...)
+				c.Extra = nil
+				route.Config = c
+				addroutes = append(addroutes, route)
+				slog.Info("reset the upstream weights of the http route", "routeid", c.Id, "upstreams", c.Upstreams)
+			} else {
+				adds = append(adds, c)
+			}
+		}
 
-		addroutes := make([]router.Route, 0, len(adds))
 		for _, c := range adds {
 			route, err := c.Build()
 			if err != nil {
@@ -48,6 +76,12 @@ func SyncHttpRoutes(ctx context.Context, config <-chan []orch.HttpRoute) {
 		}
 		router.DefaultRouter.DelRoutesByIds(delroutes...)
 
+		if cb := OnHttpRouteWarnings; cb != nil && len(adds)+len(dels) > 0 {
+			if warnings := orch.AnalyzeHttpRoutes(configs); len(warnings) > 0 {
+				cb(warnings)
+			}
+		}
+
 		lasts = configs
 	})
 }
@@ -20,6 +20,7 @@ import (
 
 	"github.com/xgfone/go-apigateway/orch"
 	"github.com/xgfone/go-apigateway/upstream"
+	"github.com/xgfone/go-apigateway/upstream/breaker"
 )
 
 var (
@@ -28,10 +29,22 @@ var (
 
 	// OnDelUpstreams is called when the upstreams are deleted.
 	OnDelUpstreams func(ids []string)
+
+	// OnBreakerStateChange is called when the state of the circuit breaker
+	// of any upstream or its endpoint changes.
+	OnBreakerStateChange func(breaker.Transition)
 )
 
 // SyncUpstreams receives the whole upstream configurations,
 // and synchronize them to the runtime.
+//
+// The background services of the upstream, such as the dynamic discovery
+// and the health checker, are started when it is added, and stopped
+// when it is replaced or deleted.
+//
+// If the replaced upstream has the lifecycle manager, the new one inherits it,
+// so only the newly added servers are in the slow start, and the removed
+// servers are drained.
 func SyncUpstreams(ctx context.Context, config <-chan []orch.Upstream) {
 	var lasts []orch.Upstream
 	_sync(ctx, config, func(configs []orch.Upstream) {
@@ -45,18 +58,41 @@ func SyncUpstreams(ctx context.Context, config <-chan []orch.Upstream) {
 				continue
 			}
 
+			if g := up.Breakers(); g != nil {
+				g.SetOnStateChange(onBreakerStateChange)
+			}
+
 			addups[up.Name()] = up
 			slog.Info("build upstream and later add or update it", "upstream", c)
 		}
+
+		// The replaced and deleted upstreams, whose services must be stopped.
+		var stops []*upstream.Upstream
+		for id, up := range addups {
+			if old, ok := upstream.Manager.Get(id); ok {
+				if lc, prev := up.Lifecycle(), old.Lifecycle(); lc != nil && prev != nil {
+					lc.Inherit(prev)
+				}
+				stops = append(stops, old)
+			}
+			up.Start()
+		}
 		upstream.Manager.Adds(addups)
 
 		delups := make([]string, len(dels))
 		for i, c := range dels {
 			delups[i] = c.Id
+			if old, ok := upstream.Manager.Get(c.Id); ok {
+				stops = append(stops, old)
+			}
 			slog.Info("later delete the upstream", "upstreamid", c.Id)
 		}
 		upstream.Manager.Dels(delups...)
 
+		for _, up := range stops {
+			up.Stop()
+		}
+
 		lasts = configs
 
 		if len(addups) > 0 && OnAddUpstreams != nil {
@@ -67,3 +103,9 @@ func SyncUpstreams(ctx context.Context, config <-chan []orch.Upstream) {
 		}
 	})
 }
+
+func onBreakerStateChange(t breaker.Transition) {
+	if OnBreakerStateChange != nil {
+		OnBreakerStateChange(t)
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package breaker provides a circuit breaker.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned when the circuit breaker is open.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Succeeded reports whether the result of a forwarded request is regarded
+// as the success by the circuit breaker.
+//
+// code is the response status code, and err is the forwarding error.
+// The request canceled by the client is regarded as the success.
+func Succeeded(code int, err error) bool {
+	if err != nil {
+		return errors.Is(err, context.Canceled)
+	}
+	return code < 500
+}
+
+// State is the state of the circuit breaker.
+type State uint8
+
+// Pre-define some states of the circuit breaker.
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+// String returns the string representation of the state.
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("State(%d)", s)
+	}
+}
+
+// MarshalText implements the interface encoding.TextMarshaler.
+func (s State) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+// Transition is a state transition of the circuit breaker.
+type Transition struct {
+	Name     string // The name of the circuit breaker, such as the upstream id.
+	Endpoint string // The endpoint id if the breaker is for the endpoint.
+	From     State
+	To       State
+}
+
+// Config is used to configure the circuit breaker.
+type Config struct {
+	// Optional, the rolling window to count the requests,
+	// which is split into 10 buckets.
+	//
+	// Default: 10s
+	Window time.Duration
+
+	// Optional, the breaker opens if the ratio of the failed requests
+	// in the window reaches ErrorRatio, and the number of the requests
+	// in the window is not less than MinRequests.
+	//
+	// ErrorRatio range: [0, 1], 0 means disabled.
+	//
+	// Default: 0, 20
+	ErrorRatio  float64
+	MinRequests int
+
+	// Optional, the breaker opens if the number of the consecutive
+	// failed requests reaches it. 0 means disabled.
+	//
+	// Default: 5 if ErrorRatio is 0. Or, 0.
+	ConsecutiveFailures int
+
+	// Optional, the duration that the breaker keeps open
+	// before it becomes half-open.
+	//
+	// Default: 30s
+	OpenTimeout time.Duration
+
+	// Optional, the maximum number of the trial requests in the half-open state.
+	// The breaker closes if all of them succeed, or opens again if any fails.
+	//
+	// Default: 1
+	HalfOpenRequests int
+
+	// Optional, the callback function called when the state changes.
+	OnStateChange func(Transition)
+}
+
+func (c *Config) init() error {
+	if c.Window <= 0 {
+		c.Window = time.Second * 10
+	}
+
+	if c.ErrorRatio < 0 || c.ErrorRatio > 1 {
+		return fmt.Errorf("invalid error ratio %v", c.ErrorRatio)
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 20
+	}
+
+	switch {
+	case c.ConsecutiveFailures < 0:
+		return fmt.Errorf("invalid consecutive failures %d", c.ConsecutiveFailures)
+	case c.ConsecutiveFailures == 0 && c.ErrorRatio == 0:
+		c.ConsecutiveFailures = 5
+	}
+
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = time.Second * 30
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 1
+	}
+
+	return nil
+}
+
+const bucketnum = 10
+
+type bucket struct {
+	start    time.Time
+	total    int
+	failures int
+}
+
+// Breaker is a circuit breaker with the closed, open and half-open states.
+type Breaker struct {
+	name     string
+	endpoint string
+	config   Config
+
+	lock     sync.Mutex
+	state    State
+	opened   time.Time
+	gen      uint64 // The generation of the state, which is increased on changing state.
+	buckets  [bucketnum]bucket
+	failures int // The number of the consecutive failures.
+	trials   int // The number of the trial requests in the half-open state.
+	passes   int // The number of the successful trial requests.
+
+	now func() time.Time
+}
+
+// New returns a new circuit breaker with the name.
+func New(name string, config Config) (*Breaker, error) {
+	if err := config.init(); err != nil {
+		return nil, err
+	}
+	return &Breaker{name: name, config: config, now: time.Now}, nil
+}
+
+// Name returns the name of the circuit breaker.
+func (b *Breaker) Name() string { return b.name }
+
+// Config returns the configuration of the circuit breaker.
+func (b *Breaker) Config() Config { return b.config }
+
+// State returns the current state of the circuit breaker.
+func (b *Breaker) State() State {
+	var t *Transition
+	defer b.emit(&t)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	t = b.refresh(b.now())
+	return b.state
+}
+
+// openUntil returns the time when the open breaker becomes half-open,
+// or the zero time if the breaker is not open.
+func (b *Breaker) openUntil() time.Time {
+	var t *Transition
+	defer b.emit(&t)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if t = b.refresh(b.now()); b.state != StateOpen {
+		return time.Time{}
+	}
+	return b.opened.Add(b.config.OpenTimeout)
+}
+
+// Allow reports whether a request is allowed to pass.
+//
+// If allowed, done must be called with the result of the request.
+// Or, return (nil, false).
+func (b *Breaker) Allow() (done func(success bool), ok bool) {
+	var t *Transition
+	defer b.emit(&t)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	t = b.refresh(b.now())
+	switch b.state {
+	case StateOpen:
+		return nil, false
+
+	case StateHalfOpen:
+		if b.trials >= b.config.HalfOpenRequests {
+			return nil, false
+		}
+		b.trials++
+	}
+
+	gen := b.gen
+	return func(success bool) { b.done(gen, success) }, true
+}
+
+func (b *Breaker) done(gen uint64, success bool) {
+	var t *Transition
+	defer b.emit(&t)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if gen != b.gen {
+		return // The result is stale.
+	}
+
+	now := b.now()
+	switch b.state {
+	case StateClosed:
+		bucket := b.bucket(now)
+		bucket.total++
+		if success {
+			b.failures = 0
+			return
+		}
+
+		bucket.failures++
+		b.failures++
+		if b.shouldOpen(now) {
+			t = b.setState(StateOpen, now)
+		}
+
+	case StateHalfOpen:
+		if !success {
+			t = b.setState(StateOpen, now)
+		} else if b.passes++; b.passes >= b.config.HalfOpenRequests {
+			t = b.setState(StateClosed, now)
+		}
+	}
+}
+
+func (b *Breaker) shouldOpen(now time.Time) bool {
+	if n := b.config.ConsecutiveFailures; n > 0 && b.failures >= n {
+		return true
+	}
+
+	if b.config.ErrorRatio <= 0 {
+		return false
+	}
+
+	var total, failures int
+	start := now.Add(-b.config.Window)
+	for _, bucket := range b.buckets {
+		if bucket.start.After(start) {
+			total += bucket.total
+			failures += bucket.failures
+		}
+	}
+
+	return total >= b.config.MinRequests &&
+		float64(failures) >= b.config.ErrorRatio*float64(total)
+}
+
+func (b *Breaker) bucket(now time.Time) *bucket {
+	size := b.config.Window / bucketnum
+	start := now.Truncate(size)
+	bucket := &b.buckets[(start.UnixNano()/int64(size))%bucketnum]
+	if !bucket.start.Equal(start) {
+		bucket.start = start
+		bucket.total = 0
+		bucket.failures = 0
+	}
+	return bucket
+}
+
+func (b *Breaker) refresh(now time.Time) *Transition {
+	if b.state == StateOpen && now.Sub(b.opened) >= b.config.OpenTimeout {
+		return b.setState(StateHalfOpen, now)
+	}
+	return nil
+}
+
+func (b *Breaker) setState(state State, now time.Time) *Transition {
+	t := &Transition{Name: b.name, Endpoint: b.endpoint, From: b.state, To: state}
+
+	b.gen++
+	b.state = state
+	b.failures = 0
+	b.trials = 0
+	b.passes = 0
+
+	switch state {
+	case StateOpen:
+		b.opened = now
+	case StateClosed:
+		b.buckets = [bucketnum]bucket{}
+	}
+
+	return t
+}
+
+func (b *Breaker) emit(t **Transition) {
+	if *t == nil {
+		return
+	}
+
+	slog.Warn("the state of the circuit breaker changes", "breaker", b.name,
+		"endpoint", b.endpoint, "from", (*t).From.String(), "to", (*t).To.String())
+	if cb := b.config.OnStateChange; cb != nil {
+		cb(**t)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-loadbalancer"
+)
+
+type testclock struct{ now time.Time }
+
+func (c *testclock) Now() time.Time      { return c.now }
+func (c *testclock) Add(d time.Duration) { c.now = c.now.Add(d) }
+func newTestClock() *testclock           { return &testclock{now: time.Unix(1700000000, 0)} }
+func request(b *Breaker, success bool) bool {
+	done, ok := b.Allow()
+	if ok {
+		done(success)
+	}
+	return ok
+}
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	var transitions []Transition
+	b, err := New("up", Config{
+		ConsecutiveFailures: 3,
+		OpenTimeout:         time.Second,
+		HalfOpenRequests:    2,
+		OnStateChange:       func(t Transition) { transitions = append(transitions, t) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newTestClock()
+	b.now = clock.Now
+
+	request(b, false)
+	request(b, false)
+	request(b, true) // Reset the consecutive failures.
+	request(b, false)
+	request(b, false)
+	if state := b.State(); state != StateClosed {
+		t.Fatalf("expect the state '%s', but got '%s'", StateClosed, state)
+	}
+
+	request(b, false)
+	if state := b.State(); state != StateOpen {
+		t.Fatalf("expect the state '%s', but got '%s'", StateOpen, state)
+	} else if request(b, true) {
+		t.Fatal("expect the request to be denied by the open breaker")
+	}
+
+	// Half-open: only 2 trial requests are allowed.
+	clock.Add(time.Second)
+	done1, ok1 := b.Allow()
+	done2, ok2 := b.Allow()
+	_, ok3 := b.Allow()
+	if !ok1 || !ok2 || ok3 {
+		t.Fatalf("expect only 2 trial requests, but got %v, %v, %v", ok1, ok2, ok3)
+	}
+
+	done1(true)
+	if state := b.State(); state != StateHalfOpen {
+		t.Fatalf("expect the state '%s', but got '%s'", StateHalfOpen, state)
+	}
+	done2(true)
+	if state := b.State(); state != StateClosed {
+		t.Fatalf("expect the state '%s', but got '%s'", StateClosed, state)
+	}
+
+	expects := []string{"closed->open", "open->half-open", "half-open->closed"}
+	if len(transitions) != len(expects) {
+		t.Fatalf("expect %d transitions, but got %d: %+v", len(expects), len(transitions), transitions)
+	}
+	for i, tr := range transitions {
+		if s := fmt.Sprintf("%s->%s", tr.From, tr.To); s != expects[i] {
+			t.Errorf("%d: expect the transition '%s', but got '%s'", i, expects[i], s)
+		} else if tr.Name != "up" || tr.Endpoint != "" {
+			t.Errorf("%d: unexpected transition %+v", i, tr)
+		}
+	}
+}
+
+func TestBreakerHalfOpenFailure(t *testing.T) {
+	b, err := New("up", Config{ConsecutiveFailures: 1, OpenTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newTestClock()
+	b.now = clock.Now
+
+	stale, _ := b.Allow()
+	request(b, false)
+	if state := b.State(); state != StateOpen {
+		t.Fatalf("expect the state '%s', but got '%s'", StateOpen, state)
+	}
+
+	clock.Add(time.Second)
+	done, ok := b.Allow()
+	if !ok {
+		t.Fatal("expect the trial request to be allowed")
+	}
+
+	stale(true) // The result before opening is ignored.
+	if state := b.State(); state != StateHalfOpen {
+		t.Fatalf("expect the state '%s', but got '%s'", StateHalfOpen, state)
+	}
+
+	done(false)
+	if state := b.State(); state != StateOpen {
+		t.Fatalf("expect the state '%s', but got '%s'", StateOpen, state)
+	}
+}
+
+func TestBreakerErrorRatio(t *testing.T) {
+	b, err := New("up", Config{Window: time.Second, ErrorRatio: 0.5, MinRequests: 10})
+	if err != nil {
+		t.Fatal(err)
+	} else if c := b.Config(); c.ConsecutiveFailures != 0 {
+		t.Fatalf("expect the consecutive failures to be disabled, but got %d", c.ConsecutiveFailures)
+	}
+
+	clock := newTestClock()
+	b.now = clock.Now
+
+	// The old requests are out of the window.
+	for range 9 {
+		request(b, false)
+	}
+	clock.Add(time.Second)
+
+	for i := range 9 {
+		request(b, i%2 == 0)
+	}
+	if state := b.State(); state != StateClosed {
+		t.Fatalf("expect the state '%s' below the min requests, but got '%s'", StateClosed, state)
+	}
+
+	request(b, false)
+	if state := b.State(); state != StateOpen {
+		t.Fatalf("expect the state '%s', but got '%s'", StateOpen, state)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	var transitions []Transition
+	g, err := NewGroup("up", GroupConfig{
+		Config:      Config{ConsecutiveFailures: 1},
+		PerEndpoint: true,
+		Fallback:    "backup",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetOnStateChange(func(t Transition) { transitions = append(transitions, t) })
+
+	if g.Fallback() != "backup" {
+		t.Errorf("expect the fallback 'backup', but got '%s'", g.Fallback())
+	} else if c := g.Config(); c.OpenTimeout != time.Second*30 {
+		t.Errorf("expect the default open timeout 30s, but got %s", c.OpenTimeout)
+	}
+
+	ep := g.Endpoint("ep1")
+	if ep != g.Endpoint("ep1") {
+		t.Fatal("expect the same breaker of the endpoint")
+	}
+
+	request(ep, false)
+	if states := g.States(); len(states) != 1 || states["ep1"] != StateOpen {
+		t.Errorf("unexpected states: %v", states)
+	} else if state := g.Upstream().State(); state != StateClosed {
+		t.Errorf("expect the upstream breaker '%s', but got '%s'", StateClosed, state)
+	}
+
+	request(g.Upstream(), false)
+	if len(transitions) != 2 {
+		t.Fatalf("expect 2 transitions, but got %+v", transitions)
+	} else if transitions[0].Endpoint != "ep1" || transitions[1].Endpoint != "" {
+		t.Errorf("unexpected transitions: %+v", transitions)
+	}
+
+	g, err = NewGroup("up", GroupConfig{})
+	if err != nil {
+		t.Fatal(err)
+	} else if b := g.Endpoint("ep1"); b != nil {
+		t.Errorf("expect no breaker of the endpoint, but got one")
+	}
+}
+
+type testendpoint string
+
+func (ep testendpoint) ID() string                              { return string(ep) }
+func (ep testendpoint) Serve(context.Context, any) (any, error) { return nil, nil }
+
+type testdiscovery struct {
+	static atomic.Pointer[loadbalancer.Static]
+}
+
+func (d *testdiscovery) Discover() *loadbalancer.Static { return d.static.Load() }
+func (d *testdiscovery) Set(ids ...string) {
+	eps := make(loadbalancer.Endpoints, len(ids))
+	for i, id := range ids {
+		eps[i] = testendpoint(id)
+	}
+	d.static.Store(loadbalancer.NewStatic(eps))
+}
+
+func TestDiscovery(t *testing.T) {
+	g, err := NewGroup("up", GroupConfig{
+		Config:      Config{ConsecutiveFailures: 1, OpenTimeout: time.Second},
+		PerEndpoint: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newTestClock()
+	g.upstream.now = clock.Now
+
+	discovery := new(testdiscovery)
+	discovery.Set("ep1", "ep2")
+	d := NewDiscovery(g, discovery)
+	d.Discover()
+
+	g.Endpoint("ep1")
+	g.Endpoint("ep2")
+	if states := g.States(); len(states) != 2 {
+		t.Fatalf("expect 2 breakers, but got %v", states)
+	}
+
+	// The breaker of the removed endpoint is removed.
+	discovery.Set("ep2", "ep3")
+	if s := d.Discover(); s != discovery.Discover() {
+		t.Errorf("expect the original static")
+	}
+	if states := g.States(); len(states) != 1 {
+		t.Errorf("expect only the breaker of 'ep2', but got %v", states)
+	} else if _, ok := states["ep2"]; !ok {
+		t.Errorf("expect the breaker of 'ep2', but got %v", states)
+	}
+
+	// The endpoint with the open breaker is filtered out.
+	request(g.Endpoint("ep2"), false)
+	if s := d.Discover(); len(s.Endpoints) != 1 || s.Endpoints[0].ID() != "ep3" {
+		t.Errorf("expect only the endpoint 'ep3', but got %v", s.Endpoints)
+	}
+
+	request(g.Endpoint("ep3"), false)
+	if s := d.Discover(); len(s.Endpoints) != 0 {
+		t.Errorf("expect no endpoints, but got %v", s.Endpoints)
+	}
+
+	// The endpoints are restored when the breakers become half-open.
+	clock.Add(time.Second)
+	if s := d.Discover(); s != discovery.Discover() {
+		t.Errorf("expect the original endpoints, but got %v", s.Endpoints)
+	}
+}
+
+func TestSucceeded(t *testing.T) {
+	if !Succeeded(404, nil) {
+		t.Error("expect 404 to be success")
+	}
+	if Succeeded(502, nil) {
+		t.Error("expect 502 to be failure")
+	}
+	if Succeeded(0, errors.New("connection refused")) {
+		t.Error("expect the error to be failure")
+	}
+	if !Succeeded(0, fmt.Errorf("forward: %w", context.Canceled)) {
+		t.Error("expect the canceled request to be success")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	for _, test := range []struct {
+		config Config
+		expect Config
+	}{
+		{ // Only the error ratio is enabled.
+			config: Config{ErrorRatio: 0.5},
+			expect: Config{Window: time.Second * 10, ErrorRatio: 0.5, MinRequests: 20,
+				OpenTimeout: time.Second * 30, HalfOpenRequests: 1},
+		},
+		{
+			config: Config{Window: time.Minute, ErrorRatio: 1, MinRequests: 10,
+				ConsecutiveFailures: 3, OpenTimeout: time.Second, HalfOpenRequests: 2},
+			expect: Config{Window: time.Minute, ErrorRatio: 1, MinRequests: 10,
+				ConsecutiveFailures: 3, OpenTimeout: time.Second, HalfOpenRequests: 2},
+		},
+	} {
+		config := test.config
+		if err := config.init(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.config, err)
+		} else if !reflect.DeepEqual(config, test.expect) {
+			t.Errorf("expect the config %+v, but got %+v", test.expect, config)
+		}
+	}
+
+	for _, config := range []Config{
+		{ErrorRatio: -0.1},
+		{ErrorRatio: 1.5},
+		{ConsecutiveFailures: -1},
+	} {
+		if err := config.init(); err == nil {
+			t.Errorf("%+v: expect an error, but got nil", config)
+		}
+	}
+}
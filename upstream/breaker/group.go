@@ -0,0 +1,268 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package breaker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xgfone/go-loadbalancer"
+)
+
+// GroupConfig is used to configure the circuit breakers of an upstream.
+type GroupConfig struct {
+	Config
+
+	// Optional, if true, each endpoint of the upstream has its own breaker
+	// besides the breaker of the upstream.
+	PerEndpoint bool
+
+	// Optional, the id of the fallback upstream used when the breaker
+	// of the upstream is open.
+	Fallback string
+}
+
+// Group is a set of the circuit breakers of an upstream and its endpoints.
+type Group struct {
+	name     string
+	config   GroupConfig
+	bconfig  Config // The config of each breaker.
+	upstream *Breaker
+	onchange atomic.Pointer[func(Transition)]
+	version  atomic.Uint64 // Increased when the state of any endpoint changes.
+
+	lock      sync.RWMutex
+	endpoints map[string]*Breaker
+}
+
+// NewGroup returns a new group of the circuit breakers named name,
+// such as the upstream id.
+func NewGroup(name string, config GroupConfig) (*Group, error) {
+	g := &Group{name: name, config: config}
+
+	var err error
+	g.bconfig = config.Config
+	g.bconfig.OnStateChange = g.emit
+	g.upstream, err = New(name, g.bconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	g.bconfig = g.upstream.Config()
+	g.config.Config = g.bconfig
+	g.config.OnStateChange = config.OnStateChange
+	if config.PerEndpoint {
+		g.endpoints = make(map[string]*Breaker, 8)
+	}
+
+	return g, nil
+}
+
+// Config returns the configuration of the group.
+func (g *Group) Config() GroupConfig { return g.config }
+
+// Fallback returns the id of the fallback upstream.
+func (g *Group) Fallback() string { return g.config.Fallback }
+
+// SetOnStateChange resets the callback function called when the state
+// of any breaker in the group changes, which is called after
+// Config.OnStateChange if it is set.
+func (g *Group) SetOnStateChange(cb func(Transition)) { g.onchange.Store(&cb) }
+
+func (g *Group) emit(t Transition) {
+	if t.Endpoint != "" {
+		g.version.Add(1)
+	}
+
+	if cb := g.config.OnStateChange; cb != nil {
+		cb(t)
+	}
+	if cb := g.onchange.Load(); cb != nil && *cb != nil {
+		(*cb)(t)
+	}
+}
+
+// Upstream returns the circuit breaker of the upstream.
+func (g *Group) Upstream() *Breaker { return g.upstream }
+
+// Endpoint returns the circuit breaker of the endpoint,
+// which is created if not exist.
+//
+// Return nil if PerEndpoint is false.
+func (g *Group) Endpoint(epid string) *Breaker {
+	if g.endpoints == nil {
+		return nil
+	}
+
+	g.lock.RLock()
+	b, ok := g.endpoints[epid]
+	g.lock.RUnlock()
+	if ok {
+		return b
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if b, ok = g.endpoints[epid]; !ok {
+		b = &Breaker{name: g.name, endpoint: epid, config: g.bconfig, now: g.upstream.now}
+		g.endpoints[epid] = b
+	}
+	return b
+}
+
+// States returns the states of the breakers of the endpoints.
+func (g *Group) States() map[string]State {
+	g.lock.RLock()
+	breakers := make([]*Breaker, 0, len(g.endpoints))
+	for _, b := range g.endpoints {
+		breakers = append(breakers, b)
+	}
+	g.lock.RUnlock()
+
+	states := make(map[string]State, len(breakers))
+	for _, b := range breakers {
+		states[b.endpoint] = b.State()
+	}
+	return states
+}
+
+// prune removes the breakers of the endpoints which are not in source.
+func (g *Group) prune(source *loadbalancer.Static) {
+	if g.endpoints == nil {
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if len(g.endpoints) == 0 {
+		return
+	}
+
+	present := make(map[string]struct{}, len(source.Endpoints))
+	for _, ep := range source.Endpoints {
+		present[ep.ID()] = struct{}{}
+	}
+	for id := range g.endpoints {
+		if _, ok := present[id]; !ok {
+			delete(g.endpoints, id)
+		}
+	}
+}
+
+// filter returns the endpoints of source whose breakers are not open,
+// and the earliest time when an open breaker becomes half-open.
+func (g *Group) filter(source *loadbalancer.Static) (result *loadbalancer.Static, expires time.Time) {
+	g.lock.RLock()
+	breakers := make([]*Breaker, len(source.Endpoints))
+	for i, ep := range source.Endpoints {
+		breakers[i] = g.endpoints[ep.ID()]
+	}
+	g.lock.RUnlock()
+
+	var eps loadbalancer.Endpoints
+	for i, b := range breakers {
+		if b != nil {
+			if until := b.openUntil(); !until.IsZero() {
+				if eps == nil {
+					eps = make(loadbalancer.Endpoints, i, len(source.Endpoints))
+					copy(eps, source.Endpoints[:i])
+				}
+
+				if expires.IsZero() || until.Before(expires) {
+					expires = until
+				}
+				continue
+			}
+		}
+
+		if eps != nil {
+			eps = append(eps, source.Endpoints[i])
+		}
+	}
+
+	switch {
+	case eps == nil:
+		result = source
+	case len(eps) == 0:
+		result = loadbalancer.None
+	default:
+		result = loadbalancer.NewStatic(eps)
+	}
+	return
+}
+
+// ------------------------------------------------------------------------ //
+
+type cache struct {
+	version uint64
+	expires time.Time // The earliest time when an open breaker becomes half-open.
+	source  *loadbalancer.Static
+	result  *loadbalancer.Static
+}
+
+// Discovery is a discovery wrapping the discovery of the upstream,
+// which only returns the endpoints whose breakers are not open,
+// so that the selector and the retries do not choose them.
+//
+// It also removes the breakers of the endpoints that are no longer discovered,
+// so that they do not accumulate when the endpoints change frequently,
+// such as the dns or file discovery.
+type Discovery struct {
+	group     *Group
+	discovery loadbalancer.Discovery
+	cache     atomic.Pointer[cache]
+}
+
+var _ loadbalancer.Discovery = new(Discovery)
+
+// NewDiscovery returns a new discovery wrapping discovery
+// to manage the breakers of its endpoints in group.
+func NewDiscovery(group *Group, discovery loadbalancer.Discovery) *Discovery {
+	if group == nil {
+		panic("breaker.NewDiscovery: group must not be nil")
+	}
+	if discovery == nil {
+		panic("breaker.NewDiscovery: discovery must not be nil")
+	}
+	return &Discovery{group: group, discovery: discovery}
+}
+
+// Discovery returns the wrapped discovery.
+func (d *Discovery) Discovery() loadbalancer.Discovery { return d.discovery }
+
+// Discover implements the interface loadbalancer.Discovery,
+// which only returns the endpoints whose breakers are not open.
+func (d *Discovery) Discover() *loadbalancer.Static {
+	source := d.discovery.Discover()
+	if source == nil {
+		return nil
+	}
+
+	version := d.group.version.Load()
+	c := d.cache.Load()
+	if c != nil && c.source == source && c.version == version &&
+		(c.expires.IsZero() || d.group.upstream.now().Before(c.expires)) {
+		return c.result
+	}
+
+	if c == nil || c.source != source {
+		d.group.prune(source)
+	}
+
+	result, expires := d.group.filter(source)
+	d.cache.Store(&cache{version: version, expires: expires, source: source, result: result})
+	return result
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package discovery provides a registry of the upstream server discoveries.
+//
+// If the built discovery has the methods Start() and Stop(),
+// such as a dynamic discovery, it will be started and stopped
+// together with the upstream.
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/xgfone/go-apigateway/registry"
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-toolkit/structx"
+)
+
+// DefaultRegistry is the global default registry of the discovery builder.
+var DefaultRegistry = registry.New[loadbalancer.Discovery]()
+
+// BindConf builds the config dstconf of the discovery named name from srcconf.
+//
+// scrconf may be one of types as follow:
+//   - map[string]any
+//   - json.RawMessage
+//   - []byte
+func BindConf(name string, dstconf, srcconf any) (err error) {
+	switch v := srcconf.(type) {
+	case map[string]any:
+		err = structx.BindMapAny(dstconf, v, "json")
+
+	case []byte:
+		err = json.Unmarshal(v, dstconf)
+
+	case json.RawMessage:
+		err = json.Unmarshal(v, dstconf)
+
+	default:
+		return fmt.Errorf("Discovery<%s>: expect a map type, but got %T", name, srcconf)
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Discovery<%s>: %w", name, err)
+	}
+
+	return
+}
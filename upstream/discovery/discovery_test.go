@@ -0,0 +1,46 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBindConf(t *testing.T) {
+	type Config struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	}
+
+	var c1 Config
+	if err := BindConf("test", &c1, map[string]any{"name": "a", "port": 80}); err != nil {
+		t.Error(err)
+	} else if c1.Name != "a" || c1.Port != 80 {
+		t.Errorf("unexpected config: %+v", c1)
+	}
+
+	var c2 Config
+	if err := BindConf("test", &c2, json.RawMessage(`{"name":"b","port":81}`)); err != nil {
+		t.Error(err)
+	} else if c2.Name != "b" || c2.Port != 81 {
+		t.Errorf("unexpected config: %+v", c2)
+	}
+
+	var c3 Config
+	if err := BindConf("test", &c3, "abc"); err == nil {
+		t.Error("expect an error, but got nil")
+	}
+}
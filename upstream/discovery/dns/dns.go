@@ -0,0 +1,433 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dns provides a discovery named "dns", which periodically resolves
+// the A/AAAA or SRV records of a domain into the upstream servers.
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xgfone/go-apigateway/http/endpoint"
+	"github.com/xgfone/go-apigateway/upstream/discovery"
+	"github.com/xgfone/go-loadbalancer"
+	lbendpoint "github.com/xgfone/go-loadbalancer/endpoint"
+	"github.com/xgfone/go-toolkit/runtimex"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func init() {
+	discovery.DefaultRegistry.Register("dns", func(name string, conf any) (loadbalancer.Discovery, error) {
+		var config Config
+		if err := discovery.BindConf(name, &config, conf); err != nil {
+			return nil, err
+		}
+		return New(config)
+	})
+}
+
+// Pre-define the types of the resolved records.
+const (
+	TypeIP4 = "ip4" // A
+	TypeIP6 = "ip6" // AAAA
+	TypeIP  = "ip"  // A and AAAA
+	TypeSRV = "srv" // SRV
+)
+
+// The minimum interval to refresh the records and timeout of each query, unit: ms.
+const (
+	minInterval = 1000
+	minTimeout  = 100
+)
+
+// Config is used to configure the dns discovery.
+type Config struct {
+	// Required, the domain name to be resolved,
+	// such as "www.example.com" or "_http._tcp.example.com" for SRV.
+	Name string `json:"name" yaml:"name"`
+
+	// Optional, the type of the records, one of "ip4", "ip6", "ip" and "srv".
+	//
+	// Default: "ip4"
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	// Port is required and Weight is optional for the A/AAAA records.
+	// For SRV, use the port and weight of the records instead.
+	//
+	// Weight Default: 1
+	Port   uint16 `json:"port,omitempty" yaml:"port,omitempty"`
+	Weight int    `json:"weight,omitempty" yaml:"weight,omitempty"`
+
+	// Optional, the addresses of the dns servers, such as "127.0.0.1:53".
+	//
+	// Default: the nameservers in /etc/resolv.conf, or "127.0.0.1:53".
+	Resolvers []string `json:"resolvers,omitempty" yaml:"resolvers,omitempty"`
+
+	// Optional, the records are refreshed after the minimum TTL of them,
+	// which is bounded by [MinInterval, MaxInterval].
+	//
+	// When failing to resolve, the last resolved servers are kept
+	// and it will be retried after MinInterval, which is 1000 at least.
+	//
+	// Unit: ms, Default: 1000, 60000
+	MinInterval int `json:"minInterval,omitempty" yaml:"minInterval,omitempty"`
+	MaxInterval int `json:"maxInterval,omitempty" yaml:"maxInterval,omitempty"`
+
+	// Optional, the timeout of each query, which is 100 at least.
+	//
+	// Unit: ms, Default: 3000
+	Timeout int `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+func (c *Config) init() error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return errors.New("missing the domain name")
+	} else if !strings.HasSuffix(c.Name, ".") {
+		c.Name += "."
+	}
+
+	switch c.Type {
+	case "":
+		c.Type = TypeIP4
+	case TypeIP4, TypeIP6, TypeIP:
+	case TypeSRV:
+	default:
+		return fmt.Errorf("invalid record type '%s'", c.Type)
+	}
+
+	if c.Type != TypeSRV && c.Port == 0 {
+		return fmt.Errorf("missing the port for the record type '%s'", c.Type)
+	}
+	if c.Weight <= 0 {
+		c.Weight = 1
+	}
+
+	if len(c.Resolvers) == 0 {
+		if c.Resolvers = getSystemResolvers(); len(c.Resolvers) == 0 {
+			c.Resolvers = []string{"127.0.0.1:53"}
+		}
+	} else {
+		resolvers := make([]string, len(c.Resolvers))
+		for i, addr := range c.Resolvers {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "53")
+			}
+			resolvers[i] = addr
+		}
+		c.Resolvers = resolvers
+	}
+
+	c.MinInterval = max(c.MinInterval, minInterval)
+	if c.MaxInterval <= 0 {
+		c.MaxInterval = 60000
+	}
+	c.MaxInterval = max(c.MaxInterval, c.MinInterval)
+
+	if c.Timeout <= 0 {
+		c.Timeout = 3000
+	}
+	c.Timeout = max(c.Timeout, minTimeout)
+
+	return nil
+}
+
+type server struct {
+	host   string
+	port   uint16
+	weight int
+}
+
+// Discovery is a dns discovery, which implements the interface
+// loadbalancer.Discovery, and should be started to resolve the records.
+type Discovery struct {
+	config Config
+	static atomic.Pointer[loadbalancer.Static]
+
+	timeout     time.Duration
+	minInterval time.Duration
+	maxInterval time.Duration
+
+	rlock     sync.Mutex
+	endpoints map[string]*lbendpoint.Endpoint
+
+	slock  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var _ loadbalancer.Discovery = new(Discovery)
+
+// New returns a new dns discovery.
+func New(config Config) (*Discovery, error) {
+	if err := config.init(); err != nil {
+		return nil, fmt.Errorf("Discovery<dns>: %w", err)
+	}
+
+	d := &Discovery{
+		config:      config,
+		timeout:     time.Duration(config.Timeout) * time.Millisecond,
+		minInterval: time.Duration(config.MinInterval) * time.Millisecond,
+		maxInterval: time.Duration(config.MaxInterval) * time.Millisecond,
+	}
+	d.static.Store(loadbalancer.None)
+	return d, nil
+}
+
+// Config returns the configuration of the discovery.
+func (d *Discovery) Config() Config { return d.config }
+
+// Discover implements the interface loadbalancer.Discovery,
+// which returns the last resolved servers.
+func (d *Discovery) Discover() *loadbalancer.Static { return d.static.Load() }
+
+// Start resolves the records once and starts to refresh them in the background.
+func (d *Discovery) Start() {
+	d.slock.Lock()
+	defer d.slock.Unlock()
+	if d.cancel != nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+	d.done = make(chan struct{})
+
+	interval := d.refresh(ctx)
+	go d.loop(ctx, d.done, interval)
+}
+
+// Stop stops refreshing the records and waits until it exits.
+func (d *Discovery) Stop() {
+	d.slock.Lock()
+	defer d.slock.Unlock()
+	if d.cancel == nil {
+		return
+	}
+
+	d.cancel()
+	<-d.done
+	d.cancel, d.done = nil, nil
+}
+
+func (d *Discovery) loop(ctx context.Context, done chan struct{}, interval time.Duration) {
+	defer close(done)
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		timer.Reset(d.refresh(ctx))
+	}
+}
+
+// refresh resolves the records and updates the servers,
+// and returns the interval to refresh them next time.
+func (d *Discovery) refresh(ctx context.Context) (interval time.Duration) {
+	interval = d.minInterval
+	defer runtimex.Recover(ctx)
+
+	servers, ttl, err := d.resolve(ctx)
+	if err == nil && len(servers) == 0 {
+		err = errors.New("no records")
+	}
+
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("fail to resolve the dns records, and keep the last servers",
+				"name", d.config.Name, "type", d.config.Type, "err", err)
+		}
+		return
+	}
+
+	d.update(servers)
+	return min(max(ttl, d.minInterval), d.maxInterval)
+}
+
+func (d *Discovery) update(servers []server) {
+	d.rlock.Lock()
+	defer d.rlock.Unlock()
+
+	var changed bool
+	endpoints := make(map[string]*lbendpoint.Endpoint, len(servers))
+	eps := make(loadbalancer.Endpoints, 0, len(servers))
+	for _, s := range servers {
+		ep := endpoint.New(s.host, s.port, s.weight)
+		if _, ok := endpoints[ep.ID()]; ok {
+			continue // Duplicated
+		}
+
+		if old, ok := d.endpoints[ep.ID()]; ok && old.Weight() == ep.Weight() {
+			eps = append(eps, old) // Reuse the endpoint to keep its runtime state.
+			endpoints[old.ID()] = old
+			continue
+		}
+
+		changed = true
+		eps = append(eps, ep)
+		endpoints[ep.ID()] = ep
+	}
+
+	if !changed && len(endpoints) == len(d.endpoints) {
+		return
+	}
+
+	d.endpoints = endpoints
+	slices.SortFunc(eps, func(a, b loadbalancer.Endpoint) int { return strings.Compare(a.ID(), b.ID()) })
+	d.static.Store(loadbalancer.NewStatic(eps))
+	slog.Info("update the servers resolved from dns", "name", d.config.Name,
+		"type", d.config.Type, "servers", len(eps))
+}
+
+func (d *Discovery) resolve(ctx context.Context) (servers []server, ttl time.Duration, err error) {
+	var _ttl uint32
+	switch d.config.Type {
+	case TypeSRV:
+		servers, _ttl, err = d.lookupSRV(ctx)
+
+	default:
+		var ips []string
+		ips, _ttl, err = d.lookupIP(ctx, d.config.Name, d.config.Type)
+		servers = make([]server, len(ips))
+		for i, ip := range ips {
+			servers[i] = server{host: ip, port: d.config.Port, weight: d.config.Weight}
+		}
+	}
+
+	ttl = time.Duration(_ttl) * time.Second
+	return
+}
+
+func (d *Discovery) lookupSRV(ctx context.Context) (servers []server, ttl uint32, err error) {
+	ans, err := d.query(ctx, d.config.Name, dnsmessage.TypeSRV)
+	if err != nil {
+		return
+	}
+
+	// Only use the records with the lowest priority.
+	var srvs []dnsmessage.Resource
+	for _, r := range ans.resources {
+		if srv, ok := r.Body.(*dnsmessage.SRVResource); ok {
+			switch {
+			case len(srvs) == 0 || srv.Priority == srvs[0].Body.(*dnsmessage.SRVResource).Priority:
+				srvs = append(srvs, r)
+			case srv.Priority < srvs[0].Body.(*dnsmessage.SRVResource).Priority:
+				srvs = append(srvs[:0], r)
+			}
+		}
+	}
+
+	for _, r := range srvs {
+		srv := r.Body.(*dnsmessage.SRVResource)
+		ttl = minttl(ttl, r.Header.TTL)
+
+		target := srv.Target.String()
+		ips, _ttl := getAdditionalIPs(ans.additionals, target)
+		if len(ips) == 0 {
+			if ips, _ttl, err = d.lookupIP(ctx, target, TypeIP); err != nil {
+				return
+			}
+		}
+
+		// The weight 0 of SRV means the very small chance to be selected,
+		// but the balancer does not support it, so regard it as 1.
+		weight := max(int(srv.Weight), 1)
+		for _, ip := range ips {
+			servers = append(servers, server{host: ip, port: srv.Port, weight: weight})
+		}
+		ttl = minttl(ttl, _ttl)
+	}
+
+	return
+}
+
+func (d *Discovery) lookupIP(ctx context.Context, name, _type string) (ips []string, ttl uint32, err error) {
+	var qtypes []dnsmessage.Type
+	switch _type {
+	case TypeIP4:
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA}
+	case TypeIP6:
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	}
+
+	for _, qtype := range qtypes {
+		var ans answer
+		if ans, err = d.query(ctx, name, qtype); err != nil {
+			return
+		}
+
+		for _, r := range ans.resources {
+			if ip := getIP(r); ip != "" {
+				ips = append(ips, ip)
+				ttl = minttl(ttl, r.Header.TTL)
+			}
+		}
+	}
+
+	return
+}
+
+func (d *Discovery) query(ctx context.Context, name string, qtype dnsmessage.Type) (answer, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return query(ctx, d.config.Resolvers, name, qtype)
+}
+
+func getAdditionalIPs(additionals []dnsmessage.Resource, name string) (ips []string, ttl uint32) {
+	for _, r := range additionals {
+		if strings.EqualFold(r.Header.Name.String(), name) {
+			if ip := getIP(r); ip != "" {
+				ips = append(ips, ip)
+				ttl = minttl(ttl, r.Header.TTL)
+			}
+		}
+	}
+	return
+}
+
+func getIP(r dnsmessage.Resource) string {
+	switch body := r.Body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(body.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(body.AAAA[:]).String()
+	default:
+		return ""
+	}
+}
+
+// minttl returns the minimum ttl, and 0 means not set.
+func minttl(ttl1, ttl2 uint32) uint32 {
+	if ttl1 == 0 || (ttl2 > 0 && ttl2 < ttl1) {
+		return ttl2
+	}
+	return ttl1
+}
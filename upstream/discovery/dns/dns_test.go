@@ -0,0 +1,393 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-apigateway/upstream/discovery"
+	"github.com/xgfone/go-loadbalancer"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testserver is an in-process dns server for test.
+type testserver struct {
+	addr string
+	udp  net.PacketConn
+	tcp  net.Listener
+
+	lock     sync.Mutex
+	records  map[dnsmessage.Question][]dnsmessage.Resource
+	extras   map[dnsmessage.Question][]dnsmessage.Resource
+	truncate map[string]bool
+	rcode    dnsmessage.RCode
+}
+
+func newTestServer(t *testing.T) *testserver {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		t.Fatal(err)
+	}
+
+	s := &testserver{
+		addr:     udp.LocalAddr().String(),
+		udp:      udp,
+		tcp:      tcp,
+		records:  make(map[dnsmessage.Question][]dnsmessage.Resource),
+		extras:   make(map[dnsmessage.Question][]dnsmessage.Resource),
+		truncate: make(map[string]bool),
+	}
+
+	go s.serveUDP()
+	go s.serveTCP()
+	t.Cleanup(func() { udp.Close(); tcp.Close() })
+	return s
+}
+
+func question(name string, qtype dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}
+}
+
+func header(name string, qtype dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET, TTL: ttl}
+}
+
+func (s *testserver) SetA(name string, ttl uint32, ips ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q := question(name, dnsmessage.TypeA)
+	s.records[q] = nil
+	for _, ip := range ips {
+		s.records[q] = append(s.records[q], dnsmessage.Resource{
+			Header: header(name, dnsmessage.TypeA, ttl),
+			Body:   &dnsmessage.AResource{A: netip.MustParseAddr(ip).As4()},
+		})
+	}
+}
+
+func (s *testserver) SetAAAA(name string, ttl uint32, ips ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q := question(name, dnsmessage.TypeAAAA)
+	s.records[q] = nil
+	for _, ip := range ips {
+		s.records[q] = append(s.records[q], dnsmessage.Resource{
+			Header: header(name, dnsmessage.TypeAAAA, ttl),
+			Body:   &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr(ip).As16()},
+		})
+	}
+}
+
+func (s *testserver) AddSRV(name string, ttl uint32, srv dnsmessage.SRVResource, additionalIPs ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q := question(name, dnsmessage.TypeSRV)
+	s.records[q] = append(s.records[q], dnsmessage.Resource{
+		Header: header(name, dnsmessage.TypeSRV, ttl),
+		Body:   &srv,
+	})
+
+	target := srv.Target.String()
+	for _, ip := range additionalIPs {
+		s.extras[q] = append(s.extras[q], dnsmessage.Resource{
+			Header: header(target, dnsmessage.TypeA, ttl),
+			Body:   &dnsmessage.AResource{A: netip.MustParseAddr(ip).As4()},
+		})
+	}
+}
+
+func (s *testserver) SetRCode(rcode dnsmessage.RCode) {
+	s.lock.Lock()
+	s.rcode = rcode
+	s.lock.Unlock()
+}
+
+func (s *testserver) Truncate(name string) {
+	s.lock.Lock()
+	s.truncate[name] = true
+	s.lock.Unlock()
+}
+
+func (s *testserver) handle(req []byte, udp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q := msg.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, RCode: s.rcode},
+		Questions: msg.Questions,
+	}
+
+	if udp && s.truncate[q.Name.String()] {
+		resp.Header.Truncated = true
+	} else if s.rcode == dnsmessage.RCodeSuccess {
+		resp.Answers = s.records[q]
+		resp.Additionals = s.extras[q]
+	}
+
+	data, _ := resp.Pack()
+	return data
+}
+
+func (s *testserver) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if resp := s.handle(buf[:n], true); resp != nil {
+			_, _ = s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *testserver) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			var size [2]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return
+			}
+
+			req := make([]byte, binary.BigEndian.Uint16(size[:]))
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+
+			resp := s.handle(req, false)
+			binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+			_, _ = conn.Write(append(size[:], resp...))
+		}()
+	}
+}
+
+func endpointIds(s *loadbalancer.Static) []string {
+	ids := make([]string, len(s.Endpoints))
+	for i, ep := range s.Endpoints {
+		ids[i] = ep.ID()
+	}
+	return ids
+}
+
+func TestDiscoveryIP(t *testing.T) {
+	server := newTestServer(t)
+	server.SetA("www.example.com.", 5, "127.0.0.2", "127.0.0.1")
+	server.SetAAAA("www.example.com.", 3, "::1")
+
+	d, err := New(Config{Name: "www.example.com", Type: TypeIP, Port: 80, Resolvers: []string{server.addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := d.Discover(); s != loadbalancer.None {
+		t.Errorf("expect no endpoints before resolving, but got %v", endpointIds(s))
+	}
+
+	ctx := context.Background()
+	if interval := d.refresh(ctx); interval != time.Second*3 {
+		t.Errorf("expect the refresh interval 3s, but got %s", interval)
+	}
+
+	static := d.Discover()
+	expects := []string{"127.0.0.1:80", "127.0.0.2:80", "[::1]:80"}
+	if ids := endpointIds(static); !reflect.DeepEqual(ids, expects) {
+		t.Errorf("expect the endpoints %v, but got %v", expects, ids)
+	}
+
+	// The unchanged records do not update the endpoints.
+	d.refresh(ctx)
+	if s := d.Discover(); s != static {
+		t.Errorf("expect the same endpoints, but got a new one")
+	}
+
+	// The endpoints that are not changed are reused.
+	server.SetA("www.example.com.", 5, "127.0.0.1")
+	d.refresh(ctx)
+	if s := d.Discover(); len(s.Endpoints) != 2 {
+		t.Errorf("expect 2 endpoints, but got %v", endpointIds(s))
+	} else if s.Endpoints[0] != static.Endpoints[0] {
+		t.Errorf("expect to reuse the endpoint '%s'", s.Endpoints[0].ID())
+	}
+
+	// Keep the last endpoints on error.
+	static = d.Discover()
+	server.SetRCode(dnsmessage.RCodeServerFailure)
+	if interval := d.refresh(ctx); interval != time.Second {
+		t.Errorf("expect the retry interval 1s, but got %s", interval)
+	} else if s := d.Discover(); s != static {
+		t.Errorf("expect the last endpoints, but got %v", endpointIds(s))
+	}
+
+	server.SetRCode(dnsmessage.RCodeNameError)
+	d.refresh(ctx)
+	if s := d.Discover(); s != static {
+		t.Errorf("expect the last endpoints, but got %v", endpointIds(s))
+	}
+}
+
+func TestDiscoverySRV(t *testing.T) {
+	server := newTestServer(t)
+	name := "_http._tcp.example.com."
+	server.AddSRV(name, 30, dnsmessage.SRVResource{
+		Priority: 10, Weight: 5, Port: 8001,
+		Target: dnsmessage.MustNewName("a.example.com."),
+	}, "127.0.0.1")
+	server.AddSRV(name, 20, dnsmessage.SRVResource{
+		Priority: 10, Weight: 0, Port: 8002,
+		Target: dnsmessage.MustNewName("b.example.com."),
+	})
+	server.AddSRV(name, 10, dnsmessage.SRVResource{ // Backup with the lower priority
+		Priority: 20, Weight: 1, Port: 8003,
+		Target: dnsmessage.MustNewName("c.example.com."),
+	})
+	server.SetA("b.example.com.", 40, "127.0.0.2")
+	server.Truncate(name) // Retry the query by TCP.
+
+	d, err := New(Config{Name: name, Type: TypeSRV, Resolvers: []string{server.addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if interval := d.refresh(context.Background()); interval != time.Second*20 {
+		t.Errorf("expect the refresh interval 20s, but got %s", interval)
+	}
+
+	static := d.Discover()
+	expects := []string{"127.0.0.1:8001", "127.0.0.2:8002"}
+	if ids := endpointIds(static); !reflect.DeepEqual(ids, expects) {
+		t.Fatalf("expect the endpoints %v, but got %v", expects, ids)
+	}
+
+	type weighter interface{ Weight() int }
+	if w := static.Endpoints[0].(weighter).Weight(); w != 5 {
+		t.Errorf("expect the weight 5, but got %d", w)
+	}
+	if w := static.Endpoints[1].(weighter).Weight(); w != 1 {
+		t.Errorf("expect the weight 1, but got %d", w)
+	}
+}
+
+func TestDiscoveryStart(t *testing.T) {
+	server := newTestServer(t)
+	server.SetA("www.example.com.", 1, "127.0.0.1")
+
+	_d, err := discovery.DefaultRegistry.Build("dns", map[string]any{
+		"name":        "www.example.com",
+		"port":        80,
+		"resolvers":   []string{server.addr},
+		"minInterval": 1000,
+		"maxInterval": 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := _d.(*Discovery)
+	d.Start()
+	defer d.Stop()
+
+	if ids := endpointIds(d.Discover()); len(ids) != 1 {
+		t.Errorf("expect 1 endpoint after starting, but got %v", ids)
+	}
+
+	server.SetA("www.example.com.", 1, "127.0.0.1", "127.0.0.2")
+	deadline := time.Now().Add(time.Second * 3)
+	for len(d.Discover().Endpoints) != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if ids := endpointIds(d.Discover()); len(ids) != 2 {
+		t.Errorf("expect 2 endpoints after refreshing, but got %v", ids)
+	}
+
+	d.Stop()
+	d.Stop() // Stop twice
+}
+
+func TestConfig(t *testing.T) {
+	for _, test := range []struct {
+		config Config
+		expect Config
+	}{
+		{
+			config: Config{Name: " example.com ", Port: 80, Resolvers: []string{"127.0.0.1"}},
+			expect: Config{Name: "example.com.", Type: TypeIP4, Port: 80, Weight: 1,
+				Resolvers: []string{"127.0.0.1:53"}, MinInterval: 1000,
+				MaxInterval: 60000, Timeout: 3000},
+		},
+		{ // The port of SRV is optional, and MaxInterval is not less than MinInterval.
+			config: Config{Name: "_http._tcp.example.com.", Type: TypeSRV, Weight: 2,
+				Resolvers: []string{"::1", "127.0.0.1:5353"}, MinInterval: 120000},
+			expect: Config{Name: "_http._tcp.example.com.", Type: TypeSRV, Weight: 2,
+				Resolvers: []string{"[::1]:53", "127.0.0.1:5353"}, MinInterval: 120000,
+				MaxInterval: 120000, Timeout: 3000},
+		},
+		{ // MinInterval and Timeout are limited to the minimums.
+			config: Config{Name: "example.com.", Port: 80, Resolvers: []string{"127.0.0.1:53"},
+				MinInterval: 5, MaxInterval: 10, Timeout: 1},
+			expect: Config{Name: "example.com.", Type: TypeIP4, Port: 80, Weight: 1,
+				Resolvers: []string{"127.0.0.1:53"}, MinInterval: minInterval,
+				MaxInterval: minInterval, Timeout: minTimeout},
+		},
+	} {
+		config := test.config
+		if err := config.init(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.config, err)
+		} else if !reflect.DeepEqual(config, test.expect) {
+			t.Errorf("expect the config %+v, but got %+v", test.expect, config)
+		}
+	}
+
+	for _, config := range []Config{
+		{Port: 80},
+		{Name: "example.com", Type: "mx", Port: 80},
+		{Name: "example.com", Type: TypeIP6},
+	} {
+		if err := config.init(); err == nil {
+			t.Errorf("%+v: expect an error, but got nil", config)
+		}
+	}
+}
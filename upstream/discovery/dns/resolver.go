@@ -0,0 +1,163 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var errNoSuchHost = errors.New("no such host")
+
+// resolvconf is the path of the resolver configuration file.
+var resolvconf = "/etc/resolv.conf"
+
+// getSystemResolvers returns the nameservers in /etc/resolv.conf.
+func getSystemResolvers() (resolvers []string) {
+	file, err := os.Open(resolvconf)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			resolvers = append(resolvers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return
+}
+
+type answer struct {
+	resources   []dnsmessage.Resource
+	additionals []dnsmessage.Resource
+}
+
+// query sends the query of the name with the type to the resolvers in turn
+// until one of them responds.
+func query(ctx context.Context, resolvers []string, name string, qtype dnsmessage.Type) (ans answer, err error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return
+	}
+
+	for _, resolver := range resolvers {
+		ans, err = exchange(ctx, resolver, qname, qtype)
+		if err == nil || errors.Is(err, errNoSuchHost) {
+			return
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+func exchange(ctx context.Context, resolver string, name dnsmessage.Name, qtype dnsmessage.Type) (ans answer, err error) {
+	id := uint16(rand.Uint32())
+	req, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return
+	}
+
+	resp, err := roundtrip(ctx, "udp", resolver, req)
+	if err == nil && resp.Header.Truncated {
+		resp, err = roundtrip(ctx, "tcp", resolver, req)
+	}
+
+	switch {
+	case err != nil:
+		return ans, fmt.Errorf("fail to query '%s' from '%s': %w", name, resolver, err)
+
+	case resp.Header.ID != id:
+		return ans, fmt.Errorf("fail to query '%s' from '%s': mismatched id", name, resolver)
+
+	case resp.Header.RCode == dnsmessage.RCodeNameError:
+		return ans, fmt.Errorf("fail to query '%s' from '%s': %w", name, resolver, errNoSuchHost)
+
+	case resp.Header.RCode != dnsmessage.RCodeSuccess:
+		return ans, fmt.Errorf("fail to query '%s' from '%s': %s", name, resolver, resp.Header.RCode)
+	}
+
+	ans.resources = resp.Answers
+	ans.additionals = resp.Additionals
+	return
+}
+
+func roundtrip(ctx context.Context, network, resolver string, req []byte) (resp dnsmessage.Message, err error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, resolver)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	}
+
+	var buf []byte
+	if network == "udp" {
+		if _, err = conn.Write(req); err != nil {
+			return
+		}
+
+		buf = make([]byte, 4096)
+		var n int
+		if n, err = conn.Read(buf); err != nil {
+			return
+		}
+		buf = buf[:n]
+	} else {
+		msg := make([]byte, 2+len(req))
+		binary.BigEndian.PutUint16(msg, uint16(len(req)))
+		copy(msg[2:], req)
+		if _, err = conn.Write(msg); err != nil {
+			return
+		}
+
+		var size [2]byte
+		if _, err = io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+
+		buf = make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return
+		}
+	}
+
+	err = resp.Unpack(buf)
+	return
+}
@@ -0,0 +1,255 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package file provides a discovery named "file", which watches a file
+// containing the upstream servers and reloads them when it changes.
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xgfone/go-apigateway/internal/jsonx"
+	"github.com/xgfone/go-apigateway/orch"
+	"github.com/xgfone/go-apigateway/upstream/discovery"
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-toolkit/runtimex"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	discovery.DefaultRegistry.Register("file", func(name string, conf any) (loadbalancer.Discovery, error) {
+		var config Config
+		if err := discovery.BindConf(name, &config, conf); err != nil {
+			return nil, err
+		}
+		return New(config)
+	})
+}
+
+// Pre-define the formats of the file.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+// minInterval is the minimum interval to check the file, unit: ms.
+const minInterval = 100
+
+// Config is used to configure the file discovery.
+type Config struct {
+	// Required, the path of the file containing the servers, []orch.Server.
+	Path string `json:"path" yaml:"path"`
+
+	// Optional, the format of the file, "json" or "yaml",
+	// and the json file may contain the comments starting with "//".
+	//
+	// Default: "yaml" if the extension of the file is ".yaml" or ".yml". Or, "json".
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+
+	// Optional, the interval to check whether the file changes,
+	// which is 100 at least.
+	//
+	// Unit: ms, Default: 1000
+	Interval int `json:"interval,omitempty" yaml:"interval,omitempty"`
+}
+
+func (c *Config) init() error {
+	if c.Path = strings.TrimSpace(c.Path); c.Path == "" {
+		return errors.New("missing the file path")
+	}
+
+	switch c.Format {
+	case "":
+		switch strings.ToLower(filepath.Ext(c.Path)) {
+		case ".yaml", ".yml":
+			c.Format = FormatYAML
+		default:
+			c.Format = FormatJSON
+		}
+
+	case FormatJSON, FormatYAML:
+	default:
+		return fmt.Errorf("invalid file format '%s'", c.Format)
+	}
+
+	switch {
+	case c.Interval <= 0:
+		c.Interval = 1000
+	case c.Interval < minInterval:
+		c.Interval = minInterval
+	}
+
+	return nil
+}
+
+// Discovery is a file discovery, which implements the interface
+// loadbalancer.Discovery, and should be started to watch the file.
+type Discovery struct {
+	config Config
+	static atomic.Pointer[loadbalancer.Static]
+
+	llock     sync.Mutex
+	data      []byte
+	endpoints map[orch.Server]loadbalancer.Endpoint
+
+	slock  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var _ loadbalancer.Discovery = new(Discovery)
+
+// New returns a new file discovery.
+func New(config Config) (*Discovery, error) {
+	if err := config.init(); err != nil {
+		return nil, fmt.Errorf("Discovery<file>: %w", err)
+	}
+
+	d := &Discovery{config: config}
+	d.static.Store(loadbalancer.None)
+	return d, nil
+}
+
+// Config returns the configuration of the discovery.
+func (d *Discovery) Config() Config { return d.config }
+
+// Discover implements the interface loadbalancer.Discovery,
+// which returns the servers loaded from the file last time.
+func (d *Discovery) Discover() *loadbalancer.Static { return d.static.Load() }
+
+// Start loads the file once and starts to watch it in the background.
+func (d *Discovery) Start() {
+	d.slock.Lock()
+	defer d.slock.Unlock()
+	if d.cancel != nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+	d.done = make(chan struct{})
+
+	d.reload(ctx)
+	go d.loop(ctx, d.done)
+}
+
+// Stop stops watching the file and waits until it exits.
+func (d *Discovery) Stop() {
+	d.slock.Lock()
+	defer d.slock.Unlock()
+	if d.cancel == nil {
+		return
+	}
+
+	d.cancel()
+	<-d.done
+	d.cancel, d.done = nil, nil
+}
+
+func (d *Discovery) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(time.Duration(d.config.Interval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.reload(ctx)
+		}
+	}
+}
+
+func (d *Discovery) reload(ctx context.Context) {
+	defer runtimex.Recover(ctx)
+	if err := d.Load(); err != nil {
+		slog.Error("fail to load the servers from the file, and keep the last servers",
+			"path", d.config.Path, "err", err)
+	}
+}
+
+// Load loads the servers from the file if it has changed.
+//
+// If failing, the last servers are kept.
+func (d *Discovery) Load() (err error) {
+	data, err := os.ReadFile(d.config.Path)
+	if err != nil {
+		return
+	}
+
+	// The file may be being written, and an empty list must be "[]".
+	if len(bytes.TrimSpace(data)) == 0 {
+		return errors.New("the file is empty")
+	}
+
+	d.llock.Lock()
+	defer d.llock.Unlock()
+
+	if d.data != nil && bytes.Equal(data, d.data) {
+		return
+	}
+
+	var servers []orch.Server
+	switch d.config.Format {
+	case FormatYAML:
+		err = yaml.Unmarshal(data, &servers)
+	default:
+		err = json.Unmarshal(jsonx.RemoveComments(data), &servers)
+	}
+	if err != nil {
+		return
+	}
+
+	endpoints := make(map[orch.Server]loadbalancer.Endpoint, len(servers))
+	eps := make(loadbalancer.Endpoints, 0, len(servers))
+	for _, server := range servers {
+		if _, ok := endpoints[server]; ok {
+			continue // Duplicated
+		}
+
+		ep, ok := d.endpoints[server] // Reuse the endpoint to keep its runtime state.
+		if !ok {
+			if ep, err = orch.BuildStaticServer(server); err != nil {
+				return
+			}
+		}
+
+		endpoints[server] = ep
+		eps = append(eps, ep)
+	}
+
+	d.data = data
+	d.endpoints = endpoints
+	if len(eps) == 0 {
+		d.static.Store(loadbalancer.None)
+	} else {
+		d.static.Store(loadbalancer.NewStatic(eps))
+	}
+
+	slog.Info("load the servers from the file", "path", d.config.Path, "servers", len(eps))
+	return
+}
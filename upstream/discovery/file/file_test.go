@@ -0,0 +1,196 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-apigateway/upstream/discovery"
+	"github.com/xgfone/go-loadbalancer"
+)
+
+func endpointIds(s *loadbalancer.Static) []string {
+	ids := make([]string, len(s.Endpoints))
+	for i, ep := range s.Endpoints {
+		ids[i] = ep.ID()
+	}
+	return ids
+}
+
+func writeFile(t *testing.T, path, data string) {
+	// Write and rename it to replace the file atomically.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscoveryJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.json")
+	writeFile(t, path, `[
+		// The comment line
+		{"host": "127.0.0.1", "port": 8001}, // The tail comment
+		{"host": "127.0.0.1", "port": 8002, "weight": 2}
+	]`)
+
+	d, err := New(Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := d.Discover(); s != loadbalancer.None {
+		t.Errorf("expect no endpoints before loading, but got %v", endpointIds(s))
+	}
+
+	if err := d.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	static := d.Discover()
+	expects := []string{"127.0.0.1:8001", "127.0.0.1:8002"}
+	if ids := endpointIds(static); !reflect.DeepEqual(ids, expects) {
+		t.Errorf("expect the endpoints %v, but got %v", expects, ids)
+	}
+
+	// The unchanged file does not update the endpoints.
+	if err := d.Load(); err != nil {
+		t.Error(err)
+	} else if s := d.Discover(); s != static {
+		t.Error("expect the same endpoints, but got a new one")
+	}
+
+	// Keep the last endpoints when failing to parse the file.
+	writeFile(t, path, `[{"host": "127.0.0.1", "port": 8003}`)
+	if err := d.Load(); err == nil {
+		t.Error("expect a parse error, but got nil")
+	} else if s := d.Discover(); s != static {
+		t.Errorf("expect the last endpoints, but got %v", endpointIds(s))
+	}
+
+	// The unchanged servers reuse the endpoints.
+	writeFile(t, path, `[{"host": "127.0.0.1", "port": 8002, "weight": 2}]`)
+	if err := d.Load(); err != nil {
+		t.Error(err)
+	} else if s := d.Discover(); len(s.Endpoints) != 1 {
+		t.Errorf("expect 1 endpoint, but got %v", endpointIds(s))
+	} else if s.Endpoints[0] != static.Endpoints[1] {
+		t.Errorf("expect to reuse the endpoint '%s'", s.Endpoints[0].ID())
+	}
+
+	// Keep the last endpoints when the file is removed.
+	static = d.Discover()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	} else if err := d.Load(); err == nil {
+		t.Error("expect a read error, but got nil")
+	} else if s := d.Discover(); s != static {
+		t.Errorf("expect the last endpoints, but got %v", endpointIds(s))
+	}
+}
+
+func TestDiscoveryYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.yaml")
+	writeFile(t, path, `
+# The comment line
+- host: 127.0.0.1
+  port: 8001
+`)
+
+	_d, err := discovery.DefaultRegistry.Build("file", map[string]any{
+		"path":     path,
+		"interval": 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := _d.(*Discovery)
+	if format := d.Config().Format; format != FormatYAML {
+		t.Errorf("expect the format '%s', but got '%s'", FormatYAML, format)
+	}
+
+	d.Start()
+	defer d.Stop()
+
+	if ids := endpointIds(d.Discover()); len(ids) != 1 {
+		t.Errorf("expect 1 endpoint after starting, but got %v", ids)
+	}
+
+	writeFile(t, path, `
+- host: 127.0.0.1
+  port: 8001
+- host: 127.0.0.1
+  port: 8002
+`)
+
+	deadline := time.Now().Add(time.Second * 3)
+	for len(d.Discover().Endpoints) != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if ids := endpointIds(d.Discover()); len(ids) != 2 {
+		t.Errorf("expect 2 endpoints after changing the file, but got %v", ids)
+	}
+
+	d.Stop()
+	d.Stop() // Stop twice
+}
+
+func TestConfig(t *testing.T) {
+	for _, test := range []struct {
+		config Config
+		expect Config
+	}{
+		{
+			config: Config{Path: " servers.txt "},
+			expect: Config{Path: "servers.txt", Format: FormatJSON, Interval: 1000},
+		},
+		{
+			config: Config{Path: "servers.YML"},
+			expect: Config{Path: "servers.YML", Format: FormatYAML, Interval: 1000},
+		},
+		{
+			config: Config{Path: "servers.yaml", Format: FormatJSON, Interval: 60000},
+			expect: Config{Path: "servers.yaml", Format: FormatJSON, Interval: 60000},
+		},
+		{ // The interval is limited to the minimum.
+			config: Config{Path: "servers.json", Interval: 1},
+			expect: Config{Path: "servers.json", Format: FormatJSON, Interval: minInterval},
+		},
+	} {
+		config := test.config
+		if err := config.init(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.config, err)
+		} else if config != test.expect {
+			t.Errorf("expect the config %+v, but got %+v", test.expect, config)
+		}
+	}
+
+	for _, config := range []Config{
+		{Path: " "},
+		{Path: "servers.toml", Format: "toml"},
+	} {
+		if err := config.init(); err == nil {
+			t.Errorf("%+v: expect an error, but got nil", config)
+		}
+	}
+}
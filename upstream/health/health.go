@@ -0,0 +1,448 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package health provides an active health checker of the upstream endpoints.
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-toolkit/runtimex"
+)
+
+// The types of the health check.
+const (
+	TypeHTTP = "http"
+	TypeTCP  = "tcp"
+)
+
+// DefaultClient is the default http client used by the http probe,
+// which does not follow the redirect.
+var DefaultClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// Config is used to configure the health checker.
+type Config struct {
+	// Optional, the type of the probe, "http" or "tcp".
+	//
+	// Default: "http"
+	Type string
+
+	// Optional, only for the http probe.
+	Scheme    string // Default: "http"
+	Path      string // Default: "/"
+	Host      string // Default: the address of the endpoint
+	StatusMin int    // Default: 200
+	StatusMax int    // Default: max(399, StatusMin/100*100+99)
+
+	// Optional, the interval and timeout of each probe.
+	Interval time.Duration // Default: 10s
+	Timeout  time.Duration // Default: 3s
+
+	// Optional, the number of the consecutive successful or failed probes
+	// to mark the endpoint healthy or unhealthy.
+	HealthyThreshold   int // Default: 2
+	UnhealthyThreshold int // Default: 3
+
+	// Optional, the http client used by the http probe.
+	//
+	// Default: DefaultClient
+	Client *http.Client
+}
+
+func (c *Config) init() error {
+	switch c.Type = strings.ToLower(c.Type); c.Type {
+	case "":
+		c.Type = TypeHTTP
+	case TypeHTTP, TypeTCP:
+	default:
+		return fmt.Errorf("unsupported health check type '%s'", c.Type)
+	}
+
+	switch c.Scheme = strings.ToLower(c.Scheme); c.Scheme {
+	case "":
+		c.Scheme = "http"
+	case "http", "https":
+	default:
+		return fmt.Errorf("unsupported health check scheme '%s'", c.Scheme)
+	}
+
+	if c.Path == "" {
+		c.Path = "/"
+	} else if c.Path[0] != '/' {
+		c.Path = "/" + c.Path
+	}
+
+	if c.StatusMin <= 0 {
+		c.StatusMin = 200
+	}
+	if c.StatusMax <= 0 {
+		c.StatusMax = max(399, c.StatusMin/100*100+99)
+	}
+	if c.StatusMin > c.StatusMax {
+		return fmt.Errorf("invalid health check status range [%d, %d]", c.StatusMin, c.StatusMax)
+	}
+
+	if c.Interval <= 0 {
+		c.Interval = time.Second * 10
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = time.Second * 3
+	}
+
+	if c.HealthyThreshold <= 0 {
+		c.HealthyThreshold = 2
+	}
+	if c.UnhealthyThreshold <= 0 {
+		c.UnhealthyThreshold = 3
+	}
+
+	if c.Client == nil {
+		c.Client = DefaultClient
+	}
+
+	return nil
+}
+
+// State is the health state of an endpoint.
+type State struct {
+	Healthy   bool      `json:"healthy"`
+	Successes int       `json:"successes"` // The number of the consecutive successful probes.
+	Failures  int       `json:"failures"`  // The number of the consecutive failed probes.
+	LastCheck time.Time `json:"lastCheck,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+type cache struct {
+	version uint64
+	source  *loadbalancer.Static
+	healthy *loadbalancer.Static
+}
+
+// Checker is an active health checker, which probes the endpoints
+// discovered by the wrapped discovery periodically, and implements
+// the interface loadbalancer.Discovery to only return the healthy endpoints.
+//
+// The id of the endpoint is used as the address to be probed,
+// such as "host:port".
+//
+// The endpoint is considered as healthy before it has been probed.
+type Checker struct {
+	name      string
+	config    Config
+	discovery loadbalancer.Discovery
+	probe     func(ctx context.Context, addr string) error
+
+	lock    sync.RWMutex
+	states  map[string]*State
+	version atomic.Uint64
+	cache   atomic.Pointer[cache]
+
+	slock  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var _ loadbalancer.Discovery = new(Checker)
+
+// NewChecker returns a new health checker named name, such as the upstream id,
+// which checks the endpoints of the discovery.
+func NewChecker(name string, discovery loadbalancer.Discovery, config Config) (*Checker, error) {
+	if discovery == nil {
+		panic("health.NewChecker: discovery must not be nil")
+	}
+
+	if err := config.init(); err != nil {
+		return nil, err
+	}
+
+	c := &Checker{
+		name:      name,
+		config:    config,
+		discovery: discovery,
+		states:    make(map[string]*State, 8),
+	}
+
+	switch config.Type {
+	case TypeTCP:
+		c.probe = c.probeTCP
+	default:
+		c.probe = c.probeHTTP
+	}
+
+	return c, nil
+}
+
+// Config returns the configuration of the checker.
+func (c *Checker) Config() Config { return c.config }
+
+// Discovery returns the wrapped discovery.
+func (c *Checker) Discovery() loadbalancer.Discovery { return c.discovery }
+
+// Discover implements the interface loadbalancer.Discovery,
+// which only returns the healthy endpoints.
+func (c *Checker) Discover() *loadbalancer.Static {
+	source := c.discovery.Discover()
+	version := c.version.Load()
+	if cache := c.cache.Load(); cache != nil && cache.source == source && cache.version == version {
+		return cache.healthy
+	}
+
+	healthy := c.filter(source)
+	c.cache.Store(&cache{version: version, source: source, healthy: healthy})
+	return healthy
+}
+
+func (c *Checker) filter(source *loadbalancer.Static) *loadbalancer.Static {
+	if source == nil || len(source.Endpoints) == 0 {
+		return source
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var eps loadbalancer.Endpoints
+	for i, ep := range source.Endpoints {
+		if state, ok := c.states[ep.ID()]; !ok || state.Healthy {
+			if eps != nil {
+				eps = append(eps, ep)
+			}
+			continue
+		}
+
+		if eps == nil {
+			eps = make(loadbalancer.Endpoints, i, len(source.Endpoints))
+			copy(eps, source.Endpoints[:i])
+		}
+	}
+
+	switch {
+	case eps == nil:
+		return source // All are healthy.
+	case len(eps) == 0:
+		return loadbalancer.None
+	default:
+		return loadbalancer.NewStatic(eps)
+	}
+}
+
+// IsHealthy reports whether the endpoint is healthy.
+//
+// The endpoint which has not been probed is considered as healthy.
+func (c *Checker) IsHealthy(epid string) bool {
+	c.lock.RLock()
+	state, ok := c.states[epid]
+	healthy := !ok || state.Healthy
+	c.lock.RUnlock()
+	return healthy
+}
+
+// State returns the health state of the endpoint.
+//
+// If the endpoint has not been probed, return (State{}, false).
+func (c *Checker) State(epid string) (state State, ok bool) {
+	c.lock.RLock()
+	if s, exist := c.states[epid]; exist {
+		state, ok = *s, true
+	}
+	c.lock.RUnlock()
+	return
+}
+
+// States returns the health states of all the probed endpoints.
+func (c *Checker) States() map[string]State {
+	c.lock.RLock()
+	states := make(map[string]State, len(c.states))
+	for id, state := range c.states {
+		states[id] = *state
+	}
+	c.lock.RUnlock()
+	return states
+}
+
+// ------------------------------------------------------------------------ //
+
+// Start starts the checker in the background, which does nothing
+// if the checker has been started.
+func (c *Checker) Start() {
+	c.slock.Lock()
+	defer c.slock.Unlock()
+	if c.cancel != nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	c.done = make(chan struct{})
+	go c.loop(ctx, c.done)
+}
+
+// Stop stops the checker and waits until it exits.
+func (c *Checker) Stop() {
+	c.slock.Lock()
+	defer c.slock.Unlock()
+	if c.cancel == nil {
+		return
+	}
+
+	c.cancel()
+	<-c.done
+	c.cancel, c.done = nil, nil
+}
+
+func (c *Checker) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check probes all the endpoints once concurrently
+// and waits until all the probes finish.
+func (c *Checker) Check(ctx context.Context) {
+	defer runtimex.Recover(ctx)
+
+	source := c.discovery.Discover()
+	var eps loadbalancer.Endpoints
+	if source != nil {
+		eps = source.Endpoints
+	}
+
+	errs := make([]error, len(eps))
+	var wg sync.WaitGroup
+	for i, ep := range eps {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+			defer cancel()
+			errs[i] = c.probe(ctx, addr)
+		}(i, ep.ID())
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return // The checker has been stopped.
+	}
+
+	c.update(eps, errs)
+}
+
+func (c *Checker) update(eps loadbalancer.Endpoints, errs []error) {
+	now := time.Now()
+	ids := make(map[string]struct{}, len(eps))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var changed bool
+	for i, ep := range eps {
+		id := ep.ID()
+		ids[id] = struct{}{}
+
+		state, ok := c.states[id]
+		if !ok {
+			state = &State{Healthy: true}
+			c.states[id] = state
+		}
+
+		state.LastCheck = now
+		if err := errs[i]; err == nil {
+			state.Failures = 0
+			state.Successes++
+			state.LastError = ""
+			if !state.Healthy && state.Successes >= c.config.HealthyThreshold {
+				state.Healthy, changed = true, true
+				slog.Info("the upstream endpoint becomes healthy", "upstream", c.name, "endpoint", id)
+			}
+		} else {
+			state.Successes = 0
+			state.Failures++
+			state.LastError = err.Error()
+			if state.Healthy && state.Failures >= c.config.UnhealthyThreshold {
+				state.Healthy, changed = false, true
+				slog.Warn("the upstream endpoint becomes unhealthy",
+					"upstream", c.name, "endpoint", id, "err", err)
+			}
+		}
+	}
+
+	// Remove the states of the endpoints that have gone.
+	for id := range c.states {
+		if _, ok := ids[id]; !ok {
+			delete(c.states, id)
+			changed = true
+		}
+	}
+
+	if changed {
+		c.version.Add(1)
+	}
+}
+
+func (c *Checker) probeTCP(ctx context.Context, addr string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (c *Checker) probeHTTP(ctx context.Context, addr string) error {
+	url := strings.Join([]string{c.config.Scheme, "://", addr, c.config.Path}, "")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	if c.config.Host != "" {
+		req.Host = c.config.Host
+	}
+	req.Header.Set("User-Agent", "go-apigateway-healthcheck")
+
+	resp, err := c.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	_, _ = io.CopyN(io.Discard, resp.Body, 4096)
+	resp.Body.Close()
+
+	if resp.StatusCode < c.config.StatusMin || resp.StatusCode > c.config.StatusMax {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
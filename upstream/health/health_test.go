@@ -0,0 +1,233 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-loadbalancer"
+)
+
+type testendpoint string
+
+func (ep testendpoint) ID() string                              { return string(ep) }
+func (ep testendpoint) Serve(context.Context, any) (any, error) { return nil, nil }
+
+func newStatic(addrs ...string) *loadbalancer.Static {
+	eps := make(loadbalancer.Endpoints, len(addrs))
+	for i, addr := range addrs {
+		eps[i] = testendpoint(addr)
+	}
+	return loadbalancer.NewStatic(eps)
+}
+
+func endpointIds(s *loadbalancer.Static) []string {
+	ids := make([]string, len(s.Endpoints))
+	for i, ep := range s.Endpoints {
+		ids[i] = ep.ID()
+	}
+	return ids
+}
+
+func TestCheckerHTTP(t *testing.T) {
+	var failed atomic.Bool
+	var host atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.Store(r.Host)
+		if r.URL.Path != "/health" || failed.Load() {
+			w.WriteHeader(500)
+		} else {
+			w.WriteHeader(204)
+		}
+	}))
+	defer server.Close()
+
+	addr := strings.TrimPrefix(server.URL, "http://")
+	static := newStatic(addr)
+	checker, err := NewChecker("up", static, Config{
+		Path:               "health",
+		Host:               "www.example.com",
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := checker.Discover(); s != static {
+		t.Errorf("expect the original static before checking, but got %v", endpointIds(s))
+	}
+
+	checker.Check(context.Background())
+	if state, ok := checker.State(addr); !ok || !state.Healthy || state.Successes != 1 {
+		t.Errorf("expect healthy with 1 success, but got %+v", state)
+	} else if h := host.Load(); h != "www.example.com" {
+		t.Errorf("expect the host 'www.example.com', but got '%v'", h)
+	}
+
+	failed.Store(true)
+	checker.Check(context.Background())
+	if !checker.IsHealthy(addr) {
+		t.Errorf("expect healthy before reaching the unhealthy threshold")
+	}
+
+	checker.Check(context.Background())
+	if checker.IsHealthy(addr) {
+		t.Errorf("expect unhealthy after reaching the unhealthy threshold")
+	} else if s := checker.Discover(); len(s.Endpoints) != 0 {
+		t.Errorf("expect no endpoints, but got %v", endpointIds(s))
+	} else if state, _ := checker.State(addr); state.LastError == "" {
+		t.Errorf("expect the last error, but got none")
+	}
+
+	failed.Store(false)
+	checker.Check(context.Background())
+	checker.Check(context.Background())
+	if !checker.IsHealthy(addr) {
+		t.Errorf("expect healthy after reaching the healthy threshold")
+	} else if s := checker.Discover(); len(s.Endpoints) != 1 {
+		t.Errorf("expect 1 endpoint, but got %v", endpointIds(s))
+	}
+}
+
+func TestCheckerTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// Get an address that is not listened.
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadaddr := ln2.Addr().String()
+	ln2.Close()
+
+	liveaddr := ln.Addr().String()
+	checker, err := NewChecker("up", newStatic(deadaddr, liveaddr), Config{
+		Type:               TypeTCP,
+		Interval:           time.Millisecond * 10,
+		Timeout:            time.Second,
+		UnhealthyThreshold: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker.Start()
+	defer checker.Stop()
+
+	deadline := time.Now().Add(time.Second * 3)
+	for checker.IsHealthy(deadaddr) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if ids := endpointIds(checker.Discover()); len(ids) != 1 || ids[0] != liveaddr {
+		t.Errorf("expect the endpoints [%s], but got %v", liveaddr, ids)
+	}
+
+	states := checker.States()
+	if len(states) != 2 {
+		t.Errorf("expect 2 states, but got %d", len(states))
+	} else if !states[liveaddr].Healthy {
+		t.Errorf("expect the endpoint '%s' healthy, but got unhealthy", liveaddr)
+	}
+
+	checker.Stop()
+	checker.Stop() // Stop twice
+}
+
+func TestCheckerRemoveEndpoint(t *testing.T) {
+	static := newStatic("127.0.0.1:1", "127.0.0.1:2")
+	discovery := loadbalancer.DiscoveryFunc(func() *loadbalancer.Static { return static })
+
+	checker, err := NewChecker("up", discovery, Config{UnhealthyThreshold: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker.probe = func(context.Context, string) error { return context.DeadlineExceeded }
+
+	checker.Check(context.Background())
+	if s := checker.Discover(); len(s.Endpoints) != 0 {
+		t.Errorf("expect no endpoints, but got %v", endpointIds(s))
+	}
+
+	static = newStatic("127.0.0.1:2")
+	checker.probe = func(context.Context, string) error { return nil }
+	checker.Check(context.Background())
+	if states := checker.States(); len(states) != 1 {
+		t.Errorf("expect 1 state, but got %d", len(states))
+	} else if state := states["127.0.0.1:2"]; state.Healthy {
+		t.Errorf("expect still unhealthy, but got healthy")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	client := new(http.Client)
+	for _, test := range []struct {
+		config Config
+		expect Config
+	}{
+		{
+			config: Config{Type: "TCP", Scheme: "HTTPS", Path: "healthz", StatusMin: 204,
+				Interval: time.Second, HealthyThreshold: 1, Client: client},
+			expect: Config{Type: TypeTCP, Scheme: "https", Path: "/healthz", StatusMin: 204, StatusMax: 399,
+				Interval: time.Second, Timeout: time.Second * 3,
+				HealthyThreshold: 1, UnhealthyThreshold: 3, Client: client},
+		},
+		{ // StatusMax defaults to the end of the class of StatusMin.
+			config: Config{StatusMin: 400, Client: client},
+			expect: Config{Type: TypeHTTP, Scheme: "http", Path: "/", StatusMin: 400, StatusMax: 499,
+				Interval: time.Second * 10, Timeout: time.Second * 3,
+				HealthyThreshold: 2, UnhealthyThreshold: 3, Client: client},
+		},
+	} {
+		config := test.config
+		if err := config.init(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.config, err)
+		} else if config != test.expect {
+			t.Errorf("expect the config %+v, but got %+v", test.expect, config)
+		}
+	}
+
+	for _, config := range []Config{
+		{Type: "udp"},
+		{Scheme: "ftp"},
+		{StatusMin: 500, StatusMax: 400},
+	} {
+		if err := config.init(); err == nil {
+			t.Errorf("%+v: expect an error, but got nil", config)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lifecycle provides the lifecycle management of the upstream
+// endpoints, which ramps up the weight of the newly added endpoints
+// and drains the removed ones.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xgfone/go-loadbalancer"
+	"github.com/xgfone/go-toolkit/runtimex"
+)
+
+// ErrDrainTimeout is the cause of the context of the in-flight request
+// canceled when the drain deadline of the endpoint arrives.
+var ErrDrainTimeout = errors.New("drain timeout")
+
+// CheckInterval is the interval to check whether the endpoints change.
+var CheckInterval = time.Second
+
+// Config is used to configure the lifecycle of the endpoints.
+type Config struct {
+	// Optional, the duration of the slow start, during which the weight
+	// of the newly added endpoint ramps up linearly from MinWeightPercent
+	// to 100 percent. 0 disables the slow start.
+	SlowStart time.Duration
+
+	// Optional, the percent of the weight when the slow start begins, range: (0, 100].
+	//
+	// Default: 10
+	MinWeightPercent int
+
+	// Optional, the maximum duration for the removed endpoint to finish
+	// the in-flight requests, after which they are canceled.
+	// 0 means no deadline.
+	DrainTimeout time.Duration
+}
+
+func (c *Config) init() error {
+	if c.SlowStart < 0 {
+		return fmt.Errorf("invalid slow start window '%s'", c.SlowStart)
+	}
+	if c.DrainTimeout < 0 {
+		return fmt.Errorf("invalid drain timeout '%s'", c.DrainTimeout)
+	}
+
+	switch {
+	case c.MinWeightPercent == 0:
+		c.MinWeightPercent = 10
+	case c.MinWeightPercent < 0 || c.MinWeightPercent > 100:
+		return fmt.Errorf("invalid min weight percent %d", c.MinWeightPercent)
+	}
+
+	return nil
+}
+
+// State is the lifecycle state of an endpoint.
+type State struct {
+	Inflight int `json:"inflight"`
+
+	// Only for the endpoint in the slow start.
+	Warming bool      `json:"warming,omitempty"`
+	Added   time.Time `json:"added,omitempty"`
+
+	// Only for the removed endpoint finishing the in-flight requests.
+	Draining bool      `json:"draining,omitempty"`
+	Since    time.Time `json:"since,omitempty"`
+	Deadline time.Time `json:"deadline,omitempty"` // Zero means no deadline.
+}
+
+// Drain is the state of the draining endpoint.
+type Drain struct {
+	Upstream string    `json:"upstream"`
+	Endpoint string    `json:"endpoint"`
+	Inflight int       `json:"inflight"`
+	Since    time.Time `json:"since"`
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
+// draining is the set of the lifecycles that have the draining endpoints,
+// which may have been removed from the upstream manager.
+var draining sync.Map // map[*Lifecycle]struct{}
+
+// Draining returns the states of all the draining endpoints,
+// including those of the replaced or deleted upstreams.
+func Draining() []Drain {
+	var drains []Drain
+	draining.Range(func(key, _ any) bool {
+		drains = append(drains, key.(*Lifecycle).drains()...)
+		return true
+	})
+
+	slices.SortFunc(drains, func(a, b Drain) int {
+		if c := strings.Compare(a.Upstream, b.Upstream); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Endpoint, b.Endpoint)
+	})
+	return drains
+}
+
+type epstate struct {
+	present  bool      // Whether the endpoint is in the discovery.
+	added    time.Time // Only for the endpoint in the slow start.
+	inflight int
+
+	since    time.Time // The time when it starts to drain.
+	deadline time.Time
+	timer    *time.Timer
+
+	// Canceled when the drain deadline arrives.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (s *epstate) state(window time.Duration) State {
+	state := State{
+		Inflight: s.inflight,
+		Draining: !s.since.IsZero(),
+		Since:    s.since,
+		Deadline: s.deadline,
+	}
+
+	// The slow start is ended lazily by Ratio.
+	if !s.added.IsZero() && time.Since(s.added) < window {
+		state.Warming, state.Added = true, s.added
+	}
+	return state
+}
+
+// Lifecycle manages the lifecycle of the endpoints of an upstream.
+//
+// The endpoints discovered when starting are ready at once, and those added
+// later are in the slow start, the weight ratio of which is returned by Ratio.
+// If it inherits the lifecycle of the replaced upstream, only the endpoints
+// that are absent from the replaced one are in the slow start.
+//
+// The removed endpoints take no new requests, but the in-flight requests
+// tracked by Track may finish until the drain deadline arrives.
+// When the lifecycle is stopped, such as the upstream is replaced or deleted,
+// the endpoints that are not inherited by the new one are drained.
+type Lifecycle struct {
+	name      string
+	config    Config
+	discovery loadbalancer.Discovery
+
+	last    atomic.Pointer[loadbalancer.Static]
+	warming atomic.Int64 // The number of the endpoints in the slow start.
+
+	lock     sync.Mutex
+	inited   bool
+	previous *Lifecycle
+	handover map[string]struct{} // The endpoints inherited by the new lifecycle.
+	states   map[string]*epstate
+	ndrains  int
+
+	slock  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New returns a new lifecycle named name, such as the upstream id,
+// which manages the endpoints of the discovery.
+func New(name string, discovery loadbalancer.Discovery, config Config) (*Lifecycle, error) {
+	if discovery == nil {
+		panic("lifecycle.New: discovery must not be nil")
+	}
+
+	if err := config.init(); err != nil {
+		return nil, err
+	}
+
+	return &Lifecycle{
+		name:      name,
+		config:    config,
+		discovery: discovery,
+		states:    make(map[string]*epstate, 8),
+	}, nil
+}
+
+// Config returns the configuration of the lifecycle.
+func (l *Lifecycle) Config() Config { return l.config }
+
+// Inherit inherits the endpoint states of the lifecycle of the replaced
+// upstream, which should be called only before starting the lifecycle.
+func (l *Lifecycle) Inherit(previous *Lifecycle) {
+	if previous != l {
+		l.lock.Lock()
+		l.previous = previous
+		l.lock.Unlock()
+	}
+}
+
+// State returns the lifecycle state of the endpoint.
+//
+// If the endpoint is not tracked, return (State{}, false).
+func (l *Lifecycle) State(epid string) (state State, ok bool) {
+	l.lock.Lock()
+	if s, exist := l.states[epid]; exist {
+		state, ok = s.state(l.config.SlowStart), true
+	}
+	l.lock.Unlock()
+	return
+}
+
+// States returns the lifecycle states of all the tracked endpoints.
+func (l *Lifecycle) States() map[string]State {
+	l.lock.Lock()
+	states := make(map[string]State, len(l.states))
+	for id, s := range l.states {
+		states[id] = s.state(l.config.SlowStart)
+	}
+	l.lock.Unlock()
+	return states
+}
+
+func (l *Lifecycle) drains() (drains []Drain) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for id, s := range l.states {
+		if !s.since.IsZero() {
+			drains = append(drains, Drain{
+				Upstream: l.name,
+				Endpoint: id,
+				Inflight: s.inflight,
+				Since:    s.since,
+				Deadline: s.deadline,
+			})
+		}
+	}
+	return
+}
+
+// Ratio returns the ratio of the weight of the endpoint, range: (0, 1],
+// which is less than 1 only if the endpoint is in the slow start.
+func (l *Lifecycle) Ratio(epid string) float64 {
+	if l.config.SlowStart <= 0 {
+		return 1
+	}
+
+	l.check()
+	if l.warming.Load() == 0 {
+		return 1
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	s, ok := l.states[epid]
+	if !ok || s.added.IsZero() {
+		return 1
+	}
+
+	elapsed := time.Since(s.added)
+	if elapsed >= l.config.SlowStart {
+		s.added = time.Time{}
+		l.warming.Add(-1)
+		return 1
+	}
+
+	low := float64(l.config.MinWeightPercent) / 100
+	return low + (1-low)*float64(elapsed)/float64(l.config.SlowStart)
+}
+
+// Track tracks the in-flight request forwarded to the endpoint,
+// and returns the context of the request, which is canceled
+// when the drain deadline of the endpoint arrives or end is called.
+//
+// end must be called when the request finishes.
+func (l *Lifecycle) Track(ctx context.Context, epid string) (_ context.Context, end func()) {
+	l.check()
+
+	l.lock.Lock()
+	s, ok := l.states[epid]
+	if !ok {
+		s = new(epstate)
+		l.states[epid] = s
+	}
+	s.inflight++
+
+	if l.config.DrainTimeout > 0 {
+		if s.ctx == nil {
+			s.ctx, s.cancel = context.WithCancel(context.Background())
+		}
+
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		stop := context.AfterFunc(s.ctx, func() { cancel(ErrDrainTimeout) })
+		l.lock.Unlock()
+
+		return ctx, func() { stop(); cancel(nil); l.end(epid, s) }
+	}
+	l.lock.Unlock()
+
+	return ctx, func() { l.end(epid, s) }
+}
+
+func (l *Lifecycle) end(epid string, s *epstate) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if s.inflight--; s.inflight > 0 || s.present {
+		return
+	}
+
+	if !s.since.IsZero() {
+		slog.Info("the endpoint has been drained", "upstream", l.name, "endpoint", epid,
+			"cost", time.Since(s.since).String())
+		l.finishDrain(s)
+	}
+
+	if l.states[epid] == s {
+		delete(l.states, epid)
+	}
+}
+
+// check synchronizes the endpoints if the discovery changes.
+func (l *Lifecycle) check() {
+	if source := l.discovery.Discover(); source != l.last.Load() {
+		l.sync(source)
+	}
+}
+
+func (l *Lifecycle) sync(source *loadbalancer.Static) {
+	var eps loadbalancer.Endpoints
+	if source != nil {
+		eps = source.Endpoints
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.last.Load() == source {
+		return
+	}
+	l.last.Store(source)
+
+	now := time.Now()
+	ids := make(map[string]struct{}, len(eps))
+	for _, ep := range eps {
+		ids[ep.ID()] = struct{}{}
+	}
+
+	initial := !l.inited && l.previous == nil
+	if initial && len(eps) == 0 {
+		return // Wait for the first endpoints, which are ready at once.
+	}
+	l.inited = true
+
+	var prevs map[string]State
+	if l.previous != nil {
+		prevs = l.previous.States()
+		l.previous.inherit(ids)
+		l.previous = nil
+	}
+
+	for id := range ids {
+		s, ok := l.states[id]
+		switch {
+		case !ok:
+			s = new(epstate)
+			l.states[id] = s
+
+		case s.present:
+			continue
+
+		case !s.since.IsZero():
+			slog.Info("the draining endpoint is added again", "upstream", l.name, "endpoint", id)
+			l.finishDrain(s)
+		}
+
+		s.present = true
+		if initial || l.config.SlowStart <= 0 {
+			continue
+		}
+
+		if prevs != nil {
+			if prev, ok := prevs[id]; ok && !prev.Draining {
+				if prev.Warming {
+					s.added = prev.Added
+					l.warming.Add(1)
+				}
+				continue
+			}
+		}
+
+		s.added = now
+		l.warming.Add(1)
+	}
+
+	for id, s := range l.states {
+		if _, ok := ids[id]; !ok && s.present {
+			l.startDrain(id, s, now)
+		}
+	}
+}
+
+// inherit records the endpoints inherited by the new lifecycle,
+// which are not drained when the lifecycle is stopped.
+func (l *Lifecycle) inherit(ids map[string]struct{}) {
+	l.lock.Lock()
+	l.handover = ids
+	l.lock.Unlock()
+}
+
+func (l *Lifecycle) startDrain(epid string, s *epstate, now time.Time) {
+	s.present = false
+	if !s.added.IsZero() {
+		s.added = time.Time{}
+		l.warming.Add(-1)
+	}
+
+	if s.inflight == 0 {
+		delete(l.states, epid)
+		return
+	}
+
+	s.since = now
+	if timeout := l.config.DrainTimeout; timeout > 0 {
+		s.deadline = now.Add(timeout)
+		s.timer = time.AfterFunc(timeout, func() { l.expire(epid, s) })
+	}
+
+	if l.ndrains++; l.ndrains == 1 {
+		draining.Store(l, struct{}{})
+	}
+
+	slog.Info("start to drain the endpoint", "upstream", l.name, "endpoint", epid,
+		"inflight", s.inflight, "timeout", l.config.DrainTimeout.String())
+}
+
+func (l *Lifecycle) finishDrain(s *epstate) {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	s.since, s.deadline = time.Time{}, time.Time{}
+	if l.ndrains--; l.ndrains == 0 {
+		draining.Delete(l)
+	}
+}
+
+func (l *Lifecycle) expire(epid string, s *epstate) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if s.since.IsZero() || s.cancel == nil {
+		return
+	}
+
+	slog.Warn("the drain deadline arrives, and cancel the in-flight requests",
+		"upstream", l.name, "endpoint", epid, "inflight", s.inflight)
+
+	// Replace the context so that the later requests are not canceled
+	// if the endpoint is added again.
+	s.cancel()
+	s.ctx, s.cancel = nil, nil
+}
+
+// Start synchronizes the endpoints once and starts to check
+// whether they change in the background.
+func (l *Lifecycle) Start() {
+	l.slock.Lock()
+	defer l.slock.Unlock()
+	if l.cancel != nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, l.cancel = context.WithCancel(context.Background())
+	l.done = make(chan struct{})
+
+	l.check()
+	go l.loop(ctx, l.done)
+}
+
+// Stop stops checking the endpoints, and drains all the endpoints
+// except those inherited by the new lifecycle.
+func (l *Lifecycle) Stop() {
+	l.slock.Lock()
+	defer l.slock.Unlock()
+	if l.cancel == nil {
+		return
+	}
+
+	l.cancel()
+	<-l.done
+	l.cancel, l.done = nil, nil
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	for id, s := range l.states {
+		if _, ok := l.handover[id]; !ok && s.present {
+			l.startDrain(id, s, now)
+		}
+	}
+}
+
+func (l *Lifecycle) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			func() {
+				defer runtimex.Recover(ctx)
+				l.check()
+			}()
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-loadbalancer"
+)
+
+type testendpoint string
+
+func (ep testendpoint) ID() string                              { return string(ep) }
+func (ep testendpoint) Serve(context.Context, any) (any, error) { return nil, nil }
+
+type testdiscovery struct {
+	static atomic.Pointer[loadbalancer.Static]
+}
+
+func (d *testdiscovery) Discover() *loadbalancer.Static { return d.static.Load() }
+func (d *testdiscovery) Set(ids ...string) {
+	eps := make(loadbalancer.Endpoints, len(ids))
+	for i, id := range ids {
+		eps[i] = testendpoint(id)
+	}
+	d.static.Store(loadbalancer.NewStatic(eps))
+}
+
+func newDiscovery(ids ...string) *testdiscovery {
+	d := new(testdiscovery)
+	d.Set(ids...)
+	return d
+}
+
+func TestSlowStart(t *testing.T) {
+	d := newDiscovery("ep1")
+	l, err := New("up", d, Config{SlowStart: time.Millisecond * 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Start()
+	defer l.Stop()
+
+	if r := l.Ratio("ep1"); r != 1 {
+		t.Errorf("expect the ratio 1 of the initial endpoint, but got %v", r)
+	}
+
+	d.Set("ep1", "ep2")
+	if r := l.Ratio("ep2"); r < 0.1 || r >= 0.5 {
+		t.Errorf("expect the ratio of the new endpoint in [0.1, 0.5), but got %v", r)
+	}
+	if s, _ := l.State("ep2"); !s.Warming {
+		t.Errorf("expect the new endpoint to be warming, but got %+v", s)
+	}
+
+	time.Sleep(time.Millisecond * 120)
+	if r := l.Ratio("ep2"); r != 1 {
+		t.Errorf("expect the ratio 1 after the slow start, but got %v", r)
+	}
+	if s, _ := l.State("ep2"); s.Warming {
+		t.Errorf("expect the slow start to end, but got %+v", s)
+	}
+}
+
+func TestInherit(t *testing.T) {
+	config := Config{SlowStart: time.Minute, DrainTimeout: time.Minute}
+
+	prev, err := New("up", newDiscovery("ep1", "ep2"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev.Start()
+
+	_, end1 := prev.Track(context.Background(), "ep1")
+	_, end2 := prev.Track(context.Background(), "ep2")
+
+	l, err := New("up", newDiscovery("ep2", "ep3"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Inherit(prev)
+	l.Start()
+	defer l.Stop()
+
+	if r := l.Ratio("ep2"); r != 1 {
+		t.Errorf("expect the ratio 1 of the inherited endpoint, but got %v", r)
+	}
+	if r := l.Ratio("ep3"); r >= 1 {
+		t.Errorf("expect the new endpoint in the slow start, but got the ratio %v", r)
+	}
+
+	prev.Stop()
+	if drains := Draining(); len(drains) != 1 {
+		t.Errorf("expect 1 draining endpoint, but got %+v", drains)
+	} else if drain := drains[0]; drain.Upstream != "up" || drain.Endpoint != "ep1" ||
+		drain.Inflight != 1 || drain.Deadline.IsZero() {
+		t.Errorf("unexpected draining endpoint %+v", drain)
+	}
+
+	end1()
+	end2()
+	if drains := Draining(); len(drains) != 0 {
+		t.Errorf("expect no draining endpoints, but got %+v", drains)
+	}
+	if _, ok := prev.State("ep1"); ok {
+		t.Error("expect the drained endpoint to be removed")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	d := newDiscovery("ep1", "ep2")
+	l, err := New("up", d, Config{DrainTimeout: time.Millisecond * 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Start()
+	defer l.Stop()
+
+	ctx1, end1 := l.Track(context.Background(), "ep1")
+	defer end1()
+
+	ctx2, end2 := l.Track(context.Background(), "ep2")
+	defer end2()
+
+	d.Set("ep2")
+	l.check()
+	if s, _ := l.State("ep1"); !s.Draining || s.Inflight != 1 {
+		t.Errorf("expect the removed endpoint to be draining, but got %+v", s)
+	}
+
+	select {
+	case <-ctx1.Done():
+		if err := context.Cause(ctx1); !errors.Is(err, ErrDrainTimeout) {
+			t.Errorf("expect the error '%v', but got '%v'", ErrDrainTimeout, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expect the in-flight request to be canceled after the drain timeout")
+	}
+
+	if err := ctx2.Err(); err != nil {
+		t.Errorf("expect the request of the present endpoint not to be canceled, but got '%v'", err)
+	}
+
+	// The draining endpoint is added again.
+	ctx3, end3 := l.Track(context.Background(), "ep2")
+	d.Set()
+	l.check()
+	d.Set("ep2")
+	l.check()
+	if err := ctx3.Err(); err != nil {
+		t.Errorf("unexpected error '%v'", err)
+	}
+
+	end3()
+	if s, _ := l.State("ep2"); s.Draining || s.Inflight != 1 {
+		t.Errorf("expect the endpoint to be not draining, but got %+v", s)
+	}
+	if ctx3.Err() == nil {
+		t.Error("expect the context to be canceled after the request ends, but not")
+	}
+}
+
+func TestTrackEnd(t *testing.T) {
+	l, err := New("up", newDiscovery("ep1"), Config{DrainTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Start()
+	defer l.Stop()
+
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx, end := l.Track(parent, "ep1")
+	if ctx.Err() != nil {
+		t.Fatalf("unexpected error '%v'", ctx.Err())
+	}
+
+	end()
+	if ctx.Err() == nil {
+		t.Error("expect the context to be canceled after end, but got nil")
+	}
+	if parent.Err() != nil {
+		t.Errorf("expect the parent context not to be canceled, but got '%v'", parent.Err())
+	}
+}
+
+func TestConfig(t *testing.T) {
+	for _, test := range []struct {
+		config Config
+		expect Config
+	}{
+		{
+			config: Config{SlowStart: time.Minute, MinWeightPercent: 100, DrainTimeout: time.Second},
+			expect: Config{SlowStart: time.Minute, MinWeightPercent: 100, DrainTimeout: time.Second},
+		},
+	} {
+		config := test.config
+		if err := config.init(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.config, err)
+		} else if config != test.expect {
+			t.Errorf("expect the config %+v, but got %+v", test.expect, config)
+		}
+	}
+
+	for _, config := range []Config{
+		{SlowStart: -1},
+		{DrainTimeout: -1},
+		{MinWeightPercent: -1},
+		{MinWeightPercent: 101},
+	} {
+		if err := config.init(); err == nil {
+			t.Errorf("%+v: expect an error, but got nil", config)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package outlier provides a passive health checker, which detects
+// the failing endpoints from the real traffic and ejects them temporarily.
+package outlier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xgfone/go-loadbalancer"
+)
+
+// OnEvent is the default callback function of the ejection events,
+// which is used when Config.OnEvent is nil.
+var OnEvent func(Event)
+
+// The reasons of the ejection.
+const (
+	ReasonErrors = "consecutive_errors"
+	ReasonSlows  = "consecutive_slows"
+)
+
+// Event is an ejection event of an endpoint.
+type Event struct {
+	Upstream string
+	Endpoint string
+	Ejected  bool          // true: ejected, false: restored
+	Reason   string        // Only for the ejection.
+	Duration time.Duration // Only for the ejection.
+}
+
+// Config is used to configure the outlier detector.
+type Config struct {
+	// Optional, the number of the consecutive errors or 5xx responses
+	// to eject the endpoint. A negative value disables it.
+	//
+	// Default: 5
+	ConsecutiveErrors int
+
+	// Optional, the number of the consecutive responses, the latency of which
+	// is greater than SlowLatency, to eject the endpoint.
+	//
+	// Default: 0 (disabled), 5 (if SlowLatency is set)
+	SlowLatency      time.Duration
+	ConsecutiveSlows int
+
+	// Optional, the ejection duration is BaseEjectionTime multiplied by
+	// the number of the times that the endpoint has been ejected,
+	// which is limited by MaxEjectionTime.
+	//
+	// If the endpoint is ejected again after it has been restored for more than
+	// MaxEjectionTime, the number of the ejection times restarts from 1.
+	//
+	// Default: 30s, 300s
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+
+	// Optional, the maximum percentage of the endpoints to be ejected, range: [0, 100].
+	// And at least one endpoint is never ejected.
+	//
+	// Default: 50
+	MaxEjectionPercent int
+
+	// Optional, the callback function of the ejection events.
+	//
+	// Default: OnEvent
+	OnEvent func(Event)
+}
+
+func (c *Config) init() error {
+	if c.ConsecutiveErrors == 0 {
+		c.ConsecutiveErrors = 5
+	}
+
+	if c.SlowLatency < 0 {
+		return fmt.Errorf("invalid slow latency '%s'", c.SlowLatency)
+	} else if c.SlowLatency > 0 && c.ConsecutiveSlows <= 0 {
+		c.ConsecutiveSlows = 5
+	}
+
+	if c.BaseEjectionTime <= 0 {
+		c.BaseEjectionTime = time.Second * 30
+	}
+	if c.MaxEjectionTime <= 0 {
+		c.MaxEjectionTime = time.Second * 300
+	}
+	if c.MaxEjectionTime < c.BaseEjectionTime {
+		c.MaxEjectionTime = c.BaseEjectionTime
+	}
+
+	switch {
+	case c.MaxEjectionPercent == 0:
+		c.MaxEjectionPercent = 50
+	case c.MaxEjectionPercent < 0 || c.MaxEjectionPercent > 100:
+		return fmt.Errorf("invalid max ejection percent %d", c.MaxEjectionPercent)
+	}
+
+	return nil
+}
+
+// State is the outlier state of an endpoint.
+type State struct {
+	Ejected   bool      `json:"ejected"`
+	Ejections int       `json:"ejections"`           // The number of the ejection times.
+	Until     time.Time `json:"until,omitempty"`     // The time when the ejection ends.
+	Restored  time.Time `json:"restored,omitempty"`  // The time when the last ejection ended.
+	Errors    int       `json:"errors,omitempty"`    // The number of the consecutive errors.
+	Slows     int       `json:"slows,omitempty"`     // The number of the consecutive slow responses.
+	LastError string    `json:"lastError,omitempty"` // The last error or 5xx status code.
+}
+
+type cache struct {
+	version uint64
+	expires time.Time // The earliest time when an ejected endpoint is restored.
+	source  *loadbalancer.Static
+	result  *loadbalancer.Static
+}
+
+// Detector is an outlier detector, which observes the results of the requests
+// forwarded to the endpoints and ejects the failing ones, and implements
+// the interface loadbalancer.Discovery to only return the non-ejected endpoints.
+type Detector struct {
+	name      string
+	config    Config
+	discovery loadbalancer.Discovery
+
+	lock    sync.Mutex
+	states  map[string]*State
+	version atomic.Uint64
+	cache   atomic.Pointer[cache]
+	total   atomic.Int64 // The number of the discovered endpoints.
+}
+
+var _ loadbalancer.Discovery = new(Detector)
+
+// NewDetector returns a new outlier detector named name, such as the upstream id,
+// which ejects the outlier endpoints of the discovery.
+func NewDetector(name string, discovery loadbalancer.Discovery, config Config) (*Detector, error) {
+	if discovery == nil {
+		panic("outlier.NewDetector: discovery must not be nil")
+	}
+
+	if err := config.init(); err != nil {
+		return nil, err
+	}
+
+	return &Detector{
+		name:      name,
+		config:    config,
+		discovery: discovery,
+		states:    make(map[string]*State, 8),
+	}, nil
+}
+
+// Config returns the configuration of the detector.
+func (d *Detector) Config() Config { return d.config }
+
+// Discovery returns the wrapped discovery.
+func (d *Detector) Discovery() loadbalancer.Discovery { return d.discovery }
+
+// Discover implements the interface loadbalancer.Discovery,
+// which only returns the non-ejected endpoints.
+func (d *Detector) Discover() *loadbalancer.Static {
+	source := d.discovery.Discover()
+	version := d.version.Load()
+	if c := d.cache.Load(); c != nil && c.source == source && c.version == version &&
+		(c.expires.IsZero() || time.Now().Before(c.expires)) {
+		return c.result
+	}
+
+	result, expires := d.filter(source)
+	d.cache.Store(&cache{version: version, expires: expires, source: source, result: result})
+	return result
+}
+
+func (d *Detector) filter(source *loadbalancer.Static) (result *loadbalancer.Static, expires time.Time) {
+	if source == nil {
+		d.total.Store(0)
+		return
+	}
+	d.total.Store(int64(len(source.Endpoints)))
+
+	var events []Event
+	defer func() { d.emit(events) }()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Remove the states of the endpoints which have been removed from the source,
+	// so that they no longer occupy the budget of the max ejection percent.
+	if len(d.states) > 0 {
+		present := make(map[string]struct{}, len(source.Endpoints))
+		for _, ep := range source.Endpoints {
+			present[ep.ID()] = struct{}{}
+		}
+		for id := range d.states {
+			if _, ok := present[id]; !ok {
+				delete(d.states, id)
+			}
+		}
+	}
+
+	now := time.Now()
+	var eps loadbalancer.Endpoints
+	for i, ep := range source.Endpoints {
+		if state, ok := d.states[ep.ID()]; ok && state.Ejected {
+			if now.Before(state.Until) {
+				if eps == nil {
+					eps = make(loadbalancer.Endpoints, i, len(source.Endpoints))
+					copy(eps, source.Endpoints[:i])
+				}
+
+				if expires.IsZero() || state.Until.Before(expires) {
+					expires = state.Until
+				}
+				continue
+			}
+
+			events = append(events, d.restore(ep.ID(), state, now))
+		}
+
+		if eps != nil {
+			eps = append(eps, ep)
+		}
+	}
+
+	switch {
+	case eps == nil:
+		result = source
+	case len(eps) == 0:
+		result = loadbalancer.None
+	default:
+		result = loadbalancer.NewStatic(eps)
+	}
+	return
+}
+
+// State returns the outlier state of the endpoint.
+//
+// If the endpoint has not been observed, return (State{}, false).
+func (d *Detector) State(epid string) (state State, ok bool) {
+	d.lock.Lock()
+	if s, exist := d.states[epid]; exist {
+		state, ok = *s, true
+	}
+	d.lock.Unlock()
+	return
+}
+
+// States returns the outlier states of all the observed endpoints.
+func (d *Detector) States() map[string]State {
+	d.lock.Lock()
+	states := make(map[string]State, len(d.states))
+	for id, state := range d.states {
+		states[id] = *state
+	}
+	d.lock.Unlock()
+	return states
+}
+
+// IsEjected reports whether the endpoint is ejected.
+func (d *Detector) IsEjected(epid string) bool {
+	d.lock.Lock()
+	state, ok := d.states[epid]
+	ejected := ok && state.Ejected && time.Now().Before(state.Until)
+	d.lock.Unlock()
+	return ejected
+}
+
+// Observe observes the result of a request forwarded to the endpoint,
+// which may eject the endpoint.
+//
+// code is the response status code, and err is the forwarding error.
+func (d *Detector) Observe(epid string, code int, err error, latency time.Duration) {
+	if errors.Is(err, context.Canceled) {
+		return // The client has canceled the request.
+	}
+
+	failed := err != nil || code >= 500
+	slow := d.config.SlowLatency > 0 && latency > d.config.SlowLatency
+
+	var events []Event
+	defer func() { d.emit(events) }()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	state, ok := d.states[epid]
+	if !ok {
+		if !failed && !slow {
+			return
+		}
+		state = new(State)
+		d.states[epid] = state
+	}
+
+	if state.Ejected {
+		return
+	}
+
+	if failed {
+		state.Errors++
+		if err != nil {
+			state.LastError = err.Error()
+		} else {
+			state.LastError = fmt.Sprintf("status code %d", code)
+		}
+	} else {
+		state.Errors = 0
+	}
+
+	if slow {
+		state.Slows++
+	} else {
+		state.Slows = 0
+	}
+
+	var reason string
+	switch {
+	case d.config.ConsecutiveErrors > 0 && state.Errors >= d.config.ConsecutiveErrors:
+		reason = ReasonErrors
+	case d.config.ConsecutiveSlows > 0 && state.Slows >= d.config.ConsecutiveSlows:
+		reason = ReasonSlows
+	default:
+		return
+	}
+
+	if event, ok := d.eject(epid, state, reason); ok {
+		events = append(events, event)
+	}
+}
+
+func (d *Detector) eject(epid string, state *State, reason string) (event Event, ok bool) {
+	now := time.Now()
+	var ejected int
+	for _, s := range d.states {
+		if s.Ejected && now.Before(s.Until) {
+			ejected++
+		}
+	}
+
+	total := int(d.total.Load())
+	if max := total * d.config.MaxEjectionPercent / 100; ejected+1 > max || ejected+1 >= total {
+		slog.Warn("skip to eject the outlier upstream endpoint, which reaches the maximum ejection percent",
+			"upstream", d.name, "endpoint", epid, "reason", reason,
+			"ejected", ejected, "total", total, "maxpercent", d.config.MaxEjectionPercent)
+		return
+	}
+
+	if state.Ejections > 0 && now.Sub(state.Restored) > d.config.MaxEjectionTime {
+		state.Ejections = 0
+	}
+
+	state.Ejections++
+	duration := min(d.config.BaseEjectionTime*time.Duration(state.Ejections), d.config.MaxEjectionTime)
+
+	state.Ejected = true
+	state.Until = now.Add(duration)
+	state.Errors, state.Slows = 0, 0
+	d.version.Add(1)
+
+	slog.Warn("eject the outlier upstream endpoint",
+		"upstream", d.name, "endpoint", epid, "reason", reason,
+		"duration", duration, "ejections", state.Ejections, "lasterr", state.LastError)
+	return Event{Upstream: d.name, Endpoint: epid, Ejected: true, Reason: reason, Duration: duration}, true
+}
+
+func (d *Detector) restore(epid string, state *State, now time.Time) Event {
+	state.Ejected = false
+	state.Restored = now
+	state.LastError = ""
+
+	slog.Info("restore the ejected upstream endpoint", "upstream", d.name, "endpoint", epid)
+	return Event{Upstream: d.name, Endpoint: epid}
+}
+
+func (d *Detector) emit(events []Event) {
+	cb := d.config.OnEvent
+	if cb == nil {
+		cb = OnEvent
+	}
+
+	if cb != nil {
+		for _, event := range events {
+			cb(event)
+		}
+	}
+}
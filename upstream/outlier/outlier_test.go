@@ -0,0 +1,235 @@
+// Copyright 2023 xgfone
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outlier
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xgfone/go-loadbalancer"
+)
+
+type testendpoint string
+
+func (ep testendpoint) ID() string                              { return string(ep) }
+func (ep testendpoint) Serve(context.Context, any) (any, error) { return nil, nil }
+
+func newStatic(ids ...string) *loadbalancer.Static {
+	eps := make(loadbalancer.Endpoints, len(ids))
+	for i, id := range ids {
+		eps[i] = testendpoint(id)
+	}
+	return loadbalancer.NewStatic(eps)
+}
+
+func endpointIds(s *loadbalancer.Static) []string {
+	ids := make([]string, len(s.Endpoints))
+	for i, ep := range s.Endpoints {
+		ids[i] = ep.ID()
+	}
+	return ids
+}
+
+func TestDetectorErrors(t *testing.T) {
+	var events []Event
+	static := newStatic("ep1", "ep2", "ep3", "ep4")
+	d, err := NewDetector("up", static, Config{
+		ConsecutiveErrors: 3,
+		BaseEjectionTime:  time.Millisecond * 50,
+		MaxEjectionTime:   time.Millisecond * 80,
+		OnEvent:           func(e Event) { events = append(events, e) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := d.Discover(); s != static {
+		t.Fatalf("expect the original static, but got %v", endpointIds(s))
+	}
+
+	// The success resets the consecutive errors.
+	d.Observe("ep1", 502, nil, 0)
+	d.Observe("ep1", 0, errors.New("connection refused"), 0)
+	d.Observe("ep1", 200, nil, 0)
+	d.Observe("ep1", 503, nil, 0)
+	d.Observe("ep1", 0, context.Canceled, 0) // Ignored
+	d.Observe("ep1", 503, nil, 0)
+	if d.IsEjected("ep1") {
+		t.Fatal("unexpect the endpoint 'ep1' to be ejected")
+	}
+
+	d.Observe("ep1", 500, nil, 0)
+	if !d.IsEjected("ep1") {
+		t.Fatal("expect the endpoint 'ep1' to be ejected")
+	} else if ids := endpointIds(d.Discover()); len(ids) != 3 || ids[0] != "ep2" {
+		t.Errorf("expect the endpoints [ep2 ep3 ep4], but got %v", ids)
+	} else if len(events) != 1 || !events[0].Ejected || events[0].Reason != ReasonErrors ||
+		events[0].Duration != time.Millisecond*50 {
+		t.Errorf("unexpected events: %+v", events)
+	}
+
+	// The maximum ejection percent is 50, so only 2 endpoints can be ejected.
+	for _, id := range []string{"ep2", "ep3"} {
+		for range 3 {
+			d.Observe(id, 500, nil, 0)
+		}
+	}
+	if !d.IsEjected("ep2") || d.IsEjected("ep3") {
+		t.Errorf("expect only 'ep2' to be ejected, but got %+v", d.States())
+	}
+
+	time.Sleep(time.Millisecond * 60)
+	if ids := endpointIds(d.Discover()); len(ids) != 4 {
+		t.Errorf("expect all the endpoints to be restored, but got %v", ids)
+	} else if len(events) != 4 || events[2].Ejected || events[3].Ejected {
+		t.Errorf("expect the restored events, but got %+v", events)
+	}
+
+	// The ejection time grows but is limited by MaxEjectionTime.
+	for range 3 {
+		d.Observe("ep1", 500, nil, 0)
+	}
+	if len(events) != 5 || events[4].Duration != time.Millisecond*80 {
+		t.Errorf("expect the ejection duration 80ms, but got %+v", events[len(events)-1])
+	} else if state, _ := d.State("ep1"); state.Ejections != 2 {
+		t.Errorf("expect 2 ejections, but got %d", state.Ejections)
+	}
+}
+
+func TestDetectorSlows(t *testing.T) {
+	d, err := NewDetector("up", newStatic("ep1", "ep2"), Config{
+		ConsecutiveErrors:  -1,
+		SlowLatency:        time.Second,
+		ConsecutiveSlows:   2,
+		MaxEjectionPercent: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Discover()
+
+	for range 5 {
+		d.Observe("ep1", 500, nil, time.Millisecond)
+	}
+	if d.IsEjected("ep1") {
+		t.Error("unexpect the endpoint to be ejected by errors")
+	}
+
+	d.Observe("ep1", 200, nil, time.Second*2)
+	d.Observe("ep1", 200, nil, time.Second*2)
+	if !d.IsEjected("ep1") {
+		t.Error("expect the endpoint to be ejected by slows")
+	}
+
+	// At least one endpoint is never ejected.
+	d.Observe("ep2", 200, nil, time.Second*2)
+	d.Observe("ep2", 200, nil, time.Second*2)
+	if d.IsEjected("ep2") {
+		t.Error("unexpect the last endpoint to be ejected")
+	}
+}
+
+type testdiscovery struct {
+	static atomic.Pointer[loadbalancer.Static]
+}
+
+func (d *testdiscovery) Discover() *loadbalancer.Static { return d.static.Load() }
+func (d *testdiscovery) Set(ids ...string)              { d.static.Store(newStatic(ids...)) }
+
+func TestDetectorMaxEjectionPercent(t *testing.T) {
+	discovery := new(testdiscovery)
+	discovery.Set("ep1", "ep2", "ep3", "ep4", "ep5")
+
+	// At most 1 endpoint can be ejected.
+	d, err := NewDetector("up", discovery, Config{
+		ConsecutiveErrors:  1,
+		BaseEjectionTime:   time.Millisecond * 50,
+		MaxEjectionPercent: 25,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Discover()
+
+	d.Observe("ep1", 500, nil, 0)
+	d.Observe("ep2", 500, nil, 0)
+	if !d.IsEjected("ep1") || d.IsEjected("ep2") {
+		t.Fatalf("expect only 'ep1' to be ejected, but got %+v", d.States())
+	}
+
+	// The removed endpoint no longer occupies the ejection budget.
+	discovery.Set("ep2", "ep3", "ep4", "ep5")
+	d.Discover()
+	if _, ok := d.State("ep1"); ok {
+		t.Error("expect the state of the removed endpoint to be removed")
+	}
+
+	d.Observe("ep2", 500, nil, 0)
+	if !d.IsEjected("ep2") {
+		t.Fatalf("expect the endpoint 'ep2' to be ejected, but got %+v", d.States())
+	}
+
+	// The expired ejection no longer occupies the ejection budget,
+	// even if the detector has not restored it by Discover.
+	time.Sleep(time.Millisecond * 60)
+	d.Observe("ep3", 500, nil, 0)
+	if !d.IsEjected("ep3") {
+		t.Errorf("expect the endpoint 'ep3' to be ejected, but got %+v", d.States())
+	}
+}
+
+func TestConfig(t *testing.T) {
+	for _, test := range []struct {
+		config Config
+		expect Config
+	}{
+		{
+			config: Config{ConsecutiveErrors: -1, SlowLatency: time.Second, MaxEjectionPercent: 100},
+			expect: Config{ConsecutiveErrors: -1, SlowLatency: time.Second, ConsecutiveSlows: 5,
+				BaseEjectionTime: time.Second * 30, MaxEjectionTime: time.Second * 300, MaxEjectionPercent: 100},
+		},
+		{ // MaxEjectionTime is not less than BaseEjectionTime.
+			config: Config{BaseEjectionTime: time.Minute * 10},
+			expect: Config{ConsecutiveErrors: 5, BaseEjectionTime: time.Minute * 10,
+				MaxEjectionTime: time.Minute * 10, MaxEjectionPercent: 50},
+		},
+		{
+			config: Config{BaseEjectionTime: time.Minute, MaxEjectionTime: time.Second},
+			expect: Config{ConsecutiveErrors: 5, BaseEjectionTime: time.Minute,
+				MaxEjectionTime: time.Minute, MaxEjectionPercent: 50},
+		},
+	} {
+		config := test.config
+		if err := config.init(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.config, err)
+		} else if !reflect.DeepEqual(config, test.expect) {
+			t.Errorf("expect the config %+v, but got %+v", test.expect, config)
+		}
+	}
+
+	for _, config := range []Config{
+		{SlowLatency: -1},
+		{MaxEjectionPercent: -1},
+		{MaxEjectionPercent: 101},
+	} {
+		if err := config.init(); err == nil {
+			t.Errorf("%+v: expect an error, but got nil", config)
+		}
+	}
+}
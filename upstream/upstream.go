@@ -16,21 +16,62 @@
 package upstream
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/xgfone/go-apigateway/manager"
+	"github.com/xgfone/go-apigateway/upstream/breaker"
+	"github.com/xgfone/go-apigateway/upstream/health"
+	"github.com/xgfone/go-apigateway/upstream/lifecycle"
+	"github.com/xgfone/go-apigateway/upstream/outlier"
 	"github.com/xgfone/go-atomicvalue"
 	"github.com/xgfone/go-loadbalancer/forwarder"
 )
 
 // Manager is used to manage a set of the http upstreams.
+//
+// NOTICE: it does not start or stop the background services of the upstreams,
+// so the caller should do it. See Upstream.Start and Upstream.Stop.
 var Manager = manager.New[*Upstream]()
 
 // Upstream represents a http upstream.
 type Upstream struct {
 	*forwarder.Forwarder
 
+	client *http.Client
 	scheme atomicvalue.Value[string]
 	host   atomicvalue.Value[string]
 	path   atomicvalue.Value[string]
+
+	checker   *health.Checker
+	detector  *outlier.Detector
+	breakers  *breaker.Group
+	lifecycle *lifecycle.Lifecycle
+	services  []Service
+	observers []Observer
+}
+
+// Observer is used to observe the result of the request
+// forwarded to the endpoint of the upstream.
+//
+// code is the response status code, and err is the forwarding error.
+type Observer interface {
+	Observe(epid string, code int, err error, latency time.Duration)
+}
+
+// Tracker is an optional interface of Observer, which is also notified
+// before forwarding the request to the endpoint, such as to count
+// the in-flight requests. Observe is always called after Begin.
+type Tracker interface {
+	Observer
+	Begin(epid string)
+}
+
+// Service is a background service bound to the upstream,
+// such as the health checker, which is started and stopped with it.
+type Service interface {
+	Start()
+	Stop()
 }
 
 // New returns a new upstream based on the forwarder.
@@ -47,6 +88,16 @@ func (u *Upstream) Host() string { return u.host.Load() }
 // Scheme returns the scheme of the upstream.
 func (u *Upstream) Scheme() string { return u.scheme.Load() }
 
+// Client returns the dedicated http client of the upstream.
+//
+// Return nil if the upstream has no dedicated http client.
+func (u *Upstream) Client() *http.Client { return u.client }
+
+// SetClient sets the dedicated http client of the upstream,
+// such as the client with the TLS configuration,
+// which should be called only before starting the upstream.
+func (u *Upstream) SetClient(client *http.Client) { u.client = client }
+
 // SetPath sets the path of the upstream.
 func (u *Upstream) SetPath(path string) { u.path.Store(path) }
 
@@ -55,3 +106,132 @@ func (u *Upstream) SetHost(host string) { u.host.Store(host) }
 
 // SetScheme sets the scheme of the upstream.
 func (u *Upstream) SetScheme(scheme string) { u.scheme.Store(scheme) }
+
+// AddService adds the background services bound to the upstream,
+// which should be called only before starting the upstream.
+func (u *Upstream) AddService(services ...Service) {
+	u.services = append(u.services, services...)
+}
+
+// Start starts all the background services of the upstream.
+func (u *Upstream) Start() {
+	for _, s := range u.services {
+		s.Start()
+	}
+}
+
+// Stop stops all the background services of the upstream in reverse order.
+func (u *Upstream) Stop() {
+	for i := len(u.services) - 1; i >= 0; i-- {
+		u.services[i].Stop()
+	}
+}
+
+// HealthChecker returns the active health checker of the upstream.
+//
+// Return nil if the upstream has no health checker.
+func (u *Upstream) HealthChecker() *health.Checker { return u.checker }
+
+// SetHealthChecker sets the active health checker of the upstream
+// and adds it as a background service,
+// which should be called only before starting the upstream.
+//
+// NOTICE: the checker should be used as the discovery of the forwarder.
+func (u *Upstream) SetHealthChecker(checker *health.Checker) {
+	u.checker = checker
+	u.AddService(checker)
+}
+
+// OutlierDetector returns the outlier detector of the upstream.
+//
+// Return nil if the upstream has no outlier detector.
+func (u *Upstream) OutlierDetector() *outlier.Detector { return u.detector }
+
+// SetOutlierDetector sets the outlier detector of the upstream
+// and adds it as an observer,
+// which should be called only before starting the upstream.
+//
+// NOTICE: the detector should be used as the discovery of the forwarder.
+func (u *Upstream) SetOutlierDetector(detector *outlier.Detector) {
+	u.detector = detector
+	u.AddObserver(detector)
+}
+
+// Lifecycle returns the lifecycle manager of the endpoints of the upstream.
+//
+// Return nil if the upstream has no lifecycle manager.
+func (u *Upstream) Lifecycle() *lifecycle.Lifecycle { return u.lifecycle }
+
+// SetLifecycle sets the lifecycle manager of the endpoints of the upstream
+// and adds it as a background service,
+// which should be called only before starting the upstream.
+//
+// NOTICE: it should be set after the service of the dynamic discovery,
+// so that the endpoints have been discovered when it starts.
+func (u *Upstream) SetLifecycle(lifecycle *lifecycle.Lifecycle) {
+	u.lifecycle = lifecycle
+	u.AddService(lifecycle)
+}
+
+// AddObserver adds the observers of the forwarding results,
+// which should be called only before starting the upstream.
+func (u *Upstream) AddObserver(observers ...Observer) {
+	u.observers = append(u.observers, observers...)
+}
+
+// Observe implements the interface Observer, which is called
+// by the endpoint after forwarding the request to notify all the observers.
+func (u *Upstream) Observe(epid string, code int, err error, latency time.Duration) {
+	for _, o := range u.observers {
+		o.Observe(epid, code, err, latency)
+	}
+}
+
+// Begin implements the interface Tracker, which is called by the endpoint
+// before forwarding the request to notify all the observers implementing
+// the interface Tracker.
+func (u *Upstream) Begin(epid string) {
+	for _, o := range u.observers {
+		if t, ok := o.(Tracker); ok {
+			t.Begin(epid)
+		}
+	}
+}
+
+// Breakers returns the circuit breakers of the upstream.
+//
+// Return nil if the upstream has no circuit breakers.
+func (u *Upstream) Breakers() *breaker.Group { return u.breakers }
+
+// SetBreakers sets the circuit breakers of the upstream,
+// which should be called only before starting the upstream.
+//
+// NOTICE: if the breakers are per endpoint, the discovery of the forwarder
+// should be wrapped by breaker.NewDiscovery.
+func (u *Upstream) SetBreakers(breakers *breaker.Group) { u.breakers = breakers }
+
+// Allow checks the circuit breaker of the upstream, and reports
+// whether the request is allowed to be forwarded by the upstream.
+//
+// If allowed, done must be called with the result of the request
+// if it is not nil.
+func (u *Upstream) Allow() (done func(success bool), ok bool) {
+	if u.breakers == nil {
+		return nil, true
+	}
+	return u.breakers.Upstream().Allow()
+}
+
+// AllowEndpoint is the same as Allow, but checks the circuit breaker
+// of the endpoint.
+func (u *Upstream) AllowEndpoint(epid string) (done func(success bool), ok bool) {
+	if u.breakers == nil {
+		return nil, true
+	}
+
+	b := u.breakers.Endpoint(epid)
+	if b == nil {
+		return nil, true
+	}
+	return b.Allow()
+}
@@ -16,6 +16,7 @@ package upstream
 
 import (
 	"testing"
+	"time"
 
 	"github.com/xgfone/go-loadbalancer"
 	"github.com/xgfone/go-loadbalancer/balancer"
@@ -35,3 +36,30 @@ func TestUpstream(t *testing.T) {
 		t.Errorf("expect scheme '%s', but got '%s'", "https", scheme)
 	}
 }
+
+type testTracker struct{ begins, observes int }
+
+func (t *testTracker) Begin(string)                              { t.begins++ }
+func (t *testTracker) Observe(string, int, error, time.Duration) { t.observes++ }
+
+type testObserver struct{ observes int }
+
+func (o *testObserver) Observe(string, int, error, time.Duration) { o.observes++ }
+
+func TestUpstreamObserver(t *testing.T) {
+	tracker, observer := new(testTracker), new(testObserver)
+
+	up := New(forwarder.New("up", balancer.DefaultBalancer, loadbalancer.None))
+	up.AddObserver(tracker, observer)
+
+	up.Begin("127.0.0.1:80")
+	up.Observe("127.0.0.1:80", 200, nil, time.Millisecond)
+
+	if tracker.begins != 1 || tracker.observes != 1 {
+		t.Errorf("expect the tracker to begin and observe once, but got %d and %d",
+			tracker.begins, tracker.observes)
+	}
+	if observer.observes != 1 {
+		t.Errorf("expect the observer to observe once, but got %d", observer.observes)
+	}
+}